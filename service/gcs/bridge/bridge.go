@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/core"
 	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
@@ -97,10 +98,16 @@ func (b *bridge) loop() error {
 			}
 		case prot.ComputeSystemShutdownGracefulV1:
 			logrus.Info("received from HCS: ComputeSystemShutdownGracefulV1")
-			response, err = b.shutdownContainer(message)
+			var shutdownResponse *prot.ContainerShutdownResponse
+			shutdownResponse, err = b.shutdownContainer(message, header)
 			if err != nil {
 				logrus.Error(err)
 			}
+			// A shutdown with a grace period is responded to once the grace
+			// period has elapsed.
+			if shutdownResponse != nil {
+				response = shutdownResponse
+			}
 		case prot.ComputeSystemSignalProcessV1:
 			logrus.Info("received from HCS: ComputeSystemSignalProcessV1")
 			response, err = b.signalProcess(message)
@@ -153,6 +160,8 @@ func (b *bridge) loop() error {
 				b.setErrorForResponseBase(response.MessageResponseBase, err)
 			case *prot.ContainerGetPropertiesResponse:
 				b.setErrorForResponseBase(response.MessageResponseBase, err)
+			case *prot.ContainerShutdownResponse:
+				b.setErrorForResponseBase(response.MessageResponseBase, err)
 			default:
 				// TODO: Should this error be handled better?
 				return errors.Errorf("invalid response type: %T", response)
@@ -253,19 +262,38 @@ func (b *bridge) killContainer(message []byte) (*prot.MessageResponseBase, error
 	return response, nil
 }
 
-func (b *bridge) shutdownContainer(message []byte) (*prot.MessageResponseBase, error) {
-	response := newResponseBase()
-	var request prot.MessageBase
+func (b *bridge) shutdownContainer(message []byte, header *prot.MessageHeader) (*prot.ContainerShutdownResponse, error) {
+	response := &prot.ContainerShutdownResponse{MessageResponseBase: newResponseBase()}
+	var request prot.ContainerShutdown
 	if err := commonutils.UnmarshalJSONWithHresult(message, &request); err != nil {
 		return response, errors.Wrapf(err, "failed to unmarshal JSON for message \"%s\"", message)
 	}
 	response.ActivityID = request.ActivityID
 
-	if err := b.coreint.SignalContainer(request.ContainerID, oslayer.SIGTERM); err != nil {
-		return response, err
+	if request.GracePeriodInMs == 0 {
+		if _, err := b.coreint.StopContainer(request.ContainerID, 0); err != nil {
+			return response, err
+		}
+		return response, nil
 	}
 
-	return response, nil
+	// Wait for the container to exit without blocking other messages, and
+	// respond with the processes which outlive the grace period.
+	gracePeriod := time.Duration(request.GracePeriodInMs) * time.Millisecond
+	go func() {
+		remainingPids, err := b.coreint.StopContainer(request.ContainerID, gracePeriod)
+		if err != nil {
+			logrus.Error(err)
+			b.setErrorForResponseBase(response.MessageResponseBase, err)
+		}
+		for _, pid := range remainingPids {
+			response.RemainingProcessIDs = append(response.RemainingProcessIDs, uint32(pid))
+		}
+		if err := b.sendResponse(response, header); err != nil {
+			logrus.Error(errors.Wrapf(err, "failed to send shutdown response \"%v\"", response))
+		}
+	}()
+	return nil, nil
 }
 
 func (b *bridge) signalProcess(message []byte) (*prot.MessageResponseBase, error) {
@@ -292,7 +320,25 @@ func (b *bridge) listProcesses(message []byte) (*prot.ContainerGetPropertiesResp
 	response.ActivityID = request.ActivityID
 	id := request.ContainerID
 
-	processes, err := b.coreint.ListProcesses(id)
+	var query prot.PropertyQuery
+	if request.Query != "" {
+		if err := commonutils.UnmarshalJSONWithHresult([]byte(request.Query), &query); err != nil {
+			return response, errors.Wrapf(err, "failed to unmarshal JSON for query \"%s\"", request.Query)
+		}
+	}
+
+	for _, propertyType := range query.PropertyTypes {
+		if prot.PropertyType(propertyType) == prot.PtGcsHealth {
+			healthJSON, err := json.Marshal(b.coreint.Health())
+			if err != nil {
+				return response, errors.Wrap(err, "failed to marshal GCS health into JSON")
+			}
+			response.Properties = string(healthJSON)
+			return response, nil
+		}
+	}
+
+	processes, err := b.coreint.ListProcesses(id, query.ReconcileProcesses)
 	if err != nil {
 		return response, err
 	}
@@ -344,6 +390,7 @@ func (b *bridge) waitOnProcess(message []byte, header *prot.MessageHeader) (*pro
 
 	exitHook := func(state oslayer.ProcessExitState) {
 		response.ExitCode = uint32(state.ExitCode())
+		response.CoreDumpPath = b.coreint.CoreDumpPath(int(request.ProcessID), state)
 		if err := b.sendResponse(response, header); err != nil {
 			logrus.Error(errors.Wrapf(err, "failed to send process exit response \"%v\"", response))
 		}
@@ -439,6 +486,9 @@ func (b *bridge) setErrorForResponseBase(response *prot.MessageResponseBase, err
 		Line:         uint32(lineNumber),
 		FunctionName: functionName,
 	}
+	if code, ok := gcserr.Code(errForResponse); ok {
+		newRecord.Code = string(code)
+	}
 	response.ErrorRecords = append(response.ErrorRecords, newRecord)
 }
 
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"syscall"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/core/mockcore"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
@@ -46,7 +47,6 @@ var _ = Describe("Bridge", func() {
 			commandConn    *transport.MockConnection
 			messageType    prot.MessageIdentifier
 			message        interface{}
-			responseHeader *prot.MessageHeader
 			responseString string
 			responseBase   *prot.MessageResponseBase
 
@@ -86,7 +86,7 @@ var _ = Describe("Bridge", func() {
 			messageString := string(messageBytes)
 			err = serverSendString(commandConn, messageType, 0, messageString)
 			Expect(err).NotTo(HaveOccurred())
-			responseString, responseHeader, err = serverReadString(commandConn)
+			responseString, _, err = serverReadString(commandConn)
 			Expect(err).NotTo(HaveOccurred())
 		}, testTimeout)
 		AfterEach(func() {
@@ -437,18 +437,18 @@ var _ = Describe("Bridge", func() {
 
 		Describe("calling shutdownContainer", func() {
 			var (
-				response prot.MessageResponseBase
-				callArgs mockcore.SignalContainerCall
+				response prot.ContainerShutdownResponse
+				callArgs mockcore.StopContainerCall
 			)
 			BeforeEach(func() {
 				messageType = prot.ComputeSystemShutdownGracefulV1
 			})
 			JustBeforeEach(func() {
-				response = prot.MessageResponseBase{}
+				response = prot.ContainerShutdownResponse{}
 				err := json.Unmarshal([]byte(responseString), &response)
 				Expect(err).NotTo(HaveOccurred())
-				responseBase = &response
-				callArgs = coreint.LastSignalContainer
+				responseBase = response.MessageResponseBase
+				callArgs = coreint.LastStopContainer
 			})
 			Context("the message is normal ASCII", func() {
 				BeforeEach(func() {
@@ -461,7 +461,32 @@ var _ = Describe("Bridge", func() {
 				AssertActivityIDCorrect()
 				It("should receive the correct values", func() {
 					Expect(callArgs.ID).To(Equal(containerID))
-					Expect(callArgs.Signal).To(Equal(oslayer.SIGTERM))
+					Expect(callArgs.Timeout).To(BeZero())
+				})
+				It("should not report remaining processes", func() {
+					Expect(response.RemainingProcessIDs).To(BeEmpty())
+				})
+			})
+			Context("the message has a grace period", func() {
+				BeforeEach(func() {
+					message = prot.ContainerShutdown{
+						MessageBase: &prot.MessageBase{
+							ContainerID: containerID,
+							ActivityID:  activityID,
+						},
+						GracePeriodInMs: 5000,
+					}
+				})
+				AssertNoResponseErrors()
+				AssertActivityIDCorrect()
+				It("should stop the container with the grace period", func() {
+					Expect(callArgs).To(Equal(mockcore.StopContainerCall{
+						ID:      containerID,
+						Timeout: 5 * time.Second,
+					}))
+				})
+				It("should report the remaining processes", func() {
+					Expect(response.RemainingProcessIDs).To(Equal([]uint32{101}))
 				})
 			})
 		})
@@ -543,6 +568,52 @@ var _ = Describe("Bridge", func() {
 				})
 				It("should have received the correct values", func() {
 					Expect(callArgs.ID).To(Equal(containerID))
+					Expect(callArgs.Reconcile).To(BeFalse())
+				})
+			})
+			Context("the query requests reconciliation", func() {
+				BeforeEach(func() {
+					message = prot.ContainerGetProperties{
+						MessageBase: &prot.MessageBase{
+							ContainerID: containerID,
+							ActivityID:  activityID,
+						},
+						Query: `{"PropertyTypes":["ProcessList"],"ReconcileProcesses":true}`,
+					}
+				})
+				AssertNoResponseErrors()
+				AssertActivityIDCorrect()
+				It("should have received the correct values", func() {
+					Expect(callArgs.ID).To(Equal(containerID))
+					Expect(callArgs.Reconcile).To(BeTrue())
+				})
+			})
+			Context("the query requests the GCS's health", func() {
+				BeforeEach(func() {
+					message = prot.ContainerGetProperties{
+						MessageBase: &prot.MessageBase{
+							ContainerID: containerID,
+							ActivityID:  activityID,
+						},
+						Query: `{"PropertyTypes":["GcsHealth"]}`,
+					}
+				})
+				AssertNoResponseErrors()
+				AssertActivityIDCorrect()
+				It("should respond with the GCS's health", func() {
+					var health prot.GcsHealth
+					err := json.Unmarshal([]byte(response.Properties), &health)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(health).To(Equal(prot.GcsHealth{
+						Version:        "mock",
+						UptimeInMs:     1000,
+						ContainerCount: 1,
+						ProcessCount:   2,
+					}))
+					Expect(coreint.HealthCalls).To(Equal(1))
+				})
+				It("should not list the container's processes", func() {
+					Expect(callArgs.ID).To(BeEmpty())
 				})
 			})
 		})
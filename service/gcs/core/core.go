@@ -3,10 +3,13 @@
 package core
 
 import (
+	"time"
+
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
 )
 
 // Core is the interface defining the core functionality of the GCS-like
@@ -14,13 +17,96 @@ import (
 // containers. However, it is also easily mocked out for testing.
 type Core interface {
 	CreateContainer(id string, info prot.VMHostedContainerSettings) error
+	StartContainer(id string) error
+	AttachContainerStdio(id string, stdioSet *stdio.ConnectionSet) error
 	ExecProcess(id string, info prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (pid int, err error)
+	ExecProcessWithResult(id string, info prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (ExecResult, error)
+	ResumeContainer(id string) error
+	GetContainerSpec(id string, redact bool) (oci.Spec, error)
+	GetContainerState(id string) (prot.ContainerState, error)
+	GetContainerResources(id string) (prot.ContainerResources, error)
+	ListMappedVirtualDisks() ([]prot.MappedVirtualDiskStatus, error)
+	GetProcessEnviron(pid int) ([]string, error)
+	GetProcessCmdline(pid int) ([]string, error)
+	GetContainerUsageHistory(id string) ([]prot.UsageSample, error)
+	GetContainerHistory(id string) ([]prot.ContainerEvent, error)
+	GetScratchUsage(id string) (prot.ScratchUsage, error)
+	WaitContainerReady(id string, timeout time.Duration) error
+	CheckpointContainer(id string, imagePath string, options runtime.CheckpointOptions) error
+	RestoreContainer(id string, imagePath string, info prot.ProcessParameters, options runtime.CheckpointOptions, stdioSet *stdio.ConnectionSet) (pid int, err error)
 	SignalContainer(id string, signal oslayer.Signal) error
+	StopContainer(id string, timeout time.Duration) (remainingPids []int, err error)
+	SignalAllContainers(signal oslayer.Signal) error
+	Shutdown(timeout time.Duration) error
 	SignalProcess(pid int, options prot.SignalProcessOptions) error
-	ListProcesses(id string) ([]runtime.ContainerProcessState, error)
+	ListProcesses(id string, reconcile bool) ([]runtime.ContainerProcessState, error)
 	RunExternalProcess(info prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (pid int, err error)
+	ReapProcess(pid int) error
+	ReapExitedProcesses() int
 	ModifySettings(id string, request prot.ResourceModificationRequestResponse) error
 	RegisterContainerExitHook(id string, onExit func(oslayer.ProcessExitState)) error
 	RegisterProcessExitHook(pid int, onExit func(oslayer.ProcessExitState)) error
+	CoreDumpPath(pid int, state oslayer.ProcessExitState) string
 	ResizeConsole(pid int, height, width uint16) error
+	SetProcessRlimit(pid int, rlimit oci.LinuxRlimit) error
+	Health() prot.GcsHealth
+}
+
+// ExecAuthorizer is a policy hook which decides whether a process may be
+// executed in a container, such as to block shells from being executed in
+// containers which shouldn't be debugged.
+type ExecAuthorizer interface {
+	// AuthorizeExec is given the ID of the container and the process's
+	// arguments, as they will be executed. If the process may not run, it
+	// returns false along with the reason.
+	AuthorizeExec(id string, args []string) (allowed bool, reason string)
+}
+
+// JournalSink writes entries to the system journal.
+type JournalSink interface {
+	// Send writes an entry with the given message, syslog priority and
+	// additional fields, whose names must be valid journal field names.
+	Send(message string, priority int, fields map[string]string) error
+}
+
+// ExecResult describes a process executed by ExecProcessWithResult.
+type ExecResult struct {
+	Pid int
+	// ConsoleAllocated is true if a console was allocated for the process,
+	// as requested by EmulateConsole, and ConsoleOpen is true if the GCS
+	// still holds the console's master end open.
+	ConsoleAllocated bool
+	ConsoleOpen      bool
+}
+
+// ExecAuditRecord describes an attempt to execute a process, as given to an
+// ExecAuditor.
+type ExecAuditRecord struct {
+	// ContainerID is the ID of the container the process was executed in,
+	// or empty for an external process.
+	ContainerID string
+	Args        []string
+	UID         uint32
+	// Time is when the process was executed or, in a record given to
+	// AuditExit, when it exited.
+	Time time.Time
+	// Pid is the process's pid, or -1 if it failed to start, in which case
+	// Error describes why.
+	Pid   int
+	Error string
+	// ExitCode is the process's exit code. It is only set in a record given
+	// to AuditExit.
+	ExitCode int
+}
+
+// ExecAuditor is a hook which keeps a record of every process executed in
+// every container, and of every external process, such as for compliance.
+type ExecAuditor interface {
+	// AuditExec is called after each attempt to execute a process, whether
+	// or not it started.
+	AuditExec(record ExecAuditRecord)
+	// AuditExit is called once a process which started has exited, with
+	// the record given to AuditExec updated with its exit. It is called with
+	// the core's locks held, so it must not call back into the Core.
+	AuditExit(record ExecAuditRecord)
 }
@@ -0,0 +1,306 @@
+package gcs
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// cgroupRoot is the directory under which the cgroup hierarchies are mounted
+// in the utility VM, or where the cgroup v2 unified hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup2SuperMagic is the filesystem type of the cgroup v2 unified
+// hierarchy.
+const cgroup2SuperMagic = 0x63677270
+
+// cgroupHierarchy abstracts the differences between the layouts and file
+// formats of cgroup v1 and of the cgroup v2 unified hierarchy.
+type cgroupHierarchy interface {
+	// dir returns the directory of the cgroup with the given cgroups path
+	// which holds the given controller's files.
+	dir(cgroupsPath, controller string) string
+	// limitFiles returns the files to write, in order, to apply the given
+	// limits.
+	limitFiles(limits prot.ResourceLimits) ([]cgroupFile, error)
+	// cpuUsage and memoryUsage locate the statistics of a cgroup's CPU time
+	// in nanoseconds and its memory usage in bytes.
+	cpuUsage() cgroupStat
+	memoryUsage() cgroupStat
+}
+
+// cgroupFile is a value to write to one of a cgroup's files.
+type cgroupFile struct {
+	controller string
+	name       string
+	value      string
+}
+
+// cgroupStat locates a statistic in one of a cgroup's files. If key is empty,
+// the file holds only the value, and otherwise the value follows key on one
+// of its lines. The value is multiplied by scale.
+type cgroupStat struct {
+	controller string
+	name       string
+	key        string
+	scale      uint64
+}
+
+// cgroupV1 is the layout of cgroup v1, which has a hierarchy for each
+// controller.
+type cgroupV1 struct{}
+
+func (cgroupV1) dir(cgroupsPath, controller string) string {
+	return filepath.Join(cgroupRoot, controller, cgroupsPath)
+}
+
+func (cgroupV1) limitFiles(limits prot.ResourceLimits) ([]cgroupFile, error) {
+	var files []cgroupFile
+	if limits.MemoryLimitInBytes != 0 {
+		files = append(files, cgroupFile{"memory", "memory.limit_in_bytes", strconv.FormatInt(limits.MemoryLimitInBytes, 10)})
+	}
+	if limits.CPUPeriodInUs != 0 {
+		files = append(files, cgroupFile{"cpu", "cpu.cfs_period_us", strconv.FormatUint(limits.CPUPeriodInUs, 10)})
+	}
+	if limits.CPUQuotaInUs != 0 {
+		files = append(files, cgroupFile{"cpu", "cpu.cfs_quota_us", strconv.FormatInt(limits.CPUQuotaInUs, 10)})
+	}
+	if limits.PidsLimit != 0 {
+		files = append(files, cgroupFile{"pids", "pids.max", formatCgroupMax(limits.PidsLimit)})
+	}
+	return files, nil
+}
+
+func (cgroupV1) cpuUsage() cgroupStat {
+	return cgroupStat{controller: "cpuacct", name: "cpuacct.usage", scale: 1}
+}
+
+func (cgroupV1) memoryUsage() cgroupStat {
+	return cgroupStat{controller: "memory", name: "memory.usage_in_bytes", scale: 1}
+}
+
+// cgroupV2 is the layout of the cgroup v2 unified hierarchy, in which each
+// cgroup's directory holds the files of all of its controllers.
+type cgroupV2 struct{}
+
+func (cgroupV2) dir(cgroupsPath, controller string) string {
+	return filepath.Join(cgroupRoot, cgroupsPath)
+}
+
+func (cgroupV2) limitFiles(limits prot.ResourceLimits) ([]cgroupFile, error) {
+	var files []cgroupFile
+	if limits.MemoryLimitInBytes != 0 {
+		files = append(files, cgroupFile{"memory", "memory.max", formatCgroupMax(limits.MemoryLimitInBytes)})
+	}
+	if limits.CPUQuotaInUs != 0 {
+		// cpu.max holds the quota followed by the optional period.
+		value := formatCgroupMax(limits.CPUQuotaInUs)
+		if limits.CPUPeriodInUs != 0 {
+			value += " " + strconv.FormatUint(limits.CPUPeriodInUs, 10)
+		}
+		files = append(files, cgroupFile{"cpu", "cpu.max", value})
+	} else if limits.CPUPeriodInUs != 0 {
+		return nil, errors.New("the CPU period cannot be changed without the CPU quota on cgroup v2")
+	}
+	if limits.PidsLimit != 0 {
+		files = append(files, cgroupFile{"pids", "pids.max", formatCgroupMax(limits.PidsLimit)})
+	}
+	return files, nil
+}
+
+func (cgroupV2) cpuUsage() cgroupStat {
+	return cgroupStat{controller: "cpu", name: "cpu.stat", key: "usage_usec", scale: 1000}
+}
+
+func (cgroupV2) memoryUsage() cgroupStat {
+	return cgroupStat{controller: "memory", name: "memory.current", scale: 1}
+}
+
+// formatCgroupMax formats a limit for a file which takes "max" for no limit.
+func formatCgroupMax(limit int64) string {
+	if limit < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+// cgroups returns the cgroup hierarchy of the utility VM, detecting its
+// version the first time it is called.
+func (c *gcsCore) cgroups() cgroupHierarchy {
+	c.cgroupsOnce.Do(func() {
+		var buf syscall.Statfs_t
+		if err := c.OS.Statfs(cgroupRoot, &buf); err == nil && int64(buf.Type) == cgroup2SuperMagic {
+			c.hierarchy = cgroupV2{}
+		} else {
+			c.hierarchy = cgroupV1{}
+		}
+	})
+	return c.hierarchy
+}
+
+// cgroupsPathSubsystem is the cgroup hierarchy in which a cgroups path
+// supplied by the host must already exist.
+const cgroupsPathSubsystem = "memory"
+
+// validateCgroupsPath checks that a cgroups path supplied by the host is a
+// clean absolute path below the root cgroup, and that the cgroup exists.
+func (c *gcsCore) validateCgroupsPath(cgroupsPath string) error {
+	if cgroupsPath == "" {
+		return nil
+	}
+	if !filepath.IsAbs(cgroupsPath) || filepath.Clean(cgroupsPath) != cgroupsPath || cgroupsPath == "/" {
+		return errors.Errorf("cgroups path \"%s\" must be a clean absolute path below the root cgroup", cgroupsPath)
+	}
+	cgroupPath := c.cgroups().dir(cgroupsPath, cgroupsPathSubsystem)
+	exists, err := c.OS.PathExists(cgroupPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check for cgroup %s", cgroupPath)
+	}
+	if !exists {
+		return errors.Errorf("cgroup %s does not exist", cgroupPath)
+	}
+	return nil
+}
+
+// parseCPUList validates a cgroup cpuset list, such as "0-3,7", and returns it
+// in canonical form. An empty list is returned unchanged.
+func parseCPUList(list string) (string, error) {
+	if list == "" {
+		return "", nil
+	}
+	ranges := strings.Split(list, ",")
+	for i, r := range ranges {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return "", errors.Errorf("cpu list \"%s\" contains invalid entry \"%s\"", list, r)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil || last < first {
+				return "", errors.Errorf("cpu list \"%s\" contains invalid range \"%s\"", list, r)
+			}
+		}
+		if first == last {
+			ranges[i] = strconv.FormatUint(first, 10)
+		} else {
+			ranges[i] = strconv.FormatUint(first, 10) + "-" + strconv.FormatUint(last, 10)
+		}
+	}
+	return strings.Join(ranges, ","), nil
+}
+
+// applyCpusetToSpec mirrors the container's cpuset settings into the
+// resources of the given spec.
+func applyCpusetToSpec(containerEntry *containerCacheEntry, config *oci.Spec) {
+	if containerEntry.CpusetCpus == "" && containerEntry.CpusetMems == "" {
+		return
+	}
+	if config.Linux == nil {
+		config.Linux = &oci.Linux{}
+	}
+	if config.Linux.Resources == nil {
+		config.Linux.Resources = &oci.LinuxResources{}
+	}
+	if config.Linux.Resources.CPU == nil {
+		config.Linux.Resources.CPU = &oci.LinuxCPU{}
+	}
+	if containerEntry.CpusetCpus != "" {
+		config.Linux.Resources.CPU.Cpus = containerEntry.CpusetCpus
+	}
+	if containerEntry.CpusetMems != "" {
+		config.Linux.Resources.CPU.Mems = containerEntry.CpusetMems
+	}
+}
+
+// containerCgroupPath returns the directory of the container's cgroup which
+// holds the given controller's files.
+//
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) containerCgroupPath(containerEntry *containerCacheEntry, controller string) string {
+	cgroupsPath := containerEntry.cgroupsPath
+	if cgroupsPath == "" {
+		cgroupsPath = containerEntry.ID
+	}
+	return c.cgroups().dir(cgroupsPath, controller)
+}
+
+// writeResourceLimits applies the given limits to the container's cgroup.
+//
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) writeResourceLimits(containerEntry *containerCacheEntry, limits prot.ResourceLimits) error {
+	for _, limit := range []int64{limits.MemoryLimitInBytes, limits.CPUQuotaInUs, limits.PidsLimit} {
+		if limit < -1 {
+			return errors.Errorf("invalid resource limit %d for container %s", limit, containerEntry.ID)
+		}
+	}
+	files, err := c.cgroups().limitFiles(limits)
+	if err != nil {
+		return errors.Wrapf(err, "invalid resource limits for container %s", containerEntry.ID)
+	}
+	for _, f := range files {
+		if err := c.writeCgroupFile(containerEntry, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCgroupFile writes a value to one of the container's cgroup files.
+//
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) writeCgroupFile(containerEntry *containerCacheEntry, f cgroupFile) error {
+	path := filepath.Join(c.containerCgroupPath(containerEntry, f.controller), f.name)
+	file, err := c.OS.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s for container %s", path, containerEntry.ID)
+	}
+	_, err = file.Write([]byte(f.value))
+	file.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s for container %s", path, containerEntry.ID)
+	}
+	return nil
+}
+
+// readCgroupStat reads a statistic from one of the container's cgroup files.
+//
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) readCgroupStat(containerEntry *containerCacheEntry, stat cgroupStat) (uint64, error) {
+	path := filepath.Join(c.containerCgroupPath(containerEntry, stat.controller), stat.name)
+	if stat.key == "" {
+		value, err := c.readCgroupUint(path)
+		return value * stat.scale, err
+	}
+	file, err := c.OS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer file.Close()
+	// Statistics files are small, but are bounded in case of a bad file.
+	scanner := bufio.NewScanner(io.LimitReader(file, 64*1024))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != stat.key {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to parse %s in %s", stat.key, path)
+		}
+		return value * stat.scale, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrapf(err, "failed to read %s", path)
+	}
+	return 0, errors.Errorf("%s has no %s", path, stat.key)
+}
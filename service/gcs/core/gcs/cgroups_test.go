@@ -0,0 +1,105 @@
+package gcs
+
+import (
+	"syscall"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/mockos"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cgroups", func() {
+	Describe("detecting the cgroup version", func() {
+		var sos *statfsOS
+		BeforeEach(func() {
+			sos = &statfsOS{OS: mockos.NewOS()}
+		})
+		Context("the cgroup root is the unified hierarchy", func() {
+			BeforeEach(func() {
+				sos.stat = syscall.Statfs_t{Type: cgroup2SuperMagic}
+			})
+			It("should select cgroup v2", func() {
+				coreint := NewGCSCore(mockruntime.NewRuntime(), sos)
+				Expect(coreint.cgroups()).To(Equal(cgroupV2{}))
+				Expect(sos.paths).To(Equal([]string{cgroupRoot}))
+			})
+		})
+		Context("the cgroup root is not the unified hierarchy", func() {
+			It("should select cgroup v1", func() {
+				coreint := NewGCSCore(mockruntime.NewRuntime(), sos)
+				Expect(coreint.cgroups()).To(Equal(cgroupV1{}))
+			})
+		})
+		It("should only detect the version once", func() {
+			coreint := NewGCSCore(mockruntime.NewRuntime(), sos)
+			coreint.cgroups()
+			coreint.cgroups()
+			Expect(sos.paths).To(HaveLen(1))
+		})
+	})
+	Describe("cgroup v1", func() {
+		It("should place each controller in its own hierarchy", func() {
+			Expect(cgroupV1{}.dir("pod/abc", "memory")).To(Equal("/sys/fs/cgroup/memory/pod/abc"))
+			Expect(cgroupV1{}.dir("pod/abc", "cpuset")).To(Equal("/sys/fs/cgroup/cpuset/pod/abc"))
+		})
+		It("should write the limits to the v1 files", func() {
+			files, err := cgroupV1{}.limitFiles(prot.ResourceLimits{
+				MemoryLimitInBytes: 1 << 30,
+				CPUQuotaInUs:       50000,
+				CPUPeriodInUs:      100000,
+				PidsLimit:          -1,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(Equal([]cgroupFile{
+				{"memory", "memory.limit_in_bytes", "1073741824"},
+				{"cpu", "cpu.cfs_period_us", "100000"},
+				{"cpu", "cpu.cfs_quota_us", "50000"},
+				{"pids", "pids.max", "max"},
+			}))
+		})
+		It("should leave unset limits unchanged", func() {
+			files, err := cgroupV1{}.limitFiles(prot.ResourceLimits{CPUPeriodInUs: 20000})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(Equal([]cgroupFile{{"cpu", "cpu.cfs_period_us", "20000"}}))
+		})
+	})
+	Describe("cgroup v2", func() {
+		It("should place every controller in the cgroup's directory", func() {
+			Expect(cgroupV2{}.dir("pod/abc", "memory")).To(Equal("/sys/fs/cgroup/pod/abc"))
+			Expect(cgroupV2{}.dir("pod/abc", "cpuset")).To(Equal("/sys/fs/cgroup/pod/abc"))
+		})
+		It("should write the limits to the unified files", func() {
+			files, err := cgroupV2{}.limitFiles(prot.ResourceLimits{
+				MemoryLimitInBytes: 1 << 30,
+				CPUQuotaInUs:       50000,
+				CPUPeriodInUs:      100000,
+				PidsLimit:          64,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(Equal([]cgroupFile{
+				{"memory", "memory.max", "1073741824"},
+				{"cpu", "cpu.max", "50000 100000"},
+				{"pids", "pids.max", "64"},
+			}))
+		})
+		It("should write max for removed limits", func() {
+			files, err := cgroupV2{}.limitFiles(prot.ResourceLimits{
+				MemoryLimitInBytes: -1,
+				CPUQuotaInUs:       -1,
+				PidsLimit:          -1,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(Equal([]cgroupFile{
+				{"memory", "memory.max", "max"},
+				{"cpu", "cpu.max", "max"},
+				{"pids", "pids.max", "max"},
+			}))
+		})
+		It("should not change the CPU period without the quota", func() {
+			_, err := cgroupV2{}.limitFiles(prot.ResourceLimits{CPUPeriodInUs: 20000})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
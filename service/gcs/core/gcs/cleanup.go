@@ -1,19 +1,40 @@
 package gcs
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
-	"github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
+// maxCleanupEntries is the most files and directories which are removed from
+// a container's writable layer for its cleanup paths, so that a container
+// which filled them with files can't stall its cleanup.
+const maxCleanupEntries = 100000
+
 // CleanupContainer cleans up the state left behind by the container with the
-// given ID.
-// This function expects containerCacheMutex to be locked on entry.
+// given ID. The container's storage is cleaned up even if its init process
+// was never created.
+// This function expects the container entry's mutex to be locked on entry.
 func (c *gcsCore) cleanupContainer(containerEntry *containerCacheEntry) error {
 	var errToReturn error
-	if err := c.forceDeleteContainer(containerEntry.container); err != nil {
-		logrus.Warn(err)
+	if containerEntry.container != nil {
+		if err := c.forceDeleteContainer(containerEntry.container); err != nil {
+			containerEntry.log().Warn(err)
+			if errToReturn == nil {
+				errToReturn = err
+			}
+		}
+	}
+
+	// The writable layer is on the scratch device, so is cleaned before it is
+	// unmounted.
+	if err := c.removeCleanupPaths(containerEntry); err != nil {
+		containerEntry.log().Warn(err)
 		if errToReturn == nil {
 			errToReturn = err
 		}
@@ -25,23 +46,33 @@ func (c *gcsCore) cleanupContainer(containerEntry *containerCacheEntry) error {
 		disks = append(disks, disk)
 	}
 	if err := c.unmountMappedVirtualDisks(disks); err != nil {
-		logrus.Warn(err)
+		containerEntry.log().Warn(err)
 		if errToReturn == nil {
 			errToReturn = err
 		}
 	}
 
-	if err := c.unmountLayers(containerEntry.ID); err != nil {
-		logrus.Warn(err)
-		if errToReturn == nil {
-			errToReturn = err
-		}
+	// The layers are unmounted along with the union filesystem only if no
+	// clone still uses them. Once the last clone of a removed container is
+	// cleaned up, it unmounts and removes that container's layers.
+	owner := c.releaseLayers(containerEntry)
+	ids := []string{containerEntry.ID}
+	if owner != "" && owner != containerEntry.ID {
+		ids = append(ids, owner)
 	}
+	for _, id := range ids {
+		if err := c.unmountLayers(id); err != nil {
+			containerEntry.log().Warn(err)
+			if errToReturn == nil {
+				errToReturn = err
+			}
+		}
 
-	if err := c.destroyContainerStorage(containerEntry.ID); err != nil {
-		logrus.Warn(err)
-		if errToReturn == nil {
-			errToReturn = err
+		if err := c.destroyContainerStorage(id); err != nil {
+			containerEntry.log().Warn(err)
+			if errToReturn == nil {
+				errToReturn = err
+			}
 		}
 	}
 
@@ -83,3 +114,104 @@ func (c *gcsCore) forceDeleteContainer(container runtime.Container) error {
 	}
 	return nil
 }
+
+// validateCleanupPaths checks that a container with the given scratch device
+// has a writable layer for the given cleanup paths, and that none of them is
+// the container's root. It returns the cleaned paths.
+func validateCleanupPaths(scratch string, paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	if scratch == "" {
+		return nil, errors.New("the container has no writable layer")
+	}
+	cleaned := make([]string, len(paths))
+	for i, path := range paths {
+		if !filepath.IsAbs(path) {
+			return nil, errors.Errorf("%s is not an absolute path", path)
+		}
+		cleaned[i] = filepath.Clean(path)
+		if cleaned[i] == "/" {
+			return nil, errors.New("the container's root can't be a cleanup path")
+		}
+	}
+	return cleaned, nil
+}
+
+// removeCleanupPaths removes the container's cleanup paths from its writable
+// layer. Only the files the container wrote are removed, as the paths are
+// removed from the overlay's upper directory rather than through its root
+// filesystem. A path which can't be removed doesn't stop the others from
+// being removed, and the first such error is returned.
+func (c *gcsCore) removeCleanupPaths(containerEntry *containerCacheEntry) error {
+	if len(containerEntry.CleanupPaths) == 0 {
+		return nil
+	}
+	_, scratchPath, _, _ := c.getUnioningPaths(containerEntry.ID)
+	upperDir := filepath.Join(scratchPath, "upper")
+	remaining := maxCleanupEntries
+	var errToReturn error
+	for _, path := range containerEntry.CleanupPaths {
+		if err := c.removeFromLayer(upperDir, path, &remaining); err != nil && errToReturn == nil {
+			errToReturn = errors.Wrapf(err, "failed to remove cleanup path %s of container %s", path, containerEntry.ID)
+		}
+	}
+	return errToReturn
+}
+
+// removeFromLayer removes the given container path from the layer at
+// layerPath, removing at most *remaining files and directories. The path's
+// parents in the layer are checked not to be symlinks, which the container
+// could otherwise have made to redirect the removal outside of the layer.
+func (c *gcsCore) removeFromLayer(layerPath, path string, remaining *int) error {
+	target := layerPath
+	names := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, name := range names {
+		target = filepath.Join(target, name)
+		info, err := c.OS.Lstat(target)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				// The container never wrote to the path.
+				return nil
+			}
+			return err
+		}
+		if i < len(names)-1 && !info.IsDir() {
+			return errors.Errorf("/%s is not a directory in the container's writable layer", filepath.Join(names[:i+1]...))
+		}
+		if i == len(names)-1 && info.IsDir() {
+			return c.removeTree(target, remaining)
+		}
+	}
+	return c.removeEntry(target, remaining)
+}
+
+// removeTree removes the given directory and everything in it, without
+// following symlinks, counting each entry removed against *remaining.
+func (c *gcsCore) removeTree(dir string, remaining *int) error {
+	infos, err := c.OS.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		child := filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := c.removeTree(child, remaining); err != nil {
+				return err
+			}
+		} else if err := c.removeEntry(child, remaining); err != nil {
+			return err
+		}
+	}
+	return c.removeEntry(dir, remaining)
+}
+
+// removeEntry removes a single file, symlink, or empty directory, counting it
+// against *remaining.
+func (c *gcsCore) removeEntry(path string, remaining *int) error {
+	if *remaining <= 0 {
+		return errors.Errorf("gave up after removing %d files", maxCleanupEntries)
+	}
+	*remaining--
+	return c.OS.RemoveAll(path)
+}
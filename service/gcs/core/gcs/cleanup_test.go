@@ -0,0 +1,161 @@
+package gcs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/mockos"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/realos"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// removalRecordingOS wraps an oslayer.OS, recording the paths removed through
+// it, which may be removed concurrently.
+type removalRecordingOS struct {
+	oslayer.OS
+	mutex sync.Mutex
+	paths []string
+}
+
+func (o *removalRecordingOS) RemoveAll(path string) error {
+	o.mutex.Lock()
+	o.paths = append(o.paths, path)
+	o.mutex.Unlock()
+	return o.OS.RemoveAll(path)
+}
+
+func (o *removalRecordingOS) removed() []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]string{}, o.paths...)
+}
+
+var _ = Describe("cleanup paths", func() {
+	Describe("validating cleanup paths", func() {
+		It("should clean the paths", func() {
+			paths, err := validateCleanupPaths("3", []string{"/tmp/", "/var/../run"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(paths).To(Equal([]string{"/tmp", "/run"}))
+		})
+		It("should reject a relative path", func() {
+			_, err := validateCleanupPaths("3", []string{"tmp"})
+			Expect(err).To(HaveOccurred())
+		})
+		It("should reject the root", func() {
+			_, err := validateCleanupPaths("3", []string{"/tmp/.."})
+			Expect(err).To(HaveOccurred())
+		})
+		It("should reject a container without a writable layer", func() {
+			_, err := validateCleanupPaths("", []string{"/tmp"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("removing cleanup paths when the container exits", func() {
+		var (
+			ros         *removalRecordingOS
+			coreint     *gcsCore
+			containerID string
+		)
+		BeforeEach(func() {
+			ros = &removalRecordingOS{OS: mockos.NewOS()}
+			coreint = NewGCSCore(mockruntime.NewRuntime(), ros)
+			containerID = "cleanup"
+			settings := prot.VMHostedContainerSettings{
+				Layers:          []prot.Layer{{Path: "0"}},
+				SandboxDataPath: "1",
+				CleanupPaths:    []string{"/tmp", "/cache"},
+			}
+			Expect(coreint.CreateContainer(containerID, settings)).To(Succeed())
+			params := prot.ProcessParameters{
+				OCISpecification: oci.Spec{
+					Process: oci.Process{Args: []string{"/bin/sh"}},
+					Root:    oci.Root{Path: "rootfs"},
+				},
+			}
+			_, err := coreint.ExecProcess(containerID, params, &stdio.ConnectionSet{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("should remove the paths from the container's writable layer", func() {
+			_, scratchPath, _, _ := coreint.getUnioningPaths(containerID)
+			upperDir := filepath.Join(scratchPath, "upper")
+			Expect(ros.removed()).NotTo(ContainElement(filepath.Join(upperDir, "tmp")))
+			Expect(coreint.SignalContainer(containerID, oslayer.SIGKILL)).To(Succeed())
+			Eventually(ros.removed).Should(ContainElement(filepath.Join(upperDir, "cache")))
+			Expect(ros.removed()).To(ContainElement(filepath.Join(upperDir, "tmp")))
+		})
+	})
+	Describe("removing a path from a layer", func() {
+		var (
+			coreint   *gcsCore
+			dir       string
+			layerPath string
+			remaining int
+			err       error
+		)
+		BeforeEach(func() {
+			coreint = NewGCSCore(mockruntime.NewRuntime(), realos.NewOS())
+			dir, err = ioutil.TempDir("", "cleanup")
+			Expect(err).NotTo(HaveOccurred())
+			layerPath = filepath.Join(dir, "upper")
+			Expect(os.MkdirAll(filepath.Join(layerPath, "tmp/a/b"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(layerPath, "tmp/a/b/file"), nil, 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(layerPath, "tmp/file"), nil, 0644)).To(Succeed())
+			remaining = maxCleanupEntries
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		It("should remove the directory and its contents", func() {
+			Expect(coreint.removeFromLayer(layerPath, "/tmp", &remaining)).To(Succeed())
+			_, err := os.Lstat(filepath.Join(layerPath, "tmp"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			Expect(remaining).To(Equal(maxCleanupEntries - 5))
+		})
+		It("should do nothing for a path which doesn't exist", func() {
+			Expect(coreint.removeFromLayer(layerPath, "/var/tmp", &remaining)).To(Succeed())
+			Expect(remaining).To(Equal(maxCleanupEntries))
+		})
+		It("should stop once it has removed the most entries", func() {
+			remaining = 2
+			Expect(coreint.removeFromLayer(layerPath, "/tmp", &remaining)).NotTo(Succeed())
+			_, err := os.Lstat(filepath.Join(layerPath, "tmp"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+		Context("a parent of the path is a symlink", func() {
+			var outside string
+			BeforeEach(func() {
+				outside = filepath.Join(dir, "outside")
+				Expect(os.MkdirAll(filepath.Join(outside, "tmp"), 0755)).To(Succeed())
+				Expect(os.Symlink(outside, filepath.Join(layerPath, "var"))).To(Succeed())
+			})
+			It("should not follow it", func() {
+				Expect(coreint.removeFromLayer(layerPath, "/var/tmp", &remaining)).NotTo(Succeed())
+				_, err := os.Stat(filepath.Join(outside, "tmp"))
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+		Context("the path is a symlink", func() {
+			var outside string
+			BeforeEach(func() {
+				outside = filepath.Join(dir, "outside")
+				Expect(os.MkdirAll(outside, 0755)).To(Succeed())
+				Expect(os.Symlink(outside, filepath.Join(layerPath, "cache"))).To(Succeed())
+			})
+			It("should remove only the symlink", func() {
+				Expect(coreint.removeFromLayer(layerPath, "/cache", &remaining)).To(Succeed())
+				_, err := os.Lstat(filepath.Join(layerPath, "cache"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+				_, err = os.Stat(outside)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
+	})
+})
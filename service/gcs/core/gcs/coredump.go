@@ -0,0 +1,103 @@
+package gcs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/pkg/errors"
+)
+
+// corePatternPath is the kernel setting which says where core dumps are
+// written, or which helper they are piped to.
+const corePatternPath = "/proc/sys/kernel/core_pattern"
+
+// defaultCoreDumpHelperPath is the path in the utility VM of the coredump
+// binary, which the kernel pipes core dumps to once they are enabled.
+const defaultCoreDumpHelperPath = "/bin/coredump"
+
+// defaultMaxCoreDumpSize is the default number of bytes of each core dump
+// which are kept. The rest of a larger dump is discarded.
+const defaultMaxCoreDumpSize = 256 << 20
+
+// maxCorePatternLength is the longest core_pattern the kernel accepts.
+const maxCorePatternLength = 127
+
+// coreDumpSignals are the signals whose default action dumps core.
+var coreDumpSignals = map[oslayer.Signal]bool{
+	oslayer.Signal(syscall.SIGQUIT): true,
+	oslayer.Signal(syscall.SIGILL):  true,
+	oslayer.Signal(syscall.SIGTRAP): true,
+	oslayer.Signal(syscall.SIGABRT): true,
+	oslayer.Signal(syscall.SIGBUS):  true,
+	oslayer.Signal(syscall.SIGFPE):  true,
+	oslayer.Signal(syscall.SIGSEGV): true,
+	oslayer.Signal(syscall.SIGXCPU): true,
+	oslayer.Signal(syscall.SIGXFSZ): true,
+	oslayer.Signal(syscall.SIGSYS):  true,
+}
+
+// ConfigureCoreDumps sets the utility VM's core_pattern so that the core
+// dumps of crashed processes, in containers or not, are piped to the
+// coredump helper and kept in CoreDumpDir, truncated to MaxCoreDumpSize
+// bytes. Core dumps are piped even if the process's RLIMIT_CORE is zero.
+func (c *gcsCore) ConfigureCoreDumps() error {
+	dir := c.CoreDumpDir
+	if !filepath.IsAbs(dir) {
+		return errors.Errorf("core dump directory %s must be absolute", dir)
+	}
+	// The kernel splits the pattern's arguments on spaces and expands the
+	// specifiers starting with %.
+	if strings.ContainsAny(dir, " \t\n%") {
+		return errors.Errorf("core dump directory %s must not contain whitespace or %%", dir)
+	}
+	if c.MaxCoreDumpSize <= 0 {
+		return errors.Errorf("invalid maximum core dump size %d", c.MaxCoreDumpSize)
+	}
+	pattern := fmt.Sprintf("|%s %d %s", c.CoreDumpHelperPath, c.MaxCoreDumpSize, filepath.Join(filepath.Clean(dir), "core.%P"))
+	if len(pattern) > maxCorePatternLength {
+		return errors.Errorf("core pattern \"%s\" is longer than the kernel's limit of %d bytes", pattern, maxCorePatternLength)
+	}
+
+	if err := c.OS.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create core dump directory %s", dir)
+	}
+	file, err := c.OS.OpenFile(corePatternPath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", corePatternPath)
+	}
+	_, err = file.Write([]byte(pattern))
+	file.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", corePatternPath)
+	}
+	return nil
+}
+
+// CoreDumpPath returns the path in the utility VM of the core dump of the
+// process with the given pid, which exited with the given state, or an
+// empty string if it didn't dump core. A process only dumps core if core
+// dumps are configured, and it was killed by a signal which dumps core.
+//
+// The core dump may be retrieved with remotefs's readcoredump command, given
+// CoreDumpDir and the path, which removes it once it has been read.
+func (c *gcsCore) CoreDumpPath(pid int, state oslayer.ProcessExitState) string {
+	if c.CoreDumpDir == "" {
+		return ""
+	}
+	signal, ok := state.Signal()
+	if !ok || !coreDumpSignals[signal] {
+		return ""
+	}
+	path := filepath.Join(c.CoreDumpDir, fmt.Sprintf("core.%d", pid))
+	// The dump may have been suppressed, such as for a process which isn't
+	// dumpable, or failed to be saved.
+	exists, err := c.OS.PathExists(path)
+	if err != nil || !exists {
+		return ""
+	}
+	return path
+}
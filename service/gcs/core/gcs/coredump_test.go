@@ -0,0 +1,138 @@
+package gcs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/mockos"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	"github.com/Microsoft/opengcs/service/gcsutils/remotefs"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var _ = Describe("core dumps", func() {
+	Describe("configuring core dumps", func() {
+		var (
+			fos     *fileRecordingOS
+			coreint *gcsCore
+		)
+		BeforeEach(func() {
+			fos = &fileRecordingOS{OS: mockos.NewOS(), files: make(map[string]*bytes.Buffer)}
+			coreint = NewGCSCore(mockruntime.NewRuntime(), fos)
+			coreint.CoreDumpDir = "/var/crash/"
+			coreint.MaxCoreDumpSize = 1 << 20
+		})
+		It("should pipe core dumps to the helper", func() {
+			Expect(coreint.ConfigureCoreDumps()).To(Succeed())
+			Expect(fos.files[corePatternPath].String()).To(Equal("|/bin/coredump 1048576 /var/crash/core.%P"))
+		})
+		It("should reject a relative directory", func() {
+			coreint.CoreDumpDir = "crash"
+			Expect(coreint.ConfigureCoreDumps()).NotTo(Succeed())
+			Expect(fos.files).NotTo(HaveKey(corePatternPath))
+		})
+		It("should reject a directory with a space", func() {
+			coreint.CoreDumpDir = "/var/crash dumps"
+			Expect(coreint.ConfigureCoreDumps()).NotTo(Succeed())
+		})
+		It("should reject a pattern which is too long", func() {
+			coreint.CoreDumpDir = "/" + string(bytes.Repeat([]byte("a"), maxCorePatternLength))
+			Expect(coreint.ConfigureCoreDumps()).NotTo(Succeed())
+		})
+		It("should reject an unbounded size", func() {
+			coreint.MaxCoreDumpSize = 0
+			Expect(coreint.ConfigureCoreDumps()).NotTo(Succeed())
+		})
+	})
+	Describe("finding a crashed process's core dump", func() {
+		var (
+			mos     *missingPathOS
+			coreint *gcsCore
+		)
+		BeforeEach(func() {
+			mos = &missingPathOS{OS: mockos.NewOS()}
+			coreint = NewGCSCore(mockruntime.NewRuntime(), mos)
+			coreint.CoreDumpDir = "/var/crash"
+		})
+		It("should return the dump of a process killed by SIGSEGV", func() {
+			state := mockos.NewSignaledProcessExitState(oslayer.Signal(syscall.SIGSEGV))
+			Expect(coreint.CoreDumpPath(42, state)).To(Equal("/var/crash/core.42"))
+		})
+		It("should not return a dump for a signal which doesn't dump core", func() {
+			Expect(coreint.CoreDumpPath(42, mockos.NewSignaledProcessExitState(oslayer.SIGKILL))).To(BeEmpty())
+			Expect(coreint.CoreDumpPath(42, mockos.NewProcessExitState(139))).To(BeEmpty())
+		})
+		It("should not return a dump which wasn't saved", func() {
+			mos.missing = "/var/crash/core.42"
+			state := mockos.NewSignaledProcessExitState(oslayer.Signal(syscall.SIGABRT))
+			Expect(coreint.CoreDumpPath(42, state)).To(BeEmpty())
+		})
+		It("should not return a dump if core dumps aren't configured", func() {
+			coreint.CoreDumpDir = ""
+			state := mockos.NewSignaledProcessExitState(oslayer.Signal(syscall.SIGSEGV))
+			Expect(coreint.CoreDumpPath(42, state)).To(BeEmpty())
+		})
+	})
+	Describe("a container's init process crashing", func() {
+		var (
+			coreint     *gcsCore
+			dir         string
+			containerID string
+			pid         int
+		)
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "coredump")
+			Expect(err).NotTo(HaveOccurred())
+			rtime := &exitingRuntime{
+				Runtime:   mockruntime.NewRuntime(),
+				exitState: mockos.NewSignaledProcessExitState(oslayer.Signal(syscall.SIGSEGV)),
+			}
+			coreint = NewGCSCore(rtime, mockos.NewOS())
+			coreint.CoreDumpDir = dir
+			containerID = "crashing"
+			Expect(coreint.CreateContainer(containerID, prot.VMHostedContainerSettings{Layers: []prot.Layer{{Path: "0"}}})).To(Succeed())
+			params := prot.ProcessParameters{
+				OCISpecification: oci.Spec{
+					Process: oci.Process{Args: []string{"/bin/sh"}},
+					Root:    oci.Root{Path: "rootfs"},
+				},
+			}
+			pid, err = coreint.ExecProcess(containerID, params, &stdio.ConnectionSet{})
+			Expect(err).NotTo(HaveOccurred())
+			// Stand in for the coredump helper, which the kernel runs before
+			// the process's exit is reported.
+			Expect(ioutil.WriteFile(filepath.Join(dir, "core.101"), []byte("ELF core"), 0600)).To(Succeed())
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		It("should report the core dump, which can be retrieved with remotefs", func() {
+			Expect(pid).To(Equal(101))
+			exited := make(chan oslayer.ProcessExitState, 1)
+			Expect(coreint.RegisterProcessExitHook(pid, func(s oslayer.ProcessExitState) { exited <- s })).To(Succeed())
+			var state oslayer.ProcessExitState
+			Eventually(exited).Should(Receive(&state))
+			path := coreint.CoreDumpPath(pid, state)
+			Expect(path).To(Equal(filepath.Join(dir, "core.101")))
+
+			events, err := coreint.GetContainerHistory(containerID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(events[len(events)-1].Type).To(Equal(prot.CeExited))
+			Expect(events[len(events)-1].Details).To(Equal("exit code -1, killed by signal 11, core dumped to " + path))
+
+			var core bytes.Buffer
+			Expect(remotefs.ReadCoreDump(nil, &core, []string{dir, path})).To(Succeed())
+			Expect(core.String()).To(Equal("ELF core"))
+			Expect(path).NotTo(BeAnExistingFile())
+		})
+	})
+})
@@ -0,0 +1,195 @@
+package gcs
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// execMountHelperName is the name of the execmount binary in a staging
+// directory.
+const execMountHelperName = "execmount"
+
+// stageExecMounts prepares the given mounts for the given process exec'd in
+// the container. The sources, along with the execmount binary, are bind
+// mounted into a new staging directory under execMountsContainerPath in the
+// container's root filesystem, which only root can enter. The returned
+// arguments run the process under execmount, which bind mounts them at their
+// destinations in a mount namespace of the process's own, and then unmounts
+// them from the staging directory in the container's mount namespace, so that
+// the container's other processes don't see them. The staging directory, as
+// seen from the utility VM, is also returned, to be passed to
+// unstageExecMounts once the process exits.
+//
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) stageExecMounts(containerEntry *containerCacheEntry, mounts []prot.ProcessMount, process oci.Process) ([]string, string, error) {
+	id := containerEntry.ID
+	// execmount unshares its mount namespace, which requires CAP_SYS_ADMIN.
+	if !hasEffectiveCapability(process, "CAP_SYS_ADMIN") {
+		return nil, "", errors.Errorf("a process in container %s requested mounts, but does not have CAP_SYS_ADMIN, which execmount requires", id)
+	}
+	exists, err := c.OS.PathExists(c.ExecMountPath)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to check for %s", c.ExecMountPath)
+	}
+	if !exists {
+		return nil, "", errors.Errorf("a process in container %s requested mounts, but %s does not exist", id, c.ExecMountPath)
+	}
+	isDir := make([]bool, len(mounts))
+	for i, m := range mounts {
+		if !filepath.IsAbs(m.Source) {
+			return nil, "", errors.Errorf("mount source %s is not an absolute path", m.Source)
+		}
+		// execmount separates the paths of its mounts with colons.
+		if !filepath.IsAbs(m.Destination) || strings.Contains(m.Destination, ":") {
+			return nil, "", errors.Errorf("invalid mount destination %s", m.Destination)
+		}
+		exists, err := c.OS.PathExists(m.Source)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to check for mount source %s", m.Source)
+		}
+		if !exists {
+			return nil, "", errors.Errorf("mount source %s does not exist", m.Source)
+		}
+		// A directory can only be bind mounted over a directory, and
+		// anything else over a file, so the staged mountpoint and the
+		// destination are created to match the source.
+		info, err := c.OS.Lstat(m.Source)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to stat mount source %s", m.Source)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil, "", errors.Errorf("mount source %s is a symbolic link", m.Source)
+		}
+		isDir[i] = info.IsDir()
+	}
+
+	containerEntry.execMounts++
+	name := strconv.Itoa(containerEntry.execMounts)
+	_, _, _, rootfsPath := c.getUnioningPaths(id)
+	stagingPath := filepath.Join(rootfsPath, execMountsContainerPath, name)
+	containerStagingPath := filepath.Join(execMountsContainerPath, name)
+	stagedArgs, err := c.stageExecMountPaths(stagingPath, containerStagingPath, mounts, isDir)
+	if err != nil {
+		if err := c.unstageExecMounts(stagingPath, len(mounts)); err != nil {
+			containerEntry.log().Error(err)
+		}
+		return nil, "", errors.Wrapf(err, "failed to stage mounts for a process in container %s", id)
+	}
+	stagedArgs = append(append(stagedArgs, "--"), process.Args...)
+	return stagedArgs, stagingPath, nil
+}
+
+// hasEffectiveCapability returns whether the given process is granted the
+// capability with the given name in its effective set.
+func hasEffectiveCapability(process oci.Process, capability string) bool {
+	if process.Capabilities == nil {
+		return false
+	}
+	for _, c := range process.Capabilities.Effective {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// stageExecMountPaths makes the bind mounts in the given staging directory,
+// returning the arguments which run execmount with them. isDir gives whether
+// the source of each mount is a directory.
+func (c *gcsCore) stageExecMountPaths(stagingPath, containerStagingPath string, mounts []prot.ProcessMount, isDir []bool) ([]string, error) {
+	// Only root can enter the staging directory, which holds the sources
+	// until execmount has mounted them.
+	if err := c.OS.MkdirAll(stagingPath, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create staging directory %s", stagingPath)
+	}
+	helperPath := filepath.Join(stagingPath, execMountHelperName)
+	if err := c.createMountpoint(helperPath, false); err != nil {
+		return nil, err
+	}
+	if err := c.bindMount(c.ExecMountPath, helperPath, true); err != nil {
+		return nil, err
+	}
+
+	args := []string{filepath.Join(containerStagingPath, execMountHelperName)}
+	for i, m := range mounts {
+		stagedPath := filepath.Join(stagingPath, strconv.Itoa(i))
+		if err := c.createMountpoint(stagedPath, isDir[i]); err != nil {
+			return nil, err
+		}
+		if err := c.bindMount(m.Source, stagedPath, m.ReadOnly); err != nil {
+			return nil, err
+		}
+		arg := filepath.Join(containerStagingPath, strconv.Itoa(i)) + ":" + m.Destination
+		if m.ReadOnly {
+			arg += ":ro"
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// createMountpoint creates a directory at path to bind mount a directory
+// over, or an empty file to bind mount anything else over.
+func (c *gcsCore) createMountpoint(path string, isDir bool) error {
+	if isDir {
+		if err := c.OS.MkdirAll(path, 0755); err != nil {
+			return errors.Wrapf(err, "failed to create %s", path)
+		}
+		return nil
+	}
+	file, err := c.OS.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", path)
+	}
+	file.Close()
+	return nil
+}
+
+// bindMount bind mounts source at target, read-only if requested.
+func (c *gcsCore) bindMount(source, target string, readOnly bool) error {
+	if err := c.OS.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return errors.Wrapf(err, "failed to bind mount %s at %s", source, target)
+	}
+	// The read-only flag of a bind mount is only applied by a remount.
+	if readOnly {
+		if err := c.OS.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			return errors.Wrapf(err, "failed to make %s read-only", target)
+		}
+	}
+	return nil
+}
+
+// unstageExecMounts unmounts the execmount binary and the given number of
+// mounts from the staging directory, and then removes it. The directory is
+// left in place if any of them can't be unmounted, so that the sources
+// aren't removed along with it.
+func (c *gcsCore) unstageExecMounts(stagingPath string, count int) error {
+	paths := []string{filepath.Join(stagingPath, execMountHelperName)}
+	for i := 0; i < count; i++ {
+		paths = append(paths, filepath.Join(stagingPath, strconv.Itoa(i)))
+	}
+	for _, path := range paths {
+		mounted, err := c.OS.PathIsMounted(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to determine if %s is mounted", path)
+		}
+		if mounted {
+			// The container's processes may still be using the mount, so it
+			// is detached rather than left in place.
+			if err := c.OS.Unmount(path, syscall.MNT_DETACH); err != nil {
+				return errors.Wrapf(err, "failed to unmount %s", path)
+			}
+		}
+	}
+	if err := c.OS.RemoveAll(stagingPath); err != nil {
+		return errors.Wrapf(err, "failed to remove staging directory %s", stagingPath)
+	}
+	return nil
+}
@@ -5,12 +5,21 @@
 package gcs
 
 import (
+	"container/list"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/Microsoft/opengcs/service/gcs/core"
 	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
@@ -20,18 +29,134 @@ import (
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Version is the version of the GCS reported by Health. It is set when
+// building the GCS, with -ldflags "-X
+// github.com/Microsoft/opengcs/service/gcs/core/gcs.Version=<version>".
+var Version = "unknown"
+
+// defaultStartTimeout is the default amount of time before startContainer
+// will give up waiting for a container's init process to start.
+const defaultStartTimeout = time.Second * 30
+
+const (
+	// defaultReapInitPath is where the reapinit binary, a link to
+	// gcstools, is installed in the utility VM.
+	defaultReapInitPath = "/bin/reapinit"
+	// reapingInitContainerPath is where the reapinit binary is bind mounted
+	// in containers which request a reaping init.
+	reapingInitContainerPath = "/.reapinit"
+	// defaultExecMountPath is where the execmount binary, a link to
+	// gcstools, is installed in the utility VM.
+	defaultExecMountPath = "/bin/execmount"
+	// execMountsContainerPath is the directory in containers under which
+	// the mounts of exec'd processes are staged.
+	execMountsContainerPath = "/.execmounts"
 )
 
 // gcsCore is an implementation of the Core interface, defining the
 // functionality of the GCS.
 type gcsCore struct {
-	// Rtime is the Runtime interface used by the GCS core.
+	// Rtime is the default Runtime interface used by the GCS core. It is used
+	// for containers which don't request a runtime by name.
 	Rtime runtime.Runtime
 
 	// OS is the OS interface used by the GCS core.
 	OS oslayer.OS
 
+	// DeviceTimeout is the amount of time to wait for the block devices of
+	// layers and mapped virtual disks to appear before mounting them.
+	DeviceTimeout time.Duration
+
+	// MountTimeout is the amount of time to wait for a mount or unmount of a
+	// container's storage to finish. An unmount which times out is replaced
+	// with a lazy one. Zero means no limit.
+	MountTimeout time.Duration
+
+	// StartTimeout is the amount of time to wait for a container's init
+	// process to start before giving up and killing the container.
+	StartTimeout time.Duration
+
+	// UsageSamples is the number of resource usage samples kept for each
+	// container which requests sampling. Older samples are discarded.
+	UsageSamples int
+
+	// MaxExitStates is the number of exited processes whose exit states are
+	// kept, so that exit hooks registered after they exit still run. Beyond
+	// it, the least recently used exit states are evicted. If it is zero,
+	// exit states are kept until the processes are reaped.
+	MaxExitStates int
+
+	// MaxContainers is the maximum number of containers which may exist at
+	// once, or zero for no limit. Creating a container beyond it fails with
+	// a capacity exceeded error until another container is removed.
+	MaxContainers int
+
+	// MaxCommandLineLength and MaxCommandLineArgs bound the length of a
+	// process's CommandLine and the number of arguments parsed from it, so
+	// that a huge command line can't exhaust the GCS's memory or CPU while
+	// it is parsed.
+	MaxCommandLineLength int
+	MaxCommandLineArgs   int
+
+	// ExecAuthorizer, if set, decides whether each process may be executed
+	// in a container, including its init process. If nil, every process is
+	// allowed.
+	ExecAuthorizer core.ExecAuthorizer
+
+	// ExecAuditor, if set, is told of every process executed in a
+	// container, including its init process, and of every external process,
+	// and of each of their exits. If nil, nothing is audited.
+	ExecAuditor core.ExecAuditor
+
+	// ImplicitStart keeps compatibility with hosts which start a container
+	// by executing its first process, which then becomes its init process.
+	// If it is false, containers must be started with StartContainer before
+	// processes are executed in them. It defaults to true.
+	ImplicitStart bool
+
+	// ReapInitPath is the path in the utility VM of the reapinit binary,
+	// which is bind mounted into containers which request a reaping init.
+	ReapInitPath string
+
+	// ExecMountPath is the path in the utility VM of the execmount binary,
+	// which runs exec'd processes which request mounts.
+	ExecMountPath string
+
+	// CoreDumpDir, if set, is the directory in the utility VM in which the
+	// core dumps of crashed processes are kept by ConfigureCoreDumps, with
+	// at most MaxCoreDumpSize bytes of each. CoreDumpHelperPath is the path
+	// of the coredump binary which saves them.
+	CoreDumpDir        string
+	MaxCoreDumpSize    int64
+	CoreDumpHelperPath string
+
+	// Journal is where the output of containers using the journald logging
+	// driver is written. It defaults to the utility VM's journald.
+	Journal core.JournalSink
+
+	// SecretKeys matches the names of environment variables and arguments
+	// whose values are redacted by GetProcessEnviron and GetProcessCmdline.
+	// If nil, nothing is redacted.
+	SecretKeys *regexp.Regexp
+
+	// HistorySize is the number of removed containers whose histories are
+	// kept for GetContainerHistory, and HistoryMaxAge is how long they are
+	// kept after the containers are removed, or zero for no limit.
+	HistorySize   int
+	HistoryMaxAge time.Duration
+
+	// containerCacheMutex protects the runtimes and containerCache maps. It
+	// is only held while the maps are accessed, and each cache entry is
+	// protected by its own mutex, so that operations on different containers
+	// don't block each other.
 	containerCacheMutex sync.RWMutex
+	// runtimes stores the additional Runtimes which containers may select by
+	// name through their settings. It is structured as a map from runtime
+	// name to Runtime.
+	runtimes map[string]runtime.Runtime
 	// containerCache stores information about containers which persists
 	// between calls into the gcsCore. It is structured as a map from container
 	// ID to cache entry.
@@ -41,28 +166,158 @@ type gcsCore struct {
 	// processCache stores information about processes which persists between calls
 	// into the gcsCore. It is structured as a map from pid to cache entry.
 	processCache map[int]*processCacheEntry
+	// exitStates lists the entries in processCache of exited processes, least
+	// recently used first, and evictedPids stores the pids whose exit states
+	// were evicted until they are reused.
+	exitStates  list.List
+	evictedPids map[int]struct{}
+
+	// historyMutex protects history, which stores the event log of each
+	// container, including removed ones until they are evicted. It is
+	// structured as a map from container ID to history.
+	historyMutex sync.Mutex
+	history      map[string]*containerHistory
+
+	// layerUsersMutex protects layerUsers, which counts the containers using
+	// the layers mounted in each container's storage, including the container
+	// itself, so that layers shared with clones are only unmounted and
+	// removed once the last of them is cleaned up. It is structured as a map
+	// from the ID of the container whose storage holds the layers to the
+	// count.
+	layerUsersMutex sync.Mutex
+	layerUsers      map[string]int
+
+	// startTime is when the gcsCore was created, from which Health reports
+	// the GCS's uptime.
+	startTime time.Time
+
+	// hierarchy is the utility VM's cgroup hierarchy, detected by the first
+	// call to cgroups.
+	cgroupsOnce sync.Once
+	hierarchy   cgroupHierarchy
 }
 
 // NewGCSCore creates a new gcsCore struct initialized with the given Runtime.
 func NewGCSCore(rtime runtime.Runtime, os oslayer.OS) *gcsCore {
 	return &gcsCore{
-		Rtime:          rtime,
-		OS:             os,
-		containerCache: make(map[string]*containerCacheEntry),
-		processCache:   make(map[int]*processCacheEntry),
+		Rtime:                rtime,
+		OS:                   os,
+		DeviceTimeout:        defaultDeviceTimeout,
+		MountTimeout:         defaultMountTimeout,
+		StartTimeout:         defaultStartTimeout,
+		UsageSamples:         defaultUsageSamples,
+		MaxExitStates:        defaultMaxExitStates,
+		MaxCommandLineLength: defaultMaxCommandLineLength,
+		MaxCommandLineArgs:   defaultMaxCommandLineArgs,
+		ImplicitStart:        true,
+		ReapInitPath:         defaultReapInitPath,
+		ExecMountPath:        defaultExecMountPath,
+		MaxCoreDumpSize:      defaultMaxCoreDumpSize,
+		CoreDumpHelperPath:   defaultCoreDumpHelperPath,
+		Journal:              &journaldSink{},
+		SecretKeys:           defaultSecretKeys,
+		HistorySize:          defaultHistorySize,
+		HistoryMaxAge:        defaultHistoryMaxAge,
+		runtimes:             make(map[string]runtime.Runtime),
+		containerCache:       make(map[string]*containerCacheEntry),
+		processCache:         make(map[int]*processCacheEntry),
+		history:              make(map[string]*containerHistory),
+		layerUsers:           make(map[string]int),
+		startTime:            time.Now(),
 	}
 }
 
 // containerCacheEntry stores cached information for a single container.
 type containerCacheEntry struct {
+	// mutex protects all of the entry's other fields except ID.
+	mutex sync.Mutex
+	// removed is true once the entry has been removed from containerCache.
+	removed bool
+
 	ID                 string
 	ExitStatus         oslayer.ProcessExitState
 	ExitHooks          []func(oslayer.ProcessExitState)
 	MappedVirtualDisks map[uint8]prot.MappedVirtualDisk
 	MappedDirectories  map[uint32]prot.MappedDirectory
 	NetworkAdapters    []prot.NetworkAdapter
-	container          runtime.Container
-	hasRunInitProcess  bool
+	Hooks              *oci.Hooks
+	Annotations        map[string]string
+	FreezeOnCreate     bool
+	RootReadonly       bool
+	// ReapingInit is true if the container's init process is run under
+	// the reaping init.
+	ReapingInit bool
+	// LoggingDriver is where the output of the container's processes goes.
+	LoggingDriver prot.LoggingDriver
+	// CleanupPaths are the paths in the container which are removed from its
+	// writable layer when it is cleaned up.
+	CleanupPaths []string
+	// SecretsPath is the directory in the utility VM holding the
+	// container's secrets, or "" if it has none.
+	SecretsPath string
+	// StopSignal is the signal which stops the container gracefully.
+	StopSignal oslayer.Signal
+	// initProcess, if set, is the init process which StartContainer runs.
+	initProcess *prot.ProcessParameters
+	// Labels are operator-supplied labels, such as a namespace or pod, which
+	// are included as fields in the logs about the container. They aren't
+	// changed once the container is created, so they may be read without
+	// holding mutex.
+	Labels map[string]string
+	// ContainerEnvironment is merged into the environment of each process
+	// executed in the container after its init process.
+	ContainerEnvironment map[string]string
+	// CpusetCpus and CpusetMems are the validated cpuset lists the container
+	// is pinned to, and cgroupsPath is its cgroups path, as supplied by the
+	// host or taken from its OCI spec.
+	CpusetCpus        string
+	CpusetMems        string
+	cgroupsPath       string
+	rtime             runtime.Runtime
+	container         runtime.Container
+	hasRunInitProcess bool
+	// fallbackRtime, if set, is the runtime which the container is created
+	// with if rtime is unsupported, and fallbackRuntimeName is its name.
+	fallbackRtime       runtime.Runtime
+	fallbackRuntimeName string
+	// isFrozen is true while the container's init process has been created
+	// in a frozen state and is waiting on a call to ResumeContainer.
+	isFrozen bool
+	// initStarted is closed once the attempt to start the container's init
+	// process has finished, successfully or not.
+	initStarted chan struct{}
+	// ready is closed once the container's init process has started,
+	// initExited is closed as soon as the init process exits, and removedCh
+	// is closed once the entry has been removed from containerCache.
+	ready      chan struct{}
+	initExited chan struct{}
+	removedCh  chan struct{}
+	// isStarting is true while the container's init process is being
+	// started by startContainer, which releases the entry's mutex.
+	isStarting bool
+	// maxConcurrentExecs is the maximum value of activeExecs, or zero for no
+	// limit. activeExecs counts the container's non-init processes which
+	// have not yet exited.
+	maxConcurrentExecs int
+	activeExecs        int
+	// execMounts counts the sets of mounts staged for the container's exec'd
+	// processes, and names their staging directories.
+	execMounts int
+	// configJSON is the OCI spec written to the container's config.json, or
+	// nil if it has not been written yet.
+	configJSON []byte
+	// usageHistory holds the container's recent resource usage samples, or
+	// is nil if sampling wasn't requested.
+	usageHistory *usageHistory
+	// layerPaths are the mountpoints of the container's read-only layers,
+	// which clones of the container share, and layerOwner is the ID of the
+	// container in whose storage they are mounted. It is empty once the
+	// container has released its reference to the layers.
+	layerPaths []string
+	layerOwner string
+	// deferredStdio holds the stdio of an explicitly started init process
+	// until the host attaches to it, or is nil if there is none.
+	deferredStdio *deferredStdio
 }
 
 func newContainerCacheEntry(id string) *containerCacheEntry {
@@ -70,8 +325,29 @@ func newContainerCacheEntry(id string) *containerCacheEntry {
 		ID:                 id,
 		MappedVirtualDisks: make(map[uint8]prot.MappedVirtualDisk),
 		MappedDirectories:  make(map[uint32]prot.MappedDirectory),
+		ready:              make(chan struct{}),
+		initExited:         make(chan struct{}),
+		removedCh:          make(chan struct{}),
 	}
 }
+func (e *containerCacheEntry) MarkReady() {
+	// An init process which exited while being started never became ready.
+	select {
+	case <-e.initExited:
+	default:
+		close(e.ready)
+	}
+}
+
+// log returns a logger for messages about the container, which adds its
+// labels as fields.
+func (e *containerCacheEntry) log() *logrus.Entry {
+	fields := make(logrus.Fields, len(e.Labels))
+	for k, v := range e.Labels {
+		fields[k] = v
+	}
+	return logrus.WithFields(fields)
+}
 func (e *containerCacheEntry) AddExitHook(hook func(oslayer.ProcessExitState)) {
 	e.ExitHooks = append(e.ExitHooks, hook)
 }
@@ -87,7 +363,7 @@ func (e *containerCacheEntry) AddMappedVirtualDisk(disk prot.MappedVirtualDisk)
 }
 func (e *containerCacheEntry) RemoveMappedVirtualDisk(disk prot.MappedVirtualDisk) {
 	if _, ok := e.MappedVirtualDisks[disk.Lun]; !ok {
-		logrus.Warnf("attempt to remove virtual disk with lun %d which is not attached to container %s", disk.Lun, e.ID)
+		e.log().Warnf("attempt to remove virtual disk with lun %d which is not attached to container %s", disk.Lun, e.ID)
 		return
 	}
 	delete(e.MappedVirtualDisks, disk.Lun)
@@ -101,7 +377,7 @@ func (e *containerCacheEntry) AddMappedDirectory(dir prot.MappedDirectory) error
 }
 func (e *containerCacheEntry) RemoveMappedDirectory(dir prot.MappedDirectory) {
 	if _, ok := e.MappedDirectories[dir.Port]; !ok {
-		logrus.Warnf("attempt to remove mapped directory with port %d which is not attached to container %s", dir.Port, e.ID)
+		e.log().Warnf("attempt to remove mapped directory with port %d which is not attached to container %s", dir.Port, e.ID)
 		return
 	}
 	delete(e.MappedDirectories, dir.Port)
@@ -113,6 +389,13 @@ type processCacheEntry struct {
 	ExitHooks   []func(oslayer.ProcessExitState)
 	Tty         *stdio.TtyRelay
 	ContainerID string // If "" a host process otherwise a container process.
+	// SecretEnv are the names of the process's environment variables which
+	// were set from secrets.
+	SecretEnv []string
+
+	pid int
+	// exitedElement is the entry's element in exitStates once it has exited.
+	exitedElement *list.Element
 }
 
 func newProcessCacheEntry(containerID string) *processCacheEntry {
@@ -122,25 +405,224 @@ func (e *processCacheEntry) AddExitHook(hook func(oslayer.ProcessExitState)) {
 	e.ExitHooks = append(e.ExitHooks, hook)
 }
 
-func (c *gcsCore) getContainer(id string) *containerCacheEntry {
-	if entry, ok := c.containerCache[id]; ok {
-		return entry
+// RegisterRuntime makes the given Runtime available to containers which
+// specify the given name as the RuntimeName in their settings.
+func (c *gcsCore) RegisterRuntime(name string, rtime runtime.Runtime) error {
+	c.containerCacheMutex.Lock()
+	defer c.containerCacheMutex.Unlock()
+
+	if name == "" {
+		return errors.New("runtime name must not be empty")
 	}
+	if _, ok := c.runtimes[name]; ok {
+		return errors.Errorf("a runtime with the name \"%s\" is already registered", name)
+	}
+	c.runtimes[name] = rtime
 	return nil
 }
 
+// getRuntime returns the Runtime registered with the given name, or the
+// default Runtime if the name is empty.
+// This function expects containerCacheMutex to be locked on entry.
+func (c *gcsCore) getRuntime(name string) (runtime.Runtime, error) {
+	if name == "" {
+		return c.Rtime, nil
+	}
+	if rtime, ok := c.runtimes[name]; ok {
+		return rtime, nil
+	}
+	return nil, errors.Errorf("no runtime with the name \"%s\" is registered", name)
+}
+
+// lockContainer returns the cache entry for the container with the given ID
+// with its mutex locked, or nil if the container does not exist. The caller
+// must unlock the entry's mutex when it is done with the entry.
+func (c *gcsCore) lockContainer(id string) *containerCacheEntry {
+	c.containerCacheMutex.RLock()
+	entry, ok := c.containerCache[id]
+	c.containerCacheMutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	entry.mutex.Lock()
+	// The container may have been removed while waiting on its mutex.
+	if entry.removed {
+		entry.mutex.Unlock()
+		return nil
+	}
+	return entry
+}
+
+// removeContainer removes the given entry from containerCache.
+// This function expects the entry's mutex to be locked on entry.
+func (c *gcsCore) removeContainer(entry *containerCacheEntry) {
+	if entry.removed {
+		return
+	}
+	entry.removed = true
+	close(entry.removedCh)
+	c.containerCacheMutex.Lock()
+	delete(c.containerCache, entry.ID)
+	c.containerCacheMutex.Unlock()
+	c.retireContainerHistory(entry.ID)
+}
+
 // CreateContainer creates all the infrastructure for a container, including
 // setting up layers and networking, and then starts up its init process in a
 // suspended state waiting for a call to StartContainer.
 func (c *gcsCore) CreateContainer(id string, settings prot.VMHostedContainerSettings) error {
-	c.containerCacheMutex.Lock()
-	defer c.containerCacheMutex.Unlock()
+	if err := validateHooks(settings.Hooks); err != nil {
+		return errors.Wrapf(err, "invalid hooks for container %s", id)
+	}
+	if err := validateAnnotations(settings.Annotations); err != nil {
+		return errors.Wrapf(err, "invalid annotations for container %s", id)
+	}
+	if err := validateDeviceLuns(settings.SandboxDataPath, settings.Layers, settings.MappedVirtualDisks); err != nil {
+		return errors.Wrapf(err, "invalid devices for container %s", id)
+	}
+	if err := validateMappedResources(settings.MappedVirtualDisks, settings.MappedDirectories); err != nil {
+		return errors.Wrapf(err, "invalid devices for container %s", id)
+	}
+	cpusetCpus, err := parseCPUList(settings.CpusetCpus)
+	if err != nil {
+		return errors.Wrapf(err, "invalid cpuset cpus for container %s", id)
+	}
+	cpusetMems, err := parseCPUList(settings.CpusetMems)
+	if err != nil {
+		return errors.Wrapf(err, "invalid cpuset mems for container %s", id)
+	}
+	if err := c.validateCgroupsPath(settings.CgroupsPath); err != nil {
+		return errors.Wrapf(err, "invalid cgroups path for container %s", id)
+	}
+	if settings.InitProcess != nil {
+		if err := validateOomScoreAdj(settings.InitProcess.OomScoreAdj); err != nil {
+			return err
+		}
+		if err := validateScheduling(settings.InitProcess.SchedulingPolicy, settings.InitProcess.SchedulingPriority); err != nil {
+			return err
+		}
+		if err := validateNice(settings.InitProcess.Nice); err != nil {
+			return err
+		}
+	}
+	switch settings.LoggingDriver {
+	case "", prot.LdRelay, prot.LdJournald:
+	default:
+		return errors.Errorf("invalid logging driver \"%s\" for container %s", settings.LoggingDriver, id)
+	}
+	stopSignal := oslayer.SIGTERM
+	if settings.StopSignal != "" {
+		stopSignal, err = oslayer.ParseSignal(settings.StopSignal)
+		if err != nil {
+			return errors.Wrapf(err, "invalid stop signal for container %s", id)
+		}
+	}
+	var (
+		cloneLayerPaths []string
+		cloneLayerOwner string
+	)
+	if settings.CloneFrom != "" {
+		if len(settings.Layers) > 0 {
+			return errors.Errorf("container %s cannot specify layers, as it is a clone of container %s", id, settings.CloneFrom)
+		}
+		// The source's layers are looked up before this container's ID is
+		// reserved, so that two containers being created can't wait on each
+		// other's mutexes.
+		cloneLayerPaths, cloneLayerOwner, err = c.getCloneLayerPaths(settings.CloneFrom)
+		if err != nil {
+			return errors.Wrapf(err, "failed to clone container %s from %s", id, settings.CloneFrom)
+		}
+	}
+	if settings.ReapingInit {
+		exists, err := c.OS.PathExists(c.ReapInitPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check for the reaping init for container %s", id)
+		}
+		if !exists {
+			return errors.Errorf("container %s requested a reaping init, but %s does not exist", id, c.ReapInitPath)
+		}
+	}
+	cleanupPaths, err := validateCleanupPaths(settings.SandboxDataPath, settings.CleanupPaths)
+	if err != nil {
+		return errors.Wrapf(err, "invalid cleanup paths for container %s", id)
+	}
+	secretsPath, err := validateSecretsPath(settings.SecretsPath)
+	if err != nil {
+		return errors.Wrapf(err, "invalid secrets path for container %s", id)
+	}
+	sampleInterval := time.Duration(settings.UsageSampleIntervalInMs) * time.Millisecond
+	if sampleInterval != 0 && sampleInterval < minUsageSampleInterval {
+		return errors.Errorf("usage sample interval %s for container %s is shorter than the minimum of %s", sampleInterval, id, minUsageSampleInterval)
+	}
 
-	if c.getContainer(id) != nil {
+	// Reserve the ID by adding the entry to the cache with its mutex locked,
+	// so that the rest of the setup doesn't hold containerCacheMutex.
+	containerEntry := newContainerCacheEntry(id)
+	containerEntry.mutex.Lock()
+	defer containerEntry.mutex.Unlock()
+	c.containerCacheMutex.Lock()
+	if _, ok := c.containerCache[id]; ok {
+		c.containerCacheMutex.Unlock()
 		return errors.WithStack(gcserr.NewContainerExistsError(id))
 	}
+	if c.MaxContainers > 0 && len(c.containerCache) >= c.MaxContainers {
+		c.containerCacheMutex.Unlock()
+		return errors.WithStack(gcserr.NewCapacityExceededError(id, c.MaxContainers))
+	}
+	rtime, err := c.getRuntime(settings.RuntimeName)
+	if err != nil {
+		c.containerCacheMutex.Unlock()
+		return errors.Wrapf(err, "failed to select runtime for container %s", id)
+	}
+	var fallbackRtime runtime.Runtime
+	if settings.FallbackRuntimeName != "" {
+		fallbackRtime, err = c.getRuntime(settings.FallbackRuntimeName)
+		if err != nil {
+			c.containerCacheMutex.Unlock()
+			return errors.Wrapf(err, "failed to select fallback runtime for container %s", id)
+		}
+	}
+	c.containerCache[id] = containerEntry
+	c.containerCacheMutex.Unlock()
 
-	containerEntry := newContainerCacheEntry(id)
+	created := false
+	defer func() {
+		if !created {
+			c.releaseLayers(containerEntry)
+			c.removeContainer(containerEntry)
+		}
+	}()
+
+	// A clone takes a reference to the layers of the container it was cloned
+	// from, so that they stay mounted until neither container uses them.
+	if settings.CloneFrom != "" {
+		err = c.acquireLayers(containerEntry, cloneLayerOwner)
+	} else {
+		err = c.claimLayers(containerEntry)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to set up layers for container %s", id)
+	}
+
+	containerEntry.Hooks = settings.Hooks
+	containerEntry.Annotations = settings.Annotations
+	containerEntry.rtime = rtime
+	containerEntry.fallbackRtime = fallbackRtime
+	containerEntry.fallbackRuntimeName = settings.FallbackRuntimeName
+	containerEntry.FreezeOnCreate = settings.FreezeOnCreate
+	containerEntry.maxConcurrentExecs = settings.MaxConcurrentExecs
+	containerEntry.ContainerEnvironment = settings.ContainerEnvironment
+	containerEntry.CpusetCpus = cpusetCpus
+	containerEntry.CpusetMems = cpusetMems
+	containerEntry.RootReadonly = settings.RootReadonly
+	containerEntry.ReapingInit = settings.ReapingInit
+	containerEntry.LoggingDriver = settings.LoggingDriver
+	containerEntry.CleanupPaths = cleanupPaths
+	containerEntry.SecretsPath = secretsPath
+	containerEntry.StopSignal = stopSignal
+	containerEntry.Labels = settings.Labels
+	containerEntry.initProcess = settings.InitProcess
+	containerEntry.cgroupsPath = settings.CgroupsPath
 
 	// Set up mapped virtual disks.
 	if err := c.setupMappedVirtualDisks(id, settings.MappedVirtualDisks, containerEntry); err != nil {
@@ -151,136 +633,281 @@ func (c *gcsCore) CreateContainer(id string, settings prot.VMHostedContainerSett
 		return errors.Wrapf(err, "failed to set up mapped directories during create for container %s", id)
 	}
 
-	// Set up layers.
+	// Set up layers. A clone only mounts its own scratch, over the layers of
+	// the container it was cloned from.
 	scratch, layers, err := c.getLayerMounts(settings.SandboxDataPath, settings.Layers)
 	if err != nil {
 		return errors.Wrapf(err, "failed to get layer devices for container %s", id)
 	}
-	if err := c.mountLayers(id, scratch, layers); err != nil {
-		return errors.Wrapf(err, "failed to mount layers for container %s", id)
+	if settings.CloneFrom != "" {
+		if err := c.mountRootfs(id, scratch, cloneLayerPaths); err != nil {
+			return errors.Wrapf(err, "failed to mount layers for container %s", id)
+		}
+		containerEntry.layerPaths = cloneLayerPaths
+	} else {
+		if err := c.mountLayers(id, scratch, layers); err != nil {
+			return errors.Wrapf(err, "failed to mount layers for container %s", id)
+		}
+		containerEntry.layerPaths = c.getLayerPaths(id, len(layers))
 	}
 
 	// Stash network adapters away
 	for _, adapter := range settings.NetworkAdapters {
 		containerEntry.AddNetworkAdapter(adapter)
 	}
-	// Create the directory that will contain the resolv.conf file.
-	//
-	// TODO(rn): This isn't quite right but works. Basically, when
-	// we do the network config in ExecProcess() the overlay for
-	// the rootfs has already been created. When we then write
-	// /etc/resolv.conf to the base layer it won't show up unless
-	// /etc exists when the overlay is created. This is a bit
-	// problematic as we basically later write to a what is
-	// supposed to be read-only layer in the overlay...  Ideally,
-	// dockerd would pass a runc config with a bind mount for
-	// /etc/resolv.conf like it does on unix.
-	if err := c.OS.MkdirAll(filepath.Join(baseFilesPath, "etc"), 0755); err != nil {
-		return errors.Wrapf(err, "failed to create resolv.conf directory")
+	// Create the container's own resolv.conf, which is bind mounted into it
+	// and written when its network adapters are configured. It isn't shared
+	// with other containers, so its DNS configuration can be updated alone.
+	resolvConf, err := c.OS.Create(c.getResolvConfPath(id))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create resolv.conf for container %s", id)
 	}
+	resolvConf.Close()
 
-	c.containerCache[id] = containerEntry
+	if sampleInterval != 0 {
+		containerEntry.usageHistory = newUsageHistory(c.UsageSamples)
+		go c.sampleUsage(containerEntry, sampleInterval)
+	}
 
+	c.recordContainerEvent(id, prot.CeCreated, "")
+	created = true
 	return nil
 }
 
+// createContainer creates the container with its runtime. If the runtime is
+// unsupported on this system and the host opted into a fallback runtime, the
+// container is created with the fallback instead, which is then used for the
+// rest of the container's lifetime.
+// This function expects containerEntry's mutex to be locked on entry.
+func (c *gcsCore) createContainer(containerEntry *containerCacheEntry, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	id := containerEntry.ID
+	container, err := containerEntry.rtime.CreateContainer(id, c.getContainerStoragePath(id), stdioSet)
+	if err == nil || containerEntry.fallbackRtime == nil {
+		return container, err
+	}
+	if _, ok := errors.Cause(err).(*runtime.UnsupportedError); !ok {
+		return nil, err
+	}
+	containerEntry.log().Warnf("falling back to runtime %s for container %s: %s", containerEntry.fallbackRuntimeName, id, err)
+	containerEntry.rtime = containerEntry.fallbackRtime
+	containerEntry.fallbackRtime = nil
+	return containerEntry.rtime.CreateContainer(id, c.getContainerStoragePath(id), stdioSet)
+}
+
+// authorizeExec checks with the ExecAuthorizer, if there is one, that a
+// process with the given arguments may be executed in the container.
+func (c *gcsCore) authorizeExec(id string, args []string) error {
+	if c.ExecAuthorizer == nil {
+		return nil
+	}
+	if allowed, reason := c.ExecAuthorizer.AuthorizeExec(id, args); !allowed {
+		return errors.WithStack(gcserr.NewExecDeniedError(id, args, reason))
+	}
+	return nil
+}
+
+// auditExec tells the ExecAuditor, if there is one, of an attempt to execute
+// the process described by record, which failed if err is non-nil. If the
+// process started, the auditor is also told of its exit once the process's
+// entry records it.
+func (c *gcsCore) auditExec(record core.ExecAuditRecord, processEntry *processCacheEntry, err error) {
+	if c.ExecAuditor == nil {
+		return
+	}
+	record.Time = time.Now()
+	if err != nil {
+		record.Pid = -1
+		record.Error = err.Error()
+		c.ExecAuditor.AuditExec(record)
+		return
+	}
+	c.ExecAuditor.AuditExec(record)
+
+	auditExit := func(state oslayer.ProcessExitState) {
+		record.Time = time.Now()
+		record.ExitCode = state.ExitCode()
+		c.ExecAuditor.AuditExit(record)
+	}
+	c.processCacheMutex.Lock()
+	defer c.processCacheMutex.Unlock()
+	// The process may already have exited.
+	if processEntry.ExitStatus != nil {
+		auditExit(processEntry.ExitStatus)
+	} else {
+		processEntry.AddExitHook(auditExit)
+	}
+}
+
 // ExecProcess executes a new process in the container. It forwards the
-// process's stdio through the members of the core.StdioSet provided.
+// process's stdio through the members of the core.StdioSet provided. If the
+// container hasn't been started, the process is run as its init process when
+// ImplicitStart is set, and is otherwise refused.
 func (c *gcsCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (int, error) {
-	c.containerCacheMutex.Lock()
-	defer c.containerCacheMutex.Unlock()
+	pid, _, err := c.execProcess(id, params, stdioSet)
+	return pid, err
+}
 
-	containerEntry := c.getContainer(id)
-	if containerEntry == nil {
-		return -1, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+// ExecProcessWithResult executes a new process in the container as
+// ExecProcess does, additionally reporting whether a console was allocated
+// for it.
+func (c *gcsCore) ExecProcessWithResult(id string, params prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (core.ExecResult, error) {
+	pid, processEntry, err := c.execProcess(id, params, stdioSet)
+	if err != nil {
+		return core.ExecResult{Pid: -1}, err
+	}
+	result := core.ExecResult{Pid: pid}
+	if processEntry.Tty != nil {
+		result.ConsoleAllocated = true
+		result.ConsoleOpen = !processEntry.Tty.Closed()
 	}
+	return result, nil
+}
+
+// execProcess implements ExecProcess, also returning the new process's cache
+// entry.
+func (c *gcsCore) execProcess(id string, params prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (pid int, entry *processCacheEntry, err error) {
 	processEntry := newProcessCacheEntry(id)
+	audit := core.ExecAuditRecord{ContainerID: id}
+	// This runs after the entry's mutex is released below.
+	defer func() {
+		audit.Pid = pid
+		c.auditExec(audit, processEntry, err)
+	}()
+
+	if err := validateOomScoreAdj(params.OomScoreAdj); err != nil {
+		return -1, nil, err
+	}
+	if err := validateScheduling(params.SchedulingPolicy, params.SchedulingPriority); err != nil {
+		return -1, nil, err
+	}
+	if err := validateNice(params.Nice); err != nil {
+		return -1, nil, err
+	}
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return -1, nil, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
 
 	var p runtime.Process
 	if !containerEntry.hasRunInitProcess {
-		containerEntry.hasRunInitProcess = true
-		if err := c.writeConfigFile(id, params.OCISpecification); err != nil {
-			return -1, err
+		if !c.ImplicitStart {
+			return -1, nil, errors.Errorf("container %s has not been started", id)
+		}
+		audit.Args = params.OCISpecification.Process.Args
+		audit.UID = params.OCISpecification.Process.User.UID
+		if params.Umask != "" {
+			return -1, nil, errors.Errorf("a umask cannot be applied to the init process of container %s", id)
+		}
+		var err error
+		p, err = c.runInitProcess(containerEntry, processEntry, params, stdioSet)
+		// Let the init process's wait goroutine clean up only once the
+		// container has been started and its process has been cached.
+		if containerEntry.initStarted != nil {
+			defer close(containerEntry.initStarted)
 		}
-
-		container, err := c.Rtime.CreateContainer(id, c.getContainerStoragePath(id), stdioSet)
 		if err != nil {
-			return -1, err
+			return -1, nil, err
 		}
-
-		containerEntry.container = container
-		p = container
-		processEntry.Tty = p.Tty()
-
-		// Configure network adapters in the namespace.
-		for _, adapter := range containerEntry.NetworkAdapters {
-			if err := c.configureAdapterInNamespace(container, adapter); err != nil {
-				return -1, err
-			}
+	} else {
+		if containerEntry.isFrozen {
+			return -1, nil, errors.Errorf("container %s is frozen and must be resumed before executing processes in it", id)
 		}
-
-		go func() {
-			state, err := container.Wait()
-			c.containerCacheMutex.Lock()
-			if err != nil {
-				logrus.Error(err)
-				if err := c.cleanupContainer(containerEntry); err != nil {
-					logrus.Error(err)
-				}
-			}
-			logrus.Infof("container init process %d exited with exit status %d", p.Pid(), state.ExitCode())
-
-			if err := c.cleanupContainer(containerEntry); err != nil {
-				logrus.Error(err)
+		if containerEntry.isStarting {
+			return -1, nil, errors.Errorf("container %s is still starting", id)
+		}
+		if containerEntry.maxConcurrentExecs > 0 && containerEntry.activeExecs >= containerEntry.maxConcurrentExecs {
+			return -1, nil, errors.WithStack(gcserr.NewTooManyProcessesError(id, containerEntry.maxConcurrentExecs))
+		}
+		if len(containerEntry.ContainerEnvironment) > 0 {
+			params.Environment = mergeEnvironment(containerEntry.ContainerEnvironment, params.Environment)
+		}
+		ociProcess, err := c.processParametersToOCI(params)
+		if err != nil {
+			return -1, nil, err
+		}
+		if params.Umask != "" {
+			_, _, _, rootfsPath := c.getUnioningPaths(id)
+			if err := c.checkUmaskShell(rootfsPath); err != nil {
+				return -1, nil, errors.Wrapf(err, "failed to apply the umask of a process in container %s", id)
 			}
-			c.containerCacheMutex.Unlock()
-
-			c.processCacheMutex.Lock()
-			processEntry.ExitStatus = state
-			for _, hook := range processEntry.ExitHooks {
-				hook(state)
+		}
+		// The command is authorized and audited without the shell which
+		// applies the umask, so that it's the one the host asked for.
+		audit.Args = commandArgs(params, ociProcess)
+		audit.UID = ociProcess.User.UID
+		if err := c.authorizeExec(id, audit.Args); err != nil {
+			return -1, nil, err
+		}
+		secretEnv, secretValues, err := c.resolveSecrets(containerEntry, params.SecretEnvironment)
+		if err != nil {
+			return -1, nil, err
+		}
+		if len(secretEnv) > 0 {
+			// The environment is copied, so that the secrets aren't written
+			// back to the caller's parameters.
+			ociProcess.Env = injectSecretEnv(ociProcess.Env, secretEnv)
+			for _, v := range secretEnv {
+				processEntry.SecretEnv = append(processEntry.SecretEnv, strings.SplitN(v, "=", 2)[0])
 			}
-			c.processCacheMutex.Unlock()
-			c.containerCacheMutex.Lock()
-			containerEntry.ExitStatus = state
-			for _, hook := range containerEntry.ExitHooks {
-				hook(state)
+		}
+		var stagingPath string
+		if len(params.Mounts) > 0 {
+			ociProcess.Args, stagingPath, err = c.stageExecMounts(containerEntry, params.Mounts, ociProcess)
+			if err != nil {
+				return -1, nil, err
 			}
-			delete(c.containerCache, id)
-			c.containerCacheMutex.Unlock()
-		}()
-
-		if err := container.Start(); err != nil {
-			return -1, err
+			// Once the process has been created, its wait goroutine unstages
+			// the mounts.
+			defer func() {
+				if p == nil {
+					if err := c.unstageExecMounts(stagingPath, len(params.Mounts)); err != nil {
+						containerEntry.log().Error(err)
+					}
+				}
+			}()
 		}
-	} else {
-		ociProcess, err := processParametersToOCI(params)
+		stdioSet, err = c.redirectStdio(containerEntry, params, ociProcess.Terminal, stdioSet)
 		if err != nil {
-			return -1, err
+			return -1, nil, scrubSecrets(err, secretValues)
 		}
 		p, err = containerEntry.container.ExecProcess(ociProcess, stdioSet)
 		if err != nil {
-			return -1, err
+			return -1, nil, scrubSecrets(err, secretValues)
 		}
 		processEntry.Tty = p.Tty()
+		containerEntry.activeExecs++
 
 		go func() {
 			state, err := p.Wait()
 			if err != nil {
-				logrus.Error(err)
+				containerEntry.log().Error(err)
 			}
-			logrus.Infof("container process %d exited with exit status %d", p.Pid(), state.ExitCode())
+			containerEntry.mutex.Lock()
+			containerEntry.activeExecs--
+			containerEntry.mutex.Unlock()
+			containerEntry.log().Infof("process %d of container %s exited with exit status %d", p.Pid(), id, state.ExitCode())
 
 			c.processCacheMutex.Lock()
-			processEntry.ExitStatus = state
-			for _, hook := range processEntry.ExitHooks {
-				hook(state)
-			}
+			c.exitProcess(p.Pid(), processEntry, state)
 			c.processCacheMutex.Unlock()
 			if err := p.Delete(); err != nil {
-				logrus.Error(err)
+				containerEntry.log().Error(err)
+			}
+			if stagingPath != "" {
+				if err := c.unstageExecMounts(stagingPath, len(params.Mounts)); err != nil {
+					containerEntry.log().Error(err)
+				}
 			}
 		}()
+
+		if err := c.tuneProcess(p.Pid(), params); err != nil {
+			// The wait goroutine cleans up the killed process.
+			if err := c.OS.Kill(p.Pid(), syscall.SIGKILL); err != nil {
+				containerEntry.log().Error(err)
+			}
+			return -1, nil, err
+		}
 	}
 
 	c.processCacheMutex.Lock()
@@ -296,28 +923,648 @@ func (c *gcsCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet
 	// apply to the old process no longer makes sense, so since the old
 	// process's pid has been reused, its cache entry can also be reused.  This
 	// applies to external processes as well.
-	c.processCache[p.Pid()] = processEntry
+	c.addProcess(p.Pid(), processEntry)
+	c.processCacheMutex.Unlock()
+	return p.Pid(), processEntry, nil
+}
+
+// StartContainer creates and starts the init process of the container with
+// the given ID from the InitProcess it was created with. Its stdio isn't
+// relayed to the host, so it is discarded unless it is redirected to files.
+func (c *gcsCore) StartContainer(id string) error {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+	if containerEntry.hasRunInitProcess {
+		return errors.Errorf("container %s has already been started", id)
+	}
+	if containerEntry.initProcess == nil {
+		return errors.Errorf("container %s was created without an init process", id)
+	}
+
+	// No host connections exist yet, so the process's output is buffered
+	// until they are attached by AttachContainerStdio.
+	deferred, stdioSet := newDeferredStdio(*containerEntry.initProcess)
+	processEntry := newProcessCacheEntry(id)
+	process := containerEntry.initProcess.OCISpecification.Process
+	audit := core.ExecAuditRecord{ContainerID: id, Args: process.Args, UID: process.User.UID}
+	p, err := c.runInitProcess(containerEntry, processEntry, *containerEntry.initProcess, stdioSet)
+	if containerEntry.initStarted != nil {
+		defer close(containerEntry.initStarted)
+	}
+	if err != nil {
+		deferred.end()
+		c.auditExec(audit, processEntry, err)
+		return err
+	}
+	containerEntry.deferredStdio = deferred
+	go func() {
+		<-containerEntry.removedCh
+		deferred.end()
+	}()
+	c.processCacheMutex.Lock()
+	c.addProcess(p.Pid(), processEntry)
+	c.processCacheMutex.Unlock()
+	audit.Pid = p.Pid()
+	c.auditExec(audit, processEntry, nil)
+	return nil
+}
+
+// AttachContainerStdio connects the given stdio connections to the init
+// process of a container started by StartContainer, first flushing any
+// output the process wrote before the attach.
+func (c *gcsCore) AttachContainerStdio(id string, stdioSet *stdio.ConnectionSet) error {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	deferred := containerEntry.deferredStdio
+	if deferred == nil {
+		containerEntry.mutex.Unlock()
+		return errors.Errorf("container %s has no stdio awaiting attach", id)
+	}
+	if deferred.attached {
+		containerEntry.mutex.Unlock()
+		return errors.Errorf("stdio has already been attached to container %s", id)
+	}
+	deferred.attached = true
+	// The flush may block on the host, so it is done without holding the
+	// entry's mutex.
+	containerEntry.mutex.Unlock()
+
+	if err := deferred.attach(stdioSet); err != nil {
+		return errors.Wrapf(err, "failed to attach stdio to container %s", id)
+	}
+	return nil
+}
+
+// runInitProcess creates the container's init process with the given
+// parameters and, unless the container is frozen on create, starts it. If
+// the process was created, containerEntry.initStarted is set, and the caller
+// must close it once the process has been cached.
+//
+// This function assumes that the entry's mutex is held by the caller.
+func (c *gcsCore) runInitProcess(containerEntry *containerCacheEntry, processEntry *processCacheEntry, params prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (runtime.Process, error) {
+	id := containerEntry.ID
+	if len(params.Mounts) > 0 {
+		return nil, errors.Errorf("the init process of container %s cannot request mounts", id)
+	}
+	// The init process's environment is written to the container's spec.
+	if len(params.SecretEnvironment) > 0 {
+		return nil, errors.Errorf("the init process of container %s cannot reference secrets", id)
+	}
+	// The spec is a copy, so the console parameters are applied to it
+	// without changing the caller's.
+	spec := params.OCISpecification
+	if err := applyConsoleParameters(params, &spec.Process); err != nil {
+		return nil, err
+	}
+	if err := c.authorizeExec(id, params.OCISpecification.Process.Args); err != nil {
+		return nil, err
+	}
+	stdioSet, err := c.redirectStdio(containerEntry, params, params.OCISpecification.Process.Terminal, stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	containerEntry.hasRunInitProcess = true
+	if err := c.writeConfigFile(containerEntry, spec); err != nil {
+		return nil, err
+	}
+
+	container, err := c.createContainer(containerEntry, stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	// From here on, the container is cleaned up by the wait goroutine which
+	// setupInitProcess starts, so it is killed if anything else fails.
+	if err := c.setupInitProcess(containerEntry, processEntry, container); err != nil {
+		return nil, err
+	}
+	// The init process exists once the container is created, so its score
+	// and scheduling policy are set before any of its code runs.
+	if err := c.tuneProcess(container.Pid(), params); err != nil {
+		c.killInitProcess(containerEntry, container)
+		return nil, err
+	}
+
+	if containerEntry.FreezeOnCreate {
+		// Freeze the init process before it is unblocked, so that the
+		// container's cgroup and memory state can be snapshotted before any
+		// of its code runs. Start is deferred to ResumeContainer.
+		if err := container.Pause(); err != nil {
+			c.killInitProcess(containerEntry, container)
+			return nil, errors.Wrapf(err, "failed to freeze container %s on create", id)
+		}
+		containerEntry.isFrozen = true
+	} else {
+		if err := c.startContainer(containerEntry, container); err != nil {
+			return nil, err
+		}
+	}
+	return container, nil
+}
+
+// startContainer starts the given container's init process, giving up if it
+// hasn't started within c.StartTimeout. The container is killed if it fails to
+// start, so that the wait goroutine started by setupInitProcess cleans it up.
+// The entry's mutex is released while waiting, so that a hung start doesn't
+// stall other operations on the container, such as signaling it.
+//
+// This function assumes that the entry's mutex is held by the caller.
+func (c *gcsCore) startContainer(containerEntry *containerCacheEntry, container runtime.Container) error {
+	containerEntry.isStarting = true
+	started := make(chan error, 1)
+	go func() {
+		started <- container.Start()
+	}()
+
+	containerEntry.mutex.Unlock()
+	timer := time.NewTimer(c.StartTimeout)
+	var err error
+	select {
+	case err = <-started:
+		timer.Stop()
+	case <-timer.C:
+		err = errors.WithStack(gcserr.NewContainerStartTimeoutError(containerEntry.ID, c.StartTimeout))
+	}
+	containerEntry.mutex.Lock()
+
+	if err != nil {
+		c.killInitProcess(containerEntry, container)
+		return err
+	}
+	containerEntry.isStarting = false
+	containerEntry.MarkReady()
+	c.recordContainerEvent(containerEntry.ID, prot.CeStarted, fmt.Sprintf("init process %d", container.Pid()))
+	return nil
+}
+
+// setupInitProcess records the newly created or restored container in its
+// cache entry, begins waiting on its init process so that the container is
+// cleaned up when it exits, and configures its network adapters. The init
+// process may exit before the caller has finished starting it, so the cleanup
+// waits until the caller closes containerEntry.initStarted, which the caller
+// must do even if this function fails. If the network adapters can't be
+// configured, the container is killed.
+//
+// This function assumes that the entry's mutex is held by the caller.
+func (c *gcsCore) setupInitProcess(containerEntry *containerCacheEntry, processEntry *processCacheEntry, container runtime.Container) error {
+	containerEntry.container = container
+	processEntry.Tty = container.Tty()
+
+	initStarted := make(chan struct{})
+	containerEntry.initStarted = initStarted
+	go func() {
+		state, err := container.Wait()
+		if err != nil {
+			containerEntry.log().Error(err)
+		}
+		close(containerEntry.initExited)
+		<-initStarted
+		containerEntry.mutex.Lock()
+		containerEntry.log().Infof("init process %d of container %s exited with exit status %d", container.Pid(), containerEntry.ID, state.ExitCode())
+
+		details := fmt.Sprintf("exit code %d", state.ExitCode())
+		if signal, ok := state.Signal(); ok {
+			details += fmt.Sprintf(", killed by signal %d", signal)
+		}
+		if path := c.CoreDumpPath(container.Pid(), state); path != "" {
+			details += fmt.Sprintf(", core dumped to %s", path)
+		}
+		c.recordContainerEvent(containerEntry.ID, prot.CeExited, details)
+		if err := c.cleanupContainer(containerEntry); err != nil {
+			containerEntry.log().Error(err)
+			c.recordContainerEvent(containerEntry.ID, prot.CeCleanupFailed, err.Error())
+		}
+		containerEntry.mutex.Unlock()
+
+		c.processCacheMutex.Lock()
+		c.exitProcess(container.Pid(), processEntry, state)
+		c.processCacheMutex.Unlock()
+		containerEntry.mutex.Lock()
+		containerEntry.ExitStatus = state
+		for _, hook := range containerEntry.ExitHooks {
+			hook(state)
+		}
+		c.removeContainer(containerEntry)
+		containerEntry.mutex.Unlock()
+	}()
+
+	// Configure network adapters in the namespace.
+	for _, adapter := range containerEntry.NetworkAdapters {
+		if err := c.configureAdapterInNamespace(containerEntry, container, adapter); err != nil {
+			c.killInitProcess(containerEntry, container)
+			return err
+		}
+	}
+	return nil
+}
+
+// killInitProcess kills the init process of a container which failed to be
+// set up or started, which causes the wait goroutine started by
+// setupInitProcess to clean up the container.
+//
+// This function assumes that the entry's mutex is held by the caller.
+func (c *gcsCore) killInitProcess(containerEntry *containerCacheEntry, container runtime.Container) {
+	if err := container.Kill(oslayer.SIGKILL); err != nil {
+		containerEntry.log().Error(err)
+	}
+}
+
+// CheckpointContainer uses CRIU to dump the state of the given container to
+// imagePath, which is typically a mapped directory so that the container may
+// be restored in another utility VM.
+func (c *gcsCore) CheckpointContainer(id string, imagePath string, options runtime.CheckpointOptions) error {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+	if containerEntry.container == nil {
+		return errors.Errorf("container %s has not been started and cannot be checkpointed", id)
+	}
+	if !filepath.IsAbs(imagePath) {
+		return errors.Errorf("checkpoint image path %s must be absolute", imagePath)
+	}
+
+	if err := containerEntry.container.Checkpoint(imagePath, options); err != nil {
+		return errors.Wrapf(err, "failed to checkpoint container %s to %s", id, imagePath)
+	}
+	return nil
+}
+
+// RestoreContainer restores the init process of a container previously
+// created with CreateContainer from the checkpoint image at imagePath. It is
+// used in place of the initial ExecProcess call, and returns the pid of the
+// restored init process.
+func (c *gcsCore) RestoreContainer(id string, imagePath string, params prot.ProcessParameters, options runtime.CheckpointOptions, stdioSet *stdio.ConnectionSet) (int, error) {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return -1, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+	if containerEntry.hasRunInitProcess {
+		return -1, errors.Errorf("container %s has already been started and cannot be restored", id)
+	}
+	if !filepath.IsAbs(imagePath) {
+		return -1, errors.Errorf("checkpoint image path %s must be absolute", imagePath)
+	}
+	processEntry := newProcessCacheEntry(id)
+
+	// Until the container has been restored, the restore may be retried.
+	if err := c.writeConfigFile(containerEntry, params.OCISpecification); err != nil {
+		return -1, err
+	}
+	container, err := containerEntry.rtime.RestoreContainer(id, c.getContainerStoragePath(id), imagePath, options, stdioSet)
+	if err != nil {
+		return -1, errors.Wrapf(err, "failed to restore container %s from %s", id, imagePath)
+	}
+	containerEntry.hasRunInitProcess = true
+	err = c.setupInitProcess(containerEntry, processEntry, container)
+	defer close(containerEntry.initStarted)
+	if err != nil {
+		return -1, err
+	}
+	containerEntry.MarkReady()
+
+	c.processCacheMutex.Lock()
+	c.addProcess(container.Pid(), processEntry)
 	c.processCacheMutex.Unlock()
-	return p.Pid(), nil
+	return container.Pid(), nil
+}
+
+// redactedValue replaces sensitive values in specs returned by
+// GetContainerSpec.
+const redactedValue = "<redacted>"
+
+// GetContainerSpec returns the OCI spec which was written to the config.json
+// of the container with the given ID. If redact is true, the values of the
+// environment variables of the container's process are replaced, since they
+// commonly carry secrets.
+func (c *gcsCore) GetContainerSpec(id string, redact bool) (oci.Spec, error) {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return oci.Spec{}, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+	if containerEntry.configJSON == nil {
+		return oci.Spec{}, errors.Errorf("the config file for container %s has not been written", id)
+	}
+
+	// Decode a fresh copy of the spec, so that the caller can't modify the
+	// cached one.
+	var spec oci.Spec
+	if err := json.Unmarshal(containerEntry.configJSON, &spec); err != nil {
+		return oci.Spec{}, errors.Wrapf(err, "failed to decode the config file for container %s", id)
+	}
+	if redact {
+		for i, v := range spec.Process.Env {
+			spec.Process.Env[i] = strings.SplitN(v, "=", 2)[0] + "=" + redactedValue
+		}
+	}
+	return spec, nil
+}
+
+// GetContainerState returns the lifecycle status of the container with the
+// given ID, and whether its init process has been run.
+func (c *gcsCore) GetContainerState(id string) (prot.ContainerState, error) {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return prot.ContainerState{}, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+
+	state := prot.ContainerState{
+		Status:            prot.CsCreated,
+		HasRunInitProcess: containerEntry.hasRunInitProcess,
+	}
+	switch {
+	case containerEntry.ExitStatus != nil:
+		state.Status = prot.CsExited
+	case containerEntry.container != nil:
+		runtimeState, err := containerEntry.container.GetState()
+		if err != nil {
+			return prot.ContainerState{}, errors.Wrapf(err, "failed to get the state of container %s", id)
+		}
+		switch runtimeState.Status {
+		case "created":
+			state.Status = prot.CsCreated
+		case "running":
+			state.Status = prot.CsRunning
+		case "paused":
+			state.Status = prot.CsPaused
+		case "stopped":
+			state.Status = prot.CsExited
+		default:
+			return prot.ContainerState{}, errors.Errorf("container %s has unknown runtime status \"%s\"", id, runtimeState.Status)
+		}
+	}
+	return state, nil
+}
+
+// GetContainerResources returns the mapped virtual disks, mapped directories,
+// and network adapters currently in the container with the given ID.
+func (c *gcsCore) GetContainerResources(id string) (prot.ContainerResources, error) {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return prot.ContainerResources{}, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+
+	var resources prot.ContainerResources
+	for _, disk := range containerEntry.MappedVirtualDisks {
+		resources.MappedVirtualDisks = append(resources.MappedVirtualDisks, disk)
+	}
+	sort.Slice(resources.MappedVirtualDisks, func(i, j int) bool {
+		return resources.MappedVirtualDisks[i].Lun < resources.MappedVirtualDisks[j].Lun
+	})
+	for _, dir := range containerEntry.MappedDirectories {
+		resources.MappedDirectories = append(resources.MappedDirectories, dir)
+	}
+	sort.Slice(resources.MappedDirectories, func(i, j int) bool {
+		return resources.MappedDirectories[i].Port < resources.MappedDirectories[j].Port
+	})
+	resources.NetworkAdapters = append(resources.NetworkAdapters, containerEntry.NetworkAdapters...)
+	return resources, nil
+}
+
+// ListMappedVirtualDisks returns the mapped virtual disks of every container,
+// with the container each belongs to and whether it is mounted, ordered by
+// LUN and then by container ID.
+func (c *gcsCore) ListMappedVirtualDisks() ([]prot.MappedVirtualDiskStatus, error) {
+	// Snapshot the IDs so that the cache lock isn't held while checking
+	// mounts.
+	c.containerCacheMutex.RLock()
+	ids := make([]string, 0, len(c.containerCache))
+	for id := range c.containerCache {
+		ids = append(ids, id)
+	}
+	c.containerCacheMutex.RUnlock()
+
+	statuses := []prot.MappedVirtualDiskStatus{}
+	for _, id := range ids {
+		containerStatuses, err := c.listContainerMappedVirtualDisks(id)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, containerStatuses...)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Lun != statuses[j].Lun {
+			return statuses[i].Lun < statuses[j].Lun
+		}
+		return statuses[i].ContainerID < statuses[j].ContainerID
+	})
+	return statuses, nil
+}
+
+// listContainerMappedVirtualDisks returns the mapped virtual disks of the
+// container with the given ID, holding its mutex so that disks aren't added
+// or removed while they are checked. A container which has been removed
+// since its ID was looked up has none.
+func (c *gcsCore) listContainerMappedVirtualDisks(id string) ([]prot.MappedVirtualDiskStatus, error) {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return nil, nil
+	}
+	defer containerEntry.mutex.Unlock()
+
+	var statuses []prot.MappedVirtualDiskStatus
+	for _, disk := range containerEntry.MappedVirtualDisks {
+		status := prot.MappedVirtualDiskStatus{MappedVirtualDisk: disk, ContainerID: id}
+		if !disk.AttachOnly {
+			mounted, err := c.OS.PathIsMounted(disk.ContainerPath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to determine if mapped virtual disk path %s of container %s is mounted", disk.ContainerPath, id)
+			}
+			status.Mounted = mounted
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// WaitContainerReady blocks until the init process of the container with the
+// given ID has started. It returns an error if the init process exits before
+// starting, or if it hasn't started within the given timeout.
+func (c *gcsCore) WaitContainerReady(id string, timeout time.Duration) error {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	ready, initExited := containerEntry.ready, containerEntry.initExited
+	containerEntry.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-initExited:
+		// The init process may have exited after it became ready.
+		select {
+		case <-ready:
+			return nil
+		default:
+		}
+		return errors.Errorf("container %s exited before it became ready", id)
+	case <-timer.C:
+		return errors.Errorf("container %s did not become ready within %s", id, timeout)
+	}
+}
+
+// ResumeContainer thaws a container whose init process was created frozen
+// because of the FreezeOnCreate setting, and then starts the init process in
+// the same way as an init process which wasn't frozen. The container stays
+// frozen as far as other operations are concerned until it has started, and
+// is killed if it fails to start.
+func (c *gcsCore) ResumeContainer(id string) error {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+	if !containerEntry.isFrozen {
+		return errors.Errorf("container %s is not frozen", id)
+	}
+	if containerEntry.isStarting {
+		return errors.Errorf("container %s is still starting", id)
+	}
+
+	if err := containerEntry.container.Resume(); err != nil {
+		return errors.Wrapf(err, "failed to thaw container %s", id)
+	}
+	if err := c.startContainer(containerEntry, containerEntry.container); err != nil {
+		return errors.Wrapf(err, "failed to start container %s after thawing", id)
+	}
+	containerEntry.isFrozen = false
+	return nil
+}
+
+// SignalAllContainers sends the specified signal to the init process of every
+// container which has been started, such as when the utility VM is shutting
+// down. Every container is signaled even if signaling some of them fails, and
+// the first failure is returned.
+func (c *gcsCore) SignalAllContainers(signal oslayer.Signal) error {
+	// Snapshot the IDs so that the cache lock isn't held while signaling.
+	c.containerCacheMutex.RLock()
+	ids := make([]string, 0, len(c.containerCache))
+	for id := range c.containerCache {
+		ids = append(ids, id)
+	}
+	c.containerCacheMutex.RUnlock()
+
+	var errToReturn error
+	failed := 0
+	for _, id := range ids {
+		if err := c.signalInitProcess(id, signal); err != nil {
+			logrus.Warn(err)
+			if errToReturn == nil {
+				errToReturn = err
+			}
+			failed++
+		}
+	}
+	if errToReturn != nil {
+		return errors.Wrapf(errToReturn, "failed to signal %d of %d containers", failed, len(ids))
+	}
+	return nil
+}
+
+// signalInitProcess sends the specified signal to the init process of the
+// container with the given ID. Containers which have not been started, or
+// which have been removed since their ID was looked up, are skipped.
+func (c *gcsCore) signalInitProcess(id string, signal oslayer.Signal) error {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return nil
+	}
+	defer containerEntry.mutex.Unlock()
+	if containerEntry.container == nil {
+		return nil
+	}
+	containerEntry.log().Infof("sending signal %d to container %s", signal, id)
+	c.recordContainerEvent(id, prot.CeSignaled, fmt.Sprintf("signal %d", signal))
+	if err := containerEntry.container.Kill(signal); err != nil {
+		return errors.Wrapf(err, "failed to signal container %s", id)
+	}
+	return nil
 }
 
 // SignalContainer sends the specified signal to the container's init process.
 func (c *gcsCore) SignalContainer(id string, signal oslayer.Signal) error {
-	c.containerCacheMutex.Lock()
-	defer c.containerCacheMutex.Unlock()
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+
+	if containerEntry.container != nil {
+		containerEntry.log().Infof("sending signal %d to container %s", signal, id)
+		c.recordContainerEvent(id, prot.CeSignaled, fmt.Sprintf("signal %d", signal))
+		if err := containerEntry.container.Kill(signal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StopContainer sends the container's stop signal to its init process and
+// waits up to timeout for it to exit. If it doesn't, the pids of the
+// container's processes which are still running are returned, so that the
+// caller can escalate, such as by sending SIGKILL. If timeout is zero, it
+// returns as soon as the signal is sent.
+func (c *gcsCore) StopContainer(id string, timeout time.Duration) ([]int, error) {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return nil, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	container, initExited := containerEntry.container, containerEntry.initExited
+	if container == nil {
+		containerEntry.mutex.Unlock()
+		return nil, nil
+	}
+	containerEntry.log().Infof("sending stop signal %d to container %s", containerEntry.StopSignal, id)
+	c.recordContainerEvent(id, prot.CeSignaled, fmt.Sprintf("stop signal %d", containerEntry.StopSignal))
+	if err := container.Kill(containerEntry.StopSignal); err != nil {
+		containerEntry.mutex.Unlock()
+		return nil, err
+	}
+	containerEntry.mutex.Unlock()
+	if timeout == 0 {
+		return nil, nil
+	}
 
-	containerEntry := c.getContainer(id)
-	if containerEntry == nil {
-		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-initExited:
+		return nil, nil
+	case <-timer.C:
 	}
 
-	if containerEntry.container != nil {
-		if err := containerEntry.container.Kill(signal); err != nil {
-			return err
+	// The container may have been removed after the timeout elapsed, in
+	// which case none of its processes remain.
+	containerEntry = c.lockContainer(id)
+	if containerEntry == nil {
+		return nil, nil
+	}
+	defer containerEntry.mutex.Unlock()
+	processes, err := container.GetAllProcesses()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the remaining processes of container %s", id)
+	}
+	c.reconcileProcesses(id, processes)
+	var remainingPids []int
+	for _, process := range processes {
+		if !process.IsZombie && !process.Exited {
+			remainingPids = append(remainingPids, process.Pid)
 		}
 	}
-
-	return nil
+	return remainingPids, nil
 }
 
 // SignalProcess sends the signal specified in options to the given process.
@@ -329,14 +1576,14 @@ func (c *gcsCore) SignalProcess(pid int, options prot.SignalProcessOptions) erro
 	}
 	c.processCacheMutex.Unlock()
 
-	// Interpret signal value 0 as SIGKILL.
+	// Signal value 0 is interpreted as SIGKILL.
 	// TODO: Remove this special casing when we are not worried about breaking
 	// older Windows builds which don't support sending signals.
-	var signal syscall.Signal
+	signal := syscall.Signal(options.Signal)
 	if options.Signal == 0 {
 		signal = syscall.SIGKILL
-	} else {
-		signal = syscall.Signal(options.Signal)
+	} else if options.WindowsHost {
+		signal = syscall.Signal(oslayer.WindowsSignalToSignal(options.Signal))
 	}
 
 	if err := c.OS.Kill(pid, signal); err != nil {
@@ -346,15 +1593,14 @@ func (c *gcsCore) SignalProcess(pid int, options prot.SignalProcessOptions) erro
 	return nil
 }
 
-// ListProcesses returns all container processes, even zombies.
-func (c *gcsCore) ListProcesses(id string) ([]runtime.ContainerProcessState, error) {
-	c.containerCacheMutex.Lock()
-	defer c.containerCacheMutex.Unlock()
-
-	containerEntry := c.getContainer(id)
+// ListProcesses returns all container processes, even zombies. If reconcile
+// is true, processes which the GCS has already seen exit are marked as such.
+func (c *gcsCore) ListProcesses(id string, reconcile bool) ([]runtime.ContainerProcessState, error) {
+	containerEntry := c.lockContainer(id)
 	if containerEntry == nil {
 		return nil, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
 	}
+	defer containerEntry.mutex.Unlock()
 
 	if containerEntry.container == nil {
 		return nil, nil
@@ -364,21 +1610,112 @@ func (c *gcsCore) ListProcesses(id string) ([]runtime.ContainerProcessState, err
 	if err != nil {
 		return nil, err
 	}
+	if reconcile {
+		c.reconcileProcesses(id, processes)
+	}
 	return processes, nil
 }
 
+// reconcileProcesses marks the processes in the given list which the GCS has
+// already seen exit, using the exit states recorded in processCache.
+//
+// Processes may still exit at any point after the reconciliation, so the list
+// only guarantees that every exit observed by the GCS before the list was
+// returned is reflected in it. In particular, a process which is not marked
+// as exited may have exited since, but a process marked as exited will never
+// be running.
+func (c *gcsCore) reconcileProcesses(id string, processes []runtime.ContainerProcessState) {
+	c.processCacheMutex.RLock()
+	defer c.processCacheMutex.RUnlock()
+	for i := range processes {
+		entry, ok := c.processCache[processes[i].Pid]
+		if !ok || entry.ContainerID != id || entry.ExitStatus == nil {
+			continue
+		}
+		processes[i].Exited = true
+		processes[i].ExitCode = entry.ExitStatus.ExitCode()
+	}
+}
+
 // RunExternalProcess runs a process in the utility VM outside of a container's
 // namespace.
 // This can be used for things like debugging or diagnosing the utility VM's
 // state.
 func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (pid int, err error) {
-	ociProcess, err := processParametersToOCI(params)
+	processEntry := newProcessCacheEntry("")
+	// External processes run as the GCS's own user.
+	audit := core.ExecAuditRecord{UID: uint32(os.Getuid())}
+	defer func() {
+		audit.Pid = pid
+		c.auditExec(audit, processEntry, err)
+	}()
+
+	if params.InheritHostEnv {
+		params.Environment = inheritHostEnv(params.Environment)
+	}
+	ociProcess, err := c.processParametersToOCI(params)
 	if err != nil {
 		return -1, err
 	}
+	if params.Umask != "" {
+		root := "/"
+		if params.Chroot != "" {
+			root = params.Chroot
+		}
+		if err := c.checkUmaskShell(root); err != nil {
+			return -1, errors.Wrap(err, "failed to apply the umask of an external process")
+		}
+	}
+	audit.Args = commandArgs(params, ociProcess)
 	cmd := c.OS.Command(ociProcess.Args[0], ociProcess.Args[1:]...)
 	cmd.SetDir(ociProcess.Cwd)
 	cmd.SetEnv(ociProcess.Env)
+	if params.Chroot != "" {
+		if !filepath.IsAbs(params.Chroot) {
+			return -1, errors.Errorf("chroot path %s must be absolute", params.Chroot)
+		}
+		exists, err := c.OS.PathExists(params.Chroot)
+		if err != nil {
+			return -1, err
+		}
+		if !exists {
+			return -1, errors.Errorf("chroot path %s does not exist", params.Chroot)
+		}
+		// The working directory is changed to after the chroot, so it is
+		// relative to the new root. Default it to the new root rather than
+		// leaving the process outside of it.
+		if ociProcess.Cwd == "" {
+			cmd.SetDir("/")
+		}
+		cmd.SetSysProcAttr(&syscall.SysProcAttr{Chroot: params.Chroot})
+	}
+
+	if params.StdinPayload != nil && params.EmulateConsole {
+		return -1, errors.New("a stdin payload cannot be used with an emulated console")
+	}
+	if params.StdOutPath != "" || params.StdErrPath != "" {
+		return -1, errors.New("stdio can only be redirected to files for container processes")
+	}
+	// Only a console's IO is relayed by the GCS, rather than handed to the
+	// process directly, so only it can be watched for activity.
+	if params.IdleTimeoutInMs != 0 && !params.EmulateConsole {
+		return -1, errors.New("an idle timeout can only be used with an emulated console")
+	}
+	if err := validateOomScoreAdj(params.OomScoreAdj); err != nil {
+		return -1, err
+	}
+	if err := validateScheduling(params.SchedulingPolicy, params.SchedulingPriority); err != nil {
+		return -1, err
+	}
+	if err := validateNice(params.Nice); err != nil {
+		return -1, err
+	}
+	if len(params.Mounts) > 0 {
+		return -1, errors.New("external processes cannot request mounts")
+	}
+	if len(params.SecretEnvironment) > 0 {
+		return -1, errors.New("external processes cannot reference secrets")
+	}
 
 	var relay *stdio.TtyRelay
 	if params.EmulateConsole {
@@ -396,6 +1733,11 @@ func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *st
 				master.Close()
 			}
 		}()
+		if size := ociProcess.ConsoleSize; size.Height != 0 {
+			if err := stdio.ResizeConsole(master, uint16(size.Height), uint16(size.Width)); err != nil {
+				return -1, errors.Wrap(err, "failed to set the size of the console for external process")
+			}
+		}
 
 		console, err := c.OS.OpenFile(consolePath, os.O_RDWR, 0777)
 		if err != nil {
@@ -414,21 +1756,51 @@ func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *st
 		}
 		defer fileSet.Close()
 		defer stdioSet.Close()
-		cmd.SetStdin(fileSet.In)
+		if params.StdinPayload == nil {
+			cmd.SetStdin(fileSet.In)
+		}
 		cmd.SetStdout(fileSet.Out)
 		cmd.SetStderr(fileSet.Err)
 	}
+
+	var stdinPipe io.WriteCloser
+	if params.StdinPayload != nil {
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			return -1, errors.Wrap(err, "failed to create stdin pipe for external process")
+		}
+	}
 	if err := cmd.Start(); err != nil {
 		return -1, errors.Wrap(err, "failed call to Start for external process")
 	}
 
+	// Feed the stdin payload to the process. If the process exits without
+	// reading all of it, Wait closes the pipe, which unblocks the copy.
+	stdinDone := make(chan struct{})
+	if stdinPipe != nil {
+		go func() {
+			defer close(stdinDone)
+			if _, err := stdinPipe.Write(params.StdinPayload); err != nil {
+				logrus.Warn(errors.Wrap(err, "failed to write stdin payload to external process"))
+			}
+			stdinPipe.Close()
+		}()
+	} else {
+		close(stdinDone)
+	}
+
 	if relay != nil {
 		relay.Start()
 	}
 
-	processEntry := newProcessCacheEntry("")
 	processEntry.Tty = relay
+	exited := make(chan struct{})
+	// added reports whether the process was added to the cache. If it was
+	// killed after failing to be tuned, no one knows its pid, so its exit
+	// state must not take up one of the MaxExitStates slots.
+	added := make(chan bool, 1)
 	go func() {
+		defer close(exited)
 		if err := cmd.Wait(); err != nil {
 			// TODO: When cmd is a shell, and last command in the shell
 			// returned an error (e.g. typing a non-existing command gives
@@ -439,38 +1811,94 @@ func (c *gcsCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *st
 		}
 		logrus.Infof("external process %d exited with exit status %d", cmd.Process().Pid(), cmd.ExitState().ExitCode())
 
+		<-stdinDone
 		if relay != nil {
 			relay.Wait()
 		}
 
+		if !<-added {
+			return
+		}
 		// Run exit hooks for the process.
 		state := cmd.ExitState()
 		c.processCacheMutex.Lock()
-		processEntry.ExitStatus = state
-		for _, hook := range processEntry.ExitHooks {
-			hook(state)
-		}
+		c.exitProcess(cmd.Process().Pid(), processEntry, state)
 		c.processCacheMutex.Unlock()
 	}()
 
 	pid = cmd.Process().Pid()
+	if err := c.tuneProcess(pid, params); err != nil {
+		// The wait goroutine reaps the killed process.
+		if err := c.OS.Kill(pid, syscall.SIGKILL); err != nil {
+			logrus.Error(err)
+		}
+		added <- false
+		return -1, err
+	}
+	if params.IdleTimeoutInMs != 0 {
+		go c.killWhenIdle(pid, relay, time.Duration(params.IdleTimeoutInMs)*time.Millisecond, exited)
+	}
 	c.processCacheMutex.Lock()
-	c.processCache[pid] = processEntry
+	c.addProcess(pid, processEntry)
 	c.processCacheMutex.Unlock()
+	added <- true
 	return pid, nil
 }
 
+// ReapProcess removes the cache entry of the given external process, which
+// must already have exited. Exit hooks can no longer be registered for the
+// process once it has been reaped.
+func (c *gcsCore) ReapProcess(pid int) error {
+	c.processCacheMutex.Lock()
+	defer c.processCacheMutex.Unlock()
+
+	entry, ok := c.processCache[pid]
+	if !ok {
+		return errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
+	}
+	if entry.ContainerID != "" {
+		return errors.Errorf("process %d belongs to container %s and is not an external process", pid, entry.ContainerID)
+	}
+	if entry.ExitStatus == nil {
+		return errors.Errorf("process %d has not exited", pid)
+	}
+	c.removeProcess(pid, entry)
+	return nil
+}
+
+// ReapExitedProcesses removes the cache entries of all external processes
+// which have exited, and returns the number of entries removed.
+func (c *gcsCore) ReapExitedProcesses() int {
+	c.processCacheMutex.Lock()
+	defer c.processCacheMutex.Unlock()
+
+	reaped := 0
+	for pid, entry := range c.processCache {
+		if entry.ContainerID == "" && entry.ExitStatus != nil {
+			c.removeProcess(pid, entry)
+			reaped++
+		}
+	}
+	return reaped
+}
+
 // ModifySettings takes the given request and performs the modification it
-// specifies. At the moment, this function only supports the request types Add
-// and Remove, both for the resource type MappedVirtualDisk.
+// specifies. The supported request and resource types are:
+//
+//   - Add and Remove, for MappedVirtualDisk and MappedDirectory. Adding a disk
+//     which is already attached with identical settings does nothing.
+//   - Update, for MappedVirtualDisk (changing whether it is read-only, or
+//     growing its filesystem), MappedDirectory (rebinding it to the host's new
+//     share), ResourceLimits (the limits of a started container's cgroup) and
+//     DNS (rewriting the container's resolv.conf).
+//
+// Any other combination produces an error.
 func (c *gcsCore) ModifySettings(id string, request prot.ResourceModificationRequestResponse) error {
-	c.containerCacheMutex.Lock()
-	defer c.containerCacheMutex.Unlock()
-
-	containerEntry := c.getContainer(id)
+	containerEntry := c.lockContainer(id)
 	if containerEntry == nil {
 		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
 	}
+	defer containerEntry.mutex.Unlock()
 
 	settings, ok := request.Settings.(prot.ResourceModificationSettings)
 	if !ok {
@@ -480,11 +1908,28 @@ func (c *gcsCore) ModifySettings(id string, request prot.ResourceModificationReq
 	case prot.RtAdd:
 		switch request.ResourceType {
 		case prot.PtMappedVirtualDisk:
-			if err := c.setupMappedVirtualDisks(id, []prot.MappedVirtualDisk{*settings.MappedVirtualDisk}, containerEntry); err != nil {
+			// The host may retry an add after a transport failure, so adding
+			// a disk which is already attached with identical parameters
+			// succeeds without doing anything.
+			disk := *settings.MappedVirtualDisk
+			if existing, ok := containerEntry.MappedVirtualDisks[disk.Lun]; ok {
+				if existing == disk {
+					containerEntry.log().Infof("mapped virtual disk with lun %d is already attached to container %s", disk.Lun, id)
+					return nil
+				}
+				return errors.Errorf("a different mapped virtual disk with lun %d is already attached to container %s", disk.Lun, id)
+			}
+			if err := c.setupMappedVirtualDisks(id, []prot.MappedVirtualDisk{disk}, containerEntry); err != nil {
 				return errors.Wrapf(err, "failed to hot add mapped virtual disk for container %s", id)
 			}
 		case prot.PtMappedDirectory:
-			if err := c.setupMappedDirectories(id, []prot.MappedDirectory{*settings.MappedDirectory}, containerEntry); err != nil {
+			// Check the port before mounting, rather than leaving it to
+			// AddMappedDirectory once the directory is already mounted.
+			dir := *settings.MappedDirectory
+			if existing, ok := containerEntry.MappedDirectories[dir.Port]; ok {
+				return errors.Errorf("port %d is already used by mapped directory %s of container %s", dir.Port, existing.ContainerPath, id)
+			}
+			if err := c.setupMappedDirectories(id, []prot.MappedDirectory{dir}, containerEntry); err != nil {
 				return errors.Wrapf(err, "failed to hot add mapped directory for container %s", id)
 			}
 		default:
@@ -503,6 +1948,34 @@ func (c *gcsCore) ModifySettings(id string, request prot.ResourceModificationReq
 		default:
 			return errors.Errorf("the resource type \"%s\" is not supported for request type \"%s\"", request.ResourceType, request.RequestType)
 		}
+	case prot.RtUpdate:
+		switch request.ResourceType {
+		case prot.PtMappedVirtualDisk:
+			if err := c.updateMappedVirtualDisk(id, *settings.MappedVirtualDisk, containerEntry); err != nil {
+				return errors.Wrapf(err, "failed to update mapped virtual disk for container %s", id)
+			}
+		case prot.PtMappedDirectory:
+			// An update of a mapped directory follows the host moving the
+			// share to a new endpoint, so it is remounted in place.
+			if err := c.rebindMappedDirectory(id, *settings.MappedDirectory, containerEntry); err != nil {
+				return errors.Wrapf(err, "failed to rebind mapped directory for container %s", id)
+			}
+		case prot.PtResourceLimits:
+			// The container's cgroup is created by the runtime along with
+			// its init process.
+			if containerEntry.container == nil {
+				return errors.Errorf("container %s has not been started", id)
+			}
+			if err := c.writeResourceLimits(containerEntry, *settings.ResourceLimits); err != nil {
+				return errors.Wrapf(err, "failed to update resource limits for container %s", id)
+			}
+		case prot.PtDNS:
+			if err := c.updateResolvConf(containerEntry, *settings.DNSSettings); err != nil {
+				return errors.Wrapf(err, "failed to update DNS configuration for container %s", id)
+			}
+		default:
+			return errors.Errorf("the resource type \"%s\" is not supported for request type \"%s\"", request.ResourceType, request.RequestType)
+		}
 	default:
 		return errors.Errorf("the request type \"%s\" is not supported", request.RequestType)
 	}
@@ -515,13 +1988,11 @@ func (c *gcsCore) ModifySettings(id string, request prot.ResourceModificationReq
 // If the container has already exited, the function will be called
 // immediately.  A container may have multiple exit hooks registered for it.
 func (c *gcsCore) RegisterContainerExitHook(id string, exitHook func(oslayer.ProcessExitState)) error {
-	c.containerCacheMutex.Lock()
-	defer c.containerCacheMutex.Unlock()
-
-	entry := c.getContainer(id)
+	entry := c.lockContainer(id)
 	if entry == nil {
 		return errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
 	}
+	defer entry.mutex.Unlock()
 
 	exitStatus := entry.ExitStatus
 	// If the container has already exited, run the hook immediately.
@@ -547,13 +2018,14 @@ func (c *gcsCore) RegisterProcessExitHook(pid int, exitHook func(oslayer.Process
 	var entry *processCacheEntry
 	var ok bool
 	if entry, ok = c.processCache[pid]; !ok {
-		return errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
+		return errors.WithStack(c.processNotFoundError(pid))
 	}
 
 	exitStatus := entry.ExitStatus
 	// If the process has already exited, run the hook immediately.  Otherwise,
 	// add it to the process's hook list.
 	if exitStatus != nil {
+		c.touchExitState(entry)
 		exitHook(exitStatus)
 	} else {
 		entry.AddExitHook(exitHook)
@@ -561,6 +2033,9 @@ func (c *gcsCore) RegisterProcessExitHook(pid int, exitHook func(oslayer.Process
 	return nil
 }
 
+// ResizeConsole resizes the console of the given process. It fails with a
+// NotATty error if the process has no console, and a ProcessDoesNotExist
+// error if its console has been closed because it exited.
 func (c *gcsCore) ResizeConsole(pid int, height, width uint16) error {
 	c.processCacheMutex.Lock()
 	var p *processCacheEntry
@@ -572,17 +2047,134 @@ func (c *gcsCore) ResizeConsole(pid int, height, width uint16) error {
 	c.processCacheMutex.Unlock()
 
 	if p.Tty == nil {
-		return fmt.Errorf("pid: %d, is not a tty and cannot be resized", pid)
+		return errors.WithStack(gcserr.NewNotATtyError(pid))
+	}
+
+	if err := p.Tty.ResizeConsole(height, width); err != nil {
+		if errors.Cause(err) == stdio.ErrConsoleClosed {
+			return errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
+		}
+		return err
+	}
+	return nil
+}
+
+// rlimitResources maps the rlimit types of an OCI spec to the resources
+// passed to prlimit(2).
+var rlimitResources = map[string]int{
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+}
+
+// SetProcessRlimit changes a resource limit of the given process while it
+// runs, such as raising the RLIMIT_NOFILE of a long-running daemon.
+func (c *gcsCore) SetProcessRlimit(pid int, rlimit oci.LinuxRlimit) error {
+	resource, ok := rlimitResources[rlimit.Type]
+	if !ok {
+		return errors.Errorf("unknown rlimit type \"%s\"", rlimit.Type)
+	}
+	if rlimit.Soft > rlimit.Hard {
+		return errors.Errorf("soft limit %d of %s exceeds hard limit %d", rlimit.Soft, rlimit.Type, rlimit.Hard)
+	}
+
+	// The pid of an exited process may be reused, so such a process is
+	// treated as though it doesn't exist. The lock isn't held across the
+	// prlimit call, so that it doesn't block other processes' operations.
+	c.processCacheMutex.RLock()
+	entry, ok := c.processCache[pid]
+	running := ok && entry.ExitStatus == nil
+	c.processCacheMutex.RUnlock()
+	if !running {
+		return errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
+	}
+
+	limit := &syscall.Rlimit{Cur: rlimit.Soft, Max: rlimit.Hard}
+	if err := c.OS.Prlimit(pid, resource, limit); err != nil {
+		return errors.Wrapf(err, "failed to set %s of process %d", rlimit.Type, pid)
+	}
+	return nil
+}
+
+// The range of values accepted by oom_score_adj.
+const (
+	minOomScoreAdj = -1000
+	maxOomScoreAdj = 1000
+)
+
+// tuneProcess applies the OOM score adjustment, scheduling policy, and
+// niceness requested by the given parameters, if any, to the running
+// process.
+func (c *gcsCore) tuneProcess(pid int, params prot.ProcessParameters) error {
+	if params.OomScoreAdj != nil {
+		if err := c.writeOomScoreAdj(pid, *params.OomScoreAdj); err != nil {
+			return err
+		}
+	}
+	if params.SchedulingPolicy != "" {
+		if err := c.setScheduling(pid, params.SchedulingPolicy, params.SchedulingPriority); err != nil {
+			return err
+		}
 	}
+	if params.Nice != nil {
+		if err := c.setNice(pid, *params.Nice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateOomScoreAdj checks that the given OOM score adjustment, if set, is
+// within the range accepted by the kernel.
+func validateOomScoreAdj(score *int) error {
+	if score != nil && (*score < minOomScoreAdj || *score > maxOomScoreAdj) {
+		return errors.Errorf("oom_score_adj %d is outside of the range %d to %d", *score, minOomScoreAdj, maxOomScoreAdj)
+	}
+	return nil
+}
 
-	return p.Tty.ResizeConsole(height, width)
+// writeOomScoreAdj sets the OOM score adjustment of the given running
+// process.
+func (c *gcsCore) writeOomScoreAdj(pid int, score int) error {
+	path := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	file, err := c.OS.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", path)
+	}
+	_, err = file.Write([]byte(strconv.Itoa(score)))
+	file.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to write oom_score_adj of process %d", pid)
+	}
+	return nil
 }
 
 // setupMappedVirtualDisks is a helper function which calls into the functions
 // in storage.go to set up a set of mapped virtual disks for a given container.
 // It then adds them to the container's cache entry.
-// This function expects containerCacheMutex to be locked on entry.
+// This function expects the container entry's mutex to be locked on entry.
 func (c *gcsCore) setupMappedVirtualDisks(id string, disks []prot.MappedVirtualDisk, containerEntry *containerCacheEntry) error {
+	for _, disk := range disks {
+		if disk.Resize {
+			return errors.Errorf("mapped virtual disk %s can only be resized by an update once it is attached", disk.ContainerPath)
+		}
+	}
+	if err := validateMappedVirtualDisks(disks); err != nil {
+		return errors.Wrapf(err, "invalid mapped virtual disks for container %s", id)
+	}
 	mounts, err := c.getMappedVirtualDiskMounts(disks)
 	if err != nil {
 		return errors.Wrapf(err, "failed to get mapped virtual disk devices for container %s", id)
@@ -601,7 +2193,7 @@ func (c *gcsCore) setupMappedVirtualDisks(id string, disks []prot.MappedVirtualD
 // setupMappedDirectories is a helper function which calls into the functions
 // in storage.go to set up a set of mapped directories for a given container.
 // It then adds them to the container's cache entry.
-// This function expects containerCacheMutex to be locked on entry.
+// This function expects the container entry's mutex to be locked on entry.
 func (c *gcsCore) setupMappedDirectories(id string, dirs []prot.MappedDirectory, containerEntry *containerCacheEntry) error {
 	if err := c.mountMappedDirectories(dirs); err != nil {
 		return errors.Wrapf(err, "failed to mount mapped directories for container %s", id)
@@ -617,7 +2209,7 @@ func (c *gcsCore) setupMappedDirectories(id string, dirs []prot.MappedDirectory,
 // removeMappedVirtualDisks is a helper function which calls into the functions
 // in storage.go to unmount a set of mapped virtual disks for a given
 // container. It then removes them from the container's cache entry.
-// This function expects containerCacheMutex to be locked on entry.
+// This function expects the container entry's mutex to be locked on entry.
 func (c *gcsCore) removeMappedVirtualDisks(id string, disks []prot.MappedVirtualDisk, containerEntry *containerCacheEntry) error {
 	if err := c.unmountMappedVirtualDisks(disks); err != nil {
 		return errors.Wrapf(err, "failed to mount mapped virtual disks for container %s", id)
@@ -631,7 +2223,7 @@ func (c *gcsCore) removeMappedVirtualDisks(id string, disks []prot.MappedVirtual
 // removeMappedDirectories is a helper function which calls into the functions
 // in storage.go to unmount a set of mapped directories for a given container.
 // It then removes them from the container's cache entry.
-// This function expects containerCacheMutex to be locked on entry.
+// This function expects the container entry's mutex to be locked on entry.
 func (c *gcsCore) removeMappedDirectories(id string, dirs []prot.MappedDirectory, containerEntry *containerCacheEntry) error {
 	if err := c.unmountMappedDirectories(dirs); err != nil {
 		return errors.Wrapf(err, "failed to mount mapped directories for container %s", id)
@@ -642,22 +2234,234 @@ func (c *gcsCore) removeMappedDirectories(id string, dirs []prot.MappedDirectory
 	return nil
 }
 
+// rebindMappedDirectory replaces the mount of the container's mapped
+// directory at dir.ContainerPath with a mount of the share at dir's port. If
+// the new share can't be mounted, the old one is mounted again in its place,
+// so that the container keeps its directory.
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) rebindMappedDirectory(id string, dir prot.MappedDirectory, containerEntry *containerCacheEntry) error {
+	var (
+		old   prot.MappedDirectory
+		found bool
+	)
+	for _, existing := range containerEntry.MappedDirectories {
+		if existing.ContainerPath == dir.ContainerPath {
+			old, found = existing, true
+			break
+		}
+	}
+	if !found {
+		return errors.Errorf("no mapped directory is mounted at %s in container %s", dir.ContainerPath, id)
+	}
+	if existing, ok := containerEntry.MappedDirectories[dir.Port]; ok && existing.ContainerPath != dir.ContainerPath {
+		return errors.Errorf("port %d is already used by mapped directory %s of container %s", dir.Port, existing.ContainerPath, id)
+	}
+	// Check what would otherwise fail the mount before the old share is
+	// unmounted.
+	if !dir.CreateInUtilityVM {
+		return errors.New("we do not currently support mapping directories inside the container namespace")
+	}
+
+	if err := c.unmountMappedDirectories([]prot.MappedDirectory{old}); err != nil {
+		return err
+	}
+	if err := c.mountMappedDirectories([]prot.MappedDirectory{dir}); err != nil {
+		if restoreErr := c.mountMappedDirectories([]prot.MappedDirectory{old}); restoreErr != nil {
+			containerEntry.RemoveMappedDirectory(old)
+			return errors.Wrapf(err, "failed to mount the new share, and failed to restore the old one (%s)", restoreErr)
+		}
+		return errors.Wrap(err, "failed to mount the new share, so the old one was restored")
+	}
+	containerEntry.RemoveMappedDirectory(old)
+	return containerEntry.AddMappedDirectory(dir)
+}
+
+// updateMappedVirtualDisk applies an update of the container's mapped virtual
+// disk with disk's lun in place. Only whether the disk is read-only may
+// change; any other change is rejected, since it can't be applied without
+// removing and adding the disk again. If disk.Resize is set, the filesystem on
+// the disk is also grown to fill it.
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) updateMappedVirtualDisk(id string, disk prot.MappedVirtualDisk, containerEntry *containerCacheEntry) error {
+	existing, ok := containerEntry.MappedVirtualDisks[disk.Lun]
+	if !ok {
+		return errors.Errorf("no mapped virtual disk with lun %d is attached to container %s", disk.Lun, id)
+	}
+	resize := disk.Resize
+	disk.Resize = false
+	unchanged := disk
+	unchanged.ReadOnly = existing.ReadOnly
+	if unchanged != existing {
+		return errors.Errorf("only the read-only setting of mapped virtual disk %s with lun %d can be updated in place", existing.ContainerPath, disk.Lun)
+	}
+	// Check this before remounting, so that a rejected update changes
+	// nothing.
+	if resize && disk.ReadOnly {
+		return errors.Errorf("mapped virtual disk %s cannot be resized because it is read-only", disk.ContainerPath)
+	}
+	if disk.ReadOnly == existing.ReadOnly && !resize {
+		containerEntry.log().Infof("update of mapped virtual disk with lun %d of container %s changes nothing", disk.Lun, id)
+		return nil
+	}
+	if disk.ReadOnly != existing.ReadOnly {
+		if err := c.setMappedVirtualDiskReadOnly(disk, containerEntry); err != nil {
+			return errors.Wrapf(err, "failed to remount mapped virtual disk %s", disk.ContainerPath)
+		}
+	}
+	if resize {
+		if err := c.resizeMappedVirtualDisk(disk); err != nil {
+			return errors.Wrapf(err, "failed to resize mapped virtual disk %s", disk.ContainerPath)
+		}
+	}
+	return nil
+}
+
+// setMappedVirtualDiskReadOnly remounts the container's mapped virtual disk
+// with disk's lun in place, making it read-only or writable as disk specifies.
+// The disk is never unmounted, so the container keeps its data throughout.
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) setMappedVirtualDiskReadOnly(disk prot.MappedVirtualDisk, containerEntry *containerCacheEntry) error {
+	if disk.AttachOnly {
+		return errors.Errorf("mapped virtual disk %s cannot be remounted because it is not mounted", disk.ContainerPath)
+	}
+	mounted, err := c.OS.PathIsMounted(disk.ContainerPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to determine if mapped virtual disk path is mounted %s", disk.ContainerPath)
+	}
+	if !mounted {
+		return errors.Errorf("mapped virtual disk %s cannot be remounted because it is not mounted", disk.ContainerPath)
+	}
+	if err := c.remountMappedVirtualDisk(disk); err != nil {
+		return err
+	}
+	containerEntry.MappedVirtualDisks[disk.Lun] = disk
+	return nil
+}
+
+// validateHooks checks that each of the given hooks refers to an absolute
+// path and, if it specifies a timeout, that the timeout is positive. A nil
+// hooks struct is valid.
+func validateHooks(hooks *oci.Hooks) error {
+	if hooks == nil {
+		return nil
+	}
+	for _, hookList := range [][]oci.Hook{hooks.Prestart, hooks.Poststart, hooks.Poststop} {
+		for _, hook := range hookList {
+			if !filepath.IsAbs(hook.Path) {
+				return errors.Errorf("hook path \"%s\" is not an absolute path", hook.Path)
+			}
+			if hook.Timeout != nil && *hook.Timeout <= 0 {
+				return errors.Errorf("hook %s has invalid timeout %d", hook.Path, *hook.Timeout)
+			}
+		}
+	}
+	return nil
+}
+
+// reservedAnnotationPrefix is the annotation key namespace reserved by the OCI
+// runtime spec and used by runC for its own metadata.
+const reservedAnnotationPrefix = "org.opencontainers."
+
+// validateAnnotations checks that none of the given annotation keys are empty
+// or fall within the namespace reserved for the OCI runtime.
+func validateAnnotations(annotations map[string]string) error {
+	for key := range annotations {
+		if key == "" {
+			return errors.New("annotation keys must not be empty")
+		}
+		if strings.HasPrefix(key, reservedAnnotationPrefix) {
+			return errors.Errorf("annotation key \"%s\" uses the reserved prefix \"%s\"", key, reservedAnnotationPrefix)
+		}
+	}
+	return nil
+}
+
+// umaskShell is the shell which applyUmask runs a process's command through.
+const umaskShell = "/bin/sh"
+
+// umaskShellArgs is the number of arguments which applyUmask prepends to a
+// process's command.
+const umaskShellArgs = 4
+
+// applyUmask validates the given octal umask and wraps args in a shell which
+// sets it before exec'ing the original command. The OCI spec version in use
+// has no umask field, so this is the only way to set it for a process. The
+// caller checks that the process's root filesystem has the shell, using
+// checkUmaskShell.
+func applyUmask(umask string, args []string) ([]string, error) {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return nil, errors.Errorf("umask %q is not a valid octal mode", umask)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("a umask cannot be applied without a command to execute")
+	}
+	script := fmt.Sprintf("umask %04o && exec \"$@\"", mask)
+	return append([]string{umaskShell, "-c", script, "sh"}, args...), nil
+}
+
+// commandArgs returns the arguments of the given process, converted from
+// params by processParametersToOCI, without the shell which applyUmask wraps
+// them in.
+func commandArgs(params prot.ProcessParameters, process oci.Process) []string {
+	if params.Umask == "" || params.OCIProcess != nil {
+		return process.Args
+	}
+	return process.Args[umaskShellArgs:]
+}
+
+// checkUmaskShell returns an error if the root filesystem at the given path
+// in the utility VM doesn't have umaskShell, such as a distroless image, so
+// that a umask can't be applied to a process run in it.
+func (c *gcsCore) checkUmaskShell(root string) error {
+	shellPath := filepath.Join(root, umaskShell)
+	// The shell may be a link, which is relative to the process's root
+	// rather than the utility VM's, so it isn't followed.
+	if _, err := c.OS.Lstat(shellPath); err != nil {
+		if os.IsNotExist(err) {
+			return errors.Errorf("a umask is applied through %s, which %s does not have", umaskShell, root)
+		}
+		return errors.Wrapf(err, "failed to check for %s", shellPath)
+	}
+	return nil
+}
+
 // processParametersToOCI converts the given ProcessParameters struct into an
 // oci.Process struct for OCI version 1.0.0-rc5-dev. Since ProcessParameters
 // doesn't include various fields which are available in oci.Process, default
-// values for these fields are chosen.
-func processParametersToOCI(params prot.ProcessParameters) (oci.Process, error) {
+// values for these fields are chosen. If params.OCIProcess is set, it is
+// returned unchanged instead.
+func (c *gcsCore) processParametersToOCI(params prot.ProcessParameters) (oci.Process, error) {
+	if params.OCIProcess != nil {
+		if params.Umask != "" {
+			return oci.Process{}, errors.New("a umask cannot be used with a supplied OCI process")
+		}
+		if len(params.OCIProcess.Args) == 0 {
+			return oci.Process{}, errors.New("the supplied OCI process must specify at least one argument")
+		}
+		if params.Term != "" || params.ConsoleSize != nil {
+			return oci.Process{}, errors.New("a terminal type or console size cannot be used with a supplied OCI process")
+		}
+		return *params.OCIProcess, nil
+	}
 	var args []string
 	if len(params.CommandArgs) == 0 {
 		var err error
-		args, err = processParamCommandLineToOCIArgs(params.CommandLine)
+		args, err = c.processParamCommandLineToOCIArgs(params.CommandLine)
 		if err != nil {
 			return oci.Process{}, err
 		}
 	} else {
 		args = params.CommandArgs
 	}
-	return oci.Process{
+	if params.Umask != "" {
+		var err error
+		args, err = applyUmask(params.Umask, args)
+		if err != nil {
+			return oci.Process{}, err
+		}
+	}
+	process := oci.Process{
 		Args:     args,
 		Cwd:      params.WorkingDirectory,
 		Env:      processParamEnvToOCIEnv(params.Environment),
@@ -737,20 +2541,106 @@ func processParametersToOCI(params prot.ProcessParameters) (oci.Process, error)
 			oci.LinuxRlimit{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024},
 		},
 		NoNewPrivileges: true,
-	}, nil
+	}
+	if err := applyConsoleParameters(params, &process); err != nil {
+		return oci.Process{}, err
+	}
+	return process, nil
+}
+
+// defaultTerm is the TERM of a process with an emulated console which
+// doesn't specify one.
+const defaultTerm = "xterm"
+
+// applyConsoleParameters sets the TERM environment variable and the initial
+// console size requested by the given parameters on a process with a
+// terminal.
+func applyConsoleParameters(params prot.ProcessParameters, process *oci.Process) error {
+	if !process.Terminal {
+		if params.Term != "" || params.ConsoleSize != nil {
+			return errors.New("a terminal type or console size can only be used with an emulated console")
+		}
+		return nil
+	}
+	term := params.Term
+	// The environment may be shared with the caller, so it is copied rather
+	// than modified in place.
+	env := make([]string, 0, len(process.Env)+1)
+	for _, v := range process.Env {
+		if strings.HasPrefix(v, "TERM=") {
+			if term == "" {
+				term = strings.TrimPrefix(v, "TERM=")
+			}
+			continue
+		}
+		env = append(env, v)
+	}
+	if term == "" {
+		term = defaultTerm
+	}
+	process.Env = append(env, "TERM="+term)
+	if size := params.ConsoleSize; size != nil {
+		if size.Height == 0 || size.Width == 0 {
+			return errors.Errorf("invalid console size %dx%d", size.Width, size.Height)
+		}
+		process.ConsoleSize = oci.Box{Height: uint(size.Height), Width: uint(size.Width)}
+	}
+	return nil
 }
 
+// defaultMaxCommandLineLength and defaultMaxCommandLineArgs are the defaults
+// of MaxCommandLineLength and MaxCommandLineArgs. They are far above what real
+// commands need.
+const (
+	defaultMaxCommandLineLength = 1 << 20
+	defaultMaxCommandLineArgs   = 32 * 1024
+)
+
 // processParamCommandLineToOCIArgs converts a CommandLine field from
 // ProcessParameters (a space separate argument string) into an array of string
 // arguments which can be used by an oci.Process.
-func processParamCommandLineToOCIArgs(commandLine string) ([]string, error) {
+func (c *gcsCore) processParamCommandLineToOCIArgs(commandLine string) ([]string, error) {
+	if len(commandLine) > c.MaxCommandLineLength {
+		return nil, errors.Wrapf(os.ErrInvalid, "command line of %d bytes exceeds the maximum length of %d", len(commandLine), c.MaxCommandLineLength)
+	}
 	args, err := shellwords.Parse(commandLine)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to parse command line string \"%s\"", commandLine)
 	}
+	if len(args) > c.MaxCommandLineArgs {
+		return nil, errors.Wrapf(os.ErrInvalid, "command line of %d arguments exceeds the maximum of %d", len(args), c.MaxCommandLineArgs)
+	}
 	return args, nil
 }
 
+// inheritHostEnv returns the utility VM's environment merged with the given
+// environment, with the values in the given environment taking precedence.
+func inheritHostEnv(environment map[string]string) map[string]string {
+	host := make(map[string]string)
+	for _, v := range os.Environ() {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		host[parts[0]] = parts[1]
+	}
+	return mergeEnvironment(host, environment)
+}
+
+// mergeEnvironment returns a new environment containing the variables of both
+// of the given environments, with the values in overrides taking precedence
+// over those in defaults.
+func mergeEnvironment(defaults, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(defaults)+len(overrides))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
 // processParamEnvToOCIEnv converts an Environment field from ProcessParameters
 // (a map from environment variable to value) into an array of environment
 // variable assignments (where each is in the form "<variable>=<value>") which
@@ -764,3 +2654,29 @@ func processParamEnvToOCIEnv(environment map[string]string) []string {
 	}
 	return environmentList
 }
+
+// Health returns the GCS's version, uptime, and the number of containers and
+// running processes it manages. It only briefly takes the cache locks, so
+// that it can serve as a liveness probe which doesn't depend on the state of
+// any container.
+func (c *gcsCore) Health() prot.GcsHealth {
+	c.containerCacheMutex.RLock()
+	containers := len(c.containerCache)
+	c.containerCacheMutex.RUnlock()
+
+	c.processCacheMutex.RLock()
+	processes := 0
+	for _, entry := range c.processCache {
+		if entry.ExitStatus == nil {
+			processes++
+		}
+	}
+	c.processCacheMutex.RUnlock()
+
+	return prot.GcsHealth{
+		Version:        Version,
+		UptimeInMs:     uint64(time.Since(c.startTime) / time.Millisecond),
+		ContainerCount: uint32(containers),
+		ProcessCount:   uint32(processes),
+	}
+}
@@ -1,20 +1,805 @@
 package gcs
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/Microsoft/opengcs/service/gcs/core"
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer/mockos"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+// checkpointCall records the arguments of a checkpoint or restore invocation.
+type checkpointCall struct {
+	id        string
+	imagePath string
+	options   runtime.CheckpointOptions
+}
+
+// recordingRuntime wraps a runtime.Runtime, recording the IDs of the
+// containers created through it, as well as the checkpoints and restores
+// performed on them.
+type recordingRuntime struct {
+	runtime.Runtime
+	createdIDs  []string
+	checkpoints []checkpointCall
+	restores    []checkpointCall
+	// onGetAllProcesses, if set, is called by the runtime's containers
+	// during GetAllProcesses.
+	onGetAllProcesses func()
+	// onStart, if set, is called by the runtime's containers in place of
+	// starting them.
+	onStart func() error
+	// execs records the processes executed in the runtime's containers.
+	execs []oci.Process
+	// kills records the signals sent to the runtime's containers, and
+	// killedIDs the IDs of the containers they were sent to. They are
+	// guarded by killsMutex, since containers are also killed by the GCS's
+	// cleanup goroutines, and should be read through killed.
+	killsMutex sync.Mutex
+	kills      []oslayer.Signal
+	killedIDs  []string
+	// dropKills, if set, stops signals from reaching the runtime's
+	// containers, so that they don't exit when signaled.
+	dropKills bool
+	// status, if set, overrides the status reported by the runtime's
+	// containers.
+	status string
+	// createErr, if set, is returned by CreateContainer in place of creating
+	// the container.
+	createErr error
+	// processes, if set, overrides the processes reported by the runtime's
+	// containers' GetAllProcesses.
+	processes []runtime.ContainerProcessState
+	// stdioSets records the stdio connections given to the runtime's
+	// containers and processes.
+	stdioSets []*stdio.ConnectionSet
+	// consoles, if set, gives the processes executed with a terminal in the
+	// runtime's containers a console relay.
+	consoles bool
+}
+
+// killed returns copies of the signals sent to the runtime's containers and of
+// the IDs of the containers they were sent to.
+func (r *recordingRuntime) killed() ([]oslayer.Signal, []string) {
+	r.killsMutex.Lock()
+	defer r.killsMutex.Unlock()
+	return append([]oslayer.Signal(nil), r.kills...), append([]string(nil), r.killedIDs...)
+}
+
+func (r *recordingRuntime) CreateContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	r.createdIDs = append(r.createdIDs, id)
+	r.stdioSets = append(r.stdioSets, stdioSet)
+	if r.createErr != nil {
+		return nil, r.createErr
+	}
+	container, err := r.Runtime.CreateContainer(id, bundlePath, stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingContainer{Container: container, r: r}, nil
+}
+
+func (r *recordingRuntime) RestoreContainer(id string, bundlePath string, imagePath string, options runtime.CheckpointOptions, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	r.restores = append(r.restores, checkpointCall{id: id, imagePath: imagePath, options: options})
+	container, err := r.Runtime.RestoreContainer(id, bundlePath, imagePath, options, stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingContainer{Container: container, r: r}, nil
+}
+
+// recordingContainer wraps a runtime.Container, recording checkpoints
+// performed on it in its recordingRuntime.
+type recordingContainer struct {
+	runtime.Container
+	r *recordingRuntime
+}
+
+func (c *recordingContainer) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
+	processes, err := c.Container.GetAllProcesses()
+	if c.r.onGetAllProcesses != nil {
+		c.r.onGetAllProcesses()
+	}
+	if c.r.processes != nil {
+		return c.r.processes, err
+	}
+	return processes, err
+}
+
+func (c *recordingContainer) ExecProcess(process oci.Process, stdioSet *stdio.ConnectionSet) (runtime.Process, error) {
+	c.r.execs = append(c.r.execs, process)
+	c.r.stdioSets = append(c.r.stdioSets, stdioSet)
+	p, err := c.Container.ExecProcess(process, stdioSet)
+	if err != nil || !c.r.consoles || !process.Terminal {
+		return p, err
+	}
+	// A pipe stands in for the console's master, since the relay is never
+	// started.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	w.Close()
+	return &consoleProcess{Process: p, relay: stdioSet.NewTtyRelay(r)}, nil
+}
+
+// consoleProcess wraps a runtime.Process, giving it a console relay.
+type consoleProcess struct {
+	runtime.Process
+	relay *stdio.TtyRelay
+}
+
+func (p *consoleProcess) Tty() *stdio.TtyRelay {
+	return p.relay
+}
+
+func (c *recordingContainer) GetState() (*runtime.ContainerState, error) {
+	state, err := c.Container.GetState()
+	if err == nil && c.r.status != "" {
+		state.Status = c.r.status
+	}
+	return state, err
+}
+
+func (c *recordingContainer) Kill(signal oslayer.Signal) error {
+	c.r.killsMutex.Lock()
+	c.r.kills = append(c.r.kills, signal)
+	c.r.killedIDs = append(c.r.killedIDs, c.ID())
+	c.r.killsMutex.Unlock()
+	if c.r.dropKills {
+		return nil
+	}
+	return c.Container.Kill(signal)
+}
+
+func (c *recordingContainer) Start() error {
+	if c.r.onStart != nil {
+		return c.r.onStart()
+	}
+	return c.Container.Start()
+}
+
+func (c *recordingContainer) Checkpoint(imagePath string, options runtime.CheckpointOptions) error {
+	c.r.checkpoints = append(c.r.checkpoints, checkpointCall{id: c.ID(), imagePath: imagePath, options: options})
+	return c.Container.Checkpoint(imagePath, options)
+}
+
+// commandAuthorizer is a core.ExecAuthorizer which denies processes whose
+// command is blocked, recording the arguments of each process it is asked
+// about.
+type commandAuthorizer struct {
+	blocked string
+	args    [][]string
+}
+
+func (a *commandAuthorizer) AuthorizeExec(id string, args []string) (bool, string) {
+	a.args = append(a.args, args)
+	if len(args) > 0 && args[0] == a.blocked {
+		return false, fmt.Sprintf("%s is blocked", a.blocked)
+	}
+	return true, ""
+}
+
+// recordingAuditor is a core.ExecAuditor which records the processes it is
+// told about. Exits are audited from other goroutines.
+type recordingAuditor struct {
+	mutex sync.Mutex
+	execs []core.ExecAuditRecord
+	exits []core.ExecAuditRecord
+}
+
+func (a *recordingAuditor) AuditExec(record core.ExecAuditRecord) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.execs = append(a.execs, record)
+}
+
+func (a *recordingAuditor) AuditExit(record core.ExecAuditRecord) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.exits = append(a.exits, record)
+}
+
+func (a *recordingAuditor) exited() []core.ExecAuditRecord {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]core.ExecAuditRecord(nil), a.exits...)
+}
+
+// journalEntry is an entry sent to a recordingJournal.
+type journalEntry struct {
+	message  string
+	priority int
+	fields   map[string]string
+}
+
+// recordingJournal is a core.JournalSink which records the entries sent to
+// it.
+type recordingJournal struct {
+	mutex   sync.Mutex
+	entries []journalEntry
+}
+
+func (j *recordingJournal) Send(message string, priority int, fields map[string]string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.entries = append(j.entries, journalEntry{message: message, priority: priority, fields: fields})
+	return nil
+}
+
+func (j *recordingJournal) sent() []journalEntry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return append([]journalEntry(nil), j.entries...)
+}
+
+// killRecordingOS wraps an oslayer.OS, recording the signals sent through it.
+type killRecordingOS struct {
+	oslayer.OS
+	signals []syscall.Signal
+}
+
+func (o *killRecordingOS) Kill(pid int, sig syscall.Signal) error {
+	o.signals = append(o.signals, sig)
+	return o.OS.Kill(pid, sig)
+}
+
+// idleRelay is an activityRelay whose activity is recorded by touch.
+type idleRelay struct {
+	mutex sync.Mutex
+	last  time.Time
+}
+
+func (r *idleRelay) LastActivity() time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.last
+}
+
+func (r *idleRelay) touch() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.last = time.Now()
+}
+
+// prlimitRecordingOS wraps an oslayer.OS, recording the resources and limits
+// set through Prlimit. If set, during is called within each call to Prlimit.
+type prlimitRecordingOS struct {
+	oslayer.OS
+	resources []int
+	limits    []syscall.Rlimit
+	during    func()
+}
+
+func (o *prlimitRecordingOS) Prlimit(pid int, resource int, limit *syscall.Rlimit) error {
+	o.resources = append(o.resources, resource)
+	o.limits = append(o.limits, *limit)
+	if o.during != nil {
+		o.during()
+	}
+	return o.OS.Prlimit(pid, resource, limit)
+}
+
+// schedRecordingOS wraps an oslayer.OS, recording the scheduling policies and
+// priorities set through SchedSetscheduler.
+type schedRecordingOS struct {
+	oslayer.OS
+	pids       []int
+	policies   []int
+	priorities []int
+}
+
+func (o *schedRecordingOS) SchedSetscheduler(pid int, policy int, priority int) error {
+	o.pids = append(o.pids, pid)
+	o.policies = append(o.policies, policy)
+	o.priorities = append(o.priorities, priority)
+	return o.OS.SchedSetscheduler(pid, policy, priority)
+}
+
+// failingOpenOS wraps an oslayer.OS, failing to open the files under dir.
+type failingOpenOS struct {
+	oslayer.OS
+	dir string
+}
+
+func (o *failingOpenOS) OpenFile(name string, flag int, perm os.FileMode) (oslayer.File, error) {
+	if strings.HasPrefix(name, o.dir+"/") {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EACCES}
+	}
+	return o.OS.OpenFile(name, flag, perm)
+}
+
+// niceRecordingOS wraps an oslayer.OS, recording the niceness values set
+// through Setpriority.
+type niceRecordingOS struct {
+	oslayer.OS
+	pids  []int
+	nices []int
+}
+
+func (o *niceRecordingOS) Setpriority(pid int, nice int) error {
+	o.pids = append(o.pids, pid)
+	o.nices = append(o.nices, nice)
+	return o.OS.Setpriority(pid, nice)
+}
+
+// externalProcessOS wraps an oslayer.OS, giving each command it creates a
+// distinct pid starting at 1000. The commands do not exit until exit is called
+// with their pid.
+type externalProcessOS struct {
+	oslayer.OS
+	mutex   sync.Mutex
+	nextPid int
+	running map[int]chan struct{}
+}
+
+func newExternalProcessOS() *externalProcessOS {
+	return &externalProcessOS{OS: mockos.NewOS(), nextPid: 1000, running: make(map[int]chan struct{})}
+}
+
+func (o *externalProcessOS) Command(name string, arg ...string) oslayer.Cmd {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	cmd := &externalProcessCmd{Cmd: o.OS.Command(name, arg...), pid: o.nextPid, exit: make(chan struct{})}
+	o.running[cmd.pid] = cmd.exit
+	o.nextPid++
+	return cmd
+}
+
+func (o *externalProcessOS) exit(pid int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if exit, ok := o.running[pid]; ok {
+		close(exit)
+		delete(o.running, pid)
+	}
+}
+
+func (o *externalProcessOS) exitAll() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for pid, exit := range o.running {
+		close(exit)
+		delete(o.running, pid)
+	}
+}
+
+type externalProcessCmd struct {
+	oslayer.Cmd
+	pid  int
+	exit chan struct{}
+}
+
+type pidProcess int
+
+func (p pidProcess) Pid() int {
+	return int(p)
+}
+
+func (c *externalProcessCmd) Process() oslayer.Process {
+	return pidProcess(c.pid)
+}
+
+func (c *externalProcessCmd) Wait() error {
+	<-c.exit
+	return c.Cmd.Wait()
+}
+
+// fileRecordingOS wraps an oslayer.OS, recording the contents written to the
+// files opened through OpenFile, and the flags they were opened with.
+type fileRecordingOS struct {
+	oslayer.OS
+	files map[string]*bytes.Buffer
+	flags map[string]int
+}
+
+func (o *fileRecordingOS) OpenFile(name string, flag int, perm os.FileMode) (oslayer.File, error) {
+	file, err := o.OS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if o.flags == nil {
+		o.flags = make(map[string]int)
+	}
+	o.flags[name] = flag
+	o.files[name] = &bytes.Buffer{}
+	return &recordingFile{File: file, contents: o.files[name]}, nil
+}
+
+// recordingFile wraps an oslayer.File, recording the contents written to it.
+type recordingFile struct {
+	oslayer.File
+	contents *bytes.Buffer
+}
+
+func (f *recordingFile) Write(p []byte) (int, error) {
+	f.contents.Write(p)
+	return f.File.Write(p)
+}
+
+// recordingConnection wraps a transport.Connection, recording the contents
+// written to it from any goroutine, and whether it has been closed.
+type recordingConnection struct {
+	transport.Connection
+	mutex    sync.Mutex
+	contents bytes.Buffer
+	closed   bool
+}
+
+func (c *recordingConnection) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.contents.Write(p)
+}
+
+func (c *recordingConnection) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *recordingConnection) String() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.contents.String()
+}
+
+func (c *recordingConnection) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// rendezvousOS wraps an oslayer.OS, making each overlay mount wait until
+// parties overlay mounts are in progress at once. A mount which waits longer
+// than a second fails.
+type rendezvousOS struct {
+	oslayer.OS
+	parties int
+	mutex   sync.Mutex
+	arrived int
+	all     chan struct{}
+}
+
+func newRendezvousOS(parties int) *rendezvousOS {
+	return &rendezvousOS{OS: mockos.NewOS(), parties: parties, all: make(chan struct{})}
+}
+
+func (o *rendezvousOS) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	if fstype == "overlay" {
+		o.mutex.Lock()
+		o.arrived++
+		if o.arrived == o.parties {
+			close(o.all)
+		}
+		o.mutex.Unlock()
+		select {
+		case <-o.all:
+		case <-time.After(time.Second):
+			return errors.New("timed out waiting for concurrent overlay mounts")
+		}
+	}
+	return o.OS.Mount(source, target, fstype, flags, data)
+}
+
+// mountRecordingOS wraps an oslayer.OS, recording the targets of the mounts
+// made through it.
+type mountRecordingOS struct {
+	oslayer.OS
+	targets []string
+	// data records the data of each mount, such as overlay options.
+	data []string
+	// flags records the flags of each mount.
+	flags []uintptr
+}
+
+func (o *mountRecordingOS) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	o.targets = append(o.targets, target)
+	o.data = append(o.data, data)
+	o.flags = append(o.flags, flags)
+	return o.OS.Mount(source, target, fstype, flags, data)
+}
+
+// failingMountOS wraps an oslayer.OS, failing the mounts with the given data,
+// such as the options of a Plan9 share.
+type failingMountOS struct {
+	oslayer.OS
+	data map[string]bool
+}
+
+func (o *failingMountOS) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	if o.data[data] {
+		return errors.Errorf("failed to mount %s", target)
+	}
+	return o.OS.Mount(source, target, fstype, flags, data)
+}
+
+// statfsOS wraps an oslayer.OS, reporting the given filesystem statistics for
+// every path.
+type statfsOS struct {
+	oslayer.OS
+	stat  syscall.Statfs_t
+	paths []string
+}
+
+func (o *statfsOS) Statfs(path string, buf *syscall.Statfs_t) error {
+	o.paths = append(o.paths, path)
+	*buf = o.stat
+	return nil
+}
+
+// logRecorder is a logrus hook which records the entries logged.
+type logRecorder struct {
+	mutex   sync.Mutex
+	entries []*logrus.Entry
+}
+
+func (r *logRecorder) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (r *logRecorder) Fire(entry *logrus.Entry) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+// find returns the recorded entries whose messages contain the given text.
+func (r *logRecorder) find(text string) []*logrus.Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var found []*logrus.Entry
+	for _, entry := range r.entries {
+		if strings.Contains(entry.Message, text) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// notMountedOS wraps an oslayer.OS, reporting that the given path isn't
+// mounted.
+type notMountedOS struct {
+	oslayer.OS
+	path string
+}
+
+func (o *notMountedOS) PathIsMounted(name string) (bool, error) {
+	if name == o.path {
+		return false, nil
+	}
+	return o.OS.PathIsMounted(name)
+}
+
+// unmountRecordingOS wraps an oslayer.OS, recording the targets of the
+// unmounts made through it, which may be made concurrently.
+type unmountRecordingOS struct {
+	oslayer.OS
+	mutex   sync.Mutex
+	targets []string
+}
+
+func (o *unmountRecordingOS) Unmount(target string, flags int) error {
+	o.mutex.Lock()
+	o.targets = append(o.targets, target)
+	o.mutex.Unlock()
+	return o.OS.Unmount(target, flags)
+}
+
+func (o *unmountRecordingOS) unmounted() []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]string{}, o.targets...)
+}
+
+// missingPathOS wraps an oslayer.OS, reporting that the given path doesn't
+// exist.
+type missingPathOS struct {
+	oslayer.OS
+	missing string
+}
+
+func (o *missingPathOS) PathExists(name string) (bool, error) {
+	if name == o.missing {
+		return false, nil
+	}
+	return o.OS.PathExists(name)
+}
+
+func (o *missingPathOS) Lstat(name string) (os.FileInfo, error) {
+	if name == o.missing {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: syscall.ENOENT}
+	}
+	return o.OS.Lstat(name)
+}
+
+// stagingOS wraps an oslayer.OS, reporting the given modes for paths passed
+// to Lstat, and recording the directories, with their permissions, and the
+// files created through it.
+type stagingOS struct {
+	oslayer.OS
+	modes   map[string]os.FileMode
+	dirs    map[string]os.FileMode
+	created []string
+}
+
+func (o *stagingOS) Lstat(name string) (os.FileInfo, error) {
+	info, err := o.OS.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &modeFileInfo{FileInfo: info, mode: o.modes[name]}, nil
+}
+
+func (o *stagingOS) MkdirAll(path string, perm os.FileMode) error {
+	o.dirs[path] = perm
+	return o.OS.MkdirAll(path, perm)
+}
+
+func (o *stagingOS) Create(name string) (oslayer.File, error) {
+	o.created = append(o.created, name)
+	return o.OS.Create(name)
+}
+
+// modeFileInfo wraps an os.FileInfo, reporting the given mode.
+type modeFileInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (i *modeFileInfo) Mode() os.FileMode {
+	return i.mode
+}
+
+func (i *modeFileInfo) IsDir() bool {
+	return i.mode.IsDir()
+}
+
+// usageOS wraps an oslayer.OS, serving the cgroup v1 and v2 files which
+// report CPU and memory usage. The CPU usage increases by 1000ns with each
+// read.
+type usageOS struct {
+	oslayer.OS
+	mutex    sync.Mutex
+	cpuReads int
+}
+
+func (o *usageOS) OpenFile(name string, flag int, perm os.FileMode) (oslayer.File, error) {
+	switch filepath.Base(name) {
+	case "cpuacct.usage":
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		o.cpuReads++
+		return &readOnlyFile{Reader: strings.NewReader(fmt.Sprintf("%d\n", o.cpuReads*1000))}, nil
+	case "cpu.stat":
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		o.cpuReads++
+		return &readOnlyFile{Reader: strings.NewReader(fmt.Sprintf("usage_usec %d\nuser_usec 0\nsystem_usec 0\n", o.cpuReads))}, nil
+	case "memory.usage_in_bytes", "memory.current":
+		return &readOnlyFile{Reader: strings.NewReader("4096\n")}, nil
+	}
+	return o.OS.OpenFile(name, flag, perm)
+}
+
+func (o *usageOS) reads() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.cpuReads
+}
+
+// procOS wraps an oslayer.OS, serving the given files in place of the real
+// ones under /proc. Other files under /proc don't exist.
+type procOS struct {
+	oslayer.OS
+	files map[string]string
+}
+
+func (o *procOS) OpenFile(name string, flag int, perm os.FileMode) (oslayer.File, error) {
+	if !strings.HasPrefix(name, "/proc/") {
+		return o.OS.OpenFile(name, flag, perm)
+	}
+	contents, ok := o.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	return &readOnlyFile{Reader: strings.NewReader(contents)}, nil
+}
+
+// readOnlyFile is an oslayer.File which reads from the wrapped reader and
+// discards writes.
+type readOnlyFile struct {
+	io.Reader
+}
+
+func (f *readOnlyFile) Write(p []byte) (int, error) { return len(p), nil }
+func (f *readOnlyFile) Close() error                { return nil }
+
+// exitingRuntime is a runtime.Runtime whose containers' init processes exit
+// as soon as they are started.
+type exitingRuntime struct {
+	runtime.Runtime
+	// waitErr is returned by the Wait method of the runtime's containers,
+	// along with exitState if it is set, or a zero exit code if it isn't.
+	waitErr   error
+	exitState oslayer.ProcessExitState
+	container *exitingContainer
+}
+
+func (r *exitingRuntime) CreateContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	container, err := r.Runtime.CreateContainer(id, bundlePath, stdioSet)
+	if err != nil {
+		return nil, err
+	}
+	exitState := r.exitState
+	if exitState == nil {
+		exitState = mockos.NewProcessExitState(0)
+	}
+	r.container = &exitingContainer{Container: container, waitErr: r.waitErr, exitState: exitState, exited: make(chan struct{})}
+	return r.container, nil
+}
+
+// exitingContainer wraps a runtime.Container, making its init process exit
+// as soon as Start is called. Start itself only returns after a short delay,
+// and the container records whether it was deleted before Start returned.
+type exitingContainer struct {
+	runtime.Container
+	waitErr   error
+	exitState oslayer.ProcessExitState
+	exited    chan struct{}
+
+	mutex                sync.Mutex
+	started              bool
+	deletes              int
+	deletedBeforeStarted bool
+}
+
+func (c *exitingContainer) Start() error {
+	close(c.exited)
+	time.Sleep(time.Millisecond * 20)
+	c.mutex.Lock()
+	c.started = true
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *exitingContainer) Wait() (oslayer.ProcessExitState, error) {
+	<-c.exited
+	return c.exitState, c.waitErr
+}
+
+func (c *exitingContainer) Delete() error {
+	c.mutex.Lock()
+	c.deletes++
+	if !c.started {
+		c.deletedBeforeStarted = true
+	}
+	c.mutex.Unlock()
+	return c.Container.Delete()
+}
+
 var _ = Describe("GCS", func() {
 	var (
 		err error
@@ -36,7 +821,7 @@ var _ = Describe("GCS", func() {
 				process oci.Process
 			)
 			JustBeforeEach(func() {
-				process, err = processParametersToOCI(params)
+				process, err = NewGCSCore(mockruntime.NewRuntime(), mockos.NewOS()).processParametersToOCI(params)
 			})
 			Context("params are zeroed", func() {
 				BeforeEach(func() {
@@ -142,7 +927,7 @@ var _ = Describe("GCS", func() {
 					Expect(process).To(Equal(oci.Process{
 						Args:     []string{"sh", "-c", "sleep", "20"},
 						Cwd:      "/home/user/work",
-						Env:      []string{"PATH=/this/is/my/path"},
+						Env:      []string{"PATH=/this/is/my/path", "TERM=xterm"},
 						Terminal: true,
 
 						User: oci.User{UID: 0, GID: 0},
@@ -220,6 +1005,75 @@ var _ = Describe("GCS", func() {
 					}))
 				})
 			})
+			Context("an OCI process is supplied", func() {
+				var (
+					supplied oci.Process
+				)
+				BeforeEach(func() {
+					supplied = oci.Process{
+						Args: []string{"/bin/server", "--port", "80"},
+						Cwd:  "/srv",
+						User: oci.User{UID: 1000, GID: 1000},
+						Capabilities: &oci.LinuxCapabilities{
+							Bounding: []string{"CAP_NET_BIND_SERVICE"},
+						},
+					}
+					params = prot.ProcessParameters{
+						CommandArgs: []string{"ignored"},
+						OCIProcess:  &supplied,
+					}
+				})
+				It("should output the supplied process unchanged", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(process).To(Equal(supplied))
+				})
+				Context("the supplied process has no arguments", func() {
+					BeforeEach(func() {
+						supplied.Args = nil
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("a umask is also supplied", func() {
+					BeforeEach(func() {
+						params.Umask = "0027"
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Context("a umask is supplied", func() {
+				BeforeEach(func() {
+					params = prot.ProcessParameters{
+						CommandArgs: []string{"touch", "/tmp/file"},
+						Umask:       "027",
+					}
+				})
+				It("should run the command with the umask set", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(process.Args).To(Equal([]string{
+						"/bin/sh", "-c", "umask 0027 && exec \"$@\"", "sh", "touch", "/tmp/file",
+					}))
+				})
+				Context("the umask is not octal", func() {
+					BeforeEach(func() {
+						params.Umask = "0089"
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("the umask is out of range", func() {
+					BeforeEach(func() {
+						params.Umask = "01777"
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
 			Context("CommandLine is used rather than CommandArgs", func() {
 				BeforeEach(func() {
 					params = prot.ProcessParameters{
@@ -240,7 +1094,7 @@ var _ = Describe("GCS", func() {
 					Expect(process).To(Equal(oci.Process{
 						Args:     []string{"sh", "-c", "sleep", "20"},
 						Cwd:      "/home/user/work",
-						Env:      []string{"PATH=/this/is/my/path"},
+						Env:      []string{"PATH=/this/is/my/path", "TERM=xterm"},
 						Terminal: true,
 
 						User: oci.User{UID: 0, GID: 0},
@@ -322,11 +1176,15 @@ var _ = Describe("GCS", func() {
 
 		Describe("calling processParamCommandLineToOCIArgs", func() {
 			var (
+				argsCore    *gcsCore
 				commandLine string
 				args        []string
 			)
+			BeforeEach(func() {
+				argsCore = NewGCSCore(mockruntime.NewRuntime(), mockos.NewOS())
+			})
 			JustBeforeEach(func() {
-				args, err = processParamCommandLineToOCIArgs(commandLine)
+				args, err = argsCore.processParamCommandLineToOCIArgs(commandLine)
 			})
 			Context("commandLine is empty", func() {
 				BeforeEach(func() {
@@ -364,6 +1222,38 @@ var _ = Describe("GCS", func() {
 					Expect(args).To(Equal([]string{"sh", "-c", "cat", "/bin/ls", "と℅Eṁに"}))
 				})
 			})
+			Context("commandLine exceeds the maximum length", func() {
+				BeforeEach(func() {
+					commandLine = "echo " + strings.Repeat("a", argsCore.MaxCommandLineLength)
+				})
+				It("should produce ErrInvalid", func() {
+					Expect(errors.Cause(err)).To(Equal(os.ErrInvalid))
+					Expect(args).To(BeNil())
+				})
+			})
+			Context("the maximum number of arguments is lowered", func() {
+				BeforeEach(func() {
+					argsCore.MaxCommandLineArgs = 3
+				})
+				Context("commandLine has the maximum number of arguments", func() {
+					BeforeEach(func() {
+						commandLine = "sh -c 'echo a b c d'"
+					})
+					AssertNoError()
+					It("should produce a slice with all the arguments", func() {
+						Expect(args).To(Equal([]string{"sh", "-c", "echo a b c d"}))
+					})
+				})
+				Context("commandLine has more than the maximum number of arguments", func() {
+					BeforeEach(func() {
+						commandLine = "echo a b c"
+					})
+					It("should produce ErrInvalid", func() {
+						Expect(errors.Cause(err)).To(Equal(os.ErrInvalid))
+						Expect(args).To(BeNil())
+					})
+				})
+			})
 			for _, quoteType := range []string{"\"", "'"} {
 				Context(fmt.Sprintf("using quote type %s", quoteType), func() {
 					Context("commandLine has a single quoted string", func() {
@@ -576,6 +1466,7 @@ var _ = Describe("GCS", func() {
 				mappedDirectory                      prot.MappedDirectory
 				diskModificationRequest              prot.ResourceModificationRequestResponse
 				diskModificationRequestSameLun       prot.ResourceModificationRequestResponse
+				diskModificationRequestRetry         prot.ResourceModificationRequestResponse
 				diskModificationRequestRemove        prot.ResourceModificationRequestResponse
 				dirModificationRequest               prot.ResourceModificationRequestResponse
 				dirModificationRequestSamePort       prot.ResourceModificationRequestResponse
@@ -643,7 +1534,10 @@ var _ = Describe("GCS", func() {
 					CreateStdOutPipe: true,
 					CreateStdErrPipe: true,
 					IsExternal:       false,
-					OCISpecification: oci.Spec{},
+					OCISpecification: oci.Spec{
+						Process: oci.Process{Args: []string{"/bin/sh"}},
+						Root:    oci.Root{Path: "rootfs"},
+					},
 				}
 				nonInitialExecParams = prot.ProcessParameters{
 					CommandLine:      "cat file",
@@ -691,7 +1585,7 @@ var _ = Describe("GCS", func() {
 					Settings:     prot.ResourceModificationSettings{MappedVirtualDisk: &mappedVirtualDisk},
 				}
 				diskSameLun := prot.MappedVirtualDisk{
-					ContainerPath:     "/path/inside/container",
+					ContainerPath:     "/other/path/inside/container",
 					Lun:               4,
 					CreateInUtilityVM: true,
 					ReadOnly:          false,
@@ -701,6 +1595,12 @@ var _ = Describe("GCS", func() {
 					RequestType:  prot.RtAdd,
 					Settings:     prot.ResourceModificationSettings{MappedVirtualDisk: &diskSameLun},
 				}
+				diskRetry := createSettings.MappedVirtualDisks[0]
+				diskModificationRequestRetry = prot.ResourceModificationRequestResponse{
+					ResourceType: prot.PtMappedVirtualDisk,
+					RequestType:  prot.RtAdd,
+					Settings:     prot.ResourceModificationSettings{MappedVirtualDisk: &diskRetry},
+				}
 				diskModificationRequestRemove = prot.ResourceModificationRequestResponse{
 					ResourceType: prot.PtMappedVirtualDisk,
 					RequestType:  prot.RtRemove,
@@ -729,6 +1629,71 @@ var _ = Describe("GCS", func() {
 				}
 			})
 			Describe("calling CreateContainer", func() {
+				Context("several containers are created concurrently", func() {
+					const count = 4
+					var (
+						errs [count]error
+					)
+					BeforeEach(func() {
+						coreint = NewGCSCore(mockruntime.NewRuntime(), newRendezvousOS(count))
+					})
+					JustBeforeEach(func() {
+						var wg sync.WaitGroup
+						for i := 0; i < count; i++ {
+							wg.Add(1)
+							go func(i int) {
+								defer wg.Done()
+								errs[i] = coreint.CreateContainer(fmt.Sprintf("%s-%d", containerID, i), createSettings)
+							}(i)
+						}
+						wg.Wait()
+					})
+					It("should create them in parallel", func() {
+						// Each create waits in its overlay mount for all of
+						// the others, so this only succeeds if no create
+						// blocks another.
+						for i := 0; i < count; i++ {
+							Expect(errs[i]).NotTo(HaveOccurred())
+						}
+						Expect(coreint.containerCache).To(HaveLen(count))
+					})
+				})
+				Context("the number of containers is limited", func() {
+					const limit = 2
+					var (
+						ids []string
+					)
+					BeforeEach(func() {
+						coreint.MaxContainers = limit
+						ids = []string{containerID + "-0", containerID + "-1", containerID + "-2"}
+					})
+					JustBeforeEach(func() {
+						for _, id := range ids[:limit] {
+							Expect(coreint.CreateContainer(id, createSettings)).To(Succeed())
+						}
+						err = coreint.CreateContainer(ids[limit], createSettings)
+					})
+					It("should produce a capacity exceeded error beyond the limit", func() {
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewCapacityExceededError("", 0)))
+						Expect(coreint.containerCache).To(HaveLen(limit))
+					})
+					It("should allow another container once one has been removed", func() {
+						_, err = coreint.ExecProcess(ids[0], initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(coreint.SignalContainer(ids[0], oslayer.SIGKILL)).To(Succeed())
+						Eventually(func() error {
+							return coreint.CreateContainer(ids[limit], createSettings)
+						}).Should(Succeed())
+					})
+					Context("the limit is zero", func() {
+						BeforeEach(func() {
+							coreint.MaxContainers = 0
+						})
+						It("should not limit the number of containers", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+					})
+				})
 				Context("mapped virtual disk is created in the utility VM", func() {
 					JustBeforeEach(func() {
 						err = coreint.CreateContainer(containerID, createSettings)
@@ -737,187 +1702,3712 @@ var _ = Describe("GCS", func() {
 						Expect(err).NotTo(HaveOccurred())
 					})
 				})
-				Context("mapped virtual disk is created in the container namespace", func() {
+				Context("a mapped virtual disk uses the lun of a layer", func() {
+					BeforeEach(func() {
+						createSettings.MappedVirtualDisks[0].Lun = 2
+					})
 					JustBeforeEach(func() {
-						err = coreint.CreateContainer(containerID, createSettingsCreateInUtilityVMFalse)
+						err = coreint.CreateContainer(containerID, createSettings)
 					})
 					It("should produce an error", func() {
 						Expect(err).To(HaveOccurred())
+						Expect(err.Error()).To(ContainSubstring("lun 2"))
+					})
+					It("should not create the container", func() {
+						Expect(coreint.containerCache).NotTo(HaveKey(containerID))
 					})
 				})
-			})
-			Describe("calling ExecProcess", func() {
-				var (
-					params prot.ProcessParameters
-					pid    int
-				)
-				JustBeforeEach(func() {
-					pid, err = coreint.ExecProcess(containerID, params, fullStdioSet)
-				})
-				Context("it is the initial process", func() {
+				Context("a mapped virtual disk uses the lun of the scratch device", func() {
 					BeforeEach(func() {
-						params = initialExecParams
+						createSettings.SandboxDataPath = "scsi:4"
 					})
-					Context("the container has already been created", func() {
-						BeforeEach(func() {
-							err = coreint.CreateContainer(containerID, createSettings)
-							Expect(err).NotTo(HaveOccurred())
-						})
-						It("should not produce an error", func() {
-							Expect(err).NotTo(HaveOccurred())
-						})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
 					})
-					Context("the container has not already been created", func() {
-						It("should produce an error", func() {
-							Expect(err).To(HaveOccurred())
-						})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
 					})
 				})
-				Context("it is not the initial process", func() {
+				Context("mapped resources share ports and luns", func() {
+					var (
+						mos *mountRecordingOS
+					)
 					BeforeEach(func() {
-						params = nonInitialExecParams
-					})
-					Context("the container has already been created", func() {
-						BeforeEach(func() {
-							err = coreint.CreateContainer(containerID, createSettings)
-							Expect(err).NotTo(HaveOccurred())
+						mos = &mountRecordingOS{OS: mockos.NewOS()}
+						coreint = NewGCSCore(mockruntime.NewRuntime(), mos)
+						createSettings.MappedVirtualDisks = append(createSettings.MappedVirtualDisks, prot.MappedVirtualDisk{
+							ContainerPath:     "/other/path/inside/container",
+							Lun:               4,
+							CreateInUtilityVM: true,
 						})
-						Context("the container already has an initial process in it", func() {
+						createSettings.MappedDirectories = []prot.MappedDirectory{
+							{ContainerPath: "/dir/a", CreateInUtilityVM: true, Port: 5},
+							{ContainerPath: "/dir/b", CreateInUtilityVM: true, Port: 6},
+							{ContainerPath: "/dir/c", CreateInUtilityVM: true, Port: 5},
+						}
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should produce an error listing every collision", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(err.Error()).To(ContainSubstring("lun 4 is used by mapped virtual disks /path/inside/container, /other/path/inside/container"))
+						Expect(err.Error()).To(ContainSubstring("port 5 is used by mapped directories /dir/a, /dir/c"))
+						Expect(err.Error()).NotTo(ContainSubstring("port 6"))
+					})
+					It("should not mount anything", func() {
+						Expect(mos.targets).To(BeEmpty())
+					})
+					It("should not create the container", func() {
+						Expect(coreint.containerCache).NotTo(HaveKey(containerID))
+					})
+				})
+				Context("a mapped virtual disk has a relative path", func() {
+					var (
+						mos *mountRecordingOS
+					)
+					BeforeEach(func() {
+						mos = &mountRecordingOS{OS: mockos.NewOS()}
+						coreint = NewGCSCore(mockruntime.NewRuntime(), mos)
+						createSettings.MappedVirtualDisks[0].ContainerPath = "path/inside/container"
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should produce ErrInvalid naming the path", func() {
+						Expect(errors.Cause(err)).To(Equal(os.ErrInvalid))
+						Expect(err.Error()).To(ContainSubstring("\"path/inside/container\""))
+					})
+					It("should not mount the disk", func() {
+						Expect(mos.targets).NotTo(ContainElement("path/inside/container"))
+					})
+					It("should not create the container", func() {
+						Expect(coreint.containerCache).NotTo(HaveKey(containerID))
+					})
+				})
+				Context("hooks are specified", func() {
+					var (
+						timeout int
+					)
+					BeforeEach(func() {
+						timeout = 5
+						createSettings.Hooks = &oci.Hooks{
+							Prestart: []oci.Hook{{Path: "/sbin/setup-network", Timeout: &timeout}},
+						}
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					Context("the hooks are valid", func() {
+						It("should not produce an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should store the hooks in the container's cache entry", func() {
+							Expect(coreint.containerCache[containerID].Hooks).To(Equal(createSettings.Hooks))
+						})
+					})
+					Context("a hook path is relative", func() {
+						BeforeEach(func() {
+							createSettings.Hooks.Poststop = []oci.Hook{{Path: "teardown-network"}}
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("a hook timeout is not positive", func() {
+						BeforeEach(func() {
+							timeout = 0
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("a cpuset is specified", func() {
+					var (
+						fos *fileRecordingOS
+					)
+					BeforeEach(func() {
+						fos = &fileRecordingOS{OS: mockos.NewOS(), files: make(map[string]*bytes.Buffer)}
+						coreint = NewGCSCore(mockruntime.NewRuntime(), fos)
+						createSettings.CpusetCpus = "0-3,7,9-9"
+						createSettings.CpusetMems = "0"
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					Context("the cpu lists are valid", func() {
+						JustBeforeEach(func() {
+							Expect(err).NotTo(HaveOccurred())
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						})
+						It("should leave applying the lists to the runtime", func() {
+							Expect(err).NotTo(HaveOccurred())
+							cgroupPath := filepath.Join("/sys/fs/cgroup/cpuset", containerID)
+							Expect(fos.files).NotTo(HaveKey(filepath.Join(cgroupPath, "cpuset.cpus")))
+							Expect(fos.files).NotTo(HaveKey(filepath.Join(cgroupPath, "cpuset.mems")))
+						})
+						It("should add the lists to the container's OCI spec", func() {
+							Expect(err).NotTo(HaveOccurred())
+							spec, err := coreint.GetContainerSpec(containerID, false)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(spec.Linux.Resources.CPU.Cpus).To(Equal("0-3,7,9"))
+							Expect(spec.Linux.Resources.CPU.Mems).To(Equal("0"))
+						})
+					})
+					Context("the cpu list has an invalid entry", func() {
+						BeforeEach(func() {
+							createSettings.CpusetCpus = "0-3,x"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("the cpu list has a descending range", func() {
+						BeforeEach(func() {
+							createSettings.CpusetCpus = "3-1"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("a reaping init is requested", func() {
+					BeforeEach(func() {
+						createSettings.ReapingInit = true
+					})
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					Context("the reaping init is installed", func() {
+						JustBeforeEach(func() {
+							Expect(err).NotTo(HaveOccurred())
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						})
+						It("should run the init process under the reaping init", func() {
+							Expect(err).NotTo(HaveOccurred())
+							spec, err := coreint.GetContainerSpec(containerID, false)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(spec.Process.Args).To(Equal([]string{reapingInitContainerPath, "--", "/bin/sh"}))
+							Expect(spec.Mounts).To(ContainElement(oci.Mount{
+								Destination: reapingInitContainerPath,
+								Type:        "bind",
+								Source:      defaultReapInitPath,
+								Options:     []string{"bind", "ro"},
+							}))
+						})
+						It("should not change the process parameters", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(initialExecParams.OCISpecification.Process.Args).To(Equal([]string{"/bin/sh"}))
+							Expect(initialExecParams.OCISpecification.Mounts).To(BeEmpty())
+						})
+					})
+					Context("the reaping init is not installed", func() {
+						BeforeEach(func() {
+							coreint = NewGCSCore(mockruntime.NewRuntime(), &missingPathOS{OS: mockos.NewOS(), missing: defaultReapInitPath})
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("a cgroups path is specified", func() {
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					Context("the cgroup exists", func() {
+						var (
+							fos *fileRecordingOS
+						)
+						BeforeEach(func() {
+							fos = &fileRecordingOS{OS: mockos.NewOS(), files: make(map[string]*bytes.Buffer)}
+							coreint = NewGCSCore(mockruntime.NewRuntime(), fos)
+							createSettings.CgroupsPath = "/external/pod1"
+							createSettings.CpusetCpus = "1"
+						})
+						JustBeforeEach(func() {
+							Expect(err).NotTo(HaveOccurred())
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						})
+						It("should use the cgroups path in the container's OCI spec", func() {
+							Expect(err).NotTo(HaveOccurred())
+							spec, err := coreint.GetContainerSpec(containerID, false)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(spec.Linux.CgroupsPath).To(Equal("/external/pod1"))
+						})
+						It("should add the cpuset to the container's OCI spec", func() {
+							Expect(err).NotTo(HaveOccurred())
+							spec, err := coreint.GetContainerSpec(containerID, false)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(spec.Linux.Resources.CPU.Cpus).To(Equal("1"))
+						})
+					})
+					Context("the cgroup does not exist", func() {
+						BeforeEach(func() {
+							coreint = NewGCSCore(mockruntime.NewRuntime(), &missingPathOS{OS: mockos.NewOS(), missing: "/sys/fs/cgroup/memory/external/pod1"})
+							createSettings.CgroupsPath = "/external/pod1"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("the cgroups path is relative", func() {
+						BeforeEach(func() {
+							createSettings.CgroupsPath = "external/pod1"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("the cgroups path escapes the root cgroup", func() {
+						BeforeEach(func() {
+							createSettings.CgroupsPath = "/external/../../pod1"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("annotations are specified", func() {
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					Context("the annotation keys are valid", func() {
+						BeforeEach(func() {
+							createSettings.Annotations = map[string]string{"io.microsoft.sandbox": "true"}
+						})
+						It("should not produce an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should store the annotations in the container's cache entry", func() {
+							Expect(coreint.containerCache[containerID].Annotations).To(Equal(createSettings.Annotations))
+						})
+					})
+					Context("an annotation key uses the reserved prefix", func() {
+						BeforeEach(func() {
+							createSettings.Annotations = map[string]string{"org.opencontainers.image.os": "linux"}
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("mapped virtual disk is created in the container namespace", func() {
+					JustBeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettingsCreateInUtilityVMFalse)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("cloning a container", func() {
+				var (
+					mos           *mountRecordingOS
+					cloneID       string
+					cloneSettings prot.VMHostedContainerSettings
+				)
+				BeforeEach(func() {
+					mos = &mountRecordingOS{OS: mockos.NewOS()}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), mos)
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					mos.targets, mos.data = nil, nil
+
+					cloneID = containerID + "-clone"
+					cloneSettings = prot.VMHostedContainerSettings{
+						SandboxDataPath: "5",
+						CloneFrom:       containerID,
+					}
+				})
+				JustBeforeEach(func() {
+					err = coreint.CreateContainer(cloneID, cloneSettings)
+				})
+				sourceLowerdir := func() string {
+					return fmt.Sprintf("lowerdir=/tmp/base/:/tmp/gcs/%[1]s/layer0:/tmp/gcs/%[1]s/layer1:/tmp/gcs/%[1]s/layer2,", containerID)
+				}
+				It("should only mount its scratch over the source's layers", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(mos.targets).To(Equal([]string{
+						"/tmp/gcs/" + cloneID + "/scratch",
+						"/tmp/gcs/" + cloneID + "/rootfs",
+					}))
+					Expect(mos.data[1]).To(HavePrefix(sourceLowerdir()))
+					Expect(mos.data[1]).To(ContainSubstring("upperdir=/tmp/gcs/" + cloneID + "/scratch/upper"))
+				})
+				It("should share the source's layers with clones of the clone", func() {
+					Expect(err).NotTo(HaveOccurred())
+					cloneSettings.CloneFrom = cloneID
+					Expect(coreint.CreateContainer(cloneID+"-2", cloneSettings)).To(Succeed())
+					Expect(mos.data[3]).To(HavePrefix(sourceLowerdir()))
+				})
+				Context("the source container does not exist", func() {
+					BeforeEach(func() {
+						cloneSettings.CloneFrom = "missing"
+					})
+					It("should produce a ContainerDoesNotExistError", func() {
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerDoesNotExistError("")))
+						Expect(mos.targets).To(BeEmpty())
+					})
+				})
+				Context("layers are specified", func() {
+					BeforeEach(func() {
+						cloneSettings.Layers = createSettings.Layers
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(mos.targets).To(BeEmpty())
+					})
+				})
+				Context("the source's layers are no longer mounted", func() {
+					BeforeEach(func() {
+						coreint.OS = &notMountedOS{OS: mos, path: "/tmp/gcs/" + containerID + "/layer1"}
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(mos.targets).To(BeEmpty())
+						Expect(coreint.containerCache).NotTo(HaveKey(cloneID))
+					})
+				})
+				Context("the source is removed before the clone", func() {
+					var (
+						uos        *unmountRecordingOS
+						ros        *removalRecordingOS
+						layerPaths []string
+					)
+					BeforeEach(func() {
+						// The layers are found by their mountpoints on disk
+						// when they are unmounted.
+						layerPaths = coreint.getLayerPaths(containerID, 3)
+						for _, layerPath := range layerPaths {
+							Expect(os.MkdirAll(layerPath, 0755)).To(Succeed())
+						}
+						ros = &removalRecordingOS{OS: mos}
+						uos = &unmountRecordingOS{OS: ros}
+						coreint.OS = uos
+					})
+					AfterEach(func() {
+						Expect(os.RemoveAll(coreint.getContainerStoragePath(containerID))).To(Succeed())
+					})
+					removed := func(id string) func() bool {
+						return func() bool {
+							coreint.containerCacheMutex.RLock()
+							defer coreint.containerCacheMutex.RUnlock()
+							_, ok := coreint.containerCache[id]
+							return !ok
+						}
+					}
+					remove := func(id string) {
+						_, err := coreint.ExecProcess(id, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(coreint.SignalContainer(id, oslayer.SIGKILL)).To(Succeed())
+						Eventually(removed(id)).Should(BeTrue())
+					}
+					It("should leave the layers mounted for the clone", func() {
+						Expect(err).NotTo(HaveOccurred())
+						remove(containerID)
+						Expect(uos.unmounted()).To(ContainElement("/tmp/gcs/" + containerID + "/rootfs"))
+						for _, layerPath := range layerPaths {
+							Expect(uos.unmounted()).NotTo(ContainElement(layerPath))
+						}
+						Expect(ros.removed()).NotTo(ContainElement(coreint.getContainerStoragePath(containerID)))
+					})
+					It("should unmount and remove the layers with the clone", func() {
+						Expect(err).NotTo(HaveOccurred())
+						remove(containerID)
+						remove(cloneID)
+						for _, layerPath := range layerPaths {
+							Expect(uos.unmounted()).To(ContainElement(layerPath))
+						}
+						Expect(ros.removed()).To(ContainElement(coreint.getContainerStoragePath(containerID)))
+						Expect(coreint.layerUsers).To(BeEmpty())
+					})
+					It("should not reuse the source's ID while the clone uses its layers", func() {
+						Expect(err).NotTo(HaveOccurred())
+						remove(containerID)
+						Expect(coreint.CreateContainer(containerID, createSettings)).NotTo(Succeed())
+					})
+				})
+			})
+			Describe("selecting a runtime by name", func() {
+				var (
+					defaultRuntime *recordingRuntime
+					kataRuntime    *recordingRuntime
+					crunRuntime    *recordingRuntime
+				)
+				BeforeEach(func() {
+					defaultRuntime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					kataRuntime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					crunRuntime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					coreint = NewGCSCore(defaultRuntime, mockos.NewOS())
+					err = coreint.RegisterRuntime("kata", kataRuntime)
+					Expect(err).NotTo(HaveOccurred())
+					err = coreint.RegisterRuntime("crun", crunRuntime)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				JustBeforeEach(func() {
+					err = coreint.CreateContainer(containerID, createSettings)
+					if err == nil {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					}
+				})
+				Context("no runtime name is given", func() {
+					It("should use the default runtime", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(defaultRuntime.createdIDs).To(Equal([]string{containerID}))
+						Expect(kataRuntime.createdIDs).To(BeEmpty())
+						Expect(crunRuntime.createdIDs).To(BeEmpty())
+					})
+				})
+				Context("a registered runtime name is given", func() {
+					BeforeEach(func() {
+						createSettings.RuntimeName = "crun"
+					})
+					It("should use the named runtime", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(crunRuntime.createdIDs).To(Equal([]string{containerID}))
+						Expect(kataRuntime.createdIDs).To(BeEmpty())
+						Expect(defaultRuntime.createdIDs).To(BeEmpty())
+					})
+				})
+				Context("an unknown runtime name is given", func() {
+					BeforeEach(func() {
+						createSettings.RuntimeName = "gvisor"
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+					It("should not create the container", func() {
+						Expect(coreint.containerCache).NotTo(HaveKey(containerID))
+					})
+				})
+				Context("a runtime name is registered twice", func() {
+					It("should produce an error", func() {
+						Expect(coreint.RegisterRuntime("kata", kataRuntime)).To(HaveOccurred())
+					})
+				})
+				Context("the named runtime is unsupported", func() {
+					BeforeEach(func() {
+						createSettings.RuntimeName = "kata"
+						kataRuntime.createErr = &runtime.UnsupportedError{Reason: "missing kernel feature"}
+					})
+					Context("a fallback runtime is given", func() {
+						BeforeEach(func() {
+							createSettings.FallbackRuntimeName = "crun"
+						})
+						It("should use the fallback runtime", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(kataRuntime.createdIDs).To(Equal([]string{containerID}))
+							Expect(crunRuntime.createdIDs).To(Equal([]string{containerID}))
+							Expect(defaultRuntime.createdIDs).To(BeEmpty())
+						})
+						Context("the named runtime fails for another reason", func() {
 							BeforeEach(func() {
-								pid, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
-								Expect(err).NotTo(HaveOccurred())
+								kataRuntime.createErr = errors.New("create failed")
 							})
-							It("should not produce an error", func() {
-								Expect(err).NotTo(HaveOccurred())
+							It("should not use the fallback runtime", func() {
+								Expect(err).To(HaveOccurred())
+								Expect(crunRuntime.createdIDs).To(BeEmpty())
 							})
 						})
-						Context("the container does not already have an initial process in it", func() {
-							It("should produce an error", func() {
-								// TODO: Find a way to produce an error in this
-								// context, possibly.
-								//Expect(err).To(HaveOccurred())
-							})
+					})
+					Context("no fallback runtime is given", func() {
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(crunRuntime.createdIDs).To(BeEmpty())
+							Expect(defaultRuntime.createdIDs).To(BeEmpty())
 						})
 					})
-					Context("the container has not already been created", func() {
+					Context("an unknown fallback runtime is given", func() {
+						BeforeEach(func() {
+							createSettings.FallbackRuntimeName = "gvisor"
+						})
 						It("should produce an error", func() {
 							Expect(err).To(HaveOccurred())
+							Expect(kataRuntime.createdIDs).To(BeEmpty())
 						})
 					})
 				})
-			})
-			Describe("calling SignalContainer", func() {
-				Context("using signal SIGKILL", func() {
-					JustBeforeEach(func() {
-						err = coreint.SignalContainer(containerID, oslayer.SIGKILL)
+			})
+			Describe("authorizing processes", func() {
+				var (
+					rtime      *recordingRuntime
+					authorizer *commandAuthorizer
+					pid        int
+				)
+				BeforeEach(func() {
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					authorizer = &commandAuthorizer{blocked: "/bin/sh"}
+					coreint = NewGCSCore(rtime, mockos.NewOS())
+					coreint.ExecAuthorizer = authorizer
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("the init process is blocked", func() {
+					JustBeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					})
+					It("should produce an authorization error", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewExecDeniedError("", nil, "")))
+						Expect(err.Error()).To(ContainSubstring("/bin/sh is blocked"))
+						hresult, herr := gcserr.GetHresult(err)
+						Expect(herr).NotTo(HaveOccurred())
+						Expect(hresult).To(Equal(gcserr.HrAccessDenied))
+					})
+					It("should not create the container", func() {
+						Expect(rtime.createdIDs).To(BeEmpty())
+					})
+				})
+				Context("the init process is allowed", func() {
+					BeforeEach(func() {
+						initialExecParams.OCISpecification.Process.Args = []string{"/sbin/init"}
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should be asked about the init process", func() {
+						Expect(authorizer.args).To(Equal([][]string{{"/sbin/init"}}))
+					})
+					Context("a blocked process is executed", func() {
+						BeforeEach(func() {
+							nonInitialExecParams.CommandLine = "/bin/sh -c ls"
+							pid, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+						})
+						It("should produce an authorization error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewExecDeniedError("", nil, "")))
+							Expect(pid).To(Equal(-1))
+						})
+						It("should pass the resolved arguments to the authorizer", func() {
+							Expect(authorizer.args[1]).To(Equal([]string{"/bin/sh", "-c", "ls"}))
+						})
+						It("should not execute the process", func() {
+							Expect(rtime.execs).To(BeEmpty())
+						})
+					})
+					Context("an allowed process is executed", func() {
+						BeforeEach(func() {
+							_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+						})
+						It("should execute the process", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtime.execs).To(HaveLen(1))
+						})
+					})
+					Context("an allowed process is executed with a umask", func() {
+						BeforeEach(func() {
+							nonInitialExecParams.Umask = "0077"
+							_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+						})
+						It("should authorize the command rather than the shell which applies the umask", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(authorizer.args[1]).To(Equal([]string{"cat", "file"}))
+							Expect(rtime.execs).To(HaveLen(1))
+						})
+					})
+				})
+			})
+			Describe("checkpointing and restoring a container", func() {
+				var (
+					rtime     *recordingRuntime
+					imagePath string
+					options   runtime.CheckpointOptions
+					pid       int
+				)
+				BeforeEach(func() {
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					coreint = NewGCSCore(rtime, mockos.NewOS())
+					imagePath = "/mnt/checkpoint"
+					options = runtime.CheckpointOptions{TCPEstablished: true, FileLocks: true}
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("the container is checkpointed", func() {
+					JustBeforeEach(func() {
+						err = coreint.CheckpointContainer(containerID, imagePath, options)
+					})
+					Context("the container has been started", func() {
+						BeforeEach(func() {
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should invoke the runtime's checkpoint", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtime.checkpoints).To(Equal([]checkpointCall{
+								checkpointCall{id: containerID, imagePath: imagePath, options: options},
+							}))
+						})
+						Context("the image path is relative", func() {
+							BeforeEach(func() {
+								imagePath = "mnt/checkpoint"
+							})
+							It("should produce an error", func() {
+								Expect(err).To(HaveOccurred())
+								Expect(rtime.checkpoints).To(BeEmpty())
+							})
+						})
+					})
+					Context("the container has not been started", func() {
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(rtime.checkpoints).To(BeEmpty())
+						})
+					})
+				})
+				Context("the container is restored", func() {
+					JustBeforeEach(func() {
+						pid, err = coreint.RestoreContainer(containerID, imagePath, initialExecParams, options, fullStdioSet)
+					})
+					It("should invoke the runtime's restore", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.restores).To(Equal([]checkpointCall{
+							checkpointCall{id: containerID, imagePath: imagePath, options: options},
+						}))
+						Expect(rtime.createdIDs).To(BeEmpty())
+					})
+					It("should add the restored init process to the process cache", func() {
+						Expect(coreint.processCache).To(HaveKey(pid))
+					})
+					Context("the container has already been started", func() {
+						BeforeEach(func() {
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(rtime.restores).To(BeEmpty())
+						})
+					})
+					Context("the restored container fails to be set up", func() {
+						BeforeEach(func() {
+							// The container's network adapter can't be
+							// configured without writing its resolv.conf.
+							coreint.OS = &failingOpenOS{OS: coreint.OS, dir: coreint.getContainerStoragePath(containerID)}
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(rtime.restores).To(HaveLen(1))
+						})
+						It("should kill the container so that it is cleaned up", func() {
+							Eventually(func() error {
+								return coreint.WaitContainerReady(containerID, time.Minute)
+							}).Should(MatchError(ContainSubstring("does not exist")))
+							_, killedIDs := rtime.killed()
+							Expect(killedIDs).To(ContainElement(containerID))
+						})
+						It("should not allow the container to be restored again", func() {
+							_, err = coreint.RestoreContainer(containerID, imagePath, initialExecParams, options, fullStdioSet)
+							Expect(err).To(HaveOccurred())
+							Expect(rtime.restores).To(HaveLen(1))
+						})
+					})
+				})
+			})
+			Describe("getting a container's spec", func() {
+				var (
+					spec     oci.Spec
+					redact   bool
+					execSpec oci.Spec
+				)
+				BeforeEach(func() {
+					redact = false
+					execSpec = oci.Spec{
+						Version:  "1.0.0",
+						Hostname: "container",
+						Process: oci.Process{
+							Args: []string{"sh"},
+							Env:  []string{"PATH=/usr/bin", "TOKEN=secret"},
+						},
+						Root: oci.Root{Path: "rootfs"},
+					}
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				JustBeforeEach(func() {
+					spec, err = coreint.GetContainerSpec(containerID, redact)
+				})
+				Context("the init process has been started", func() {
+					BeforeEach(func() {
+						initialExecParams.OCISpecification = execSpec
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should return the spec which was written", func() {
+						Expect(err).NotTo(HaveOccurred())
+						execSpec.Mounts = []oci.Mount{coreint.resolvConfMount(containerID)}
+						Expect(spec).To(Equal(execSpec))
+					})
+					Context("redaction is requested", func() {
+						BeforeEach(func() {
+							redact = true
+						})
+						It("should redact the environment", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(spec.Process.Env).To(Equal([]string{"PATH=<redacted>", "TOKEN=<redacted>"}))
+							Expect(spec.Hostname).To(Equal("container"))
+						})
+						It("should not modify the cached spec", func() {
+							spec, err = coreint.GetContainerSpec(containerID, false)
+							Expect(err).NotTo(HaveOccurred())
+							execSpec.Mounts = []oci.Mount{coreint.resolvConfMount(containerID)}
+							Expect(spec).To(Equal(execSpec))
+						})
+					})
+				})
+				Context("the init process has not been started", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("the container does not exist", func() {
+					BeforeEach(func() {
+						containerID = "nonexistent"
+					})
+					It("should produce a container does not exist error", func() {
+						Expect(errors.Cause(err)).To(Equal(gcserr.NewContainerDoesNotExistError("nonexistent")))
+					})
+				})
+			})
+			Describe("creating a container frozen", func() {
+				JustBeforeEach(func() {
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+				})
+				Context("FreezeOnCreate is not set", func() {
+					It("should leave the container running", func() {
+						Expect(err).NotTo(HaveOccurred())
+						state, err := coreint.containerCache[containerID].container.GetState()
+						Expect(err).NotTo(HaveOccurred())
+						Expect(state.Status).To(Equal("running"))
+					})
+					It("should fail to resume the container", func() {
+						Expect(coreint.ResumeContainer(containerID)).To(HaveOccurred())
+					})
+				})
+				Context("FreezeOnCreate is set", func() {
+					BeforeEach(func() {
+						createSettings.FreezeOnCreate = true
+					})
+					It("should leave the container paused", func() {
+						Expect(err).NotTo(HaveOccurred())
+						state, err := coreint.containerCache[containerID].container.GetState()
+						Expect(err).NotTo(HaveOccurred())
+						Expect(state.Status).To(Equal("paused"))
+					})
+					It("should refuse to execute further processes", func() {
+						_, err := coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+						Expect(err).To(HaveOccurred())
+					})
+					Context("the container is resumed", func() {
+						JustBeforeEach(func() {
+							err = coreint.ResumeContainer(containerID)
+						})
+						It("should leave the container running", func() {
+							Expect(err).NotTo(HaveOccurred())
+							state, err := coreint.containerCache[containerID].container.GetState()
+							Expect(err).NotTo(HaveOccurred())
+							Expect(state.Status).To(Equal("running"))
+						})
+						It("should fail to resume the container again", func() {
+							Expect(coreint.ResumeContainer(containerID)).To(HaveOccurred())
+						})
+						It("should record that the container started", func() {
+							events, err := coreint.GetContainerHistory(containerID)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(events).To(HaveLen(2))
+							Expect(events[1].Type).To(Equal(prot.CeStarted))
+						})
+					})
+					Context("the container fails to start once resumed", func() {
+						var rtime *recordingRuntime
+						BeforeEach(func() {
+							rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+							rtime.onStart = func() error {
+								return errors.New("start failed")
+							}
+							coreint = NewGCSCore(rtime, mockos.NewOS())
+						})
+						JustBeforeEach(func() {
+							Expect(err).NotTo(HaveOccurred())
+							err = coreint.ResumeContainer(containerID)
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(err.Error()).To(ContainSubstring("start failed"))
+						})
+						It("should kill the container so that it is cleaned up", func() {
+							signals, _ := rtime.killed()
+							Expect(signals).To(Equal([]oslayer.Signal{oslayer.SIGKILL}))
+							Eventually(func() error {
+								_, err := coreint.GetContainerState(containerID)
+								return err
+							}).Should(HaveOccurred())
+						})
+					})
+				})
+				Context("the container does not exist", func() {
+					It("should fail to resume it", func() {
+						Expect(coreint.ResumeContainer("nonexistent")).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("waiting for a container to become ready", func() {
+				JustBeforeEach(func() {
+					err = coreint.WaitContainerReady(containerID, time.Second)
+				})
+				Context("the container does not exist", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("the container has been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					Context("its init process has been started", func() {
+						BeforeEach(func() {
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should return promptly without an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+					})
+					Context("its init process has not been started", func() {
+						It("should time out", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(err.Error()).To(ContainSubstring("did not become ready"))
+						})
+					})
+				})
+				Context("the container's init process exits as soon as it is started", func() {
+					BeforeEach(func() {
+						coreint = NewGCSCore(&exitingRuntime{Runtime: mockruntime.NewRuntime()}, mockos.NewOS())
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						// The container is only removed from the cache once
+						// its delayed Start returns, so the wait begins first.
+						core, params, stdioSet := coreint, initialExecParams, fullStdioSet
+						go core.ExecProcess(containerID, params, stdioSet)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(err.Error()).To(ContainSubstring("exited before it became ready"))
+					})
+				})
+			})
+			Describe("getting a container's state", func() {
+				var (
+					rtime *recordingRuntime
+					state prot.ContainerState
+				)
+				BeforeEach(func() {
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					coreint = NewGCSCore(rtime, mockos.NewOS())
+				})
+				JustBeforeEach(func() {
+					state, err = coreint.GetContainerState(containerID)
+				})
+				Context("the container does not exist", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+				Context("the container has been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should report that it is created and its init process has not run", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(state).To(Equal(prot.ContainerState{Status: prot.CsCreated}))
+					})
+					Context("its init process has been started", func() {
+						BeforeEach(func() {
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should report that it is running", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(state).To(Equal(prot.ContainerState{Status: prot.CsRunning, HasRunInitProcess: true}))
+						})
+						Context("its init process has exited", func() {
+							BeforeEach(func() {
+								rtime.status = "stopped"
+							})
+							It("should report that it has exited", func() {
+								Expect(err).NotTo(HaveOccurred())
+								Expect(state).To(Equal(prot.ContainerState{Status: prot.CsExited, HasRunInitProcess: true}))
+							})
+						})
+					})
+				})
+				Context("the container has been created frozen", func() {
+					BeforeEach(func() {
+						createSettings.FreezeOnCreate = true
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should report that it is paused", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(state).To(Equal(prot.ContainerState{Status: prot.CsPaused, HasRunInitProcess: true}))
+					})
+					Context("the container has been resumed", func() {
+						BeforeEach(func() {
+							err = coreint.ResumeContainer(containerID)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should report that it is running", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(state).To(Equal(prot.ContainerState{Status: prot.CsRunning, HasRunInitProcess: true}))
+						})
+					})
+				})
+			})
+			Describe("getting a container's resources", func() {
+				var resources prot.ContainerResources
+				JustBeforeEach(func() {
+					resources, err = coreint.GetContainerResources(containerID)
+				})
+				Context("the container does not exist", func() {
+					It("should produce a ContainerDoesNotExistError", func() {
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerDoesNotExistError("")))
+					})
+				})
+				Context("the container has been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should return the resources it was created with", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(resources).To(Equal(prot.ContainerResources{
+							MappedVirtualDisks: createSettings.MappedVirtualDisks,
+							NetworkAdapters:    createSettings.NetworkAdapters,
+						}))
+					})
+					Context("resources have been added", func() {
+						BeforeEach(func() {
+							Expect(coreint.ModifySettings(containerID, diskModificationRequest)).To(Succeed())
+							Expect(coreint.ModifySettings(containerID, dirModificationRequest)).To(Succeed())
+						})
+						It("should return the added resources", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(resources.MappedVirtualDisks).To(Equal([]prot.MappedVirtualDisk{
+								createSettings.MappedVirtualDisks[0],
+								mappedVirtualDisk,
+							}))
+							Expect(resources.MappedDirectories).To(Equal([]prot.MappedDirectory{mappedDirectory}))
+						})
+						Context("and then removed", func() {
+							BeforeEach(func() {
+								Expect(coreint.ModifySettings(containerID, diskModificationRequestRemove)).To(Succeed())
+								Expect(coreint.ModifySettings(containerID, dirModificationRequestRemove)).To(Succeed())
+							})
+							It("should no longer return them", func() {
+								Expect(err).NotTo(HaveOccurred())
+								Expect(resources.MappedVirtualDisks).To(Equal(createSettings.MappedVirtualDisks))
+								Expect(resources.MappedDirectories).To(BeEmpty())
+							})
+						})
+					})
+				})
+			})
+			Describe("listing the mapped virtual disks of all containers", func() {
+				var (
+					statuses      []prot.MappedVirtualDiskStatus
+					otherSettings prot.VMHostedContainerSettings
+				)
+				BeforeEach(func() {
+					otherSettings = createSettings
+					otherSettings.MappedVirtualDisks = []prot.MappedVirtualDisk{
+						{ContainerPath: "/other/disk", Lun: 5, CreateInUtilityVM: true, ReadOnly: true},
+						{ContainerPath: "/attached/disk", Lun: 7, AttachOnly: true},
+					}
+				})
+				JustBeforeEach(func() {
+					statuses, err = coreint.ListMappedVirtualDisks()
+				})
+				Context("there are no containers", func() {
+					It("should return no disks", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(statuses).To(BeEmpty())
+					})
+				})
+				Context("two containers have disks", func() {
+					BeforeEach(func() {
+						Expect(coreint.CreateContainer(containerID, createSettings)).To(Succeed())
+						Expect(coreint.CreateContainer("def", otherSettings)).To(Succeed())
+						coreint.OS = &notMountedOS{OS: coreint.OS, path: "/other/disk"}
+					})
+					It("should return every disk with its container and mount state", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(statuses).To(Equal([]prot.MappedVirtualDiskStatus{
+							{MappedVirtualDisk: createSettings.MappedVirtualDisks[0], ContainerID: containerID, Mounted: true},
+							{MappedVirtualDisk: otherSettings.MappedVirtualDisks[0], ContainerID: "def", Mounted: false},
+							{MappedVirtualDisk: otherSettings.MappedVirtualDisks[1], ContainerID: "def", Mounted: false},
+						}))
+					})
+					Context("a disk has been removed", func() {
+						BeforeEach(func() {
+							Expect(coreint.ModifySettings(containerID, prot.ResourceModificationRequestResponse{
+								ResourceType: prot.PtMappedVirtualDisk,
+								RequestType:  prot.RtRemove,
+								Settings:     prot.ResourceModificationSettings{MappedVirtualDisk: &createSettings.MappedVirtualDisks[0]},
+							})).To(Succeed())
+						})
+						It("should no longer return it", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(statuses).To(HaveLen(2))
+							for _, status := range statuses {
+								Expect(status.ContainerID).To(Equal("def"))
+							}
+						})
+					})
+				})
+			})
+			Describe("updating a container's resource limits", func() {
+				var (
+					fos     *fileRecordingOS
+					limits  *prot.ResourceLimits
+					request prot.ResourceModificationRequestResponse
+				)
+				BeforeEach(func() {
+					fos = &fileRecordingOS{OS: mockos.NewOS(), files: make(map[string]*bytes.Buffer)}
+					limits = &prot.ResourceLimits{
+						MemoryLimitInBytes: 512 << 20,
+						CPUQuotaInUs:       25000,
+						CPUPeriodInUs:      100000,
+						PidsLimit:          -1,
+					}
+					request = prot.ResourceModificationRequestResponse{
+						ResourceType: prot.PtResourceLimits,
+						RequestType:  prot.RtUpdate,
+						Settings:     prot.ResourceModificationSettings{ResourceLimits: limits},
+					}
+				})
+				JustBeforeEach(func() {
+					coreint = NewGCSCore(mockruntime.NewRuntime(), fos)
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("the container's init process has not been created", func() {
+					It("should produce an error", func() {
+						Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+					})
+				})
+				Context("the container's init process is running", func() {
+					JustBeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should write the limits to the container's v1 cgroups", func() {
+						Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+						Expect(fos.files[filepath.Join("/sys/fs/cgroup/memory", containerID, "memory.limit_in_bytes")].String()).To(Equal("536870912"))
+						Expect(fos.files[filepath.Join("/sys/fs/cgroup/cpu", containerID, "cpu.cfs_quota_us")].String()).To(Equal("25000"))
+						Expect(fos.files[filepath.Join("/sys/fs/cgroup/cpu", containerID, "cpu.cfs_period_us")].String()).To(Equal("100000"))
+						Expect(fos.files[filepath.Join("/sys/fs/cgroup/pids", containerID, "pids.max")].String()).To(Equal("max"))
+					})
+					It("should reject an invalid limit", func() {
+						limits.PidsLimit = -2
+						Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+					})
+					Context("the utility VM uses cgroup v2", func() {
+						BeforeEach(func() {
+							fos.OS = &statfsOS{OS: mockos.NewOS(), stat: syscall.Statfs_t{Type: cgroup2SuperMagic}}
+						})
+						It("should write the limits to the container's unified cgroup", func() {
+							Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+							cgroupPath := filepath.Join("/sys/fs/cgroup", containerID)
+							Expect(fos.files[filepath.Join(cgroupPath, "memory.max")].String()).To(Equal("536870912"))
+							Expect(fos.files[filepath.Join(cgroupPath, "cpu.max")].String()).To(Equal("25000 100000"))
+							Expect(fos.files[filepath.Join(cgroupPath, "pids.max")].String()).To(Equal("max"))
+						})
+					})
+				})
+			})
+			Describe("updating a mapped virtual disk", func() {
+				var (
+					mos     *mountRecordingOS
+					sos     *scriptedOS
+					disk    prot.MappedVirtualDisk
+					request prot.ResourceModificationRequestResponse
+				)
+				BeforeEach(func() {
+					mos = &mountRecordingOS{OS: mockos.NewOS()}
+					sos = &scriptedOS{OS: mos, exitCodes: make(map[string]int), outputs: make(map[string]string)}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), sos)
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					mos.targets, mos.flags = nil, nil
+					disk = createSettings.MappedVirtualDisks[0]
+					disk.ReadOnly = true
+					request = prot.ResourceModificationRequestResponse{
+						ResourceType: prot.PtMappedVirtualDisk,
+						RequestType:  prot.RtUpdate,
+						Settings:     prot.ResourceModificationSettings{MappedVirtualDisk: &disk},
+					}
+				})
+				getDisks := func() []prot.MappedVirtualDisk {
+					resources, err := coreint.GetContainerResources(containerID)
+					Expect(err).NotTo(HaveOccurred())
+					return resources.MappedVirtualDisks
+				}
+				It("should remount the disk read-only and then writable in place", func() {
+					Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+					Expect(mos.targets).To(Equal([]string{disk.ContainerPath}))
+					Expect(mos.flags).To(Equal([]uintptr{syscall.MS_REMOUNT | syscall.MS_RDONLY}))
+					Expect(getDisks()).To(Equal([]prot.MappedVirtualDisk{disk}))
+
+					disk.ReadOnly = false
+					Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+					Expect(mos.targets).To(Equal([]string{disk.ContainerPath, disk.ContainerPath}))
+					Expect(mos.flags[1]).To(Equal(uintptr(syscall.MS_REMOUNT)))
+					Expect(sos.commands).To(HaveLen(1))
+					Expect(sos.commands[0][:2]).To(Equal([]string{"dumpe2fs", "-h"}))
+					Expect(getDisks()).To(Equal([]prot.MappedVirtualDisk{disk}))
+				})
+				It("should not make a disk whose journal needs recovery writable", func() {
+					Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+					sos.outputs["dumpe2fs"] = "Filesystem features:      has_journal ext_attr needs_recovery extent\n"
+					disk.ReadOnly = false
+					Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+					Expect(mos.targets).To(HaveLen(1))
+					Expect(getDisks()[0].ReadOnly).To(BeTrue())
+				})
+				It("should reject an update which changes anything else", func() {
+					disk.ContainerPath = "/another/path"
+					Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+					Expect(mos.targets).To(BeEmpty())
+					Expect(getDisks()[0].ReadOnly).To(BeFalse())
+				})
+				It("should do nothing for an update which changes nothing", func() {
+					disk.ReadOnly = false
+					Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+					Expect(mos.targets).To(BeEmpty())
+					Expect(sos.commands).To(BeEmpty())
+				})
+				It("should grow the filesystem when asked to resize the disk", func() {
+					sos.outputs["blkid"] = "ext4"
+					disk.ReadOnly = false
+					disk.Resize = true
+					Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+					Expect(mos.targets).To(BeEmpty())
+					Expect(sos.commands).To(HaveLen(2))
+					Expect(sos.commands[0][0]).To(Equal("blkid"))
+					Expect(sos.commands[1][0]).To(Equal("resize2fs"))
+					disk.Resize = false
+					Expect(getDisks()).To(Equal([]prot.MappedVirtualDisk{disk}))
+				})
+				It("should reject resizing a disk which is being made read-only", func() {
+					disk.Resize = true
+					Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+					Expect(mos.targets).To(BeEmpty())
+					Expect(sos.commands).To(BeEmpty())
+					Expect(getDisks()[0].ReadOnly).To(BeFalse())
+				})
+				It("should reject resizing a disk as it is added", func() {
+					added := prot.MappedVirtualDisk{ContainerPath: "/mnt/added", Lun: 9, Resize: true}
+					Expect(coreint.ModifySettings(containerID, prot.ResourceModificationRequestResponse{
+						ResourceType: prot.PtMappedVirtualDisk,
+						RequestType:  prot.RtAdd,
+						Settings:     prot.ResourceModificationSettings{MappedVirtualDisk: &added},
+					})).NotTo(Succeed())
+					Expect(mos.targets).To(BeEmpty())
+					Expect(getDisks()).To(HaveLen(1))
+				})
+			})
+			Describe("updating a container's DNS configuration", func() {
+				var (
+					fos     *fileRecordingOS
+					dns     *prot.DNSSettings
+					request prot.ResourceModificationRequestResponse
+				)
+				var resolvPath string
+				baseResolvPath := filepath.Join(baseFilesPath, "etc/resolv.conf")
+				BeforeEach(func() {
+					fos = &fileRecordingOS{OS: mockos.NewOS(), files: make(map[string]*bytes.Buffer)}
+					dns = &prot.DNSSettings{
+						Servers:       []string{"10.0.0.2", "fd00::53"},
+						SearchDomains: []string{"corp.example.com", "example.com"},
+					}
+					request = prot.ResourceModificationRequestResponse{
+						ResourceType: prot.PtDNS,
+						RequestType:  prot.RtUpdate,
+						Settings:     prot.ResourceModificationSettings{DNSSettings: dns},
+					}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), fos)
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					resolvPath = coreint.getResolvConfPath(containerID)
+				})
+				Context("the init process has been created", func() {
+					BeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should bind mount the container's own resolv.conf", func() {
+						spec, err := coreint.GetContainerSpec(containerID, false)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(spec.Mounts).To(ContainElement(oci.Mount{
+							Destination: "/etc/resolv.conf",
+							Type:        "bind",
+							Source:      resolvPath,
+							Options:     []string{"bind"},
+						}))
+						// The container's network adapters were configured
+						// through its own file rather than the base layer's.
+						Expect(fos.files[resolvPath].String()).To(HavePrefix("nameserver"))
+						Expect(fos.files).NotTo(HaveKey(baseResolvPath))
+					})
+					It("should rewrite the container's own resolv.conf", func() {
+						Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+						Expect(fos.files[resolvPath].String()).To(Equal("nameserver 10.0.0.2\nnameserver fd00::53\nsearch corp.example.com example.com\n"))
+						Expect(fos.flags[resolvPath] & os.O_TRUNC).NotTo(BeZero())
+						Expect(fos.files).NotTo(HaveKey(baseResolvPath))
+					})
+					It("should reject an invalid server", func() {
+						dns.Servers = []string{"dns.example.com"}
+						Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+						Expect(fos.files[resolvPath].String()).NotTo(ContainSubstring("dns.example.com"))
+					})
+					It("should reject too many servers", func() {
+						dns.Servers = []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}
+						Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+					})
+				})
+				Context("the container's network adapter doesn't use NAT", func() {
+					BeforeEach(func() {
+						fos.OS = &secretsOS{OS: mockos.NewOS(), dir: "/etc", files: map[string]string{"/etc/resolv.conf": "nameserver 10.1.1.1\n"}}
+						containerID = "nonat"
+						settings := createSettings
+						settings.NetworkAdapters = []prot.NetworkAdapter{createSettings.NetworkAdapters[0]}
+						settings.NetworkAdapters[0].NatEnabled = false
+						Expect(coreint.CreateContainer(containerID, settings)).To(Succeed())
+						resolvPath = coreint.getResolvConfPath(containerID)
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should copy the utility VM's resolv.conf rather than link it", func() {
+						Expect(fos.files[resolvPath].String()).To(Equal("nameserver 10.1.1.1\n"))
+						Expect(coreint.ModifySettings(containerID, request)).To(Succeed())
+						Expect(fos.files).NotTo(HaveKey(baseResolvPath))
+					})
+				})
+				Context("the init process has not been created", func() {
+					It("should produce an error", func() {
+						Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+						Expect(fos.files).NotTo(HaveKey(resolvPath))
+						Expect(fos.files).NotTo(HaveKey(baseResolvPath))
+					})
+				})
+				Context("the container's spec bind mounts its own resolv.conf", func() {
+					BeforeEach(func() {
+						initialExecParams.OCISpecification.Mounts = []oci.Mount{
+							{Destination: "/etc/resolv.conf", Type: "bind", Source: "/run/dns/resolv.conf", Options: []string{"rbind", "ro"}},
+						}
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not add a mount of the container's own resolv.conf", func() {
+						spec, err := coreint.GetContainerSpec(containerID, false)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(spec.Mounts).To(HaveLen(1))
+					})
+					It("should produce an error without writing either file", func() {
+						Expect(coreint.ModifySettings(containerID, request)).NotTo(Succeed())
+						Expect(fos.files).NotTo(HaveKey("/run/dns/resolv.conf"))
+						Expect(fos.files[resolvPath].String()).NotTo(ContainSubstring("10.0.0.2"))
+					})
+				})
+			})
+			Describe("starting a container explicitly", func() {
+				BeforeEach(func() {
+					coreint.ImplicitStart = false
+					initProcess := initialExecParams
+					createSettings.InitProcess = &initProcess
+				})
+				JustBeforeEach(func() {
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("the container is started", func() {
+					JustBeforeEach(func() {
+						err = coreint.StartContainer(containerID)
+					})
+					It("should run the init process", func() {
+						Expect(err).NotTo(HaveOccurred())
+						state, err := coreint.GetContainerState(containerID)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(state.HasRunInitProcess).To(BeTrue())
+						Expect(coreint.processCache).To(HaveLen(1))
+					})
+					It("should allow processes to be executed", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not allow it to be started again", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(coreint.StartContainer(containerID)).NotTo(Succeed())
+					})
+					It("should not allow stdio to be attached twice", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(coreint.AttachContainerStdio(containerID, &stdio.ConnectionSet{})).To(Succeed())
+						Expect(coreint.AttachContainerStdio(containerID, &stdio.ConnectionSet{})).NotTo(Succeed())
+					})
+					Context("the container was created without an init process", func() {
+						BeforeEach(func() {
+							createSettings.InitProcess = nil
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("the container is started with deferred stdio attach", func() {
+					var (
+						rtime *recordingRuntime
+						out   *recordingConnection
+					)
+					BeforeEach(func() {
+						rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+						coreint = NewGCSCore(rtime, mockos.NewOS())
+						coreint.ImplicitStart = false
+						out = &recordingConnection{Connection: mockos.NewMockReadWriteCloser()}
+					})
+					JustBeforeEach(func() {
+						Expect(coreint.StartContainer(containerID)).To(Succeed())
+						Expect(rtime.stdioSets).To(HaveLen(1))
+					})
+					It("should flush output written before the attach", func() {
+						_, err := rtime.stdioSets[0].Out.Write([]byte("early "))
+						Expect(err).NotTo(HaveOccurred())
+						err = coreint.AttachContainerStdio(containerID, &stdio.ConnectionSet{Out: out})
+						Expect(err).NotTo(HaveOccurred())
+						Expect(out.String()).To(Equal("early "))
+						_, err = rtime.stdioSets[0].Out.Write([]byte("late"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(out.String()).To(Equal("early late"))
+					})
+					It("should keep only the most recent output", func() {
+						early := strings.Repeat("a", deferredStdioBufferSize) + "end"
+						_, err := rtime.stdioSets[0].Out.Write([]byte(early))
+						Expect(err).NotTo(HaveOccurred())
+						err = coreint.AttachContainerStdio(containerID, &stdio.ConnectionSet{Out: out})
+						Expect(err).NotTo(HaveOccurred())
+						Expect(out.String()).To(HaveLen(deferredStdioBufferSize))
+						Expect(out.String()).To(HaveSuffix("aend"))
+					})
+					It("should relay output the process wrote to its pipe before and after the attach", func() {
+						f, err := rtime.stdioSets[0].Out.File()
+						Expect(err).NotTo(HaveOccurred())
+						// The runtime closes the connection once the process has
+						// its end of the pipe.
+						Expect(rtime.stdioSets[0].Out.Close()).To(Succeed())
+						_, err = f.Write([]byte("early "))
+						Expect(err).NotTo(HaveOccurred())
+						// The early output may or may not have been relayed into
+						// the buffer yet, but must arrive first either way.
+						err = coreint.AttachContainerStdio(containerID, &stdio.ConnectionSet{Out: out})
+						Expect(err).NotTo(HaveOccurred())
+						_, err = f.Write([]byte("late"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(f.Close()).To(Succeed())
+						Eventually(out.isClosed).Should(BeTrue())
+						Expect(out.String()).To(Equal("early late"))
+					})
+				})
+				Context("a process is executed before the container is started", func() {
+					JustBeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+					})
+					It("should produce an error without starting the container", func() {
+						Expect(err).To(HaveOccurred())
+						state, err := coreint.GetContainerState(containerID)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(state.HasRunInitProcess).To(BeFalse())
+					})
+				})
+				Context("implicit start is enabled for compatibility", func() {
+					BeforeEach(func() {
+						coreint.ImplicitStart = true
+					})
+					JustBeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					})
+					It("should start the container with the first process as its init process", func() {
+						Expect(err).NotTo(HaveOccurred())
+						state, err := coreint.GetContainerState(containerID)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(state.HasRunInitProcess).To(BeTrue())
+					})
+				})
+			})
+			Describe("labeling a container's logs", func() {
+				var (
+					recorder *logRecorder
+					oldHooks logrus.LevelHooks
+					labels   map[string]string
+					exited   chan struct{}
+					// Other tests' containers may still be logging their
+					// exits, so this container's ID is distinct from theirs.
+					labeledID string
+				)
+				BeforeEach(func() {
+					labeledID = "labeled-" + containerID
+					recorder = &logRecorder{}
+					oldHooks = logrus.StandardLogger().Hooks
+					logrus.StandardLogger().Hooks = make(logrus.LevelHooks)
+					logrus.AddHook(recorder)
+
+					labels = map[string]string{"namespace": "prod", "pod": "web-1"}
+					createSettings.Labels = labels
+					err = coreint.CreateContainer(labeledID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					_, err = coreint.ExecProcess(labeledID, initialExecParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+					exited = make(chan struct{})
+					err = coreint.RegisterContainerExitHook(labeledID, func(oslayer.ProcessExitState) {
+						close(exited)
+					})
+					Expect(err).NotTo(HaveOccurred())
+				})
+				AfterEach(func() {
+					logrus.StandardLogger().Hooks = oldHooks
+				})
+				JustBeforeEach(func() {
+					err = coreint.SignalContainer(labeledID, oslayer.SIGKILL)
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(exited).Should(BeClosed())
+				})
+				expectLabeled := func(text string) {
+					entries := recorder.find(text)
+					Expect(entries).NotTo(BeEmpty())
+					for _, entry := range entries {
+						for k, v := range labels {
+							Expect(entry.Data).To(HaveKeyWithValue(k, v))
+						}
+					}
+				}
+				It("should include the labels in the signal's logs", func() {
+					expectLabeled("sending signal 9 to container " + labeledID)
+				})
+				It("should include the labels in the init process's exit logs", func() {
+					expectLabeled("of container " + labeledID + " exited")
+				})
+			})
+			Describe("getting a container's scratch usage", func() {
+				var (
+					sos   *statfsOS
+					usage prot.ScratchUsage
+				)
+				BeforeEach(func() {
+					sos = &statfsOS{
+						OS:   mockos.NewOS(),
+						stat: syscall.Statfs_t{Bsize: 4096, Blocks: 1000, Bfree: 250},
+					}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), sos)
+				})
+				JustBeforeEach(func() {
+					usage, err = coreint.GetScratchUsage(containerID)
+				})
+				Context("the container does not exist", func() {
+					It("should produce a ContainerDoesNotExistError", func() {
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerDoesNotExistError("")))
+					})
+				})
+				Context("the container has been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should report the usage of the upper directory's filesystem", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(sos.paths).To(Equal([]string{"/tmp/gcs/" + containerID + "/scratch/upper"}))
+						Expect(usage).To(Equal(prot.ScratchUsage{UsedBytes: 750 * 4096, TotalBytes: 1000 * 4096}))
+					})
+					Context("the container's overlay is not mounted", func() {
+						BeforeEach(func() {
+							coreint.OS = &notMountedOS{OS: sos, path: "/tmp/gcs/" + containerID + "/rootfs"}
+						})
+						It("should produce a ContainerNotReadyError", func() {
+							Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerNotReadyError("", "")))
+							Expect(gcserr.IsTransient(err)).To(BeTrue())
+							Expect(sos.paths).To(BeEmpty())
+						})
+					})
+				})
+			})
+			Describe("sampling a container's resource usage", func() {
+				var (
+					uos     *usageOS
+					history []prot.UsageSample
+				)
+				BeforeEach(func() {
+					uos = &usageOS{OS: mockos.NewOS()}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), uos)
+					coreint.UsageSamples = 3
+					createSettings.UsageSampleIntervalInMs = 100
+				})
+				getHistory := func() []prot.UsageSample {
+					history, err = coreint.GetContainerUsageHistory(containerID)
+					Expect(err).NotTo(HaveOccurred())
+					return history
+				}
+				Context("the container's init process has not been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not record any samples", func() {
+						Consistently(getHistory, "300ms").Should(BeEmpty())
+						Expect(uos.reads()).To(Equal(0))
+					})
+				})
+				Context("the container's init process is running", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should accumulate samples and roll over the oldest", func() {
+						Eventually(getHistory, "2s").Should(HaveLen(3))
+						Eventually(func() uint64 { return getHistory()[0].CPUUsageInNs }, "2s").Should(BeNumerically(">", 1000))
+						Expect(history).To(HaveLen(3))
+						for i := 1; i < len(history); i++ {
+							Expect(history[i].CPUUsageInNs).To(Equal(history[i-1].CPUUsageInNs + 1000))
+							Expect(history[i].TimestampInMs).To(BeNumerically(">=", history[i-1].TimestampInMs))
+						}
+						Expect(history[0].MemoryUsageInBytes).To(Equal(uint64(4096)))
+					})
+					Context("the utility VM uses cgroup v2", func() {
+						BeforeEach(func() {
+							uos = &usageOS{OS: &statfsOS{OS: mockos.NewOS(), stat: syscall.Statfs_t{Type: cgroup2SuperMagic}}}
+							coreint = NewGCSCore(mockruntime.NewRuntime(), uos)
+							coreint.UsageSamples = 3
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should read the usage from the unified files", func() {
+							Eventually(getHistory, "2s").ShouldNot(BeEmpty())
+							Expect(history[0].CPUUsageInNs).To(BeNumerically(">=", 1000))
+							Expect(history[0].CPUUsageInNs % 1000).To(BeZero())
+							Expect(history[0].MemoryUsageInBytes).To(Equal(uint64(4096)))
+						})
+					})
+				})
+				Context("the container's init process exits", func() {
+					BeforeEach(func() {
+						coreint = NewGCSCore(&exitingRuntime{Runtime: mockruntime.NewRuntime()}, uos)
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should stop sampling", func() {
+						Eventually(func() error {
+							_, err := coreint.GetContainerUsageHistory(containerID)
+							return err
+						}).Should(HaveOccurred())
+						reads := uos.reads()
+						Consistently(uos.reads, "300ms").Should(Equal(reads))
+					})
+				})
+				Context("the sample interval is too short", func() {
+					BeforeEach(func() {
+						createSettings.UsageSampleIntervalInMs = 10
+						err = coreint.CreateContainer(containerID, createSettings)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(coreint.containerCache).NotTo(HaveKey(containerID))
+					})
+				})
+				Context("sampling was not requested", func() {
+					BeforeEach(func() {
+						createSettings.UsageSampleIntervalInMs = 0
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.GetContainerUsageHistory(containerID)
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("calling ExecProcess", func() {
+				var (
+					params prot.ProcessParameters
+				)
+				JustBeforeEach(func() {
+					_, err = coreint.ExecProcess(containerID, params, fullStdioSet)
+				})
+				Context("it is the initial process", func() {
+					BeforeEach(func() {
+						params = initialExecParams
+					})
+					Context("the container has already been created", func() {
+						BeforeEach(func() {
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should not produce an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+					})
+					Context("the container's init process exits as soon as it is started", func() {
+						var (
+							rtime *exitingRuntime
+						)
+						BeforeEach(func() {
+							rtime = &exitingRuntime{Runtime: mockruntime.NewRuntime()}
+							coreint = NewGCSCore(rtime, mockos.NewOS())
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						removed := func() bool {
+							coreint.containerCacheMutex.RLock()
+							defer coreint.containerCacheMutex.RUnlock()
+							_, ok := coreint.containerCache[containerID]
+							return !ok
+						}
+						It("should clean up the container once after Start returns", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Eventually(removed).Should(BeTrue())
+							rtime.container.mutex.Lock()
+							defer rtime.container.mutex.Unlock()
+							Expect(rtime.container.deletes).To(Equal(1))
+							Expect(rtime.container.deletedBeforeStarted).To(BeFalse())
+						})
+						Context("waiting on the init process fails", func() {
+							BeforeEach(func() {
+								rtime.waitErr = errors.New("wait failed")
+							})
+							It("should clean up the container once after Start returns", func() {
+								Expect(err).NotTo(HaveOccurred())
+								Eventually(removed).Should(BeTrue())
+								rtime.container.mutex.Lock()
+								defer rtime.container.mutex.Unlock()
+								Expect(rtime.container.deletes).To(Equal(1))
+								Expect(rtime.container.deletedBeforeStarted).To(BeFalse())
+							})
+						})
+					})
+					Context("the container hangs while starting", func() {
+						var (
+							release           chan struct{}
+							lockedDuringStart chan struct{}
+						)
+						BeforeEach(func() {
+							// The start goroutine may outlive the spec, so it
+							// must only use values local to this spec.
+							rel := make(chan struct{})
+							locked := make(chan struct{})
+							rtime := &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+							core := NewGCSCore(rtime, mockos.NewOS())
+							rtime.onStart = func() error {
+								// Other operations must be able to take the
+								// cache lock while the start is pending.
+								core.containerCacheMutex.Lock()
+								core.containerCacheMutex.Unlock()
+								close(locked)
+								<-rel
+								return nil
+							}
+							release, lockedDuringStart, coreint = rel, locked, core
+							coreint.StartTimeout = time.Millisecond * 50
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						AfterEach(func() {
+							close(release)
+						})
+						It("should produce a timeout error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(err.Error()).To(ContainSubstring("did not start within"))
+						})
+						It("should not hold the cache lock while waiting", func() {
+							Expect(lockedDuringStart).To(BeClosed())
+						})
+					})
+					Context("the container has not already been created", func() {
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("it is not the initial process", func() {
+					BeforeEach(func() {
+						params = nonInitialExecParams
+					})
+					Context("the container has already been created", func() {
+						BeforeEach(func() {
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						Context("the container already has an initial process in it", func() {
+							BeforeEach(func() {
+								_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+								Expect(err).NotTo(HaveOccurred())
+							})
+							It("should not produce an error", func() {
+								Expect(err).NotTo(HaveOccurred())
+							})
+						})
+						Context("the container does not already have an initial process in it", func() {
+							It("should produce an error", func() {
+								// TODO: Find a way to produce an error in this
+								// context, possibly.
+								//Expect(err).To(HaveOccurred())
+							})
+						})
+					})
+					Context("the container has a container-level environment", func() {
+						var (
+							rtime *recordingRuntime
+						)
+						BeforeEach(func() {
+							rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+							coreint = NewGCSCore(rtime, mockos.NewOS())
+							createSettings.ContainerEnvironment = map[string]string{
+								"APP_HOME": "/app",
+								"MODE":     "container",
+							}
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+							params.Environment = map[string]string{"MODE": "process"}
+						})
+						It("should merge it into the process's environment", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtime.execs).To(HaveLen(1))
+							Expect(rtime.execs[0].Env).To(ConsistOf("APP_HOME=/app", "MODE=process", "TERM=xterm"))
+						})
+					})
+					Context("the process's OCI spec is supplied", func() {
+						var (
+							rtime    *recordingRuntime
+							supplied oci.Process
+						)
+						BeforeEach(func() {
+							rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+							coreint = NewGCSCore(rtime, mockos.NewOS())
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+							supplied = oci.Process{
+								Args:            []string{"/bin/sh", "-c", "id"},
+								Env:             []string{"PATH=/bin"},
+								Cwd:             "/",
+								User:            oci.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{4}},
+								NoNewPrivileges: true,
+							}
+							params = prot.ProcessParameters{OCIProcess: &supplied}
+						})
+						It("should execute the supplied spec unchanged", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(rtime.execs).To(Equal([]oci.Process{supplied}))
+						})
+					})
+					Context("the container has reached its concurrent exec limit", func() {
+						BeforeEach(func() {
+							createSettings.MaxConcurrentExecs = 2
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+							_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+							Expect(err).NotTo(HaveOccurred())
+							for i := 0; i < 2; i++ {
+								_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+								Expect(err).NotTo(HaveOccurred())
+							}
+						})
+						It("should produce a too many processes error", func() {
+							Expect(errors.Cause(err)).To(Equal(gcserr.NewTooManyProcessesError(containerID, 2)))
+						})
+					})
+					Context("the container has not already been created", func() {
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+			})
+			Describe("executing a process with a result", func() {
+				var (
+					params prot.ProcessParameters
+					result core.ExecResult
+				)
+				BeforeEach(func() {
+					coreint = NewGCSCore(&recordingRuntime{Runtime: mockruntime.NewRuntime(), consoles: true}, mockos.NewOS())
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+					params = nonInitialExecParams
+				})
+				JustBeforeEach(func() {
+					result, err = coreint.ExecProcessWithResult(containerID, params, &stdio.ConnectionSet{})
+				})
+				Context("a console is requested", func() {
+					BeforeEach(func() {
+						params.EmulateConsole = true
+					})
+					It("should report the allocated console", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(result).To(Equal(core.ExecResult{Pid: 101, ConsoleAllocated: true, ConsoleOpen: true}))
+					})
+				})
+				Context("a console is not requested", func() {
+					BeforeEach(func() {
+						params.EmulateConsole = false
+					})
+					It("should report that no console was allocated", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(result).To(Equal(core.ExecResult{Pid: 101}))
+					})
+				})
+				Context("the container does not exist", func() {
+					BeforeEach(func() {
+						params = nonInitialExecParams
+						containerID = "nonexistent"
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(result.Pid).To(Equal(-1))
+					})
+				})
+			})
+			Describe("redirecting stdio to files", func() {
+				var (
+					fos   *fileRecordingOS
+					rtime *recordingRuntime
+				)
+				BeforeEach(func() {
+					fos = &fileRecordingOS{OS: mockos.NewOS(), files: make(map[string]*bytes.Buffer)}
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					coreint = NewGCSCore(rtime, fos)
+					createSettings.MappedDirectories = []prot.MappedDirectory{
+						{ContainerPath: "/data", CreateInUtilityVM: true, Port: 1},
+						{ContainerPath: "/config", CreateInUtilityVM: true, ReadOnly: true, Port: 2},
+					}
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("the init process's stdout is redirected", func() {
+					JustBeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					})
+					BeforeEach(func() {
+						initialExecParams.StdOutPath = "/data/job/out.log"
+					})
+					It("should write the process's output to the file", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.stdioSets).To(HaveLen(1))
+						_, err = rtime.stdioSets[0].Out.Write([]byte("hello\n"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fos.files["/data/job/out.log"].String()).To(Equal("hello\n"))
+						Expect(fos.flags["/data/job/out.log"] & os.O_TRUNC).NotTo(BeZero())
+						Expect(fos.flags["/data/job/out.log"] & syscall.O_NOFOLLOW).NotTo(BeZero())
+					})
+					Context("a directory in the path is a symlink", func() {
+						BeforeEach(func() {
+							fos.OS = &stagingOS{OS: mockos.NewOS(), modes: map[string]os.FileMode{"/data/job": os.ModeSymlink}}
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(fos.files).NotTo(HaveKey("/data/job/out.log"))
+						})
+					})
+					It("should relay stderr to the host", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.stdioSets[0].Err).To(Equal(fullStdioSet.Err))
+					})
+					Context("the path is in a read-only mapped directory", func() {
+						BeforeEach(func() {
+							initialExecParams.StdOutPath = "/config/out.log"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(fos.files).NotTo(HaveKey("/config/out.log"))
+						})
+					})
+					Context("the path is not in a mapped directory", func() {
+						BeforeEach(func() {
+							initialExecParams.StdOutPath = "/var/log/out.log"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("the path escapes the mapped directory", func() {
+						BeforeEach(func() {
+							initialExecParams.StdOutPath = "/data/../var/log/out.log"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("the mode is invalid", func() {
+						BeforeEach(func() {
+							initialExecParams.StdOutMode = "overwrite"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("the process has a terminal", func() {
+						BeforeEach(func() {
+							initialExecParams.OCISpecification.Process.Terminal = true
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("a process's stderr is appended to a file", func() {
+					BeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						nonInitialExecParams.EmulateConsole = false
+						nonInitialExecParams.StdErrPath = "/data/err.log"
+						nonInitialExecParams.StdErrMode = prot.SfmAppend
+					})
+					It("should append the process's errors to the file", func() {
+						_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.stdioSets).To(HaveLen(2))
+						_, err = rtime.stdioSets[1].Err.Write([]byte("failed\n"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fos.files["/data/err.log"].String()).To(Equal("failed\n"))
+						Expect(fos.flags["/data/err.log"] & os.O_APPEND).NotTo(BeZero())
+					})
+				})
+			})
+			Describe("retrieving a container's history", func() {
+				eventTypes := func(events []prot.ContainerEvent) []prot.ContainerEventType {
+					var types []prot.ContainerEventType
+					for _, event := range events {
+						types = append(types, event.Type)
+					}
+					return types
+				}
+				removed := func() bool {
+					_, err := coreint.GetContainerState(containerID)
+					return err != nil
+				}
+				Context("the container has never existed", func() {
+					It("should produce a ContainerDoesNotExistError", func() {
+						_, err = coreint.GetContainerHistory(containerID)
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerDoesNotExistError("")))
+					})
+				})
+				Context("the container has exited", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					JustBeforeEach(func() {
+						Expect(coreint.SignalContainer(containerID, oslayer.SIGKILL)).To(Succeed())
+						Eventually(removed).Should(BeTrue())
+					})
+					It("should return the container's events after it is removed", func() {
+						events, err := coreint.GetContainerHistory(containerID)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(eventTypes(events)).To(Equal([]prot.ContainerEventType{prot.CeCreated, prot.CeStarted, prot.CeSignaled, prot.CeExited}))
+						Expect(events[2].Details).To(Equal(fmt.Sprintf("signal %d", oslayer.SIGKILL)))
+						Expect(events[3].Details).To(Equal("exit code 123"))
+						for i := 1; i < len(events); i++ {
+							Expect(events[i].TimestampInMs).To(BeNumerically(">=", events[i-1].TimestampInMs))
+						}
+					})
+					Context("a container with the same ID is created", func() {
+						JustBeforeEach(func() {
+							Expect(coreint.CreateContainer(containerID, createSettings)).To(Succeed())
+						})
+						It("should start a new history", func() {
+							events, err := coreint.GetContainerHistory(containerID)
+							Expect(err).NotTo(HaveOccurred())
+							Expect(eventTypes(events)).To(Equal([]prot.ContainerEventType{prot.CeCreated}))
+						})
+					})
+					Context("no removed containers' histories are kept", func() {
+						BeforeEach(func() {
+							coreint.HistorySize = 0
+						})
+						It("should evict the history", func() {
+							_, err = coreint.GetContainerHistory(containerID)
+							Expect(err).To(HaveOccurred())
+						})
+					})
+					Context("the history has outlived the maximum age", func() {
+						BeforeEach(func() {
+							coreint.HistoryMaxAge = 50 * time.Millisecond
+						})
+						It("should evict the history", func() {
+							_, err = coreint.GetContainerHistory(containerID)
+							Expect(err).NotTo(HaveOccurred())
+							Eventually(func() error {
+								_, err := coreint.GetContainerHistory(containerID)
+								return err
+							}).Should(HaveOccurred())
+						})
+					})
+				})
+			})
+			Describe("calling SignalContainer", func() {
+				Context("using a signal which Windows numbers differently", func() {
+					var (
+						rtime *recordingRuntime
+					)
+					BeforeEach(func() {
+						rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+						coreint = NewGCSCore(rtime, mockos.NewOS())
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						err = coreint.SignalContainer(containerID, oslayer.Signal(syscall.SIGTTIN))
+					})
+					It("should send the signal unchanged", func() {
+						Expect(err).NotTo(HaveOccurred())
+						// The container's cleanup may kill it again once it
+						// has exited, so only the first signal is checked.
+						kills, _ := rtime.killed()
+						Expect(kills).NotTo(BeEmpty())
+						Expect(kills[0]).To(Equal(oslayer.Signal(syscall.SIGTTIN)))
+					})
+				})
+				Context("using signal SIGKILL", func() {
+					JustBeforeEach(func() {
+						err = coreint.SignalContainer(containerID, oslayer.SIGKILL)
+					})
+					Context("the container has already been created", func() {
+						BeforeEach(func() {
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should not produce an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+					})
+					Context("the container has not already been created", func() {
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+				Context("using signal SIGTERM", func() {
+					JustBeforeEach(func() {
+						err = coreint.SignalContainer(containerID, oslayer.SIGTERM)
+					})
+					Context("the container has already been created", func() {
+						BeforeEach(func() {
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should not produce an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+					})
+					Context("the container has not already been created", func() {
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+			})
+			Describe("calling StopContainer", func() {
+				var (
+					rtime         *recordingRuntime
+					remainingPids []int
+				)
+				BeforeEach(func() {
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					coreint = NewGCSCore(rtime, mockos.NewOS())
+				})
+				JustBeforeEach(func() {
+					remainingPids, err = coreint.StopContainer(containerID, 100*time.Millisecond)
+				})
+				Context("the container exits when signaled", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not report remaining processes", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(remainingPids).To(BeEmpty())
+					})
+					It("should stop the container with SIGTERM", func() {
+						// The container's cleanup kills it again once it has
+						// exited, so only the first signal is checked.
+						kills, _ := rtime.killed()
+						Expect(kills).NotTo(BeEmpty())
+						Expect(kills[0]).To(Equal(oslayer.SIGTERM))
+					})
+				})
+				Context("the container's processes ignore the signal", func() {
+					BeforeEach(func() {
+						rtime.dropKills = true
+						rtime.processes = []runtime.ContainerProcessState{
+							{Pid: 123, Command: []string{"sh"}, CreatedByRuntime: true},
+							{Pid: 124, Command: []string{"sleep"}},
+							{Pid: 125, Command: []string{"defunct"}, IsZombie: true},
+						}
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					AfterEach(func() {
+						// Let the init process exit, now that the test is done.
+						rtime.dropKills = false
+						Expect(coreint.SignalContainer(containerID, oslayer.SIGKILL)).To(Succeed())
+					})
+					It("should report the processes which are still running", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(remainingPids).To(Equal([]int{123, 124}))
+					})
+					It("should stop the container with SIGTERM", func() {
+						kills, _ := rtime.killed()
+						Expect(kills).To(Equal([]oslayer.Signal{oslayer.SIGTERM}))
+					})
+				})
+				Context("the container has a stop signal", func() {
+					BeforeEach(func() {
+						// Drop the signal, so that the container isn't
+						// cleaned up while its signals are inspected.
+						rtime.dropKills = true
+						createSettings.StopSignal = "SIGQUIT"
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					AfterEach(func() {
+						rtime.dropKills = false
+						Expect(coreint.SignalContainer(containerID, oslayer.SIGKILL)).To(Succeed())
+					})
+					It("should stop the container with its stop signal", func() {
+						Expect(err).NotTo(HaveOccurred())
+						kills, _ := rtime.killed()
+						Expect(kills).To(Equal([]oslayer.Signal{oslayer.Signal(syscall.SIGQUIT)}))
+					})
+				})
+				Context("the stop signal is invalid", func() {
+					BeforeEach(func() {
+						createSettings.StopSignal = "SIGBOGUS"
+					})
+					It("should fail to create the container", func() {
+						Expect(coreint.CreateContainer(containerID, createSettings)).NotTo(Succeed())
+					})
+				})
+				Context("the container has not been started", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not report remaining processes", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(remainingPids).To(BeEmpty())
+					})
+				})
+				Context("the container has not already been created", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("calling SignalAllContainers", func() {
+				var (
+					rtime *recordingRuntime
+				)
+				BeforeEach(func() {
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime(), dropKills: true}
+					coreint = NewGCSCore(rtime, mockos.NewOS())
+					for i := 0; i < 3; i++ {
+						id := fmt.Sprintf("%s-%d", containerID, i)
+						err = coreint.CreateContainer(id, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(id, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					}
+				})
+				JustBeforeEach(func() {
+					err = coreint.SignalAllContainers(oslayer.SIGTERM)
+				})
+				It("should signal every container", func() {
+					Expect(err).NotTo(HaveOccurred())
+					kills, killedIDs := rtime.killed()
+					Expect(killedIDs).To(ConsistOf(containerID+"-0", containerID+"-1", containerID+"-2"))
+					Expect(kills).To(Equal([]oslayer.Signal{oslayer.SIGTERM, oslayer.SIGTERM, oslayer.SIGTERM}))
+				})
+				Context("a container has not been started", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should only signal the started containers", func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, killedIDs := rtime.killed()
+						Expect(killedIDs).To(HaveLen(3))
+						Expect(killedIDs).NotTo(ContainElement(containerID))
+					})
+				})
+			})
+			Describe("calling Shutdown", func() {
+				var (
+					uos      *unmountRecordingOS
+					stubborn *recordingRuntime
+				)
+				BeforeEach(func() {
+					uos = &unmountRecordingOS{OS: mockos.NewOS()}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), uos)
+					// Containers created with the stubborn runtime don't exit
+					// when signaled.
+					stubborn = &recordingRuntime{Runtime: mockruntime.NewRuntime(), dropKills: true}
+					Expect(coreint.RegisterRuntime("stubborn", stubborn)).To(Succeed())
+					for i := 0; i < 2; i++ {
+						id := fmt.Sprintf("%s-%d", containerID, i)
+						err = coreint.CreateContainer(id, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(id, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					}
+				})
+				JustBeforeEach(func() {
+					err = coreint.Shutdown(100 * time.Millisecond)
+				})
+				Context("every container exits when signaled", func() {
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should remove the containers", func() {
+						_, err = coreint.GetContainerState(containerID + "-0")
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerDoesNotExistError("")))
+						_, err = coreint.GetContainerState(containerID + "-1")
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerDoesNotExistError("")))
+					})
+					It("should unmount the containers' storage", func() {
+						Expect(uos.unmounted()).To(ContainElement("/tmp/gcs/" + containerID + "-0/rootfs"))
+						Expect(uos.unmounted()).To(ContainElement("/tmp/gcs/" + containerID + "-1/rootfs"))
+					})
+				})
+				Context("a container has not been started", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should clean it up", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(uos.unmounted()).To(ContainElement("/tmp/gcs/" + containerID + "/rootfs"))
+						_, err = coreint.GetContainerState(containerID)
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerDoesNotExistError("")))
+					})
+				})
+				Context("a container doesn't exit when signaled", func() {
+					BeforeEach(func() {
+						createSettings.RuntimeName = "stubborn"
+						createSettings.StopSignal = "SIGINT"
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					AfterEach(func() {
+						stubborn.dropKills = false
+						Expect(coreint.SignalContainer(containerID, oslayer.SIGKILL)).To(Succeed())
+					})
+					It("should report the container which didn't stop", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewShutdownTimeoutError(nil, 0)))
+						Expect(err.Error()).To(ContainSubstring(containerID))
+						Expect(err.Error()).NotTo(ContainSubstring(containerID + "-0"))
+					})
+					It("should stop it with its stop signal, and then kill it", func() {
+						kills, _ := stubborn.killed()
+						Expect(kills).To(Equal([]oslayer.Signal{oslayer.Signal(syscall.SIGINT), oslayer.SIGKILL}))
+					})
+					It("should still stop the other containers", func() {
+						_, err = coreint.GetContainerState(containerID + "-0")
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewContainerDoesNotExistError("")))
+					})
+				})
+			})
+			Describe("calling SignalProcess", func() {
+				var (
+					sigkillOptions prot.SignalProcessOptions
+				)
+				BeforeEach(func() {
+					sigkillOptions = prot.SignalProcessOptions{Signal: int32(syscall.SIGKILL)}
+				})
+				JustBeforeEach(func() {
+					err = coreint.SignalProcess(processID, sigkillOptions)
+				})
+				Context("the process has already been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+				Context("the signal is sent by a Linux host", func() {
+					var (
+						kos *killRecordingOS
+					)
+					BeforeEach(func() {
+						kos = &killRecordingOS{OS: mockos.NewOS()}
+						coreint = NewGCSCore(mockruntime.NewRuntime(), kos)
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						sigkillOptions = prot.SignalProcessOptions{Signal: int32(syscall.SIGTTIN)}
+					})
+					It("should send the signal unchanged", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(kos.signals).To(Equal([]syscall.Signal{syscall.SIGTTIN}))
+					})
+				})
+				Context("the signal is sent by a Windows host", func() {
+					var (
+						kos *killRecordingOS
+					)
+					BeforeEach(func() {
+						kos = &killRecordingOS{OS: mockos.NewOS()}
+						coreint = NewGCSCore(mockruntime.NewRuntime(), kos)
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					Context("the signal is 0", func() {
+						BeforeEach(func() {
+							sigkillOptions = prot.SignalProcessOptions{Signal: 0}
+						})
+						It("should send SIGKILL", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(kos.signals).To(Equal([]syscall.Signal{syscall.SIGKILL}))
+						})
+					})
+					Context("the signal is SIGBREAK", func() {
+						BeforeEach(func() {
+							sigkillOptions = prot.SignalProcessOptions{Signal: 21, WindowsHost: true}
+						})
+						It("should send SIGQUIT", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(kos.signals).To(Equal([]syscall.Signal{syscall.SIGQUIT}))
+						})
+					})
+					Context("the signal is SIGABRT", func() {
+						BeforeEach(func() {
+							sigkillOptions = prot.SignalProcessOptions{Signal: 22, WindowsHost: true}
+						})
+						It("should send SIGABRT", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(kos.signals).To(Equal([]syscall.Signal{syscall.SIGABRT}))
+						})
+					})
+				})
+				Context("the external process has already been created", func() {
+					BeforeEach(func() {
+						_, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+				})
+				Context("the process has not already been created", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("calling ResizeConsole", func() {
+				var (
+					pid int
+				)
+				BeforeEach(func() {
+					coreint = NewGCSCore(&recordingRuntime{Runtime: mockruntime.NewRuntime(), consoles: true}, mockos.NewOS())
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("the process does not exist", func() {
+					It("should produce a ProcessDoesNotExistError", func() {
+						err = coreint.ResizeConsole(12345, 24, 80)
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessDoesNotExistError(0)))
+					})
+				})
+				Context("the process has no console", func() {
+					BeforeEach(func() {
+						params := nonInitialExecParams
+						params.EmulateConsole = false
+						pid, err = coreint.ExecProcess(containerID, params, &stdio.ConnectionSet{})
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should produce a NotATty error", func() {
+						err = coreint.ResizeConsole(pid, 24, 80)
+						code, ok := gcserr.Code(err)
+						Expect(ok).To(BeTrue())
+						Expect(code).To(Equal(gcserr.CodeNotATty))
+					})
+				})
+				Context("the process's console has been closed", func() {
+					BeforeEach(func() {
+						params := nonInitialExecParams
+						params.EmulateConsole = true
+						pid, err = coreint.ExecProcess(containerID, params, &stdio.ConnectionSet{})
+						Expect(err).NotTo(HaveOccurred())
+						coreint.processCacheMutex.Lock()
+						relay := coreint.processCache[pid].Tty
+						coreint.processCacheMutex.Unlock()
+						Expect(relay).NotTo(BeNil())
+						// The relay finishes once the process exits.
+						relay.Wait()
+					})
+					It("should produce a ProcessDoesNotExistError", func() {
+						err = coreint.ResizeConsole(pid, 24, 80)
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessDoesNotExistError(0)))
+					})
+				})
+			})
+			Describe("calling SetProcessRlimit", func() {
+				var (
+					pos    *prlimitRecordingOS
+					rlimit oci.LinuxRlimit
+				)
+				BeforeEach(func() {
+					pos = &prlimitRecordingOS{OS: mockos.NewOS()}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), pos)
+					rlimit = oci.LinuxRlimit{Type: "RLIMIT_NOFILE", Hard: 65536, Soft: 4096}
+				})
+				JustBeforeEach(func() {
+					err = coreint.SetProcessRlimit(processID, rlimit)
+				})
+				Context("the process has already been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should set the limit through prlimit", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(pos.resources).To(Equal([]int{syscall.RLIMIT_NOFILE}))
+						Expect(pos.limits).To(Equal([]syscall.Rlimit{{Cur: 4096, Max: 65536}}))
+					})
+					Context("the process cache is checked during the call to prlimit", func() {
+						var cacheLocked bool
+						BeforeEach(func() {
+							pos.during = func() {
+								cacheLocked = !coreint.processCacheMutex.TryLock()
+								if !cacheLocked {
+									coreint.processCacheMutex.Unlock()
+								}
+							}
+						})
+						It("should not be locked", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(cacheLocked).To(BeFalse())
+						})
+					})
+					Context("the soft limit exceeds the hard limit", func() {
+						BeforeEach(func() {
+							rlimit.Soft = 65537
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(pos.limits).To(BeEmpty())
+						})
+					})
+					Context("the rlimit type is unknown", func() {
+						BeforeEach(func() {
+							rlimit.Type = "RLIMIT_BOGUS"
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(pos.limits).To(BeEmpty())
+						})
+					})
+				})
+				Context("the process has not already been created", func() {
+					It("should produce a ProcessDoesNotExistError", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessDoesNotExistError(0)))
+						Expect(pos.limits).To(BeEmpty())
+					})
+				})
+			})
+			Describe("calling Health", func() {
+				var (
+					health prot.GcsHealth
+				)
+				JustBeforeEach(func() {
+					health = coreint.Health()
+				})
+				It("should report the GCS's version", func() {
+					Expect(health.Version).To(Equal(Version))
+				})
+				It("should report no containers or processes", func() {
+					Expect(health.ContainerCount).To(BeZero())
+					Expect(health.ProcessCount).To(BeZero())
+				})
+				Context("the GCS has been running for a while", func() {
+					BeforeEach(func() {
+						coreint.startTime = time.Now().Add(-time.Minute)
+					})
+					It("should report its uptime", func() {
+						Expect(health.UptimeInMs).To(BeNumerically(">=", 60000))
+					})
+				})
+				Context("a container and an external process are running", func() {
+					var (
+						eos *externalProcessOS
+					)
+					BeforeEach(func() {
+						eos = newExternalProcessOS()
+						coreint = NewGCSCore(mockruntime.NewRuntime(), eos)
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						externalParams.EmulateConsole = false
+						_, err = coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
+						Expect(err).NotTo(HaveOccurred())
+					})
+					AfterEach(func() {
+						eos.exitAll()
+					})
+					It("should count them", func() {
+						Expect(health.ContainerCount).To(Equal(uint32(1)))
+						Expect(health.ProcessCount).To(Equal(uint32(2)))
+					})
+				})
+			})
+			Describe("calling ListProcesses", func() {
+				var (
+					processes []runtime.ContainerProcessState
+					reconcile bool
+				)
+				BeforeEach(func() {
+					reconcile = false
+				})
+				JustBeforeEach(func() {
+					processes, err = coreint.ListProcesses(containerID, reconcile)
+				})
+				Context("the container has already been created", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+					It("should not report any processes", func() {
+						Expect(processes).To(BeEmpty())
+					})
+				})
+				Context("a process exits while the container's processes are enumerated", func() {
+					var (
+						rtime *recordingRuntime
+					)
+					BeforeEach(func() {
+						rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+						coreint = NewGCSCore(rtime, mockos.NewOS())
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						// The mock runtime reports a single process with pid
+						// 123. Record its exit partway through enumeration.
+						rtime.onGetAllProcesses = func() {
+							coreint.processCacheMutex.Lock()
+							entry := newProcessCacheEntry(containerID)
+							entry.ExitStatus = mockos.NewProcessExitState(7)
+							coreint.processCache[123] = entry
+							coreint.processCacheMutex.Unlock()
+						}
+					})
+					Context("reconciliation is not requested", func() {
+						It("should not mark the process as exited", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(processes).To(HaveLen(1))
+							Expect(processes[0].Exited).To(BeFalse())
+						})
+					})
+					Context("reconciliation is requested", func() {
+						BeforeEach(func() {
+							reconcile = true
+						})
+						It("should mark the process as exited", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(processes).To(HaveLen(1))
+							Expect(processes[0].Pid).To(Equal(123))
+							Expect(processes[0].Exited).To(BeTrue())
+							Expect(processes[0].ExitCode).To(Equal(7))
+						})
+					})
+				})
+				Context("the container has not already been created", func() {
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("calling RunExternalProcess", func() {
+				JustBeforeEach(func() {
+					_, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+				})
+				It("should not produce an error", func() {
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("an idle timeout is given", func() {
+					BeforeEach(func() {
+						externalParams.IdleTimeoutInMs = 1000
+					})
+					It("should not produce an error", func() {
+						Expect(err).NotTo(HaveOccurred())
+					})
+					Context("without an emulated console", func() {
+						BeforeEach(func() {
+							externalParams.EmulateConsole = false
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+					})
+				})
+			})
+			Describe("killing idle external processes", func() {
+				var (
+					kos    *killRecordingOS
+					relay  *idleRelay
+					exited chan struct{}
+				)
+				BeforeEach(func() {
+					kos = &killRecordingOS{OS: mockos.NewOS()}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), kos)
+					relay = &idleRelay{}
+					relay.touch()
+					exited = make(chan struct{})
+				})
+				Context("the relay goes idle", func() {
+					It("should kill the process after the timeout", func() {
+						start := time.Now()
+						coreint.killWhenIdle(1000, relay, 100*time.Millisecond, exited)
+						Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+						Expect(kos.signals).To(Equal([]syscall.Signal{syscall.SIGKILL}))
+					})
+				})
+				Context("the relay stays active", func() {
+					It("should not kill the process", func() {
+						done := make(chan struct{})
+						go func() {
+							defer close(done)
+							coreint.killWhenIdle(1000, relay, 100*time.Millisecond, exited)
+						}()
+						for i := 0; i < 10; i++ {
+							time.Sleep(30 * time.Millisecond)
+							relay.touch()
+						}
+						close(exited)
+						Eventually(done).Should(BeClosed())
+						Expect(kos.signals).To(BeEmpty())
+					})
+				})
+				Context("the process exits first", func() {
+					It("should not kill the process", func() {
+						close(exited)
+						coreint.killWhenIdle(1000, relay, time.Hour, exited)
+						Expect(kos.signals).To(BeEmpty())
+					})
+				})
+			})
+			Describe("inspecting a process's environment and command line", func() {
+				var (
+					fos  *procOS
+					args []string
+				)
+				BeforeEach(func() {
+					fos = &procOS{OS: mockos.NewOS(), files: map[string]string{
+						"/proc/101/environ": "PATH=/usr/bin\x00DB_PASSWORD=hunter2\x00GITHUB_TOKEN=abc=def\x00EMPTY=\x00",
+						"/proc/101/cmdline": "/bin/server\x00--listen=:80\x00--api-key=xyz\x00secret\x00",
+						"/proc/102/environ": "",
+					}}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), fos)
+				})
+				It("should parse the environment, redacting secrets", func() {
+					args, err = coreint.GetProcessEnviron(101)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(args).To(Equal([]string{
+						"PATH=/usr/bin",
+						"DB_PASSWORD=" + redactedValue,
+						"GITHUB_TOKEN=" + redactedValue,
+						"EMPTY=",
+					}))
+				})
+				It("should parse the command line, redacting secrets", func() {
+					args, err = coreint.GetProcessCmdline(101)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(args).To(Equal([]string{"/bin/server", "--listen=:80", "--api-key=" + redactedValue, "secret"}))
+				})
+				It("should parse an empty environment", func() {
+					args, err = coreint.GetProcessEnviron(102)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(args).To(BeEmpty())
+				})
+				It("should redact with a configured pattern", func() {
+					coreint.SecretKeys = regexp.MustCompile("^PATH$")
+					args, err = coreint.GetProcessEnviron(101)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(args[0]).To(Equal("PATH=" + redactedValue))
+					Expect(args[1]).To(Equal("DB_PASSWORD=hunter2"))
+				})
+				It("should produce a ProcessDoesNotExistError for a process which is gone", func() {
+					_, err = coreint.GetProcessEnviron(103)
+					Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessDoesNotExistError(0)))
+					_, err = coreint.GetProcessCmdline(103)
+					Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessDoesNotExistError(0)))
+				})
+			})
+			Describe("forwarding output to the journal", func() {
+				var (
+					rtime   *recordingRuntime
+					journal *recordingJournal
+				)
+				BeforeEach(func() {
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					journal = &recordingJournal{}
+					coreint = NewGCSCore(rtime, mockos.NewOS())
+					coreint.Journal = journal
+					createSettings.LoggingDriver = prot.LdJournald
+				})
+				JustBeforeEach(func() {
+					err = coreint.CreateContainer(containerID, createSettings)
+				})
+				Context("processes are executed", func() {
+					JustBeforeEach(func() {
+						Expect(err).NotTo(HaveOccurred())
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						nonInitialExecParams.EmulateConsole = false
+						_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.stdioSets).To(HaveLen(2))
+					})
+					It("should write each line of stdout and stderr to the journal tagged with the container's ID", func() {
+						out := rtime.stdioSets[0].Out
+						Expect(out).NotTo(Equal(fullStdioSet.Out))
+						_, err = out.Write([]byte("hello\nwor"))
+						Expect(err).NotTo(HaveOccurred())
+						_, err = out.Write([]byte("ld\n"))
+						Expect(err).NotTo(HaveOccurred())
+						_, err = rtime.stdioSets[1].Err.Write([]byte("oops"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.stdioSets[1].Err.Close()).To(Succeed())
+
+						entries := journal.sent()
+						Expect(entries).To(HaveLen(3))
+						Expect(entries[0].message).To(Equal("hello"))
+						Expect(entries[1].message).To(Equal("world"))
+						for _, entry := range entries[:2] {
+							Expect(entry.priority).To(Equal(journalPriorityInfo))
+							Expect(entry.fields).To(HaveKeyWithValue("CONTAINER_STREAM", "stdout"))
+						}
+						Expect(entries[2].message).To(Equal("oops"))
+						Expect(entries[2].priority).To(Equal(journalPriorityErr))
+						Expect(entries[2].fields).To(HaveKeyWithValue("CONTAINER_STREAM", "stderr"))
+						for _, entry := range entries {
+							Expect(entry.fields).To(HaveKeyWithValue("CONTAINER_ID", containerID))
+							Expect(entry.fields).To(HaveKeyWithValue("SYSLOG_IDENTIFIER", containerID))
+						}
+					})
+					It("should write the output of a process given a pipe once it closes the pipe", func() {
+						f, err := rtime.stdioSets[0].Out.File()
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.stdioSets[0].Out.Close()).To(Succeed())
+						_, err = f.Write([]byte("piped\nlast"))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(f.Close()).To(Succeed())
+						Eventually(journal.sent).Should(HaveLen(2))
+						Expect(journal.sent()[0].message).To(Equal("piped"))
+						Expect(journal.sent()[1].message).To(Equal("last"))
+					})
+				})
+				Context("the logging driver is invalid", func() {
+					BeforeEach(func() {
+						createSettings.LoggingDriver = "syslog"
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("auditing executed processes", func() {
+				var (
+					auditor *recordingAuditor
+					pid     int
+				)
+				BeforeEach(func() {
+					auditor = &recordingAuditor{}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), mockos.NewOS())
+					coreint.ExecAuditor = auditor
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("a process is executed", func() {
+					JustBeforeEach(func() {
+						pid, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+					})
+					It("should audit the init process and the executed process", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(auditor.execs).To(HaveLen(2))
+						Expect(auditor.execs[0].ContainerID).To(Equal(containerID))
+						Expect(auditor.execs[0].Args).To(Equal([]string{"/bin/sh"}))
+						exec := auditor.execs[1]
+						Expect(exec.ContainerID).To(Equal(containerID))
+						Expect(exec.Args).To(Equal([]string{"cat", "file"}))
+						Expect(exec.UID).To(BeZero())
+						Expect(exec.Pid).To(Equal(pid))
+						Expect(exec.Error).To(BeEmpty())
+						Expect(exec.Time).NotTo(BeZero())
+					})
+					It("should audit the processes' exits", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(auditor.exited()).To(BeEmpty())
+						Expect(coreint.SignalContainer(containerID, oslayer.SIGKILL)).To(Succeed())
+						Eventually(auditor.exited).Should(HaveLen(2))
+						for _, exit := range auditor.exited() {
+							Expect(exit.ContainerID).To(Equal(containerID))
+							Expect(exit.ExitCode).To(Equal(123))
+						}
+					})
+					Context("the process is denied", func() {
+						BeforeEach(func() {
+							coreint.ExecAuthorizer = &commandAuthorizer{blocked: "cat"}
+						})
+						It("should audit the failure", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(auditor.execs).To(HaveLen(2))
+							Expect(auditor.execs[1].Args).To(Equal([]string{"cat", "file"}))
+							Expect(auditor.execs[1].Pid).To(Equal(-1))
+							Expect(auditor.execs[1].Error).To(Equal(err.Error()))
+						})
+					})
+					Context("the process has a umask", func() {
+						BeforeEach(func() {
+							nonInitialExecParams.Umask = "0077"
+						})
+						It("should audit the command rather than the shell which applies the umask", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(auditor.execs[1].Args).To(Equal([]string{"cat", "file"}))
+						})
+					})
+				})
+				Context("an external process with a umask is run", func() {
+					BeforeEach(func() {
+						externalParams.EmulateConsole = false
+						externalParams.Umask = "0077"
+						_, err = coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
+					})
+					It("should audit the command rather than the shell which applies the umask", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(auditor.execs[1].Args).To(Equal([]string{"cat", "file"}))
+					})
+				})
+			})
+			Describe("setting a process's OOM score adjustment", func() {
+				var (
+					fos   *fileRecordingOS
+					score int
+				)
+				const scorePath = "/proc/101/oom_score_adj"
+				BeforeEach(func() {
+					fos = &fileRecordingOS{OS: mockos.NewOS(), files: make(map[string]*bytes.Buffer)}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), fos)
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					score = 500
+				})
+				Context("for the init process", func() {
+					JustBeforeEach(func() {
+						initialExecParams.OomScoreAdj = &score
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					})
+					It("should write the score once the process has started", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fos.files[scorePath].String()).To(Equal("500"))
+					})
+					Context("the score can't be written", func() {
+						BeforeEach(func() {
+							fos.OS = &failingOpenOS{OS: mockos.NewOS(), dir: "/proc"}
+						})
+						It("should produce an error and clean up the container", func() {
+							Expect(err).To(HaveOccurred())
+							Eventually(func() error {
+								return coreint.WaitContainerReady(containerID, time.Minute)
+							}).Should(MatchError(ContainSubstring("does not exist")))
+						})
+					})
+				})
+				Context("for an exec'd process", func() {
+					JustBeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fos.files).NotTo(HaveKey(scorePath))
+						nonInitialExecParams.OomScoreAdj = &score
+						_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+					})
+					Context("the score is the minimum", func() {
+						BeforeEach(func() {
+							score = -1000
+						})
+						It("should write the score once the process has started", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(fos.files[scorePath].String()).To(Equal("-1000"))
+						})
+					})
+					Context("the score is out of range", func() {
+						BeforeEach(func() {
+							score = 1001
+						})
+						It("should produce an error without starting the process", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(fos.files).NotTo(HaveKey(scorePath))
+						})
+					})
+				})
+				Context("for an external process", func() {
+					JustBeforeEach(func() {
+						externalParams.EmulateConsole = false
+						externalParams.OomScoreAdj = &score
+						_, err = coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
+					})
+					It("should write the score once the process has started", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(fos.files[scorePath].String()).To(Equal("500"))
+					})
+					Context("the score can't be written", func() {
+						var pid int
+						BeforeEach(func() {
+							coreint.MaxExitStates = 1
+							externalParams.EmulateConsole = false
+							pid, err = coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
+							Expect(err).NotTo(HaveOccurred())
+							Eventually(func() int {
+								coreint.processCacheMutex.Lock()
+								defer coreint.processCacheMutex.Unlock()
+								return coreint.exitStates.Len()
+							}).Should(Equal(1))
+							fos.OS = &failingOpenOS{OS: mockos.NewOS(), dir: "/proc"}
+						})
+						It("should not evict the exit state of an earlier process", func() {
+							Expect(err).To(HaveOccurred())
+							Consistently(func() error {
+								return coreint.RegisterProcessExitHook(pid, func(oslayer.ProcessExitState) {})
+							}, "300ms").Should(Succeed())
+						})
+					})
+					Context("the score is out of range", func() {
+						BeforeEach(func() {
+							score = -1001
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(fos.files).NotTo(HaveKey(scorePath))
+						})
+					})
+				})
+			})
+			Describe("setting a process's scheduling policy", func() {
+				var sos *schedRecordingOS
+				BeforeEach(func() {
+					sos = &schedRecordingOS{OS: mockos.NewOS()}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), sos)
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("for the init process", func() {
+					JustBeforeEach(func() {
+						initialExecParams.SchedulingPolicy = "fifo"
+						initialExecParams.SchedulingPriority = 10
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					})
+					It("should apply the policy once the process has started", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(sos.pids).To(Equal([]int{101}))
+						Expect(sos.policies).To(Equal([]int{1}))
+						Expect(sos.priorities).To(Equal([]int{10}))
+					})
+				})
+				Context("for an exec'd process", func() {
+					JustBeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(sos.pids).To(BeEmpty())
+						_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+					})
+					Context("the policy is batch", func() {
+						BeforeEach(func() {
+							nonInitialExecParams.SchedulingPolicy = "batch"
+						})
+						It("should apply the policy once the process has started", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(sos.policies).To(Equal([]int{3}))
+							Expect(sos.priorities).To(Equal([]int{0}))
+						})
+					})
+					Context("the policy is unknown", func() {
+						BeforeEach(func() {
+							nonInitialExecParams.SchedulingPolicy = "deadline"
+						})
+						It("should produce an error without starting the process", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(sos.pids).To(BeEmpty())
+						})
+					})
+					Context("the real-time priority is out of range", func() {
+						BeforeEach(func() {
+							nonInitialExecParams.SchedulingPolicy = "rr"
+							nonInitialExecParams.SchedulingPriority = 100
+						})
+						It("should produce an error without starting the process", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(sos.pids).To(BeEmpty())
+						})
+					})
+					Context("a priority is given for a non-real-time policy", func() {
+						BeforeEach(func() {
+							nonInitialExecParams.SchedulingPolicy = "other"
+							nonInitialExecParams.SchedulingPriority = 5
+						})
+						It("should produce an error without starting the process", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(sos.pids).To(BeEmpty())
+						})
+					})
+					Context("no policy is given", func() {
+						It("should leave the inherited policy", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(sos.pids).To(BeEmpty())
+						})
+					})
+				})
+				Context("for an external process", func() {
+					JustBeforeEach(func() {
+						externalParams.EmulateConsole = false
+						externalParams.SchedulingPolicy = "idle"
+						_, err = coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
+					})
+					It("should apply the policy once the process has started", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(sos.policies).To(Equal([]int{5}))
+					})
+				})
+			})
+			Describe("setting a process's niceness", func() {
+				var nos *niceRecordingOS
+				BeforeEach(func() {
+					nos = &niceRecordingOS{OS: mockos.NewOS()}
+					coreint = NewGCSCore(mockruntime.NewRuntime(), nos)
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				Context("for the init process", func() {
+					JustBeforeEach(func() {
+						nice := 5
+						initialExecParams.Nice = &nice
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					})
+					It("should set the niceness once the process has started", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(nos.pids).To(Equal([]int{101}))
+						Expect(nos.nices).To(Equal([]int{5}))
+					})
+				})
+				Context("for an exec'd process", func() {
+					JustBeforeEach(func() {
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(nos.pids).To(BeEmpty())
+						_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+					})
+					Context("the niceness is in range", func() {
+						BeforeEach(func() {
+							nice := 19
+							nonInitialExecParams.Nice = &nice
+						})
+						It("should set the niceness once the process has started", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(nos.pids).To(HaveLen(1))
+							Expect(nos.nices).To(Equal([]int{19}))
+						})
+					})
+					Context("the niceness is negative", func() {
+						BeforeEach(func() {
+							nice := -20
+							nonInitialExecParams.Nice = &nice
+						})
+						It("should set the niceness", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(nos.nices).To(Equal([]int{-20}))
+						})
+					})
+					Context("the niceness is out of range", func() {
+						BeforeEach(func() {
+							nice := 20
+							nonInitialExecParams.Nice = &nice
+						})
+						It("should produce an error without starting the process", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(nos.pids).To(BeEmpty())
+						})
+					})
+					Context("no niceness is given", func() {
+						It("should leave the inherited niceness", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(nos.pids).To(BeEmpty())
+						})
+					})
+				})
+				Context("for an external process", func() {
+					JustBeforeEach(func() {
+						nice := 10
+						externalParams.EmulateConsole = false
+						externalParams.Nice = &nice
+						_, err = coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
+					})
+					It("should set the niceness once the process has started", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(nos.nices).To(Equal([]int{10}))
+					})
+				})
+			})
+			Describe("setting the terminal type and console size", func() {
+				var rtime *recordingRuntime
+				BeforeEach(func() {
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					coreint = NewGCSCore(rtime, mockos.NewOS())
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+				})
+				JustBeforeEach(func() {
+					_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
+				})
+				Context("a terminal type and console size are given", func() {
+					BeforeEach(func() {
+						nonInitialExecParams.Term = "xterm-256color"
+						nonInitialExecParams.ConsoleSize = &prot.ConsoleSize{Height: 40, Width: 120}
+					})
+					It("should set TERM and the console size of the process", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.execs).To(HaveLen(1))
+						Expect(rtime.execs[0].Env).To(ContainElement("TERM=xterm-256color"))
+						Expect(rtime.execs[0].ConsoleSize).To(Equal(oci.Box{Height: 40, Width: 120}))
+					})
+				})
+				Context("neither is given", func() {
+					It("should default TERM and leave the console size unset", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.execs[0].Env).To(ContainElement("TERM=" + defaultTerm))
+						Expect(rtime.execs[0].ConsoleSize).To(Equal(oci.Box{}))
+					})
+				})
+				Context("the environment sets TERM", func() {
+					BeforeEach(func() {
+						nonInitialExecParams.Environment["TERM"] = "vt100"
 					})
-					Context("the container has already been created", func() {
+					It("should keep it", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.execs[0].Env).To(ContainElement("TERM=vt100"))
+						Expect(rtime.execs[0].Env).NotTo(ContainElement("TERM=" + defaultTerm))
+					})
+					Context("and a terminal type is given", func() {
 						BeforeEach(func() {
-							err = coreint.CreateContainer(containerID, createSettings)
-							Expect(err).NotTo(HaveOccurred())
+							nonInitialExecParams.Term = "screen"
 						})
-						It("should not produce an error", func() {
+						It("should override it", func() {
 							Expect(err).NotTo(HaveOccurred())
-						})
-					})
-					Context("the container has not already been created", func() {
-						It("should produce an error", func() {
-							Expect(err).To(HaveOccurred())
+							Expect(rtime.execs[0].Env).To(ContainElement("TERM=screen"))
+							Expect(rtime.execs[0].Env).NotTo(ContainElement("TERM=vt100"))
 						})
 					})
 				})
-				Context("using signal SIGTERM", func() {
-					JustBeforeEach(func() {
-						err = coreint.SignalContainer(containerID, oslayer.SIGTERM)
+				Context("the console size is empty", func() {
+					BeforeEach(func() {
+						nonInitialExecParams.ConsoleSize = &prot.ConsoleSize{Height: 40}
 					})
-					Context("the container has already been created", func() {
-						BeforeEach(func() {
-							err = coreint.CreateContainer(containerID, createSettings)
-							Expect(err).NotTo(HaveOccurred())
-						})
-						It("should not produce an error", func() {
-							Expect(err).NotTo(HaveOccurred())
-						})
+					It("should produce an error without starting the process", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(rtime.execs).To(BeEmpty())
 					})
-					Context("the container has not already been created", func() {
-						It("should produce an error", func() {
-							Expect(err).To(HaveOccurred())
-						})
+				})
+				Context("no console is emulated", func() {
+					BeforeEach(func() {
+						nonInitialExecParams.EmulateConsole = false
+						nonInitialExecParams.Term = "xterm"
+					})
+					It("should produce an error without starting the process", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(rtime.execs).To(BeEmpty())
 					})
 				})
 			})
-			Describe("calling SignalProcess", func() {
+			Describe("executing a process with mounts", func() {
 				var (
-					sigkillOptions prot.SignalProcessOptions
+					rtime       *recordingRuntime
+					mos         *mountRecordingOS
+					uos         *unmountRecordingOS
+					stagingPath string
 				)
 				BeforeEach(func() {
-					sigkillOptions = prot.SignalProcessOptions{Signal: int32(syscall.SIGKILL)}
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					mos = &mountRecordingOS{OS: mockos.NewOS()}
+					uos = &unmountRecordingOS{OS: mos}
+					coreint = NewGCSCore(rtime, uos)
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+					Expect(err).NotTo(HaveOccurred())
+					mos.targets, mos.data = nil, nil
+					_, _, _, rootfsPath := coreint.getUnioningPaths(containerID)
+					stagingPath = filepath.Join(rootfsPath, execMountsContainerPath, "1")
+					nonInitialExecParams.Mounts = []prot.ProcessMount{
+						{Source: "/tools", Destination: "/debug", ReadOnly: true},
+						{Source: "/data", Destination: "/mnt/data"},
+					}
 				})
 				JustBeforeEach(func() {
-					err = coreint.SignalProcess(processID, sigkillOptions)
+					_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
 				})
-				Context("the process has already been created", func() {
+				It("should run the process under execmount with the staged mounts", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(rtime.execs).To(HaveLen(1))
+					Expect(rtime.execs[0].Args).To(Equal([]string{
+						"/.execmounts/1/execmount",
+						"/.execmounts/1/0:/debug:ro",
+						"/.execmounts/1/1:/mnt/data",
+						"--",
+						"cat", "file",
+					}))
+				})
+				It("should bind mount the sources into the container's root filesystem", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(mos.targets).To(Equal([]string{
+						filepath.Join(stagingPath, "execmount"),
+						filepath.Join(stagingPath, "execmount"),
+						filepath.Join(stagingPath, "0"),
+						filepath.Join(stagingPath, "0"),
+						filepath.Join(stagingPath, "1"),
+					}))
+				})
+				It("should unstage the mounts once the process exits", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(uos.unmounted()).To(BeEmpty())
+					// The mock runtime's processes exit along with their
+					// container, whose storage is then unmounted too.
+					Expect(coreint.SignalContainer(containerID, oslayer.SIGKILL)).To(Succeed())
+					// The staged mounts are unmounted in order.
+					Eventually(uos.unmounted).Should(ContainElement(filepath.Join(stagingPath, "1")))
+					Expect(uos.unmounted()).To(ContainElement(filepath.Join(stagingPath, "execmount")))
+					Expect(uos.unmounted()).To(ContainElement(filepath.Join(stagingPath, "0")))
+				})
+				Context("the sources are a directory and a file", func() {
+					var (
+						sos *stagingOS
+					)
 					BeforeEach(func() {
-						err = coreint.CreateContainer(containerID, createSettings)
-						Expect(err).NotTo(HaveOccurred())
-						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						sos = &stagingOS{
+							OS:    uos,
+							modes: map[string]os.FileMode{"/tools": os.ModeDir, "/data": 0},
+							dirs:  make(map[string]os.FileMode),
+						}
+						coreint.OS = sos
+					})
+					It("should stage them on a directory and a file", func() {
 						Expect(err).NotTo(HaveOccurred())
+						Expect(sos.dirs).To(HaveKey(filepath.Join(stagingPath, "0")))
+						Expect(sos.created).To(ConsistOf(
+							filepath.Join(stagingPath, "execmount"),
+							filepath.Join(stagingPath, "1"),
+						))
 					})
-					It("should not produce an error", func() {
+					It("should only let root enter the staging directory", func() {
 						Expect(err).NotTo(HaveOccurred())
+						Expect(sos.dirs[stagingPath]).To(Equal(os.FileMode(0700)))
 					})
 				})
-				Context("the external process has already been created", func() {
+				Context("a source is a symbolic link", func() {
 					BeforeEach(func() {
-						_, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
-						Expect(err).NotTo(HaveOccurred())
+						coreint.OS = &stagingOS{
+							OS:    uos,
+							modes: map[string]os.FileMode{"/data": os.ModeSymlink},
+							dirs:  make(map[string]os.FileMode),
+						}
 					})
-					It("should not produce an error", func() {
+					It("should produce an error without starting the process", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(rtime.execs).To(BeEmpty())
+						Expect(mos.targets).To(BeEmpty())
+					})
+				})
+				Context("the process does not have CAP_SYS_ADMIN", func() {
+					It("should produce an error", func() {
 						Expect(err).NotTo(HaveOccurred())
+						containerEntry := coreint.lockContainer(containerID)
+						defer containerEntry.mutex.Unlock()
+						process := oci.Process{
+							Args:         []string{"cat", "file"},
+							Capabilities: &oci.LinuxCapabilities{Effective: []string{"CAP_KILL"}},
+						}
+						_, _, err := coreint.stageExecMounts(containerEntry, nonInitialExecParams.Mounts, process)
+						Expect(err).To(HaveOccurred())
 					})
 				})
-				Context("the process has not already been created", func() {
+				Context("a source does not exist", func() {
+					BeforeEach(func() {
+						coreint.OS = &missingPathOS{OS: uos, missing: "/data"}
+					})
+					It("should produce an error without starting the process", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(rtime.execs).To(BeEmpty())
+						Expect(mos.targets).To(BeEmpty())
+					})
+				})
+				Context("execmount is not installed", func() {
+					BeforeEach(func() {
+						coreint.OS = &missingPathOS{OS: uos, missing: defaultExecMountPath}
+					})
+					It("should produce an error without starting the process", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(rtime.execs).To(BeEmpty())
+					})
+				})
+				Context("a destination is not absolute", func() {
+					BeforeEach(func() {
+						nonInitialExecParams.Mounts[1].Destination = "data"
+					})
+					It("should produce an error without starting the process", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(rtime.execs).To(BeEmpty())
+					})
+				})
+				Context("the process fails to start", func() {
+					BeforeEach(func() {
+						// An emulated console's output can't be redirected.
+						nonInitialExecParams.StdOutPath = "/data/out.log"
+					})
+					It("should unstage the mounts", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(rtime.execs).To(BeEmpty())
+						Expect(uos.unmounted()).To(ConsistOf(
+							filepath.Join(stagingPath, "execmount"),
+							filepath.Join(stagingPath, "0"),
+							filepath.Join(stagingPath, "1"),
+						))
+					})
+				})
+				Context("the process is an external process", func() {
 					It("should produce an error", func() {
+						externalParams.Mounts = nonInitialExecParams.Mounts
+						_, err = coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
 						Expect(err).To(HaveOccurred())
 					})
 				})
 			})
-			Describe("calling ListProcesses", func() {
+			Describe("executing a process with a umask", func() {
 				var (
-					processes []runtime.ContainerProcessState
+					rtime *recordingRuntime
 				)
+				BeforeEach(func() {
+					rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+					coreint = NewGCSCore(rtime, mockos.NewOS())
+					err = coreint.CreateContainer(containerID, createSettings)
+					Expect(err).NotTo(HaveOccurred())
+					nonInitialExecParams.Umask = "0077"
+				})
 				JustBeforeEach(func() {
-					processes, err = coreint.ListProcesses(containerID)
+					_, err = coreint.ExecProcess(containerID, nonInitialExecParams, fullStdioSet)
 				})
-				Context("the container has already been created", func() {
+				Context("the container has been started", func() {
 					BeforeEach(func() {
-						err = coreint.CreateContainer(containerID, createSettings)
+						_, err = coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
 						Expect(err).NotTo(HaveOccurred())
 					})
-					It("should not produce an error", func() {
+					It("should run the process through the shell", func() {
 						Expect(err).NotTo(HaveOccurred())
+						Expect(rtime.execs).To(HaveLen(1))
+						Expect(rtime.execs[0].Args[0]).To(Equal("/bin/sh"))
+					})
+					Context("the container has no shell", func() {
+						BeforeEach(func() {
+							_, _, _, rootfsPath := coreint.getUnioningPaths(containerID)
+							coreint.OS = &missingPathOS{OS: coreint.OS, missing: filepath.Join(rootfsPath, "bin", "sh")}
+						})
+						It("should produce an error without starting the process", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(rtime.execs).To(BeEmpty())
+						})
 					})
 				})
-				Context("the container has not already been created", func() {
+				Context("the process is the container's init process", func() {
+					BeforeEach(func() {
+						nonInitialExecParams = initialExecParams
+						nonInitialExecParams.Umask = "0077"
+					})
+					It("should produce an error without starting the container", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(rtime.createdIDs).To(BeEmpty())
+					})
+				})
+				Context("the process is an external process in a chroot without a shell", func() {
 					It("should produce an error", func() {
+						externalParams.Umask = "0077"
+						externalParams.Chroot = "/tmp/gcs/rootfs"
+						coreint.OS = &missingPathOS{OS: coreint.OS, missing: "/tmp/gcs/rootfs/bin/sh"}
+						_, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
 						Expect(err).To(HaveOccurred())
 					})
 				})
 			})
-			Describe("calling RunExternalProcess", func() {
+			Describe("reaping external processes", func() {
 				var (
-					pid int
+					eos    *externalProcessOS
+					pids   []int
+					exited map[int]chan struct{}
+				)
+				BeforeEach(func() {
+					eos = newExternalProcessOS()
+					coreint = NewGCSCore(mockruntime.NewRuntime(), eos)
+					externalParams.EmulateConsole = false
+					pids = nil
+					exited = make(map[int]chan struct{})
+					for i := 0; i < 3; i++ {
+						pid, err := coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
+						Expect(err).NotTo(HaveOccurred())
+						done := make(chan struct{})
+						Expect(coreint.RegisterProcessExitHook(pid, func(oslayer.ProcessExitState) {
+							close(done)
+						})).To(Succeed())
+						pids = append(pids, pid)
+						exited[pid] = done
+					}
+				})
+				AfterEach(func() {
+					eos.exitAll()
+				})
+				exit := func(pid int) {
+					eos.exit(pid)
+					Eventually(exited[pid]).Should(BeClosed())
+				}
+				Context("calling ReapProcess", func() {
+					It("should remove an exited process", func() {
+						exit(pids[0])
+						Expect(coreint.ReapProcess(pids[0])).To(Succeed())
+						err = coreint.ReapProcess(pids[0])
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessDoesNotExistError(0)))
+						Expect(coreint.SignalProcess(pids[0], prot.SignalProcessOptions{Signal: int32(syscall.SIGKILL)})).NotTo(Succeed())
+					})
+					It("should produce an error for a running process", func() {
+						Expect(coreint.ReapProcess(pids[0])).NotTo(Succeed())
+						Expect(coreint.SignalProcess(pids[0], prot.SignalProcessOptions{Signal: int32(syscall.SIGKILL)})).To(Succeed())
+					})
+					It("should produce an error for a container process", func() {
+						Expect(coreint.CreateContainer(containerID, createSettings)).To(Succeed())
+						pid, err := coreint.ExecProcess(containerID, initialExecParams, fullStdioSet)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(coreint.ReapProcess(pid)).NotTo(Succeed())
+					})
+					It("should produce an error for an unknown process", func() {
+						err = coreint.ReapProcess(processID + 1)
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessDoesNotExistError(0)))
+					})
+				})
+				Context("more processes have exited than exit states are kept", func() {
+					wait := func(pid int) error {
+						return coreint.RegisterProcessExitHook(pid, func(oslayer.ProcessExitState) {})
+					}
+					BeforeEach(func() {
+						coreint.MaxExitStates = 2
+					})
+					It("should evict the least recently used exit states", func() {
+						exit(pids[0])
+						exit(pids[1])
+						// Waiting on the first process makes its exit state
+						// the most recently used.
+						Expect(wait(pids[0])).To(Succeed())
+
+						exit(pids[2])
+						err = wait(pids[1])
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessExitEvictedError(0)))
+						Expect(wait(pids[0])).To(Succeed())
+						Expect(wait(pids[2])).To(Succeed())
+					})
+					It("should never evict running processes", func() {
+						coreint.MaxExitStates = 1
+						exit(pids[0])
+						exit(pids[2])
+						err = wait(pids[0])
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessExitEvictedError(0)))
+						Expect(coreint.SignalProcess(pids[1], prot.SignalProcessOptions{Signal: int32(syscall.SIGKILL)})).To(Succeed())
+
+						exit(pids[1])
+						err = wait(pids[2])
+						Expect(errors.Cause(err)).To(BeAssignableToTypeOf(gcserr.NewProcessExitEvictedError(0)))
+						Expect(wait(pids[1])).To(Succeed())
+					})
+				})
+				Context("calling ReapExitedProcesses", func() {
+					It("should remove only the exited processes", func() {
+						exit(pids[0])
+						exit(pids[2])
+						Expect(coreint.ReapExitedProcesses()).To(Equal(2))
+						Expect(coreint.ReapExitedProcesses()).To(Equal(0))
+						Expect(coreint.SignalProcess(pids[1], prot.SignalProcessOptions{Signal: int32(syscall.SIGKILL)})).To(Succeed())
+
+						exit(pids[1])
+						Expect(coreint.ReapExitedProcesses()).To(Equal(1))
+					})
+				})
+			})
+			Describe("calling RunExternalProcess with a stdin payload", func() {
+				var (
+					pid    int
+					exited chan struct{}
 				)
+				// The mock OS is shared by the tests in this Describe so that
+				// the commands it records can be inspected.
+				mos := mockos.NewOS()
+				BeforeEach(func() {
+					coreint = NewGCSCore(mockruntime.NewRuntime(), mos)
+					externalParams.CommandLine = "cat"
+					externalParams.EmulateConsole = false
+					externalParams.StdinPayload = []byte("echo hello\n")
+				})
+				JustBeforeEach(func() {
+					pid, err = coreint.RunExternalProcess(externalParams, &stdio.ConnectionSet{})
+					if err == nil {
+						exited = make(chan struct{})
+						err = coreint.RegisterProcessExitHook(pid, func(oslayer.ProcessExitState) {
+							close(exited)
+						})
+					}
+				})
+				It("should feed the payload to the process's stdin", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Eventually(exited).Should(BeClosed())
+					Expect(mos.LastCommand().Name()).To(Equal("cat"))
+					Expect(string(mos.LastCommand().StdinData())).To(Equal("echo hello\n"))
+				})
+				Context("the process emulates a console", func() {
+					BeforeEach(func() {
+						externalParams.EmulateConsole = true
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
+				})
+			})
+			Describe("calling RunExternalProcess with host environment inheritance", func() {
+				mos := mockos.NewOS()
+				BeforeEach(func() {
+					coreint = NewGCSCore(mockruntime.NewRuntime(), mos)
+					externalParams.Environment = map[string]string{"TEST": "value"}
+				})
 				JustBeforeEach(func() {
-					pid, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+					_, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
 				})
-				It("should not produce an error", func() {
+				Context("InheritHostEnv is not set", func() {
+					It("should only use the supplied environment", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(mos.LastCommand().Env()).To(ConsistOf("TEST=value", "TERM=xterm"))
+					})
+				})
+				Context("InheritHostEnv is set", func() {
+					BeforeEach(func() {
+						externalParams.InheritHostEnv = true
+					})
+					It("should include the utility VM's PATH", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(mos.LastCommand().Env()).To(ContainElement("PATH=" + os.Getenv("PATH")))
+						Expect(mos.LastCommand().Env()).To(ContainElement("TEST=value"))
+					})
+					Context("the supplied environment overrides PATH", func() {
+						BeforeEach(func() {
+							externalParams.Environment["PATH"] = "/custom/bin"
+						})
+						It("should prefer the supplied PATH", func() {
+							Expect(err).NotTo(HaveOccurred())
+							Expect(mos.LastCommand().Env()).To(ContainElement("PATH=/custom/bin"))
+							Expect(mos.LastCommand().Env()).NotTo(ContainElement("PATH=" + os.Getenv("PATH")))
+						})
+					})
+				})
+			})
+			Describe("calling RunExternalProcess with a umask", func() {
+				mos := mockos.NewOS()
+				BeforeEach(func() {
+					coreint = NewGCSCore(mockruntime.NewRuntime(), mos)
+					externalParams.Umask = "0077"
+				})
+				JustBeforeEach(func() {
+					_, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+				})
+				It("should run the process with the umask set", func() {
 					Expect(err).NotTo(HaveOccurred())
+					Expect(mos.LastCommand().Name()).To(Equal("/bin/sh"))
+					Expect(mos.LastCommand().Args()[:3]).To(Equal([]string{"-c", "umask 0077 && exec \"$@\"", "sh"}))
+				})
+			})
+			Describe("calling RunExternalProcess with a chroot", func() {
+				mos := mockos.NewOS()
+				BeforeEach(func() {
+					coreint = NewGCSCore(mockruntime.NewRuntime(), mos)
+					externalParams.Chroot = "/tmp/gcs/rootfs"
+				})
+				JustBeforeEach(func() {
+					_, err = coreint.RunExternalProcess(externalParams, fullStdioSet)
+				})
+				It("should run the process chrooted", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(mos.LastCommand().SysProcAttr()).NotTo(BeNil())
+					Expect(mos.LastCommand().SysProcAttr().Chroot).To(Equal("/tmp/gcs/rootfs"))
+					Expect(mos.LastCommand().Dir()).To(Equal("/"))
+				})
+				Context("the chroot path is relative", func() {
+					BeforeEach(func() {
+						externalParams.Chroot = "tmp/gcs/rootfs"
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
 				})
 			})
 			Describe("calling ModifySettings", func() {
 				Context("adding a mapped virtual disk", func() {
-					Context("the lun is already in use", func() {
+					Context("the lun is already in use by a different disk", func() {
 						BeforeEach(func() {
 							err = coreint.CreateContainer(containerID, createSettings)
 							Expect(err).NotTo(HaveOccurred())
@@ -927,6 +5417,21 @@ var _ = Describe("GCS", func() {
 							Expect(err).To(HaveOccurred())
 						})
 					})
+					Context("the same disk is already attached at the lun", func() {
+						BeforeEach(func() {
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+							err = coreint.ModifySettings(containerID, diskModificationRequestRetry)
+						})
+						It("should not produce an error", func() {
+							Expect(err).NotTo(HaveOccurred())
+						})
+						It("should leave the disk attached once", func() {
+							Expect(coreint.containerCache[containerID].MappedVirtualDisks).To(Equal(map[uint8]prot.MappedVirtualDisk{
+								4: createSettings.MappedVirtualDisks[0],
+							}))
+						})
+					})
 					Context("the lun is not already in use", func() {
 						JustBeforeEach(func() {
 							err = coreint.ModifySettings(containerID, diskModificationRequest)
@@ -946,6 +5451,65 @@ var _ = Describe("GCS", func() {
 							})
 						})
 					})
+					Context("the disk is invalid", func() {
+						var disk prot.MappedVirtualDisk
+						BeforeEach(func() {
+							err = coreint.CreateContainer(containerID, createSettings)
+							Expect(err).NotTo(HaveOccurred())
+							disk = mappedVirtualDisk
+						})
+						JustBeforeEach(func() {
+							err = coreint.ModifySettings(containerID, prot.ResourceModificationRequestResponse{
+								ResourceType: prot.PtMappedVirtualDisk,
+								RequestType:  prot.RtAdd,
+								Settings:     prot.ResourceModificationSettings{MappedVirtualDisk: &disk},
+							})
+						})
+						Context("the path is relative", func() {
+							BeforeEach(func() {
+								disk.ContainerPath = "path/inside/container"
+							})
+							It("should produce ErrInvalid naming the path", func() {
+								Expect(errors.Cause(err)).To(Equal(os.ErrInvalid))
+								Expect(err.Error()).To(ContainSubstring("\"path/inside/container\""))
+								Expect(coreint.containerCache[containerID].MappedVirtualDisks).NotTo(HaveKey(disk.Lun))
+							})
+						})
+						Context("the path is not clean", func() {
+							BeforeEach(func() {
+								disk.ContainerPath = "/path/../inside/container"
+							})
+							It("should produce ErrInvalid naming the path", func() {
+								Expect(errors.Cause(err)).To(Equal(os.ErrInvalid))
+								Expect(err.Error()).To(ContainSubstring("\"/path/../inside/container\""))
+							})
+						})
+						Context("the lun is out of range", func() {
+							BeforeEach(func() {
+								disk.Lun = 64
+							})
+							It("should produce ErrInvalid naming the lun", func() {
+								Expect(errors.Cause(err)).To(Equal(os.ErrInvalid))
+								Expect(err.Error()).To(ContainSubstring("lun 64"))
+							})
+						})
+					})
+				})
+				Context("updating a mapped virtual disk which has not been added", func() {
+					BeforeEach(func() {
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						update := mappedVirtualDisk
+						update.Lun = 7
+						err = coreint.ModifySettings(containerID, prot.ResourceModificationRequestResponse{
+							ResourceType: prot.PtMappedVirtualDisk,
+							RequestType:  prot.RtUpdate,
+							Settings:     prot.ResourceModificationSettings{MappedVirtualDisk: &update},
+						})
+					})
+					It("should produce an error", func() {
+						Expect(err).To(HaveOccurred())
+					})
 				})
 				Context("removing a mapped virtual disk", func() {
 					Context("the disk has not been added", func() {
@@ -990,6 +5554,7 @@ var _ = Describe("GCS", func() {
 						})
 						It("should produce an error", func() {
 							Expect(err).To(HaveOccurred())
+							Expect(err.Error()).To(ContainSubstring("port 4 is already used by mapped directory abcdefghijklmnopqrstuvwxyz"))
 						})
 					})
 					Context("the port is not already in use", func() {
@@ -1012,6 +5577,76 @@ var _ = Describe("GCS", func() {
 						})
 					})
 				})
+				Context("updating a mapped directory", func() {
+					var (
+						fos    *failingMountOS
+						mos    *mountRecordingOS
+						uos    *unmountRecordingOS
+						update prot.MappedDirectory
+					)
+					BeforeEach(func() {
+						fos = &failingMountOS{OS: mockos.NewOS(), data: make(map[string]bool)}
+						mos = &mountRecordingOS{OS: fos}
+						uos = &unmountRecordingOS{OS: mos}
+						coreint = NewGCSCore(mockruntime.NewRuntime(), uos)
+						err = coreint.CreateContainer(containerID, createSettings)
+						Expect(err).NotTo(HaveOccurred())
+						err = coreint.ModifySettings(containerID, dirModificationRequest)
+						Expect(err).NotTo(HaveOccurred())
+						mos.targets, mos.data = nil, nil
+
+						update = mappedDirectory
+						update.Port = 7
+					})
+					JustBeforeEach(func() {
+						err = coreint.ModifySettings(containerID, prot.ResourceModificationRequestResponse{
+							ResourceType: prot.PtMappedDirectory,
+							RequestType:  prot.RtUpdate,
+							Settings:     prot.ResourceModificationSettings{MappedDirectory: &update},
+						})
+					})
+					It("should remount the directory from the new endpoint", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(uos.unmounted()).To(Equal([]string{mappedDirectory.ContainerPath}))
+						Expect(mos.targets).To(Equal([]string{mappedDirectory.ContainerPath}))
+						Expect(mos.data).To(Equal([]string{"trans=vsock,port=7"}))
+						Expect(coreint.containerCache[containerID].MappedDirectories).To(Equal(map[uint32]prot.MappedDirectory{
+							7: update,
+						}))
+					})
+					Context("the new share fails to mount", func() {
+						BeforeEach(func() {
+							fos.data["trans=vsock,port=7"] = true
+						})
+						It("should produce an error", func() {
+							Expect(err).To(HaveOccurred())
+						})
+						It("should restore the old share", func() {
+							Expect(mos.data).To(Equal([]string{"trans=vsock,port=7", "trans=vsock,port=5"}))
+							Expect(coreint.containerCache[containerID].MappedDirectories).To(Equal(map[uint32]prot.MappedDirectory{
+								5: mappedDirectory,
+							}))
+						})
+						Context("and the old share fails to mount again", func() {
+							BeforeEach(func() {
+								fos.data["trans=vsock,port=5"] = true
+							})
+							It("should no longer track the directory", func() {
+								Expect(err).To(HaveOccurred())
+								Expect(coreint.containerCache[containerID].MappedDirectories).To(BeEmpty())
+							})
+						})
+					})
+					Context("no mapped directory is mounted at the path", func() {
+						BeforeEach(func() {
+							update.ContainerPath = "/other/path"
+						})
+						It("should produce an error without unmounting anything", func() {
+							Expect(err).To(HaveOccurred())
+							Expect(uos.unmounted()).To(BeEmpty())
+						})
+					})
+				})
 				Context("removing a mapped directory", func() {
 					Context("the directory has not been added", func() {
 						BeforeEach(func() {
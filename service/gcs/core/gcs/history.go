@@ -0,0 +1,109 @@
+package gcs
+
+import (
+	"sort"
+	"time"
+
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxContainerHistoryEvents is the number of events kept in each
+	// container's history. Beyond it, the oldest events are discarded,
+	// apart from the container's creation.
+	maxContainerHistoryEvents = 64
+	// defaultHistorySize and defaultHistoryMaxAge are the defaults of
+	// HistorySize and HistoryMaxAge.
+	defaultHistorySize   = 64
+	defaultHistoryMaxAge = time.Hour
+)
+
+// containerHistory is the event log of a container, which is kept after the
+// container is removed from the cache.
+type containerHistory struct {
+	events []prot.ContainerEvent
+	// removedAt is when the container was removed from the cache, or zero
+	// while it still exists.
+	removedAt time.Time
+}
+
+// GetContainerHistory returns the events of the container with the given
+// ID, oldest first. The history of a container which has been removed can be
+// retrieved until it is evicted according to HistorySize and HistoryMaxAge.
+func (c *gcsCore) GetContainerHistory(id string) ([]prot.ContainerEvent, error) {
+	c.historyMutex.Lock()
+	defer c.historyMutex.Unlock()
+	c.evictContainerHistories(time.Now())
+	history, ok := c.history[id]
+	if !ok {
+		return nil, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	return append([]prot.ContainerEvent(nil), history.events...), nil
+}
+
+// recordContainerEvent adds an event to the history of the container with the
+// given ID. The creation of a container starts a new history, replacing that
+// of any removed container with the same ID.
+func (c *gcsCore) recordContainerEvent(id string, eventType prot.ContainerEventType, details string) {
+	c.historyMutex.Lock()
+	defer c.historyMutex.Unlock()
+	history, ok := c.history[id]
+	if !ok || eventType == prot.CeCreated {
+		history = &containerHistory{}
+		c.history[id] = history
+	}
+	if len(history.events) >= maxContainerHistoryEvents {
+		history.events = append(history.events[:1], history.events[2:]...)
+	}
+	history.events = append(history.events, prot.ContainerEvent{
+		TimestampInMs: time.Now().UnixNano() / int64(time.Millisecond),
+		Type:          eventType,
+		Details:       details,
+	})
+}
+
+// retireContainerHistory marks the history of the container with the given
+// ID as belonging to a removed container, which makes it eligible for
+// eviction.
+func (c *gcsCore) retireContainerHistory(id string) {
+	c.historyMutex.Lock()
+	defer c.historyMutex.Unlock()
+	history, ok := c.history[id]
+	if !ok || !history.removedAt.IsZero() {
+		return
+	}
+	now := time.Now()
+	history.removedAt = now
+	c.evictContainerHistories(now)
+}
+
+// evictContainerHistories evicts the histories of removed containers which
+// were removed more than HistoryMaxAge ago, and then the oldest of the rest
+// beyond HistorySize. The histories of existing containers are never
+// evicted.
+//
+// This function expects historyMutex to be held.
+func (c *gcsCore) evictContainerHistories(now time.Time) {
+	var retired []string
+	for id, history := range c.history {
+		if history.removedAt.IsZero() {
+			continue
+		}
+		if c.HistoryMaxAge > 0 && now.Sub(history.removedAt) > c.HistoryMaxAge {
+			delete(c.history, id)
+			continue
+		}
+		retired = append(retired, id)
+	}
+	if len(retired) <= c.HistorySize {
+		return
+	}
+	sort.Slice(retired, func(i, j int) bool {
+		return c.history[retired[i]].removedAt.Before(c.history[retired[j]].removedAt)
+	})
+	for _, id := range retired[:len(retired)-c.HistorySize] {
+		delete(c.history, id)
+	}
+}
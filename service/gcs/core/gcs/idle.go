@@ -0,0 +1,39 @@
+package gcs
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// activityRelay is a relay of a process's stdio which reports when IO was
+// last relayed through it, such as a stdio.TtyRelay.
+type activityRelay interface {
+	LastActivity() time.Time
+}
+
+// killWhenIdle kills the external process with the given pid once no IO has
+// been relayed through relay for timeout, unless exited is closed first.
+func (c *gcsCore) killWhenIdle(pid int, relay activityRelay, timeout time.Duration, exited <-chan struct{}) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-exited:
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(relay.LastActivity())
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+		logrus.Infof("killing external process %d after %s without stdio activity", pid, idle.Truncate(time.Millisecond))
+		if err := c.OS.Kill(pid, syscall.SIGKILL); err != nil {
+			logrus.Error(errors.Wrapf(err, "failed to kill idle external process %d", pid))
+		}
+		return
+	}
+}
@@ -0,0 +1,211 @@
+package gcs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Microsoft/opengcs/service/gcs/core"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// journaldSocketPath is the socket journald receives entries on in its
+// native protocol.
+const journaldSocketPath = "/run/systemd/journal/socket"
+
+// The syslog priorities of a process's stdout and stderr in the journal.
+const (
+	journalPriorityErr  = 3
+	journalPriorityInfo = 6
+)
+
+// maxJournalLineLength is the longest line of a process's output which is
+// written to the journal as one entry. Longer lines are split.
+const maxJournalLineLength = 16 * 1024
+
+// journaldSink is a core.JournalSink which sends entries to journald over its
+// native protocol. The socket is connected on first use.
+type journaldSink struct {
+	mutex sync.Mutex
+	conn  *net.UnixConn
+}
+
+var _ core.JournalSink = &journaldSink{}
+
+func (j *journaldSink) Send(message string, priority int, fields map[string]string) error {
+	var entry bytes.Buffer
+	writeJournalField(&entry, "MESSAGE", message)
+	writeJournalField(&entry, "PRIORITY", strconv.Itoa(priority))
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeJournalField(&entry, name, fields[name])
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.conn == nil {
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocketPath, Net: "unixgram"})
+		if err != nil {
+			return errors.Wrap(err, "failed to connect to journald")
+		}
+		j.conn = conn
+	}
+	if _, err := j.conn.Write(entry.Bytes()); err != nil {
+		return errors.Wrap(err, "failed to write to journald")
+	}
+	return nil
+}
+
+// writeJournalField appends a field to an entry in journald's native
+// protocol. Values containing newlines are written with their length, as
+// the protocol requires.
+func writeJournalField(entry *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		entry.WriteString(name + "=" + value + "\n")
+		return
+	}
+	entry.WriteString(name + "\n")
+	binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	entry.WriteString(value + "\n")
+}
+
+// journalConnection is a transport.Connection which writes each line of a
+// process's output to the journal in place of relaying it to the host.
+type journalConnection struct {
+	journal  core.JournalSink
+	priority int
+	fields   map[string]string
+
+	// mutex guards partial, the output written since the last complete
+	// line, and piped.
+	mutex   sync.Mutex
+	partial []byte
+	// piped is true once File has handed the process a pipe, whose end
+	// flushes the output.
+	piped bool
+}
+
+var _ transport.Connection = &journalConnection{}
+
+// newJournalConnection returns a connection which writes the given stream of
+// a process in the container to the journal with the given priority.
+func (c *gcsCore) newJournalConnection(containerEntry *containerCacheEntry, stream string, priority int) *journalConnection {
+	return &journalConnection{
+		journal:  c.Journal,
+		priority: priority,
+		fields: map[string]string{
+			"CONTAINER_ID":      containerEntry.ID,
+			"CONTAINER_STREAM":  stream,
+			"SYSLOG_IDENTIFIER": containerEntry.ID,
+		},
+	}
+}
+
+// Read returns io.EOF, as the connection is only written to.
+func (c *journalConnection) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Write sends each complete line of output to the journal, keeping any
+// incomplete line until the rest of it is written.
+func (c *journalConnection) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			if len(c.partial) < maxJournalLineLength {
+				return len(p), nil
+			}
+			i = maxJournalLineLength
+		} else if i > maxJournalLineLength {
+			i = maxJournalLineLength
+		}
+		line := string(c.partial[:i])
+		if i < len(c.partial) && c.partial[i] == '\n' {
+			i++
+		}
+		c.partial = c.partial[i:]
+		if err := c.journal.Send(line, c.priority, c.fields); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close sends any incomplete last line to the journal. If the process was
+// handed a pipe by File, the line is instead sent once the pipe is done,
+// since the runtime closes the connection as soon as the process has its
+// end.
+func (c *journalConnection) Close() error {
+	c.mutex.Lock()
+	piped := c.piped
+	c.mutex.Unlock()
+	if piped {
+		return nil
+	}
+	return c.flush()
+}
+
+func (c *journalConnection) flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.partial) == 0 {
+		return nil
+	}
+	line := string(c.partial)
+	c.partial = nil
+	return c.journal.Send(line, c.priority, c.fields)
+}
+
+// CloseRead does nothing, as the connection is only written to.
+func (c *journalConnection) CloseRead() error {
+	return nil
+}
+
+// CloseWrite does nothing. Any incomplete line is sent by Close.
+func (c *journalConnection) CloseWrite() error {
+	return nil
+}
+
+// File returns the write end of a pipe which can be given to a process. The
+// output written to it is sent to the journal until the process's end is
+// closed.
+func (c *journalConnection) File() (*os.File, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.piped {
+		return nil, errors.New("journal connection has already been given to a process")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create journal pipe")
+	}
+	c.piped = true
+	go func() {
+		defer r.Close()
+		if _, err := io.Copy(c, r); err != nil {
+			logrus.Warn(errors.Wrapf(err, "failed to write output of container %s to the journal", c.fields["CONTAINER_ID"]))
+			// Keep draining the pipe, so that the process doesn't block.
+			io.Copy(ioutil.Discard, r)
+			return
+		}
+		if err := c.flush(); err != nil {
+			logrus.Warn(errors.Wrapf(err, "failed to write output of container %s to the journal", c.fields["CONTAINER_ID"]))
+		}
+	}()
+	return w, nil
+}
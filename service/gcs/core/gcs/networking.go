@@ -4,19 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sirupsen/logrus"
 	"github.com/pkg/errors"
 )
 
 // configureAdapterInNamespace moves a given adapter into a network
 // namespace and configures it there.
-func (c *gcsCore) configureAdapterInNamespace(container runtime.Container, adapter prot.NetworkAdapter) error {
+func (c *gcsCore) configureAdapterInNamespace(containerEntry *containerCacheEntry, container runtime.Container, adapter prot.NetworkAdapter) error {
 	id := adapter.AdapterInstanceID
 	interfaceName, err := c.instanceIDToName(id)
 	if err != nil {
@@ -38,9 +40,10 @@ func (c *gcsCore) configureAdapterInNamespace(container runtime.Container, adapt
 	logrus.Debugf("netnscfg output:\n%s", out)
 
 	// Handle resolve.conf
-	// There is no need to create <baseFilesPath>/etc here as it
-	// is created in CreateContainer().
-	resolvPath := filepath.Join(baseFilesPath, "etc/resolv.conf")
+	// The container's own resolv.conf is created in CreateContainer(). It is
+	// never linked to the utility VM's, so that updating one doesn't change
+	// the other.
+	resolvPath := c.getResolvConfPath(containerEntry.ID)
 
 	if adapter.NatEnabled {
 		// Set the DNS configuration.
@@ -48,22 +51,41 @@ func (c *gcsCore) configureAdapterInNamespace(container runtime.Container, adapt
 			return errors.Wrapf(err, "failed to generate resolv.conf file for adapter %s", adapter.AdapterInstanceID)
 		}
 	} else {
-		exists, err := c.OS.PathExists(resolvPath)
+		info, err := c.OS.Lstat(resolvPath)
 		if err != nil {
-			return errors.Wrapf(err, "failed to check if resolv.conf path already exists for adapter %s", adapter.AdapterInstanceID)
+			return errors.Wrapf(err, "failed to stat resolv.conf file for adapter %s", adapter.AdapterInstanceID)
 		}
-		if !exists {
-			if err := c.OS.Link("/etc/resolv.conf", resolvPath); err != nil {
-				return errors.Wrapf(err, "failed to link resolv.conf file for adapter %s", adapter.AdapterInstanceID)
+		// An earlier adapter may already have written it.
+		if info.Size() == 0 {
+			if err := c.copyFile("/etc/resolv.conf", resolvPath); err != nil {
+				return errors.Wrapf(err, "failed to copy resolv.conf file for adapter %s", adapter.AdapterInstanceID)
 			}
 		}
+	}
+	return nil
+}
 
+// copyFile replaces the contents of the file at dst with those of the file at
+// src.
+func (c *gcsCore) copyFile(src, dst string) error {
+	in, err := c.OS.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", src)
+	}
+	defer in.Close()
+	out, err := c.OS.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", dst)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.Wrapf(err, "failed to copy %s to %s", src, dst)
 	}
 	return nil
 }
 
-// generateResolvConfFile generate a resolve.conf file in $baseFilesPath/etc
-// for the given adapter.
+// generateResolvConfFile generates the resolv.conf file at resolvPath for the
+// given adapter.
 // TODO: This method of managing DNS will potentially be replaced with another
 // method in the future.
 func (c *gcsCore) generateResolvConfFile(resolvPath string, adapter prot.NetworkAdapter) error {
@@ -78,7 +100,7 @@ func (c *gcsCore) generateResolvConfFile(resolvPath string, adapter prot.Network
 	}
 	fileContents += fmt.Sprintf("search %s\n", adapter.HostDNSSuffix)
 
-	file, err := c.OS.OpenFile(resolvPath, os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := c.OS.OpenFile(resolvPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return errors.Wrapf(err, "failed to create resolv.conf file for adapter %s", adapter.AdapterInstanceID)
 	}
@@ -90,6 +112,123 @@ func (c *gcsCore) generateResolvConfFile(resolvPath string, adapter prot.Network
 	return nil
 }
 
+// maxNameservers is the most nameservers which the resolver reads from
+// resolv.conf.
+const maxNameservers = 3
+
+// resolvConfContainerPath is where containers see their resolv.conf.
+const resolvConfContainerPath = "/etc/resolv.conf"
+
+// updateResolvConf rewrites the resolv.conf of the given container with the
+// given DNS configuration. The file is rewritten in place, rather than
+// replaced, so that its bind mount into the container sees the change
+// immediately. Only the container's own resolv.conf, which the GCS bind
+// mounts into it, is rewritten, since any other file may be shared.
+//
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) updateResolvConf(containerEntry *containerCacheEntry, dns prot.DNSSettings) error {
+	if len(dns.Servers) == 0 || len(dns.Servers) > maxNameservers {
+		return errors.Errorf("between 1 and %d DNS servers must be given, not %d", maxNameservers, len(dns.Servers))
+	}
+	for _, server := range dns.Servers {
+		if net.ParseIP(server) == nil {
+			return errors.Errorf("invalid DNS server address \"%s\"", server)
+		}
+	}
+	for _, domain := range dns.SearchDomains {
+		if domain == "" || strings.ContainsAny(domain, " \t\n") {
+			return errors.Errorf("invalid DNS search domain \"%s\"", domain)
+		}
+	}
+	resolvPath, err := c.containerResolvConfPath(containerEntry)
+	if err != nil {
+		return err
+	}
+
+	fileContents := ""
+	for _, server := range dns.Servers {
+		fileContents += fmt.Sprintf("nameserver %s\n", server)
+	}
+	if len(dns.SearchDomains) > 0 {
+		fileContents += fmt.Sprintf("search %s\n", strings.Join(dns.SearchDomains, " "))
+	}
+	file, err := c.OS.OpenFile(resolvPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", resolvPath)
+	}
+	defer file.Close()
+	if _, err := io.WriteString(file, fileContents); err != nil {
+		return errors.Wrapf(err, "failed to write %s", resolvPath)
+	}
+	logrus.Debugf("wrote %s:\n%s", resolvPath, fileContents)
+	return nil
+}
+
+// containerResolvConfPath returns the path in the utility VM of the
+// container's own resolv.conf. It is an error if the container doesn't see
+// that file as /etc/resolv.conf, either because its init process, which
+// mounts it, hasn't been created or because its spec mounts another file in
+// its place.
+//
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) containerResolvConfPath(containerEntry *containerCacheEntry) (string, error) {
+	if containerEntry.configJSON == nil {
+		return "", errors.Errorf("container %s has not been started", containerEntry.ID)
+	}
+	var spec oci.Spec
+	if err := json.Unmarshal(containerEntry.configJSON, &spec); err != nil {
+		return "", errors.Wrapf(err, "failed to decode the spec of container %s", containerEntry.ID)
+	}
+	resolvPath := c.getResolvConfPath(containerEntry.ID)
+	mounted := false
+	for _, mount := range spec.Mounts {
+		if filepath.Clean(mount.Destination) == resolvConfContainerPath {
+			mounted = isBindMount(mount) && mount.Source == resolvPath
+		}
+	}
+	if !mounted {
+		return "", errors.Errorf("the spec of container %s mounts its own %s", containerEntry.ID, resolvConfContainerPath)
+	}
+	return resolvPath, nil
+}
+
+// resolvConfMount returns the bind mount of the given container's own
+// resolv.conf, which is added to its spec unless the spec mounts another file
+// at resolvConfContainerPath.
+func (c *gcsCore) resolvConfMount(id string) oci.Mount {
+	return oci.Mount{
+		Destination: resolvConfContainerPath,
+		Type:        "bind",
+		Source:      c.getResolvConfPath(id),
+		Options:     []string{"bind"},
+	}
+}
+
+// hasResolvConfMount returns true if any of the given mounts is at
+// resolvConfContainerPath.
+func hasResolvConfMount(mounts []oci.Mount) bool {
+	for _, mount := range mounts {
+		if filepath.Clean(mount.Destination) == resolvConfContainerPath {
+			return true
+		}
+	}
+	return false
+}
+
+// isBindMount returns true if the given OCI mount is a bind mount, which is
+// given either by its type or by its options.
+func isBindMount(mount oci.Mount) bool {
+	if mount.Type == "bind" {
+		return true
+	}
+	for _, option := range mount.Options {
+		if option == "bind" || option == "rbind" {
+			return true
+		}
+	}
+	return false
+}
+
 // instanceIDToName converts from the given instance ID (a GUID generated on
 // the Windows host) to its corresponding interface name (e.g. "eth0").
 func (c *gcsCore) instanceIDToName(id string) (string, error) {
@@ -0,0 +1,94 @@
+package gcs
+
+import (
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+)
+
+// defaultMaxExitStates is the default number of exited processes whose exit
+// states are kept in the process cache.
+const defaultMaxExitStates = 1024
+
+// The following methods must be called with processCacheMutex held.
+
+// addProcess stores the given entry in processCache, replacing the entry of
+// any earlier process with the same pid.
+func (c *gcsCore) addProcess(pid int, entry *processCacheEntry) {
+	if old, ok := c.processCache[pid]; ok {
+		c.untrackExitState(old)
+	}
+	delete(c.evictedPids, pid)
+	entry.pid = pid
+	c.processCache[pid] = entry
+	// The process may have exited, and even been evicted, before it was
+	// added to the cache.
+	if entry.ExitStatus != nil && entry.exitedElement == nil {
+		c.trackExitState(entry)
+	}
+}
+
+// exitProcess records the exit state of the given process and runs its exit
+// hooks. The exit state is then kept until it is evicted to make room for
+// more recently used ones.
+func (c *gcsCore) exitProcess(pid int, entry *processCacheEntry, state oslayer.ProcessExitState) {
+	entry.pid = pid
+	entry.ExitStatus = state
+	for _, hook := range entry.ExitHooks {
+		hook(state)
+	}
+	c.trackExitState(entry)
+}
+
+// removeProcess deletes the given process's entry from processCache.
+func (c *gcsCore) removeProcess(pid int, entry *processCacheEntry) {
+	c.untrackExitState(entry)
+	delete(c.processCache, pid)
+}
+
+// processNotFoundError returns the error for a pid which has no entry in
+// processCache, distinguishing processes whose exit states were evicted.
+func (c *gcsCore) processNotFoundError(pid int) error {
+	if _, ok := c.evictedPids[pid]; ok {
+		return gcserr.NewProcessExitEvictedError(pid)
+	}
+	return gcserr.NewProcessDoesNotExistError(pid)
+}
+
+// touchExitState marks the given exited process's exit state as the most
+// recently used.
+func (c *gcsCore) touchExitState(entry *processCacheEntry) {
+	if entry.exitedElement != nil {
+		c.exitStates.MoveToBack(entry.exitedElement)
+	}
+}
+
+// trackExitState adds the given exited process's exit state to exitStates,
+// evicting the least recently used exit states while there are more than
+// MaxExitStates of them. Running processes are never evicted, as only exited
+// processes are tracked.
+func (c *gcsCore) trackExitState(entry *processCacheEntry) {
+	entry.exitedElement = c.exitStates.PushBack(entry)
+	if c.MaxExitStates <= 0 {
+		return
+	}
+	for c.exitStates.Len() > c.MaxExitStates {
+		evicted := c.exitStates.Front().Value.(*processCacheEntry)
+		c.untrackExitState(evicted)
+		// The entry may not have been added to the cache yet, in which case
+		// it is tracked again once it is.
+		if c.processCache[evicted.pid] == evicted {
+			delete(c.processCache, evicted.pid)
+			if c.evictedPids == nil {
+				c.evictedPids = make(map[int]struct{})
+			}
+			c.evictedPids[evicted.pid] = struct{}{}
+		}
+	}
+}
+
+func (c *gcsCore) untrackExitState(entry *processCacheEntry) {
+	if entry.exitedElement != nil {
+		c.exitStates.Remove(entry.exitedElement)
+		entry.exitedElement = nil
+	}
+}
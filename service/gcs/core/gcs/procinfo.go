@@ -0,0 +1,102 @@
+package gcs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/pkg/errors"
+)
+
+// defaultSecretKeys matches the names of environment variables and
+// arguments whose values GetProcessEnviron and GetProcessCmdline redact.
+var defaultSecretKeys = regexp.MustCompile(`(?i)(secret|passw(or)?d|token|credential|api[-_]?key|private[-_]?key)`)
+
+// maxProcFileSize is the most which is read of a process's environ or
+// cmdline. Together they are limited by the kernel to well under it.
+const maxProcFileSize = 4 << 20
+
+// GetProcessEnviron returns the environment of the process with the given
+// pid, as "name=value" strings. The values of variables whose names match
+// SecretKeys, or which the GCS set from secrets, are redacted.
+func (c *gcsCore) GetProcessEnviron(pid int) ([]string, error) {
+	env, err := c.readProcStrings(pid, "environ")
+	if err != nil {
+		return nil, err
+	}
+	secretEnv := make(map[string]bool)
+	c.processCacheMutex.Lock()
+	if entry, ok := c.processCache[pid]; ok {
+		for _, name := range entry.SecretEnv {
+			secretEnv[name] = true
+		}
+	}
+	c.processCacheMutex.Unlock()
+	for i, v := range env {
+		if kv := strings.SplitN(v, "=", 2); len(kv) == 2 && secretEnv[kv[0]] {
+			env[i] = kv[0] + "=" + redactedValue
+			continue
+		}
+		env[i] = c.redactAssignment(v)
+	}
+	return env, nil
+}
+
+// GetProcessCmdline returns the arguments of the process with the given pid.
+// The values of arguments of the form "name=value" or "--name=value" whose
+// names match SecretKeys are redacted.
+func (c *gcsCore) GetProcessCmdline(pid int) ([]string, error) {
+	args, err := c.readProcStrings(pid, "cmdline")
+	if err != nil {
+		return nil, err
+	}
+	for i, arg := range args {
+		args[i] = c.redactAssignment(arg)
+	}
+	return args, nil
+}
+
+// redactAssignment redacts the value of a "name=value" string if its name,
+// without any leading dashes, matches SecretKeys.
+func (c *gcsCore) redactAssignment(s string) string {
+	if c.SecretKeys == nil {
+		return s
+	}
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || !c.SecretKeys.MatchString(strings.TrimLeft(kv[0], "-")) {
+		return s
+	}
+	return kv[0] + "=" + redactedValue
+}
+
+// readProcStrings reads the NUL-separated strings in the given file of the
+// process's /proc directory.
+func (c *gcsCore) readProcStrings(pid int, name string) ([]string, error) {
+	path := fmt.Sprintf("/proc/%d/%s", pid, name)
+	file, err := c.OS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
+		}
+		return nil, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(io.LimitReader(file, maxProcFileSize))
+	if err != nil {
+		// The process exited after the file was opened.
+		if pathErr, ok := errors.Cause(err).(*os.PathError); ok && pathErr.Err == syscall.ESRCH {
+			return nil, errors.WithStack(gcserr.NewProcessDoesNotExistError(pid))
+		}
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	trimmed := strings.TrimRight(string(contents), "\x00")
+	if trimmed == "" {
+		return []string{}, nil
+	}
+	return strings.Split(trimmed, "\x00"), nil
+}
@@ -0,0 +1,75 @@
+package gcs
+
+import (
+	"github.com/pkg/errors"
+)
+
+// schedulingPolicies maps the names of the scheduling policies a process may
+// request to their Linux SCHED_* numbers.
+var schedulingPolicies = map[string]int{
+	"other": 0, // SCHED_OTHER
+	"fifo":  1, // SCHED_FIFO
+	"rr":    2, // SCHED_RR
+	"batch": 3, // SCHED_BATCH
+	"idle":  5, // SCHED_IDLE
+}
+
+// The range of static priorities of the real-time scheduling policies.
+const (
+	minRealtimePriority = 1
+	maxRealtimePriority = 99
+)
+
+// The range of niceness values accepted by setpriority.
+const (
+	minNice = -20
+	maxNice = 19
+)
+
+// validateScheduling checks that the given scheduling policy, if set, is
+// known, and that the priority is valid for it.
+func validateScheduling(policy string, priority int) error {
+	if policy == "" {
+		if priority != 0 {
+			return errors.Errorf("scheduling priority %d was given without a scheduling policy", priority)
+		}
+		return nil
+	}
+	if _, ok := schedulingPolicies[policy]; !ok {
+		return errors.Errorf("unknown scheduling policy \"%s\"", policy)
+	}
+	if policy == "fifo" || policy == "rr" {
+		if priority < minRealtimePriority || priority > maxRealtimePriority {
+			return errors.Errorf("scheduling priority %d is outside of the range %d to %d for policy \"%s\"", priority, minRealtimePriority, maxRealtimePriority, policy)
+		}
+	} else if priority != 0 {
+		return errors.Errorf("scheduling priority must be 0 for policy \"%s\"", policy)
+	}
+	return nil
+}
+
+// setScheduling sets the scheduling policy and priority of the given running
+// process.
+func (c *gcsCore) setScheduling(pid int, policy string, priority int) error {
+	if err := c.OS.SchedSetscheduler(pid, schedulingPolicies[policy], priority); err != nil {
+		return errors.Wrapf(err, "failed to set scheduling policy %s of process %d", policy, pid)
+	}
+	return nil
+}
+
+// validateNice checks that the given niceness, if set, is within the range
+// accepted by the kernel.
+func validateNice(nice *int) error {
+	if nice != nil && (*nice < minNice || *nice > maxNice) {
+		return errors.Errorf("niceness %d is outside of the range %d to %d", *nice, minNice, maxNice)
+	}
+	return nil
+}
+
+// setNice sets the niceness of the given running process.
+func (c *gcsCore) setNice(pid int, nice int) error {
+	if err := c.OS.Setpriority(pid, nice); err != nil {
+		return errors.Wrapf(err, "failed to set niceness %d of process %d", nice, pid)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package gcs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxSecretSize is the largest secret which is read from a container's
+// secrets directory.
+const maxSecretSize = 64 * 1024
+
+// validateSecretsPath checks that the given secrets directory of a container,
+// if any, is an absolute path, and returns it cleaned.
+func validateSecretsPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(path) {
+		return "", errors.Errorf("secrets path %s must be absolute", path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// resolveSecrets reads the secrets referenced by a process's
+// SecretEnvironment from the container's secrets directory. It returns the
+// environment variable assignments to inject into the process, and the
+// secrets' values, so that they can be scrubbed from errors. Neither is ever
+// included in the returned error.
+func (c *gcsCore) resolveSecrets(containerEntry *containerCacheEntry, secretEnv map[string]string) (env []string, values []string, err error) {
+	if len(secretEnv) == 0 {
+		return nil, nil, nil
+	}
+	if containerEntry.SecretsPath == "" {
+		return nil, nil, errors.Errorf("container %s has no secrets path, so its processes can't reference secrets", containerEntry.ID)
+	}
+	// The variables are injected in a consistent order.
+	names := make([]string, 0, len(secretEnv))
+	for name := range secretEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		secret := secretEnv[name]
+		if name == "" || strings.Contains(name, "=") {
+			return nil, nil, errors.Errorf("invalid environment variable name \"%s\" for secret %s", name, secret)
+		}
+		if secret == "" || secret == "." || secret == ".." || strings.Contains(secret, "/") {
+			return nil, nil, errors.Errorf("invalid secret name \"%s\" for environment variable %s", secret, name)
+		}
+		value, err := c.readSecret(filepath.Join(containerEntry.SecretsPath, secret))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to read secret %s for environment variable %s", secret, name)
+		}
+		env = append(env, name+"="+value)
+		values = append(values, value)
+	}
+	return env, values, nil
+}
+
+// readSecret returns the contents of the secret file at the given path.
+func (c *gcsCore) readSecret(path string) (string, error) {
+	file, err := c.OS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(io.LimitReader(file, maxSecretSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(contents) > maxSecretSize {
+		return "", errors.Errorf("the secret is larger than the maximum of %d bytes", maxSecretSize)
+	}
+	if strings.ContainsRune(string(contents), 0) {
+		return "", errors.New("the secret contains a NUL byte, which can't be in an environment variable")
+	}
+	return string(contents), nil
+}
+
+// injectSecretEnv returns the given environment with the secrets' variables
+// set, replacing any variables of the same names. The given environment is
+// not modified.
+func injectSecretEnv(env []string, secretEnv []string) []string {
+	secretNames := make(map[string]bool, len(secretEnv))
+	for _, v := range secretEnv {
+		secretNames[strings.SplitN(v, "=", 2)[0]] = true
+	}
+	injected := make([]string, 0, len(env)+len(secretEnv))
+	for _, v := range env {
+		if !secretNames[strings.SplitN(v, "=", 2)[0]] {
+			injected = append(injected, v)
+		}
+	}
+	return append(injected, secretEnv...)
+}
+
+// scrubSecrets returns err with any of the given secret values in its message
+// replaced by redactedValue, so that a failure to execute a process doesn't
+// leak its secrets to the host or the logs.
+func scrubSecrets(err error, values []string) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	scrubbed := message
+	for _, value := range values {
+		if value != "" {
+			scrubbed = strings.Replace(scrubbed, value, redactedValue, -1)
+		}
+	}
+	if scrubbed == message {
+		return err
+	}
+	return errors.New(scrubbed)
+}
@@ -0,0 +1,218 @@
+package gcs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/mockos"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+// secretsOS wraps an oslayer.OS, serving the given files in place of the
+// real ones under dir. Other files under dir don't exist.
+type secretsOS struct {
+	oslayer.OS
+	dir   string
+	files map[string]string
+}
+
+func (o *secretsOS) OpenFile(name string, flag int, perm os.FileMode) (oslayer.File, error) {
+	if !strings.HasPrefix(name, o.dir+"/") {
+		return o.OS.OpenFile(name, flag, perm)
+	}
+	contents, ok := o.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	return &readOnlyFile{Reader: strings.NewReader(contents)}, nil
+}
+
+var _ = Describe("secrets", func() {
+	const (
+		containerID = "abc"
+		secretsPath = "/run/secrets/abc"
+		secretValue = "hunter2"
+	)
+	var (
+		rtime    *recordingRuntime
+		fos      *fileRecordingOS
+		pos      *procOS
+		sos      *secretsOS
+		coreint  *gcsCore
+		settings prot.VMHostedContainerSettings
+		params   prot.ProcessParameters
+		pid      int
+		err      error
+	)
+	BeforeEach(func() {
+		rtime = &recordingRuntime{Runtime: mockruntime.NewRuntime()}
+		pos = &procOS{OS: mockos.NewOS(), files: make(map[string]string)}
+		fos = &fileRecordingOS{OS: pos, files: make(map[string]*bytes.Buffer)}
+		sos = &secretsOS{
+			OS:    fos,
+			dir:   secretsPath,
+			files: map[string]string{filepath.Join(secretsPath, "db-password"): secretValue},
+		}
+		coreint = NewGCSCore(rtime, sos)
+		settings = prot.VMHostedContainerSettings{
+			Layers:          []prot.Layer{{Path: "0"}},
+			SandboxDataPath: "1",
+			SecretsPath:     secretsPath,
+		}
+		params = prot.ProcessParameters{
+			CommandLine:       "cat file",
+			WorkingDirectory:  "/",
+			Environment:       map[string]string{"PATH": "/usr/bin"},
+			SecretEnvironment: map[string]string{"DB_PASS": "db-password"},
+		}
+	})
+	JustBeforeEach(func() {
+		err = coreint.CreateContainer(containerID, settings)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = coreint.ExecProcess(containerID, prot.ProcessParameters{
+			OCISpecification: oci.Spec{
+				Process: oci.Process{Args: []string{"/bin/sh"}},
+				Root:    oci.Root{Path: "rootfs"},
+			},
+		}, &stdio.ConnectionSet{})
+		Expect(err).NotTo(HaveOccurred())
+		pid, err = coreint.ExecProcess(containerID, params, &stdio.ConnectionSet{})
+	})
+	It("should inject the secret into the process's environment", func() {
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rtime.execs).To(HaveLen(1))
+		Expect(rtime.execs[0].Env).To(ConsistOf("PATH=/usr/bin", "DB_PASS="+secretValue))
+		Expect(params.Environment).NotTo(HaveKey("DB_PASS"))
+	})
+	It("should not write the secret to the container's spec", func() {
+		Expect(err).NotTo(HaveOccurred())
+		// The config file's contents are cached as they are written.
+		configJSON := string(coreint.containerCache[containerID].configJSON)
+		Expect(configJSON).To(ContainSubstring("/bin/sh"))
+		Expect(configJSON).NotTo(ContainSubstring(secretValue))
+		for _, contents := range fos.files {
+			Expect(contents.String()).NotTo(ContainSubstring(secretValue))
+		}
+		spec, err := coreint.GetContainerSpec(containerID, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.Process.Env).NotTo(ContainElement(ContainSubstring(secretValue)))
+	})
+	It("should redact the secret from the process's environment", func() {
+		Expect(err).NotTo(HaveOccurred())
+		pos.files[fmt.Sprintf("/proc/%d/environ", pid)] = "PATH=/usr/bin\x00DB_PASS=" + secretValue + "\x00"
+		env, err := coreint.GetProcessEnviron(pid)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(env).To(Equal([]string{"PATH=/usr/bin", "DB_PASS=" + redactedValue}))
+	})
+	Context("the environment sets the same variable", func() {
+		BeforeEach(func() {
+			params.Environment["DB_PASS"] = "placeholder"
+		})
+		It("should replace it with the secret", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rtime.execs[0].Env).To(ConsistOf("PATH=/usr/bin", "DB_PASS="+secretValue))
+		})
+	})
+	Context("the secret does not exist", func() {
+		BeforeEach(func() {
+			params.SecretEnvironment = map[string]string{"DB_PASS": "missing"}
+		})
+		It("should produce an error naming the secret", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("missing"))
+			Expect(rtime.execs).To(BeEmpty())
+		})
+	})
+	Context("the secret name escapes the secrets path", func() {
+		BeforeEach(func() {
+			params.SecretEnvironment = map[string]string{"DB_PASS": "../db-password"}
+		})
+		It("should produce an error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(rtime.execs).To(BeEmpty())
+		})
+	})
+	Context("the variable name is invalid", func() {
+		BeforeEach(func() {
+			params.SecretEnvironment = map[string]string{"DB=PASS": "db-password"}
+		})
+		It("should produce an error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(rtime.execs).To(BeEmpty())
+		})
+	})
+	Context("the secret contains a NUL byte", func() {
+		BeforeEach(func() {
+			sos.files[filepath.Join(secretsPath, "db-password")] = "hunter\x002"
+		})
+		It("should produce an error without the secret", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).NotTo(ContainSubstring("hunter"))
+		})
+	})
+	Context("the secret is too large", func() {
+		BeforeEach(func() {
+			sos.files[filepath.Join(secretsPath, "db-password")] = strings.Repeat("x", maxSecretSize+1)
+		})
+		It("should produce an error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(rtime.execs).To(BeEmpty())
+		})
+	})
+	Context("the container has no secrets path", func() {
+		BeforeEach(func() {
+			settings.SecretsPath = ""
+		})
+		It("should produce an error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(rtime.execs).To(BeEmpty())
+		})
+	})
+	Describe("the init process referencing secrets", func() {
+		It("should produce an error", func() {
+			Expect(coreint.CreateContainer("def", settings)).To(Succeed())
+			_, err := coreint.ExecProcess("def", prot.ProcessParameters{
+				OCISpecification: oci.Spec{
+					Process: oci.Process{Args: []string{"/bin/sh"}},
+					Root:    oci.Root{Path: "rootfs"},
+				},
+				SecretEnvironment: map[string]string{"DB_PASS": "db-password"},
+			}, &stdio.ConnectionSet{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("an external process referencing secrets", func() {
+		It("should produce an error", func() {
+			params.IsExternal = true
+			_, err := coreint.RunExternalProcess(params, &stdio.ConnectionSet{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Describe("a relative secrets path", func() {
+		It("should be refused", func() {
+			settings.SecretsPath = "secrets"
+			Expect(coreint.CreateContainer("def", settings)).NotTo(Succeed())
+		})
+	})
+	Describe("scrubbing secrets from errors", func() {
+		It("should redact every occurrence of each secret", func() {
+			err := scrubSecrets(errors.New("exec failed: DB_PASS=hunter2 KEY=abc hunter2"), []string{"hunter2", "abc"})
+			Expect(err.Error()).To(Equal("exec failed: DB_PASS=<redacted> KEY=<redacted> <redacted>"))
+		})
+		It("should leave errors without secrets unchanged", func() {
+			orig := errors.New("exec failed")
+			Expect(scrubSecrets(orig, []string{"hunter2"})).To(BeIdenticalTo(orig))
+		})
+	})
+})
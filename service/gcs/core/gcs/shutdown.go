@@ -0,0 +1,90 @@
+package gcs
+
+import (
+	"sort"
+	"time"
+
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/pkg/errors"
+)
+
+// Shutdown drains the GCS of containers before the utility VM stops. Each
+// container is sent its stop signal and given up to the timeout to exit, after
+// which the survivors are killed. Containers are cleaned up, unmounting their
+// storage, as they exit. Containers which were never started are cleaned up
+// immediately. If any container had to be killed, an error listing them is
+// returned.
+func (c *gcsCore) Shutdown(timeout time.Duration) error {
+	c.containerCacheMutex.RLock()
+	entries := make([]*containerCacheEntry, 0, len(c.containerCache))
+	for _, entry := range c.containerCache {
+		entries = append(entries, entry)
+	}
+	c.containerCacheMutex.RUnlock()
+
+	var running []*containerCacheEntry
+	for _, entry := range entries {
+		entry.mutex.Lock()
+		if entry.removed {
+			entry.mutex.Unlock()
+			continue
+		}
+		if entry.container == nil {
+			if err := c.cleanupContainer(entry); err != nil {
+				entry.log().Warn(errors.Wrapf(err, "failed to clean up container %s", entry.ID))
+			}
+			c.removeContainer(entry)
+		} else {
+			if err := entry.container.Kill(entry.StopSignal); err != nil {
+				entry.log().Warn(errors.Wrapf(err, "failed to signal container %s to stop", entry.ID))
+			}
+			running = append(running, entry)
+		}
+		entry.mutex.Unlock()
+	}
+
+	survivors := waitForRemoval(running, timeout)
+	if len(survivors) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(survivors))
+	for _, entry := range survivors {
+		ids = append(ids, entry.ID)
+		entry.mutex.Lock()
+		if !entry.removed {
+			if err := entry.container.Kill(oslayer.SIGKILL); err != nil {
+				entry.log().Warn(errors.Wrapf(err, "failed to kill container %s", entry.ID))
+			}
+		}
+		entry.mutex.Unlock()
+	}
+	for _, entry := range waitForRemoval(survivors, timeout) {
+		entry.log().Warnf("container %s did not exit within %s of being killed", entry.ID, timeout)
+	}
+	sort.Strings(ids)
+	return errors.WithStack(gcserr.NewShutdownTimeoutError(ids, timeout))
+}
+
+// waitForRemoval waits up to the timeout for the given containers to exit and
+// be removed from containerCache, and returns those which weren't.
+func waitForRemoval(entries []*containerCacheEntry, timeout time.Duration) []*containerCacheEntry {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for i, entry := range entries {
+		select {
+		case <-entry.removedCh:
+		case <-timer.C:
+			var remaining []*containerCacheEntry
+			for _, entry := range entries[i:] {
+				select {
+				case <-entry.removedCh:
+				default:
+					remaining = append(remaining, entry)
+				}
+			}
+			return remaining
+		}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package gcs
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	"github.com/pkg/errors"
+)
+
+// deferredStdioBufferSize is the number of bytes of each output stream of an
+// explicitly started init process which are kept until its stdio is
+// attached. Older output is discarded.
+const deferredStdioBufferSize = 64 * 1024
+
+// ringBuffer keeps the most recent bytes written to it, up to its size.
+type ringBuffer struct {
+	data []byte
+	// next is the index the next byte is written at, and full is true once
+	// the buffer has wrapped around.
+	next int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{data: make([]byte, size)}
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	size := len(b.data)
+	if len(p) >= size {
+		copy(b.data, p[len(p)-size:])
+		b.next = 0
+		b.full = true
+		return
+	}
+	n := copy(b.data[b.next:], p)
+	copy(b.data, p[n:])
+	if b.next+len(p) >= size {
+		b.full = true
+	}
+	b.next = (b.next + len(p)) % size
+}
+
+// Bytes returns a copy of the buffered bytes, oldest first.
+func (b *ringBuffer) Bytes() []byte {
+	if !b.full {
+		return append([]byte(nil), b.data[:b.next]...)
+	}
+	return append(append([]byte(nil), b.data[b.next:]...), b.data[:b.next]...)
+}
+
+// deferredConnection is a transport.Connection standing in for one of a
+// process's stdio connections until the host attaches the real one. Output
+// written before then is kept in a ring buffer and flushed on attach, and
+// reads of input block until attach.
+type deferredConnection struct {
+	input bool
+	// mutex guards the fields below. Writes hold it while forwarding to
+	// conn, so that output flushed on attach is never reordered with output
+	// written concurrently.
+	mutex  sync.Mutex
+	buffer *ringBuffer
+	conn   transport.Connection
+	ended  bool
+	// pipe is the GCS's end of the pipe handed to the process by File, if
+	// File has been called.
+	pipe *os.File
+	// attached is closed once conn is set, and done once the stream has
+	// ended.
+	attached chan struct{}
+	done     chan struct{}
+}
+
+var _ transport.Connection = &deferredConnection{}
+
+func newDeferredConnection(input bool) *deferredConnection {
+	c := &deferredConnection{
+		input:    input,
+		attached: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if !input {
+		c.buffer = newRingBuffer(deferredStdioBufferSize)
+	}
+	return c
+}
+
+// Read blocks until the connection is attached, and then reads from the
+// attached connection. It returns io.EOF if the stream ends first.
+func (c *deferredConnection) Read(p []byte) (int, error) {
+	select {
+	case <-c.attached:
+		return c.conn.Read(p)
+	case <-c.done:
+		return 0, io.EOF
+	}
+}
+
+// Write forwards p to the attached connection, or buffers it if the
+// connection has not been attached yet.
+func (c *deferredConnection) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != nil {
+		return c.conn.Write(p)
+	}
+	if c.ended {
+		return 0, errors.New("stdio connection has been closed")
+	}
+	c.buffer.Write(p)
+	return len(p), nil
+}
+
+// Close ends the stream, closing the attached connection if there is one. A
+// stream which has been handed to the process by File instead ends once the
+// GCS's end of the pipe is done, since the runtime closes the connection as
+// soon as the process has its end.
+func (c *deferredConnection) Close() error {
+	c.mutex.Lock()
+	piped := c.pipe != nil
+	c.mutex.Unlock()
+	if !piped {
+		c.end()
+	}
+	return nil
+}
+
+// CloseRead ends an input stream, unblocking any pending Read.
+func (c *deferredConnection) CloseRead() error {
+	if c.input {
+		c.end()
+	}
+	return nil
+}
+
+// CloseWrite closes the write side of the attached connection, if there is
+// one.
+func (c *deferredConnection) CloseWrite() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != nil {
+		return c.conn.CloseWrite()
+	}
+	return nil
+}
+
+// File returns one end of a pipe which can be given to a process. The other
+// end is relayed through the connection.
+func (c *deferredConnection) File() (*os.File, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.pipe != nil {
+		return nil, errors.New("stdio connection has already been given to a process")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create stdio pipe")
+	}
+	if c.input {
+		c.pipe = w
+		go c.relayInput()
+		return r, nil
+	}
+	c.pipe = r
+	go c.relayOutput()
+	return w, nil
+}
+
+// relayInput copies the attached connection into the pipe once it has been
+// attached, closing the pipe when the input ends.
+func (c *deferredConnection) relayInput() {
+	select {
+	case <-c.attached:
+		io.Copy(c.pipe, c.conn)
+	case <-c.done:
+	}
+	c.pipe.Close()
+}
+
+// relayOutput copies the pipe through Write until the process's end of it
+// is closed, and then ends the stream.
+func (c *deferredConnection) relayOutput() {
+	io.Copy(c, c.pipe)
+	c.pipe.Close()
+	c.end()
+}
+
+// end marks the stream as ended, closing the attached connection if there
+// is one.
+func (c *deferredConnection) end() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ended {
+		return
+	}
+	c.ended = true
+	close(c.done)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// attach flushes any buffered output to conn and then relays the stream
+// through it. If the stream has already ended, conn is closed after the
+// flush.
+func (c *deferredConnection) attach(conn transport.Connection) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.buffer != nil {
+		if buffered := c.buffer.Bytes(); len(buffered) > 0 {
+			if _, err := conn.Write(buffered); err != nil {
+				return errors.Wrap(err, "failed to flush buffered output")
+			}
+		}
+		c.buffer = nil
+	}
+	c.conn = conn
+	close(c.attached)
+	if c.ended {
+		conn.Close()
+	}
+	return nil
+}
+
+// deferredStdio holds the stdio connections of an explicitly started init
+// process until the host attaches to them with AttachContainerStdio.
+type deferredStdio struct {
+	in, out, err *deferredConnection
+	attached     bool
+}
+
+// newDeferredStdio returns deferred connections for the stdio pipes which the
+// given process parameters request, and the connection set to start the
+// process with.
+func newDeferredStdio(params prot.ProcessParameters) (*deferredStdio, *stdio.ConnectionSet) {
+	d := &deferredStdio{}
+	set := &stdio.ConnectionSet{}
+	if params.CreateStdInPipe {
+		d.in = newDeferredConnection(true)
+		set.In = d.in
+	}
+	if params.CreateStdOutPipe {
+		d.out = newDeferredConnection(false)
+		set.Out = d.out
+	}
+	if params.CreateStdErrPipe {
+		d.err = newDeferredConnection(false)
+		set.Err = d.err
+	}
+	return d, set
+}
+
+// attach connects the host's connections to the deferred ones. Connections
+// in stdioSet which the process has no counterpart for are closed.
+func (d *deferredStdio) attach(stdioSet *stdio.ConnectionSet) error {
+	pairs := []struct {
+		deferred *deferredConnection
+		conn     transport.Connection
+	}{
+		{d.in, stdioSet.In},
+		{d.out, stdioSet.Out},
+		{d.err, stdioSet.Err},
+	}
+	for _, pair := range pairs {
+		if pair.conn == nil {
+			continue
+		}
+		if pair.deferred == nil {
+			pair.conn.Close()
+			continue
+		}
+		if err := pair.deferred.attach(pair.conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// end ends all of the deferred connections, discarding any output which was
+// never attached.
+func (d *deferredStdio) end() {
+	for _, c := range []*deferredConnection{d.in, d.out, d.err} {
+		if c != nil {
+			c.end()
+		}
+	}
+}
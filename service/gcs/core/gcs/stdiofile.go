@@ -0,0 +1,188 @@
+package gcs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	"github.com/pkg/errors"
+)
+
+// fileConnection is a transport.Connection which writes a process's stdio to
+// a file in place of relaying it to the host.
+type fileConnection struct {
+	file oslayer.File
+	path string
+}
+
+var _ transport.Connection = &fileConnection{}
+
+func (c *fileConnection) Read(p []byte) (int, error) {
+	return c.file.Read(p)
+}
+func (c *fileConnection) Write(p []byte) (int, error) {
+	return c.file.Write(p)
+}
+func (c *fileConnection) Close() error {
+	return c.file.Close()
+}
+
+// CloseRead does nothing, as the file is only written to.
+func (c *fileConnection) CloseRead() error {
+	return nil
+}
+
+// CloseWrite does nothing. The file is closed by Close.
+func (c *fileConnection) CloseWrite() error {
+	return nil
+}
+
+// File returns a duplicate of the file's handle, which can be given to a
+// process.
+func (c *fileConnection) File() (*os.File, error) {
+	f, ok := c.file.(*os.File)
+	if !ok {
+		return nil, errors.Errorf("stdio file %s cannot be given to a process", c.path)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dup stdio file %s", c.path)
+	}
+	return os.NewFile(uintptr(fd), c.path), nil
+}
+
+// redirectStdio returns the stdio connections of a process in the given
+// container, replacing its stdout and stderr with the files the process
+// parameters specify, or otherwise with the system journal if the container
+// uses the journald logging driver. The replaced connections are closed, so
+// that the host sees the end of the output. This function expects
+// containerEntry's mutex to be locked on entry.
+func (c *gcsCore) redirectStdio(containerEntry *containerCacheEntry, params prot.ProcessParameters, terminal bool, stdioSet *stdio.ConnectionSet) (*stdio.ConnectionSet, error) {
+	journald := containerEntry.LoggingDriver == prot.LdJournald
+	if params.StdOutPath == "" && params.StdErrPath == "" && !journald {
+		return stdioSet, nil
+	}
+	if terminal && (params.StdOutPath != "" || params.StdErrPath != "") {
+		return nil, errors.New("stdio cannot be redirected to files for a process with an emulated console")
+	}
+	var (
+		out, errOut transport.Connection
+		err         error
+	)
+	if params.StdOutPath != "" {
+		if out, err = c.openStdioFile(containerEntry, params.StdOutPath, params.StdOutMode); err != nil {
+			return nil, errors.Wrap(err, "failed to redirect stdout")
+		}
+	}
+	if params.StdErrPath != "" {
+		if errOut, err = c.openStdioFile(containerEntry, params.StdErrPath, params.StdErrMode); err != nil {
+			if out != nil {
+				out.Close()
+			}
+			return nil, errors.Wrap(err, "failed to redirect stderr")
+		}
+	}
+	if journald {
+		if out == nil {
+			out = c.newJournalConnection(containerEntry, "stdout", journalPriorityInfo)
+		}
+		if errOut == nil {
+			errOut = c.newJournalConnection(containerEntry, "stderr", journalPriorityErr)
+		}
+	}
+
+	redirected := *stdioSet
+	if out != nil {
+		if stdioSet.Out != nil {
+			stdioSet.Out.Close()
+		}
+		redirected.Out = out
+	}
+	if errOut != nil {
+		if stdioSet.Err != nil {
+			stdioSet.Err.Close()
+		}
+		redirected.Err = errOut
+	}
+	return &redirected, nil
+}
+
+// openStdioFile opens the file at the given path in the container for a
+// process's output, with the given mode. The path must be within one of the
+// container's writable mapped directories or mapped virtual disks, which are
+// mounted at the same paths in the utility VM. The container can write to
+// them, so neither the file nor any directory between the mount and the file
+// may be a symlink, which could otherwise redirect the GCS to any file in the
+// utility VM.
+func (c *gcsCore) openStdioFile(containerEntry *containerCacheEntry, path string, mode prot.StdioFileMode) (transport.Connection, error) {
+	flag := os.O_WRONLY | os.O_CREATE
+	switch mode {
+	case "", prot.SfmTruncate:
+		flag |= os.O_TRUNC
+	case prot.SfmAppend:
+		flag |= os.O_APPEND
+	default:
+		return nil, errors.Errorf("invalid stdio file mode \"%s\" for %s", mode, path)
+	}
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return nil, errors.Errorf("stdio file path %s must be a clean absolute path", path)
+	}
+	root := ""
+	for _, disk := range containerEntry.MappedVirtualDisks {
+		if !disk.AttachOnly && !disk.ReadOnly && pathIsWithin(path, disk.ContainerPath) {
+			root = disk.ContainerPath
+		}
+	}
+	for _, dir := range containerEntry.MappedDirectories {
+		if !dir.ReadOnly && pathIsWithin(path, dir.ContainerPath) {
+			root = dir.ContainerPath
+		}
+	}
+	if root == "" {
+		return nil, errors.Errorf("stdio file path %s is not within a writable mapped directory or mapped virtual disk of container %s", path, containerEntry.ID)
+	}
+	if err := c.checkNoSymlinks(root, filepath.Dir(path)); err != nil {
+		return nil, errors.Wrapf(err, "invalid stdio file path %s", path)
+	}
+	file, err := c.OS.OpenFile(path, flag|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open stdio file %s", path)
+	}
+	return &fileConnection{file: file, path: path}, nil
+}
+
+// checkNoSymlinks checks that none of the directories below root down to and
+// including dir, which must be within root, is a symlink.
+func (c *gcsCore) checkNoSymlinks(root, dir string) error {
+	root = filepath.Clean(root)
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to find %s relative to %s", dir, root)
+	}
+	if rel == "." {
+		return nil
+	}
+	current := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, name)
+		info, err := c.OS.Lstat(current)
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %s", current)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("%s is a symlink", current)
+		}
+	}
+	return nil
+}
+
+// pathIsWithin returns whether the given clean path is strictly within dir.
+func pathIsWithin(path, dir string) bool {
+	dir = filepath.Clean(dir)
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,59 @@
+package gcs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/realos"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stdio files", func() {
+	var (
+		coreint        *gcsCore
+		containerEntry *containerCacheEntry
+		dir            string
+		target         string
+	)
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "stdiofile")
+		Expect(err).NotTo(HaveOccurred())
+		// target stands in for a file of the utility VM outside the mapped
+		// directory.
+		target = filepath.Join(dir, "target")
+		Expect(ioutil.WriteFile(target, []byte("secret\n"), 0600)).To(Succeed())
+		mapped := filepath.Join(dir, "data")
+		Expect(os.MkdirAll(filepath.Join(mapped, "job"), 0755)).To(Succeed())
+
+		coreint = NewGCSCore(mockruntime.NewRuntime(), realos.NewOS())
+		containerEntry = newContainerCacheEntry("abc")
+		containerEntry.MappedDirectories[1] = prot.MappedDirectory{ContainerPath: mapped, Port: 1}
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+	It("should open a file in a writable mapped directory", func() {
+		conn, err := coreint.openStdioFile(containerEntry, filepath.Join(dir, "data/job/out.log"), prot.SfmTruncate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Close()).To(Succeed())
+	})
+	It("should not follow a symlink in place of the file", func() {
+		path := filepath.Join(dir, "data/job/out.log")
+		Expect(os.Symlink(target, path)).To(Succeed())
+		_, err := coreint.openStdioFile(containerEntry, path, prot.SfmTruncate)
+		Expect(err).To(HaveOccurred())
+		Expect(ioutil.ReadFile(target)).To(Equal([]byte("secret\n")))
+	})
+	It("should not follow a symlink in place of a directory", func() {
+		Expect(os.RemoveAll(filepath.Join(dir, "data/job"))).To(Succeed())
+		Expect(os.Symlink(dir, filepath.Join(dir, "data/job"))).To(Succeed())
+		_, err := coreint.openStdioFile(containerEntry, filepath.Join(dir, "data/job/target"), prot.SfmTruncate)
+		Expect(err).To(HaveOccurred())
+		Expect(ioutil.ReadFile(target)).To(Equal([]byte("secret\n")))
+	})
+})
@@ -11,6 +11,7 @@ import (
 	"syscall"
 	"time"
 
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
@@ -30,6 +31,19 @@ const (
 	// mappedDiskMountTimeout is the amount of time before
 	// mountMappedVirtualDisks will give up trying to mount a device.
 	mappedDiskMountTimeout = time.Second * 2
+
+	// deviceNodeInitialBackoff and deviceNodeMaxBackoff bound the interval
+	// between checks for a device node to appear.
+	deviceNodeInitialBackoff = time.Millisecond * 10
+	deviceNodeMaxBackoff     = time.Millisecond * 500
+
+	// defaultDeviceTimeout is the default amount of time before
+	// waitForBlockDevice will give up waiting for a device to appear.
+	defaultDeviceTimeout = time.Second * 5
+
+	// defaultMountTimeout is the default amount of time before a mount or
+	// unmount of a container's storage is given up on.
+	defaultMountTimeout = time.Second * 30
 )
 
 type mountSpec struct {
@@ -55,15 +69,62 @@ const (
 )
 
 // Mount mounts the file system to the specified target.
-func (ms *mountSpec) Mount(osl oslayer.OS, target string) error {
+func (ms *mountSpec) Mount(c *gcsCore, target string) error {
 	options := strings.Join(ms.Options, ",")
-	err := osl.Mount(ms.Source, target, ms.FileSystem, ms.Flags, options)
+	err := c.mount(ms.Source, target, ms.FileSystem, ms.Flags, options)
 	if err != nil {
 		return errors.Wrapf(err, "mount %s %s %s 0x%x %s", ms.Source, target, ms.FileSystem, ms.Flags, options)
 	}
 	return nil
 }
 
+// mount makes the given mount, giving up on it if it hasn't finished within
+// c.MountTimeout, as a mount of an unresponsive backing store may never
+// finish. The abandoned mount is left to finish in the background.
+func (c *gcsCore) mount(source string, target string, fstype string, flags uintptr, data string) error {
+	if c.MountTimeout <= 0 {
+		return c.OS.Mount(source, target, fstype, flags, data)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- c.OS.Mount(source, target, fstype, flags, data)
+	}()
+	timer := time.NewTimer(c.MountTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return errors.Errorf("mount of %s timed out after %s", target, c.MountTimeout)
+	}
+}
+
+// unmount unmounts the given target. If the unmount hasn't finished within
+// c.MountTimeout, the target is instead detached with a lazy unmount, so
+// that an unresponsive backing store can't block the caller forever. The
+// backing store is then released once it is no longer in use.
+func (c *gcsCore) unmount(target string) error {
+	if c.MountTimeout <= 0 {
+		return c.OS.Unmount(target, 0)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- c.OS.Unmount(target, 0)
+	}()
+	timer := time.NewTimer(c.MountTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+	}
+	logrus.Warnf("unmount of %s timed out after %s, detaching it lazily", target, c.MountTimeout)
+	if err := c.OS.Unmount(target, syscall.MNT_DETACH); err != nil {
+		return errors.Wrapf(err, "failed to lazily unmount %s after its unmount timed out", target)
+	}
+	return nil
+}
+
 // getLayerMounts computes the mount specs for the scratch and layers.
 func (c *gcsCore) getLayerMounts(scratch string, layers []prot.Layer) (scratchMount *mountSpec, layerMounts []*mountSpec, err error) {
 	layerMounts = make([]*mountSpec, len(layers))
@@ -72,6 +133,9 @@ func (c *gcsCore) getLayerMounts(scratch string, layers []prot.Layer) (scratchMo
 		if err != nil {
 			return nil, nil, err
 		}
+		if err := c.waitForBlockDevice(deviceName, c.DeviceTimeout); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to wait for layer %s", layer.Path)
+		}
 		options := []string{mountOptionNoLoad}
 		if pmem {
 			// PMEM devices support DAX and should use it
@@ -90,6 +154,9 @@ func (c *gcsCore) getLayerMounts(scratch string, layers []prot.Layer) (scratchMo
 		if err != nil {
 			return nil, nil, err
 		}
+		if err := c.waitForBlockDevice(scratchDevice, c.DeviceTimeout); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to wait for scratch device %s", scratch)
+		}
 		scratchMount = &mountSpec{
 			Source:     scratchDevice,
 			FileSystem: defaultFileSystem,
@@ -108,6 +175,9 @@ func (c *gcsCore) getMappedVirtualDiskMounts(disks []prot.MappedVirtualDisk) ([]
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to get device name for mapped virtual disk %s, lun %d", disk.ContainerPath, disk.Lun)
 		}
+		if err := c.waitForBlockDevice(device, c.DeviceTimeout); err != nil {
+			return nil, errors.Wrapf(err, "failed to wait for mapped virtual disk %s, lun %d", disk.ContainerPath, disk.Lun)
+		}
 		flags := uintptr(0)
 		var options []string
 		if disk.ReadOnly {
@@ -124,6 +194,56 @@ func (c *gcsCore) getMappedVirtualDiskMounts(disks []prot.MappedVirtualDisk) ([]
 	return devices, nil
 }
 
+// maxScsiLun is the highest LUN of a disk attached to the utility VM's SCSI
+// controller.
+const maxScsiLun = 63
+
+// validateMappedVirtualDisks checks the fields of the given mapped virtual
+// disks which are supplied by the host, so that a malformed disk is reported
+// as such rather than as a confusing device lookup or mount failure.
+func validateMappedVirtualDisks(disks []prot.MappedVirtualDisk) error {
+	for _, disk := range disks {
+		if !filepath.IsAbs(disk.ContainerPath) || filepath.Clean(disk.ContainerPath) != disk.ContainerPath {
+			return errors.Wrapf(os.ErrInvalid, "mapped virtual disk path %q must be an absolute and clean path", disk.ContainerPath)
+		}
+		if disk.Lun > maxScsiLun {
+			return errors.Wrapf(os.ErrInvalid, "mapped virtual disk %s has lun %d, which is greater than the maximum of %d", disk.ContainerPath, disk.Lun, maxScsiLun)
+		}
+	}
+	return nil
+}
+
+// waitForBlockDevice waits for the block device at the given path to be
+// present and readable, polling with backoff. The guest kernel may not have
+// created the device node yet for a disk which was just hot added, so this
+// should be called before the device is mounted.
+func (c *gcsCore) waitForBlockDevice(path string, timeout time.Duration) error {
+	backoff := deviceNodeInitialBackoff
+	deadline := time.Now().Add(timeout)
+	for {
+		exists, err := c.OS.PathExists(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check for device %s", path)
+		}
+		if exists {
+			f, err := c.OS.OpenFile(path, os.O_RDONLY, 0)
+			if err == nil {
+				f.Close()
+				return nil
+			}
+			logrus.Debugf("device %s is present but not yet readable: %s", path, err)
+		}
+		if time.Now().After(deadline) {
+			return errors.WithStack(gcserr.NewDeviceNotPresentError(path, timeout))
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > deviceNodeMaxBackoff {
+			backoff = deviceNodeMaxBackoff
+		}
+	}
+}
+
 // scsiLunToName finds the SCSI device with the given LUN. This assumes
 // only one SCSI controller.
 func scsiLunToName(osl oslayer.OS, lun uint8) (string, error) {
@@ -162,26 +282,99 @@ func scsiLunToName(osl oslayer.OS, lun uint8) (string, error) {
 // device name (/dev/sd? or /dev/pmem?).
 // For temporary compatibility, this also accepts just <lun> for SCSI devices.
 func deviceIDToName(osl oslayer.OS, id string) (device string, pmem bool, err error) {
-	const (
-		pmemPrefix = "pmem:"
-		scsiPrefix = "scsi:"
-	)
-
 	if strings.HasPrefix(id, pmemPrefix) {
 		return "/dev/pmem" + id[len(pmemPrefix):], true, nil
 	}
 
+	if lun, ok := deviceIDToSCSILun(id); ok {
+		name, err := scsiLunToName(osl, lun)
+		return name, false, err
+	}
+
+	return "", false, errors.Errorf("unknown device ID %s", id)
+}
+
+const (
+	pmemPrefix = "pmem:"
+	scsiPrefix = "scsi:"
+)
+
+// deviceIDToSCSILun returns the SCSI LUN referred to by the given device ID,
+// as used by deviceIDToName. ok is false if the ID does not refer to a SCSI
+// device.
+func deviceIDToSCSILun(id string) (lun uint8, ok bool) {
 	lunStr := id
 	if strings.HasPrefix(id, scsiPrefix) {
 		lunStr = id[len(scsiPrefix):]
 	}
+	n, err := strconv.ParseInt(lunStr, 10, 8)
+	if err != nil {
+		return 0, false
+	}
+	return uint8(n), true
+}
 
-	if lun, err := strconv.ParseInt(lunStr, 10, 8); err == nil {
-		name, err := scsiLunToName(osl, uint8(lun))
-		return name, false, err
+// validateDeviceLuns checks that none of the given mapped virtual disks use
+// the same SCSI LUN as one of the given layers or the scratch device, since
+// the disk would otherwise be mounted over the layer's device.
+func validateDeviceLuns(scratch string, layers []prot.Layer, disks []prot.MappedVirtualDisk) error {
+	layerLuns := make(map[uint8]string)
+	for _, layer := range layers {
+		if lun, ok := deviceIDToSCSILun(layer.Path); ok {
+			layerLuns[lun] = fmt.Sprintf("layer %s", layer.Path)
+		}
 	}
+	if scratch != "" {
+		if lun, ok := deviceIDToSCSILun(scratch); ok {
+			layerLuns[lun] = fmt.Sprintf("scratch device %s", scratch)
+		}
+	}
+	for _, disk := range disks {
+		if user, ok := layerLuns[disk.Lun]; ok {
+			return errors.Errorf("mapped virtual disk %s uses lun %d, which is already used by %s", disk.ContainerPath, disk.Lun, user)
+		}
+	}
+	return nil
+}
 
-	return "", false, errors.Errorf("unknown device ID %s", id)
+// validateMappedResources checks that none of the given mapped virtual disks
+// share a LUN, and none of the given mapped directories share a port, so that
+// every collision is reported together before any of them are mounted.
+func validateMappedResources(disks []prot.MappedVirtualDisk, dirs []prot.MappedDirectory) error {
+	var collisions []string
+
+	var luns []uint8
+	diskPaths := make(map[uint8][]string)
+	for _, disk := range disks {
+		if _, ok := diskPaths[disk.Lun]; !ok {
+			luns = append(luns, disk.Lun)
+		}
+		diskPaths[disk.Lun] = append(diskPaths[disk.Lun], disk.ContainerPath)
+	}
+	for _, lun := range luns {
+		if paths := diskPaths[lun]; len(paths) > 1 {
+			collisions = append(collisions, fmt.Sprintf("lun %d is used by mapped virtual disks %s", lun, strings.Join(paths, ", ")))
+		}
+	}
+
+	var ports []uint32
+	dirPaths := make(map[uint32][]string)
+	for _, dir := range dirs {
+		if _, ok := dirPaths[dir.Port]; !ok {
+			ports = append(ports, dir.Port)
+		}
+		dirPaths[dir.Port] = append(dirPaths[dir.Port], dir.ContainerPath)
+	}
+	for _, port := range ports {
+		if paths := dirPaths[port]; len(paths) > 1 {
+			collisions = append(collisions, fmt.Sprintf("port %d is used by mapped directories %s", port, strings.Join(paths, ", ")))
+		}
+	}
+
+	if len(collisions) > 0 {
+		return errors.Errorf("conflicting mapped resources: %s", strings.Join(collisions, "; "))
+	}
+	return nil
 }
 
 // mountMappedVirtualDisks mounts the given disks to the given directories,
@@ -201,6 +394,14 @@ func (c *gcsCore) mountMappedVirtualDisks(disks []prot.MappedVirtualDisk, mounts
 			if err := c.OS.MkdirAll(disk.ContainerPath, 0700); err != nil {
 				return errors.Wrapf(err, "failed to create directory for mapped virtual disk %s", disk.ContainerPath)
 			}
+			if disk.FormatIfEmpty {
+				if disk.ReadOnly {
+					return errors.Errorf("mapped virtual disk %s cannot be formatted because it is read-only", disk.ContainerPath)
+				}
+				if err := c.formatIfEmpty(mount.Source); err != nil {
+					return errors.Wrapf(err, "failed to format mapped virtual disk %s", disk.ContainerPath)
+				}
+			}
 
 			// Attempt mounting multiple times up until the given timout. This is
 			// necessary because there is a span of time between when the device
@@ -211,7 +412,7 @@ func (c *gcsCore) mountMappedVirtualDisks(disks []prot.MappedVirtualDisk, mounts
 			// before the timeout.
 			startTime := time.Now()
 			for {
-				err := mount.Mount(c.OS, disk.ContainerPath)
+				err := mount.Mount(c, disk.ContainerPath)
 				if err != nil {
 					currentTime := time.Now()
 					elapsedTime := currentTime.Sub(startTime)
@@ -228,6 +429,127 @@ func (c *gcsCore) mountMappedVirtualDisks(disks []prot.MappedVirtualDisk, mounts
 	return nil
 }
 
+// blkidNoSignatureExitCode is the exit code blkid returns when the device has
+// no recognizable signature.
+const blkidNoSignatureExitCode = 2
+
+// formatIfEmpty formats the given device with the default filesystem if blkid
+// finds no filesystem, partition table, or other signature on it. Devices
+// which have a signature are left untouched.
+func (c *gcsCore) formatIfEmpty(device string) error {
+	cmd := c.OS.Command("blkid", "-p", device)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		// The device has a signature, so it must not be formatted.
+		return nil
+	}
+	if cmd.ExitState().ExitCode() != blkidNoSignatureExitCode {
+		return errors.Wrapf(err, "failed to probe device %s for a signature: %s", device, out)
+	}
+
+	logrus.Infof("formatting empty device %s with %s", device, defaultFileSystem)
+	cmd = c.OS.Command("mkfs."+defaultFileSystem, "-q", device)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to format device %s: %s", device, out)
+	}
+	return nil
+}
+
+// onlineResizeFileSystems is the set of filesystem types which resize2fs can
+// grow while they are mounted.
+var onlineResizeFileSystems = map[string]bool{
+	"ext3": true,
+	"ext4": true,
+}
+
+// resizeMappedVirtualDisk grows the filesystem on the given mounted mapped
+// virtual disk to fill its device. This is needed after the host grows the
+// disk's backing VHD, since the filesystem is not expanded automatically.
+func (c *gcsCore) resizeMappedVirtualDisk(disk prot.MappedVirtualDisk) error {
+	if disk.AttachOnly {
+		return errors.Errorf("mapped virtual disk %s cannot be resized because it is not mounted", disk.ContainerPath)
+	}
+	if disk.ReadOnly {
+		return errors.Errorf("mapped virtual disk %s cannot be resized because it is read-only", disk.ContainerPath)
+	}
+	device, err := scsiLunToName(c.OS, disk.Lun)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get device name for mapped virtual disk %s, lun %d", disk.ContainerPath, disk.Lun)
+	}
+
+	out, err := c.OS.Command("blkid", "-o", "value", "-s", "TYPE", device).Output()
+	if err != nil {
+		return errors.Wrapf(err, "failed to determine the filesystem type of device %s", device)
+	}
+	fsType := strings.TrimSpace(string(out))
+	if !onlineResizeFileSystems[fsType] {
+		return errors.Errorf("the filesystem type \"%s\" of device %s does not support online resize", fsType, device)
+	}
+
+	logrus.Infof("resizing %s filesystem on device %s", fsType, device)
+	out, err = c.OS.Command("resize2fs", device).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "resize2fs failed for device %s: %s", device, out)
+	}
+	return nil
+}
+
+// remountMappedVirtualDisk remounts the given mounted mapped virtual disk in
+// place, read-only or writable as disk.ReadOnly specifies. Making a disk
+// read-only fails while files on it are open for writing, and making one
+// writable fails if its filesystem's journal needs to be replayed.
+func (c *gcsCore) remountMappedVirtualDisk(disk prot.MappedVirtualDisk) error {
+	flags := uintptr(syscall.MS_REMOUNT)
+	if disk.ReadOnly {
+		flags |= syscall.MS_RDONLY
+	} else {
+		// Read-only disks are mounted without loading their journal, so a
+		// filesystem left needing recovery would be written to without its
+		// journal having been replayed.
+		device, err := scsiLunToName(c.OS, disk.Lun)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get device name for mapped virtual disk %s, lun %d", disk.ContainerPath, disk.Lun)
+		}
+		needsRecovery, err := c.journalNeedsRecovery(device)
+		if err != nil {
+			return err
+		}
+		if needsRecovery {
+			return errors.Errorf("mapped virtual disk %s cannot be made writable in place because its journal needs recovery; remove and add it again instead", disk.ContainerPath)
+		}
+	}
+
+	logrus.Infof("remounting mapped virtual disk %s with read-only %t", disk.ContainerPath, disk.ReadOnly)
+	if err := c.mount("", disk.ContainerPath, "", flags, ""); err != nil {
+		if disk.ReadOnly && errors.Cause(err) == syscall.EBUSY {
+			return errors.Wrapf(err, "mapped virtual disk %s cannot be made read-only while files on it are open for writing", disk.ContainerPath)
+		}
+		return errors.Wrapf(err, "failed to remount mapped virtual disk %s", disk.ContainerPath)
+	}
+	return nil
+}
+
+// journalNeedsRecovery returns whether the ext filesystem on the given device
+// has a journal which must be replayed before the filesystem is written to.
+func (c *gcsCore) journalNeedsRecovery(device string) (bool, error) {
+	out, err := c.OS.Command("dumpe2fs", "-h", device).Output()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read the filesystem header of device %s", device)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "Filesystem features:") {
+			continue
+		}
+		for _, feature := range strings.Fields(strings.TrimPrefix(line, "Filesystem features:")) {
+			if feature == "needs_recovery" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 // unmountMappedVirtualDisks unmounts the given container's mapped virtual disk
 // directories.
 func (c *gcsCore) unmountMappedVirtualDisks(disks []prot.MappedVirtualDisk) error {
@@ -244,7 +566,7 @@ func (c *gcsCore) unmountMappedVirtualDisks(disks []prot.MappedVirtualDisk) erro
 				return errors.Wrapf(err, "failed to determine if mapped virtual disk path is mounted %s", disk.ContainerPath)
 			}
 			if exists && mounted {
-				if err := c.OS.Unmount(disk.ContainerPath, 0); err != nil {
+				if err := c.unmount(disk.ContainerPath); err != nil {
 					return errors.Wrapf(err, "failed to unmount mapped virtual disk path %s", disk.ContainerPath)
 				}
 			}
@@ -269,7 +591,7 @@ func (c *gcsCore) mountMappedDirectories(dirs []prot.MappedDirectory) error {
 			mountOptions |= syscall.MS_RDONLY
 			data += ",noload"
 		}
-		if err := c.OS.Mount(dir.ContainerPath, dir.ContainerPath, "9p", mountOptions, data); err != nil {
+		if err := c.mount(dir.ContainerPath, dir.ContainerPath, "9p", mountOptions, data); err != nil {
 			return errors.Wrapf(err, "failed to mount directory for mapped directory %s", dir.ContainerPath)
 		}
 	}
@@ -288,7 +610,7 @@ func (c *gcsCore) unmountMappedDirectories(dirs []prot.MappedDirectory) error {
 			return errors.Wrapf(err, "failed to determine if mapped directory path is mounted %s", dir.ContainerPath)
 		}
 		if exists && mounted {
-			if err := c.OS.Unmount(dir.ContainerPath, 0); err != nil {
+			if err := c.unmount(dir.ContainerPath); err != nil {
 				return errors.Wrapf(err, "failed to unmount mapped directory path %s", dir.ContainerPath)
 			}
 		}
@@ -301,33 +623,41 @@ func (c *gcsCore) unmountMappedDirectories(dirs []prot.MappedDirectory) error {
 // These mountpoints are all stored under a directory reserved for the container
 // with the given ID.
 func (c *gcsCore) mountLayers(id string, scratchMount *mountSpec, layers []*mountSpec) error {
-	layerPrefix, scratchPath, workdirPath, rootfsPath := c.getUnioningPaths(id)
-
-	logrus.Infof("layerPrefix=%s\n", layerPrefix)
-	logrus.Infof("scratchPath:%s\n", scratchPath)
-	logrus.Infof("workdirPath=%s\n", workdirPath)
-	logrus.Infof("rootfsPath=%s\n", rootfsPath)
+	layerPaths := c.getLayerPaths(id, len(layers))
 
 	// Mount the layer devices.
-	layerPaths := make([]string, len(layers)+1)
 	for i, layer := range layers {
-		layerPath := fmt.Sprintf("%s%d", layerPrefix, i)
+		layerPath := layerPaths[i]
 		logrus.Infof("layerPath: %s\n", layerPath)
 		if err := c.OS.MkdirAll(layerPath, 0700); err != nil {
 			return errors.Wrapf(err, "failed to create directory for layer %s", layerPath)
 		}
-		if err := layer.Mount(c.OS, layerPath); err != nil {
+		if err := layer.Mount(c, layerPath); err != nil {
 			return errors.Wrapf(err, "failed to mount layer directory %s", layerPath)
 		}
-		layerPaths[i+1] = layerPath
 	}
+	return c.mountRootfs(id, scratchMount, layerPaths)
+}
+
+// mountRootfs mounts the scratch device, if there is one, and layers it over
+// the already mounted layers at the given paths in a union filesystem, which
+// becomes the container's root filesystem. The layers may belong to another
+// container, whose read-only layers are then shared.
+func (c *gcsCore) mountRootfs(id string, scratchMount *mountSpec, layerPaths []string) error {
+	layerPrefix, scratchPath, workdirPath, rootfsPath := c.getUnioningPaths(id)
+
+	logrus.Infof("layerPrefix=%s\n", layerPrefix)
+	logrus.Infof("scratchPath:%s\n", scratchPath)
+	logrus.Infof("workdirPath=%s\n", workdirPath)
+	logrus.Infof("rootfsPath=%s\n", rootfsPath)
+
 	// TODO: The base path code may be temporary until a more permanent DNS
 	// solution is reached.
 	// NOTE: This should probably still always be kept, because otherwise
 	// mounting will fail when no layer devices are attached. There should
 	// always be at least one layer, even if it's empty, to prevent this
 	// from happening.
-	layerPaths[0] = baseFilesPath
+	layerPaths = append([]string{baseFilesPath}, layerPaths...)
 
 	// Mount the layers into a union filesystem.
 	var mountOptions uintptr
@@ -338,7 +668,7 @@ func (c *gcsCore) mountLayers(id string, scratchMount *mountSpec, layers []*moun
 		return errors.Wrapf(err, "failed to create directory for scratch space %s", scratchPath)
 	}
 	if scratchMount != nil {
-		if err := scratchMount.Mount(c.OS, scratchPath); err != nil {
+		if err := scratchMount.Mount(c, scratchPath); err != nil {
 			return errors.Wrapf(err, "failed to mount scratch directory %s", scratchPath)
 		}
 	} else {
@@ -358,7 +688,7 @@ func (c *gcsCore) mountLayers(id string, scratchMount *mountSpec, layers []*moun
 	}
 	lowerdir := strings.Join(layerPaths, ":")
 	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, upperDir, workdirPath)
-	if err := c.OS.Mount("overlay", rootfsPath, "overlay", mountOptions, options); err != nil {
+	if err := c.mount("overlay", rootfsPath, "overlay", mountOptions, options); err != nil {
 		return errors.Wrapf(err, "failed to mount container root filesystem using overlayfs %s", rootfsPath)
 	}
 
@@ -366,7 +696,8 @@ func (c *gcsCore) mountLayers(id string, scratchMount *mountSpec, layers []*moun
 }
 
 // unmountLayers unmounts the union filesystem for the container with the given
-// ID, as well as any devices whose mountpoints were layers in that filesystem.
+// ID, as well as any devices whose mountpoints were layers in that filesystem,
+// unless those layers are still used by the container's clones.
 func (c *gcsCore) unmountLayers(id string) error {
 	layerPrefix, scratchPath, _, rootfsPath := c.getUnioningPaths(id)
 
@@ -380,7 +711,7 @@ func (c *gcsCore) unmountLayers(id string) error {
 		return errors.Wrapf(err, "failed to determine if container root filesystem path is mounted %s", rootfsPath)
 	}
 	if exists && mounted {
-		if err := c.OS.Unmount(rootfsPath, 0); err != nil {
+		if err := c.unmount(rootfsPath); err != nil {
 			return errors.Wrapf(err, "failed to unmount container root filesystem %s", rootfsPath)
 		}
 	}
@@ -395,12 +726,15 @@ func (c *gcsCore) unmountLayers(id string) error {
 		return errors.Wrapf(err, "failed to determine if scratch path is mounted %s", scratchPath)
 	}
 	if exists && mounted {
-		if err := c.OS.Unmount(scratchPath, 0); err != nil {
+		if err := c.unmount(scratchPath); err != nil {
 			return errors.Wrapf(err, "failed to unmount scratch path %s", scratchPath)
 		}
 	}
 
 	// Clean up layer path operations
+	if c.layersInUse(id) {
+		return nil
+	}
 	layerPaths, err := filepath.Glob(layerPrefix + "*")
 	if err != nil {
 		return errors.Wrap(err, "failed to get layer paths using Glob")
@@ -415,7 +749,7 @@ func (c *gcsCore) unmountLayers(id string) error {
 			return errors.Wrapf(err, "failed to determine if layer path is mounted %s", layerPath)
 		}
 		if exists && mounted {
-			if err := c.OS.Unmount(layerPath, 0); err != nil {
+			if err := c.unmount(layerPath); err != nil {
 				return errors.Wrapf(err, "failed to unmount layer path %s", layerPath)
 			}
 		}
@@ -427,8 +761,12 @@ func (c *gcsCore) unmountLayers(id string) error {
 // destroyContainerStorage removes any files the GCS stores on disk for the
 // container with the given ID.
 // These files include directories used for mountpoints in the union filesystem
-// and config files.
+// and config files. They are kept while the container's layers are still used
+// by its clones.
 func (c *gcsCore) destroyContainerStorage(id string) error {
+	if c.layersInUse(id) {
+		return nil
+	}
 	if err := c.OS.RemoveAll(c.getContainerStoragePath(id)); err != nil {
 		return errors.Wrapf(err, "failed to remove container storage path for container %s", id)
 	}
@@ -436,8 +774,72 @@ func (c *gcsCore) destroyContainerStorage(id string) error {
 }
 
 // writeConfigFile writes the given oci.Spec to disk so that it can be consumed
-// by an OCI runtime.
-func (c *gcsCore) writeConfigFile(id string, config oci.Spec) error {
+// by an OCI runtime. Any hooks stored in the container's cache entry are
+// appended to those already present in the spec, and any annotations stored
+// there are added to the spec's annotations, replacing existing values.
+func (c *gcsCore) writeConfigFile(containerEntry *containerCacheEntry, config oci.Spec) error {
+	id := containerEntry.ID
+	if hooks := containerEntry.Hooks; hooks != nil {
+		// The spec's hooks may be shared with the caller's, so they are
+		// copied rather than appended to.
+		merged := &oci.Hooks{}
+		if config.Hooks != nil {
+			merged.Prestart = append(merged.Prestart, config.Hooks.Prestart...)
+			merged.Poststart = append(merged.Poststart, config.Hooks.Poststart...)
+			merged.Poststop = append(merged.Poststop, config.Hooks.Poststop...)
+		}
+		merged.Prestart = append(merged.Prestart, hooks.Prestart...)
+		merged.Poststart = append(merged.Poststart, hooks.Poststart...)
+		merged.Poststop = append(merged.Poststop, hooks.Poststop...)
+		config.Hooks = merged
+	}
+	if len(containerEntry.Annotations) > 0 {
+		annotations := make(map[string]string, len(config.Annotations)+len(containerEntry.Annotations))
+		for k, v := range config.Annotations {
+			annotations[k] = v
+		}
+		for k, v := range containerEntry.Annotations {
+			annotations[k] = v
+		}
+		config.Annotations = annotations
+	}
+	applyCpusetToSpec(containerEntry, &config)
+	if containerEntry.cgroupsPath != "" {
+		// The host supplied an existing cgroup, which takes precedence over
+		// the spec's.
+		if config.Linux == nil {
+			config.Linux = &oci.Linux{}
+		}
+		config.Linux.CgroupsPath = containerEntry.cgroupsPath
+	} else if config.Linux != nil {
+		containerEntry.cgroupsPath = config.Linux.CgroupsPath
+	}
+	if !hasResolvConfMount(config.Mounts) {
+		// The spec's mounts may be shared with the caller's, so they are
+		// copied rather than appended to.
+		config.Mounts = append(append([]oci.Mount(nil), config.Mounts...), c.resolvConfMount(id))
+	}
+	if containerEntry.ReapingInit {
+		config.Process.Args = append([]string{reapingInitContainerPath, "--"}, config.Process.Args...)
+		reapingInitMount := oci.Mount{
+			Destination: reapingInitContainerPath,
+			Type:        "bind",
+			Source:      c.ReapInitPath,
+			Options:     []string{"bind", "ro"},
+		}
+		// The spec's mounts may be shared with the caller's, so they are
+		// copied rather than appended to.
+		config.Mounts = append(append([]oci.Mount(nil), config.Mounts...), reapingInitMount)
+	}
+	if containerEntry.RootReadonly {
+		// runC creates the mount points for the spec's mounts before
+		// remounting the root read-only, so they are unaffected.
+		config.Root.Readonly = true
+	}
+	if err := validateSpec(&config); err != nil {
+		return errors.Wrapf(err, "invalid OCI spec for container %s", id)
+	}
+
 	configPath := c.getConfigPath(id)
 	if err := c.OS.MkdirAll(filepath.Dir(configPath), 0700); err != nil {
 		return errors.Wrapf(err, "failed to create config file directory for container %s", id)
@@ -447,13 +849,46 @@ func (c *gcsCore) writeConfigFile(id string, config oci.Spec) error {
 		return errors.Wrapf(err, "failed to create config file for container %s", id)
 	}
 	defer configFile.Close()
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode config file for container %s", id)
+	}
 	writer := bufio.NewWriter(configFile)
-	if err := json.NewEncoder(writer).Encode(config); err != nil {
+	if _, err := writer.Write(configJSON); err != nil {
 		return errors.Wrapf(err, "failed to write contents of config file for container %s", id)
 	}
 	if err := writer.Flush(); err != nil {
 		return errors.Wrapf(err, "failed to flush to config file for container %s", id)
 	}
+	containerEntry.configJSON = configJSON
+	return nil
+}
+
+// validateSpec checks the fields of the given oci.Spec which the runtime
+// requires, so that a bad spec is reported with the offending field rather
+// than by a failure of the runtime.
+func validateSpec(config *oci.Spec) error {
+	if len(config.Process.Args) == 0 {
+		return errors.WithStack(gcserr.NewInvalidSpecError("process.args", "must not be empty"))
+	}
+	if config.Process.Args[0] == "" {
+		return errors.WithStack(gcserr.NewInvalidSpecError("process.args[0]", "must not be empty"))
+	}
+	if config.Root.Path == "" {
+		return errors.WithStack(gcserr.NewInvalidSpecError("root.path", "must not be empty"))
+	}
+	for i, mount := range config.Mounts {
+		field := fmt.Sprintf("mounts[%d]", i)
+		if mount.Destination == "" {
+			return errors.WithStack(gcserr.NewInvalidSpecError(field+".destination", "must not be empty"))
+		}
+		if !filepath.IsAbs(mount.Destination) {
+			return errors.WithStack(gcserr.NewInvalidSpecError(field+".destination", fmt.Sprintf("\"%s\" must be an absolute path", mount.Destination)))
+		}
+		if mount.Source == "" {
+			return errors.WithStack(gcserr.NewInvalidSpecError(field+".source", fmt.Sprintf("for %s must not be empty", mount.Destination)))
+		}
+	}
 	return nil
 }
 
@@ -478,7 +913,106 @@ func (c *gcsCore) getUnioningPaths(id string) (layerPrefix string, scratchPath s
 	return
 }
 
+// getLayerPaths returns the mountpoints of the given number of layers of the
+// container with the given ID.
+func (c *gcsCore) getLayerPaths(id string, count int) []string {
+	layerPrefix, _, _, _ := c.getUnioningPaths(id)
+	layerPaths := make([]string, count)
+	for i := range layerPaths {
+		layerPaths[i] = fmt.Sprintf("%s%d", layerPrefix, i)
+	}
+	return layerPaths
+}
+
+// getCloneLayerPaths returns the mountpoints of the layers of the container
+// with the given ID, which a clone of it shares, checking that they are still
+// mounted, and the ID of the container in whose storage they are mounted.
+func (c *gcsCore) getCloneLayerPaths(sourceID string) ([]string, string, error) {
+	sourceEntry := c.lockContainer(sourceID)
+	if sourceEntry == nil {
+		return nil, "", errors.WithStack(gcserr.NewContainerDoesNotExistError(sourceID))
+	}
+	defer sourceEntry.mutex.Unlock()
+	if sourceEntry.layerOwner == "" {
+		return nil, "", errors.Errorf("the layers of container %s have been released", sourceID)
+	}
+	for _, layerPath := range sourceEntry.layerPaths {
+		mounted, err := c.OS.PathIsMounted(layerPath)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to determine if layer path is mounted %s", layerPath)
+		}
+		if !mounted {
+			return nil, "", errors.Errorf("layer %s of container %s is no longer mounted", layerPath, sourceID)
+		}
+	}
+	return append([]string{}, sourceEntry.layerPaths...), sourceEntry.layerOwner, nil
+}
+
+// claimLayers records that the layers mounted in the storage of the given
+// container are used by it. It fails if layers of an earlier container with
+// the same ID are still mounted there for its clones.
+// This function expects the entry's mutex to be locked on entry.
+func (c *gcsCore) claimLayers(containerEntry *containerCacheEntry) error {
+	c.layerUsersMutex.Lock()
+	defer c.layerUsersMutex.Unlock()
+	if c.layerUsers[containerEntry.ID] > 0 {
+		return errors.Errorf("the layers of a removed container %s are still used by its clones", containerEntry.ID)
+	}
+	c.layerUsers[containerEntry.ID] = 1
+	containerEntry.layerOwner = containerEntry.ID
+	return nil
+}
+
+// acquireLayers records that the layers mounted in the storage of the
+// container with the given ID are also used by the given container, a clone.
+// It fails if they have been released by all of their users in the meantime.
+// This function expects the entry's mutex to be locked on entry.
+func (c *gcsCore) acquireLayers(containerEntry *containerCacheEntry, owner string) error {
+	c.layerUsersMutex.Lock()
+	defer c.layerUsersMutex.Unlock()
+	if c.layerUsers[owner] == 0 {
+		return errors.Errorf("the layers of container %s are no longer mounted", owner)
+	}
+	c.layerUsers[owner]++
+	containerEntry.layerOwner = owner
+	return nil
+}
+
+// releaseLayers drops the given container's reference to its layers, if it
+// still holds one. It returns the ID of the container in whose storage the
+// layers are mounted if this was the last reference, so that they can be
+// unmounted and removed, and an empty string otherwise.
+// This function expects the entry's mutex to be locked on entry.
+func (c *gcsCore) releaseLayers(containerEntry *containerCacheEntry) string {
+	owner := containerEntry.layerOwner
+	if owner == "" {
+		return ""
+	}
+	containerEntry.layerOwner = ""
+	c.layerUsersMutex.Lock()
+	defer c.layerUsersMutex.Unlock()
+	c.layerUsers[owner]--
+	if c.layerUsers[owner] > 0 {
+		return ""
+	}
+	delete(c.layerUsers, owner)
+	return owner
+}
+
+// layersInUse returns whether the layers mounted in the storage of the
+// container with the given ID are still used by it or by its clones.
+func (c *gcsCore) layersInUse(id string) bool {
+	c.layerUsersMutex.Lock()
+	defer c.layerUsersMutex.Unlock()
+	return c.layerUsers[id] > 0
+}
+
 // getConfigPath returns the path to the container's config file.
 func (c *gcsCore) getConfigPath(id string) string {
 	return filepath.Join(c.getContainerStoragePath(id), "config.json")
 }
+
+// getResolvConfPath returns the path to the container's own resolv.conf.
+func (c *gcsCore) getResolvConfPath(id string) string {
+	return filepath.Join(c.getContainerStoragePath(id), "resolv.conf")
+}
@@ -1,21 +1,118 @@
 package gcs
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/mockos"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer/realos"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/Microsoft/opengcs/service/gcs/runtime/mockruntime"
 	"github.com/Microsoft/opengcs/service/gcs/runtime/runc"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+// delayedDeviceOS wraps an oslayer.OS, reporting that paths don't exist until
+// they have been checked for a given number of times.
+type delayedDeviceOS struct {
+	oslayer.OS
+	polls     int
+	remaining int
+}
+
+func (o *delayedDeviceOS) PathExists(name string) (bool, error) {
+	o.polls++
+	if o.remaining > 0 {
+		o.remaining--
+		return false, nil
+	}
+	return o.OS.PathExists(name)
+}
+
+// scriptedOS wraps an oslayer.OS, recording the commands created through it
+// and making each command exit with the code and produce the output given for
+// its program name.
+type scriptedOS struct {
+	oslayer.OS
+	exitCodes map[string]int
+	outputs   map[string]string
+	commands  [][]string
+}
+
+func (o *scriptedOS) Command(name string, arg ...string) oslayer.Cmd {
+	o.commands = append(o.commands, append([]string{name}, arg...))
+	return &scriptedCmd{Cmd: o.OS.Command(name, arg...), exitCode: o.exitCodes[name], output: o.outputs[name]}
+}
+
+// scriptedCmd wraps an oslayer.Cmd, making it exit with the given code and
+// produce the given output.
+type scriptedCmd struct {
+	oslayer.Cmd
+	exitCode int
+	output   string
+}
+
+func (c *scriptedCmd) err() error {
+	if c.exitCode != 0 {
+		return fmt.Errorf("exit status %d", c.exitCode)
+	}
+	return nil
+}
+func (c *scriptedCmd) ExitState() oslayer.ProcessExitState {
+	return mockos.NewProcessExitState(c.exitCode)
+}
+func (c *scriptedCmd) Run() error {
+	return c.err()
+}
+func (c *scriptedCmd) Output() ([]byte, error) {
+	return []byte(c.output), c.err()
+}
+func (c *scriptedCmd) CombinedOutput() ([]byte, error) {
+	return []byte(c.output), c.err()
+}
+
+// blockingMountOS wraps an oslayer.OS, making mounts and unmounts other than
+// lazy unmounts block until release is closed. It records the flags of the
+// unmounts made through it, which may be made concurrently.
+type blockingMountOS struct {
+	oslayer.OS
+	release      chan struct{}
+	mutex        sync.Mutex
+	unmountFlags []int
+}
+
+func (o *blockingMountOS) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	<-o.release
+	return o.OS.Mount(source, target, fstype, flags, data)
+}
+
+func (o *blockingMountOS) Unmount(target string, flags int) error {
+	o.mutex.Lock()
+	o.unmountFlags = append(o.unmountFlags, flags)
+	o.mutex.Unlock()
+	if flags&syscall.MNT_DETACH == 0 {
+		<-o.release
+	}
+	return o.OS.Unmount(target, flags)
+}
+
+func (o *blockingMountOS) flags() []int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]int{}, o.unmountFlags...)
+}
+
 var _ = Describe("Storage", func() {
 	var (
 		coreint *gcsCore
@@ -28,6 +125,282 @@ var _ = Describe("Storage", func() {
 		coreint = NewGCSCore(rtime, os)
 	})
 
+	Describe("waiting for block devices", func() {
+		var (
+			dos *delayedDeviceOS
+			err error
+		)
+		BeforeEach(func() {
+			dos = &delayedDeviceOS{OS: mockos.NewOS()}
+			coreint = NewGCSCore(mockruntime.NewRuntime(), dos)
+		})
+		JustBeforeEach(func() {
+			err = coreint.waitForBlockDevice("/dev/sdc", time.Millisecond*50)
+		})
+		Context("the device is present immediately", func() {
+			It("should not produce an error", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dos.polls).To(Equal(1))
+			})
+		})
+		Context("the device appears after several polls", func() {
+			BeforeEach(func() {
+				dos.remaining = 3
+			})
+			It("should wait for the device", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(dos.polls).To(Equal(4))
+			})
+		})
+		Context("the device never appears", func() {
+			BeforeEach(func() {
+				dos.remaining = 1000000
+			})
+			It("should produce a timeout error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("timed out"))
+			})
+			It("should produce a transient error", func() {
+				Expect(gcserr.IsTransient(err)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("getting mounts for layers and mapped virtual disks", func() {
+		var (
+			dos *delayedDeviceOS
+			err error
+		)
+		BeforeEach(func() {
+			dos = &delayedDeviceOS{OS: mockos.NewOS(), remaining: 3}
+			coreint = NewGCSCore(mockruntime.NewRuntime(), dos)
+		})
+		Context("mapped virtual disk devices appear late", func() {
+			var (
+				mounts []*mountSpec
+			)
+			JustBeforeEach(func() {
+				mounts, err = coreint.getMappedVirtualDiskMounts([]prot.MappedVirtualDisk{{ContainerPath: "/path/inside/container", Lun: 4}})
+			})
+			It("should wait for the device", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(mounts).To(HaveLen(1))
+				Expect(dos.polls).To(Equal(4))
+			})
+			Context("the device never appears", func() {
+				BeforeEach(func() {
+					dos.remaining = 1000000
+					coreint.DeviceTimeout = time.Millisecond * 50
+				})
+				It("should produce a timeout error", func() {
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("timed out"))
+				})
+			})
+		})
+		Context("layer devices appear late", func() {
+			var (
+				scratch *mountSpec
+				layers  []*mountSpec
+			)
+			JustBeforeEach(func() {
+				scratch, layers, err = coreint.getLayerMounts("3", []prot.Layer{{Path: "0"}})
+			})
+			It("should wait for the devices", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(scratch).NotTo(BeNil())
+				Expect(layers).To(HaveLen(1))
+				Expect(dos.polls).To(Equal(5))
+			})
+		})
+	})
+
+	Describe("mounting a mapped virtual disk which may need formatting", func() {
+		var (
+			sos  *scriptedOS
+			disk prot.MappedVirtualDisk
+			err  error
+		)
+		BeforeEach(func() {
+			sos = &scriptedOS{OS: mockos.NewOS(), exitCodes: make(map[string]int), outputs: make(map[string]string)}
+			coreint = NewGCSCore(mockruntime.NewRuntime(), sos)
+			disk = prot.MappedVirtualDisk{
+				ContainerPath:     "/path/inside/container",
+				Lun:               4,
+				CreateInUtilityVM: true,
+				FormatIfEmpty:     true,
+			}
+		})
+		JustBeforeEach(func() {
+			err = coreint.mountMappedVirtualDisks([]prot.MappedVirtualDisk{disk}, []*mountSpec{{Source: "/dev/sdc", FileSystem: defaultFileSystem}})
+		})
+		Context("the disk is empty", func() {
+			BeforeEach(func() {
+				sos.exitCodes["blkid"] = blkidNoSignatureExitCode
+			})
+			It("should format the disk", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(sos.commands).To(Equal([][]string{
+					{"blkid", "-p", "/dev/sdc"},
+					{"mkfs.ext4", "-q", "/dev/sdc"},
+				}))
+			})
+		})
+		Context("the disk has an existing filesystem", func() {
+			It("should not format the disk", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(sos.commands).To(Equal([][]string{
+					{"blkid", "-p", "/dev/sdc"},
+				}))
+			})
+		})
+		Context("the disk can't be probed", func() {
+			BeforeEach(func() {
+				sos.exitCodes["blkid"] = 4
+			})
+			It("should produce an error without formatting the disk", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(sos.commands).To(HaveLen(1))
+			})
+		})
+		Context("FormatIfEmpty is not set", func() {
+			BeforeEach(func() {
+				disk.FormatIfEmpty = false
+			})
+			It("should not probe the disk", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(sos.commands).To(BeEmpty())
+			})
+		})
+		Context("the disk is read-only", func() {
+			BeforeEach(func() {
+				disk.ReadOnly = true
+			})
+			It("should produce an error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(sos.commands).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("resizing a mapped virtual disk", func() {
+		var (
+			sos  *scriptedOS
+			disk prot.MappedVirtualDisk
+			err  error
+		)
+		BeforeEach(func() {
+			sos = &scriptedOS{OS: mockos.NewOS(), exitCodes: make(map[string]int), outputs: map[string]string{"blkid": "ext4\n"}}
+			coreint = NewGCSCore(mockruntime.NewRuntime(), sos)
+			disk = prot.MappedVirtualDisk{
+				ContainerPath:     "/path/inside/container",
+				Lun:               4,
+				CreateInUtilityVM: true,
+			}
+		})
+		JustBeforeEach(func() {
+			err = coreint.resizeMappedVirtualDisk(disk)
+		})
+		Context("the disk has an ext4 filesystem", func() {
+			It("should run resize2fs on the device", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(sos.commands).To(HaveLen(2))
+				Expect(sos.commands[0][0]).To(Equal("blkid"))
+				Expect(sos.commands[1]).To(Equal([]string{"resize2fs", sos.commands[0][len(sos.commands[0])-1]}))
+			})
+		})
+		Context("the disk has a filesystem which can't be resized online", func() {
+			BeforeEach(func() {
+				sos.outputs["blkid"] = "xfs\n"
+			})
+			It("should produce an error without running resize2fs", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(sos.commands).To(HaveLen(1))
+			})
+		})
+		Context("resize2fs fails", func() {
+			BeforeEach(func() {
+				sos.exitCodes["resize2fs"] = 1
+				sos.outputs["resize2fs"] = "resize2fs: Device or resource busy"
+			})
+			It("should produce an error containing resize2fs's output", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Device or resource busy"))
+			})
+		})
+		Context("the disk is read-only", func() {
+			BeforeEach(func() {
+				disk.ReadOnly = true
+			})
+			It("should produce an error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(sos.commands).To(BeEmpty())
+			})
+		})
+		Context("the disk is attach-only", func() {
+			BeforeEach(func() {
+				disk.AttachOnly = true
+			})
+			It("should produce an error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(sos.commands).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("mounting and unmounting with a timeout", func() {
+		var (
+			bos  *blockingMountOS
+			dirs []prot.MappedDirectory
+		)
+		BeforeEach(func() {
+			bos = &blockingMountOS{OS: mockos.NewOS(), release: make(chan struct{})}
+			coreint = NewGCSCore(mockruntime.NewRuntime(), bos)
+			coreint.MountTimeout = 10 * time.Millisecond
+			dirs = []prot.MappedDirectory{{ContainerPath: "/mnt/share", CreateInUtilityVM: true, Port: 1}}
+		})
+		AfterEach(func() {
+			// Let the abandoned mounts and unmounts finish.
+			select {
+			case <-bos.release:
+			default:
+				close(bos.release)
+			}
+		})
+		Context("the unmount blocks", func() {
+			It("should fall back to a lazy unmount", func() {
+				Expect(coreint.unmountMappedDirectories(dirs)).To(Succeed())
+				Expect(bos.flags()).To(Equal([]int{0, syscall.MNT_DETACH}))
+			})
+		})
+		Context("the unmount finishes in time", func() {
+			BeforeEach(func() {
+				close(bos.release)
+			})
+			It("should not unmount lazily", func() {
+				Expect(coreint.unmountMappedDirectories(dirs)).To(Succeed())
+				Expect(bos.flags()).To(Equal([]int{0}))
+			})
+		})
+		Context("the mount blocks", func() {
+			It("should produce an error", func() {
+				err := coreint.mountMappedDirectories(dirs)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("timed out"))
+			})
+		})
+		Context("there is no timeout", func() {
+			BeforeEach(func() {
+				coreint.MountTimeout = 0
+				close(bos.release)
+			})
+			It("should wait for the unmount", func() {
+				Expect(coreint.unmountMappedDirectories(dirs)).To(Succeed())
+				Expect(bos.flags()).To(Equal([]int{0}))
+			})
+		})
+	})
+
 	Describe("getting the container paths", func() {
 		var (
 			validID string
@@ -192,6 +565,196 @@ var _ = Describe("Storage", func() {
 		})
 	})
 
+	Describe("writing the config file", func() {
+		var (
+			containerID    string
+			containerEntry *containerCacheEntry
+			spec           oci.Spec
+			writtenSpec    oci.Spec
+			err            error
+		)
+		BeforeEach(func() {
+			containerID = "configtest"
+			containerEntry = newContainerCacheEntry(containerID)
+			spec = oci.Spec{
+				Version: oci.Version,
+				Process: oci.Process{Args: []string{"/bin/sh"}},
+				Root:    oci.Root{Path: "rootfs"},
+			}
+		})
+		AfterEach(func() {
+			err := coreint.destroyContainerStorage(containerID)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		JustBeforeEach(func() {
+			err = coreint.writeConfigFile(containerEntry, spec)
+			Expect(err).NotTo(HaveOccurred())
+			contents, err := ioutil.ReadFile(coreint.getConfigPath(containerID))
+			Expect(err).NotTo(HaveOccurred())
+			writtenSpec = oci.Spec{}
+			err = json.Unmarshal(contents, &writtenSpec)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		Context("the container has no hooks", func() {
+			It("should not add hooks to the spec", func() {
+				Expect(writtenSpec.Hooks).To(BeNil())
+			})
+		})
+		Context("both the spec and the container have hooks", func() {
+			BeforeEach(func() {
+				spec.Hooks = &oci.Hooks{Prestart: []oci.Hook{{Path: "/bin/spec-hook"}}}
+				containerEntry.Hooks = &oci.Hooks{Prestart: []oci.Hook{{Path: "/bin/container-hook"}}}
+			})
+			It("should run the spec's hooks before the container's", func() {
+				Expect(writtenSpec.Hooks.Prestart).To(Equal([]oci.Hook{{Path: "/bin/spec-hook"}, {Path: "/bin/container-hook"}}))
+			})
+			It("should not modify the caller's hooks", func() {
+				Expect(spec.Hooks.Prestart).To(Equal([]oci.Hook{{Path: "/bin/spec-hook"}}))
+			})
+			It("should not add the container's hooks twice when written again", func() {
+				Expect(coreint.writeConfigFile(containerEntry, spec)).To(Succeed())
+				contents, err := ioutil.ReadFile(coreint.getConfigPath(containerID))
+				Expect(err).NotTo(HaveOccurred())
+				var rewritten oci.Spec
+				Expect(json.Unmarshal(contents, &rewritten)).To(Succeed())
+				Expect(rewritten.Hooks.Prestart).To(HaveLen(2))
+			})
+		})
+		Context("the container has a read-only root filesystem", func() {
+			BeforeEach(func() {
+				containerEntry.RootReadonly = true
+				spec.Root = oci.Root{Path: "rootfs"}
+				spec.Mounts = []oci.Mount{
+					{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "nodev"}},
+				}
+			})
+			It("should mark the root read-only", func() {
+				Expect(writtenSpec.Root).To(Equal(oci.Root{Path: "rootfs", Readonly: true}))
+			})
+			It("should leave the spec's mounts writable", func() {
+				Expect(writtenSpec.Mounts).To(Equal(append(spec.Mounts, coreint.resolvConfMount(containerID))))
+			})
+		})
+		Context("the container does not have a read-only root filesystem", func() {
+			It("should leave the root writable", func() {
+				Expect(writtenSpec.Root.Readonly).To(BeFalse())
+			})
+		})
+		Context("the container has annotations", func() {
+			BeforeEach(func() {
+				containerEntry.Annotations = map[string]string{
+					"io.microsoft.sandbox": "true",
+					"com.example.owner":    "test",
+				}
+			})
+			Context("the spec has no annotations of its own", func() {
+				It("should write the container's annotations", func() {
+					Expect(writtenSpec.Annotations).To(Equal(containerEntry.Annotations))
+				})
+			})
+			Context("the spec has annotations of its own", func() {
+				BeforeEach(func() {
+					spec.Annotations = map[string]string{
+						"com.example.owner": "spec",
+						"com.example.other": "value",
+					}
+				})
+				It("should merge the annotations, preferring the container's values", func() {
+					Expect(writtenSpec.Annotations).To(Equal(map[string]string{
+						"io.microsoft.sandbox": "true",
+						"com.example.owner":    "test",
+						"com.example.other":    "value",
+					}))
+				})
+			})
+		})
+		Context("the container has hooks", func() {
+			var (
+				timeout int
+			)
+			BeforeEach(func() {
+				timeout = 10
+				containerEntry.Hooks = &oci.Hooks{
+					Prestart:  []oci.Hook{{Path: "/sbin/setup-network", Args: []string{"setup-network", "eth0"}, Timeout: &timeout}},
+					Poststart: []oci.Hook{{Path: "/bin/true"}},
+					Poststop:  []oci.Hook{{Path: "/sbin/teardown-network"}},
+				}
+			})
+			Context("the spec has no hooks of its own", func() {
+				It("should write the container's hooks", func() {
+					Expect(writtenSpec.Hooks).To(Equal(containerEntry.Hooks))
+				})
+			})
+			Context("the spec has hooks of its own", func() {
+				BeforeEach(func() {
+					spec.Hooks = &oci.Hooks{
+						Prestart: []oci.Hook{{Path: "/bin/spec-hook"}},
+					}
+				})
+				It("should append the container's hooks to the spec's hooks", func() {
+					Expect(writtenSpec.Hooks.Prestart).To(Equal([]oci.Hook{
+						{Path: "/bin/spec-hook"},
+						{Path: "/sbin/setup-network", Args: []string{"setup-network", "eth0"}, Timeout: &timeout},
+					}))
+					Expect(writtenSpec.Hooks.Poststart).To(Equal(containerEntry.Hooks.Poststart))
+					Expect(writtenSpec.Hooks.Poststop).To(Equal(containerEntry.Hooks.Poststop))
+				})
+			})
+		})
+	})
+
+	Describe("writing an invalid config file", func() {
+		var (
+			containerEntry *containerCacheEntry
+			spec           oci.Spec
+			err            error
+		)
+		BeforeEach(func() {
+			containerEntry = newContainerCacheEntry("invalidconfigtest")
+			spec = oci.Spec{
+				Version: oci.Version,
+				Process: oci.Process{Args: []string{"/bin/sh"}},
+				Root:    oci.Root{Path: "rootfs"},
+			}
+		})
+		JustBeforeEach(func() {
+			err = coreint.writeConfigFile(containerEntry, spec)
+		})
+		Context("the process args are empty", func() {
+			BeforeEach(func() {
+				spec.Process.Args = nil
+			})
+			It("should produce an error naming the field", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("process.args"))
+			})
+			It("should not write the config file", func() {
+				Expect(containerEntry.configJSON).To(BeNil())
+			})
+		})
+		Context("the root path is missing", func() {
+			BeforeEach(func() {
+				spec.Root = oci.Root{}
+			})
+			It("should produce an error naming the field", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("root.path"))
+			})
+		})
+		Context("a mount destination is relative", func() {
+			BeforeEach(func() {
+				spec.Mounts = []oci.Mount{
+					{Destination: "/dev", Type: "tmpfs", Source: "tmpfs"},
+					{Destination: "tmp", Type: "tmpfs", Source: "tmpfs"},
+				}
+			})
+			It("should produce an error naming the mount", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("mounts[1].destination"))
+			})
+		})
+	})
+
 	Describe("mounting and unmounting layers", func() {
 		var (
 			containerID string
@@ -0,0 +1,176 @@
+package gcs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	gcserr "github.com/Microsoft/opengcs/service/gcs/errors"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+)
+
+// defaultUsageSamples is the default number of resource usage samples kept
+// for each container. At the minimum interval, this covers the last minute.
+const defaultUsageSamples = 600
+
+// minUsageSampleInterval is the shortest interval at which a container's
+// resource usage may be sampled.
+const minUsageSampleInterval = 100 * time.Millisecond
+
+// usageHistory is a ring of a container's most recent resource usage
+// samples. Its memory is bounded by its length, however long the container
+// runs.
+type usageHistory struct {
+	samples []prot.UsageSample
+	// next is the index at which the next sample is stored, and full is true
+	// once samples has wrapped around.
+	next int
+	full bool
+}
+
+func newUsageHistory(length int) *usageHistory {
+	if length <= 0 {
+		length = defaultUsageSamples
+	}
+	return &usageHistory{samples: make([]prot.UsageSample, length)}
+}
+
+// add stores the given sample, replacing the oldest sample if the history is
+// full.
+func (h *usageHistory) add(sample prot.UsageSample) {
+	h.samples[h.next] = sample
+	h.next++
+	if h.next == len(h.samples) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// list returns a copy of the samples in the history, oldest first.
+func (h *usageHistory) list() []prot.UsageSample {
+	if !h.full {
+		return append([]prot.UsageSample{}, h.samples[:h.next]...)
+	}
+	return append(append([]prot.UsageSample{}, h.samples[h.next:]...), h.samples[:h.next]...)
+}
+
+// GetContainerUsageHistory returns the container's recent resource usage
+// samples, oldest first. The container must have been created with a usage
+// sample interval.
+func (c *gcsCore) GetContainerUsageHistory(id string) ([]prot.UsageSample, error) {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return nil, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+
+	if containerEntry.usageHistory == nil {
+		return nil, errors.Errorf("resource usage sampling is not enabled for container %s", id)
+	}
+	return containerEntry.usageHistory.list(), nil
+}
+
+// GetScratchUsage returns the space used on the filesystem holding the
+// container's writable layer, which is its scratch device if it has one.
+func (c *gcsCore) GetScratchUsage(id string) (prot.ScratchUsage, error) {
+	containerEntry := c.lockContainer(id)
+	if containerEntry == nil {
+		return prot.ScratchUsage{}, errors.WithStack(gcserr.NewContainerDoesNotExistError(id))
+	}
+	defer containerEntry.mutex.Unlock()
+
+	// The upper directory only holds the container's writes once the overlay
+	// is mounted over it.
+	_, scratchPath, _, rootfsPath := c.getUnioningPaths(id)
+	mounted, err := c.OS.PathIsMounted(rootfsPath)
+	if err != nil {
+		return prot.ScratchUsage{}, errors.Wrapf(err, "failed to determine if the rootfs of container %s is mounted", id)
+	}
+	if !mounted {
+		return prot.ScratchUsage{}, errors.WithStack(gcserr.NewContainerNotReadyError(id, "its root filesystem is not mounted"))
+	}
+
+	upperDir := filepath.Join(scratchPath, "upper")
+	var stat syscall.Statfs_t
+	if err := c.OS.Statfs(upperDir, &stat); err != nil {
+		return prot.ScratchUsage{}, errors.Wrapf(err, "failed to statfs %s", upperDir)
+	}
+	blockSize := uint64(stat.Bsize)
+	return prot.ScratchUsage{
+		UsedBytes:  (stat.Blocks - stat.Bfree) * blockSize,
+		TotalBytes: stat.Blocks * blockSize,
+	}, nil
+}
+
+// sampleUsage records the container's resource usage in its usageHistory at
+// the given interval, until its init process exits or it is removed. Samples
+// are only taken once the init process has been created, since the
+// container's cgroups don't exist before then.
+func (c *gcsCore) sampleUsage(containerEntry *containerCacheEntry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-containerEntry.initExited:
+			return
+		case <-ticker.C:
+		}
+
+		containerEntry.mutex.Lock()
+		if containerEntry.removed {
+			containerEntry.mutex.Unlock()
+			return
+		}
+		if containerEntry.hasRunInitProcess {
+			sample, err := c.readUsage(containerEntry)
+			if err != nil {
+				containerEntry.log().Debugf("failed to sample resource usage of container %s: %s", containerEntry.ID, err)
+			} else {
+				containerEntry.usageHistory.add(sample)
+			}
+		}
+		containerEntry.mutex.Unlock()
+	}
+}
+
+// readUsage reads the container's current resource usage from its cgroups.
+//
+// This function expects the container entry's mutex to be locked on entry.
+func (c *gcsCore) readUsage(containerEntry *containerCacheEntry) (prot.UsageSample, error) {
+	sample := prot.UsageSample{TimestampInMs: time.Now().UnixNano() / int64(time.Millisecond)}
+	var err error
+	sample.CPUUsageInNs, err = c.readCgroupStat(containerEntry, c.cgroups().cpuUsage())
+	if err != nil {
+		return prot.UsageSample{}, err
+	}
+	sample.MemoryUsageInBytes, err = c.readCgroupStat(containerEntry, c.cgroups().memoryUsage())
+	if err != nil {
+		return prot.UsageSample{}, err
+	}
+	return sample, nil
+}
+
+// readCgroupUint reads a cgroup file holding a single unsigned integer.
+func (c *gcsCore) readCgroupUint(path string) (uint64, error) {
+	file, err := c.OS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to open %s", path)
+	}
+	defer file.Close()
+	// A 64 bit integer and a newline never exceed this many bytes.
+	contents, err := ioutil.ReadAll(io.LimitReader(file, 32))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read %s", path)
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return value, nil
+}
@@ -2,11 +2,16 @@
 package mockcore
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/core"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer/mockos"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
 )
 
 // CreateContainerCall captures the arguments of CreateContainer.
@@ -15,6 +20,17 @@ type CreateContainerCall struct {
 	Settings prot.VMHostedContainerSettings
 }
 
+// StartContainerCall captures the arguments of StartContainer.
+type StartContainerCall struct {
+	ID string
+}
+
+// AttachContainerStdioCall captures the arguments of AttachContainerStdio.
+type AttachContainerStdioCall struct {
+	ID       string
+	StdioSet *stdio.ConnectionSet
+}
+
 // ExecProcessCall captures the arguments of ExecProcess.
 type ExecProcessCall struct {
 	ID       string
@@ -22,12 +38,97 @@ type ExecProcessCall struct {
 	StdioSet *stdio.ConnectionSet
 }
 
+// ResumeContainerCall captures the arguments of ResumeContainer.
+type ResumeContainerCall struct {
+	ID string
+}
+
+// GetContainerSpecCall captures the arguments of GetContainerSpec.
+type GetContainerSpecCall struct {
+	ID     string
+	Redact bool
+}
+
+// GetContainerStateCall captures the arguments of GetContainerState.
+type GetContainerStateCall struct {
+	ID string
+}
+
+// GetProcessEnvironCall captures the arguments of GetProcessEnviron.
+type GetProcessEnvironCall struct {
+	Pid int
+}
+
+// GetProcessCmdlineCall captures the arguments of GetProcessCmdline.
+type GetProcessCmdlineCall struct {
+	Pid int
+}
+
+// GetContainerResourcesCall captures the arguments of GetContainerResources.
+type GetContainerResourcesCall struct {
+	ID string
+}
+
+// GetContainerUsageHistoryCall captures the arguments of
+// GetContainerUsageHistory.
+type GetContainerUsageHistoryCall struct {
+	ID string
+}
+
+// GetContainerHistoryCall captures the arguments of GetContainerHistory.
+type GetContainerHistoryCall struct {
+	ID string
+}
+
+// GetScratchUsageCall captures the arguments of GetScratchUsage.
+type GetScratchUsageCall struct {
+	ID string
+}
+
+// WaitContainerReadyCall captures the arguments of WaitContainerReady.
+type WaitContainerReadyCall struct {
+	ID      string
+	Timeout time.Duration
+}
+
+// CheckpointContainerCall captures the arguments of CheckpointContainer.
+type CheckpointContainerCall struct {
+	ID        string
+	ImagePath string
+	Options   runtime.CheckpointOptions
+}
+
+// RestoreContainerCall captures the arguments of RestoreContainer.
+type RestoreContainerCall struct {
+	ID        string
+	ImagePath string
+	Params    prot.ProcessParameters
+	Options   runtime.CheckpointOptions
+	StdioSet  *stdio.ConnectionSet
+}
+
 // SignalContainerCall captures the arguments of SignalContainer.
 type SignalContainerCall struct {
 	ID     string
 	Signal oslayer.Signal
 }
 
+// StopContainerCall captures the arguments of StopContainer.
+type StopContainerCall struct {
+	ID      string
+	Timeout time.Duration
+}
+
+// SignalAllContainersCall captures the arguments of SignalAllContainers.
+type SignalAllContainersCall struct {
+	Signal oslayer.Signal
+}
+
+// ShutdownCall captures the arguments of Shutdown.
+type ShutdownCall struct {
+	Timeout time.Duration
+}
+
 // SignalProcessCall captures the arguments of SignalProcess.
 type SignalProcessCall struct {
 	Pid     int
@@ -36,7 +137,8 @@ type SignalProcessCall struct {
 
 // ListProcessesCall captures the arguments of ListProcesses.
 type ListProcessesCall struct {
-	ID string
+	ID        string
+	Reconcile bool
 }
 
 // RunExternalProcessCall captures the arguments of RunExternalProcess.
@@ -45,6 +147,11 @@ type RunExternalProcessCall struct {
 	StdioSet *stdio.ConnectionSet
 }
 
+// ReapProcessCall captures the arguments of ReapProcess.
+type ReapProcessCall struct {
+	Pid int
+}
+
 // ModifySettingsCall captures the arguments of ModifySettings.
 type ModifySettingsCall struct {
 	ID      string
@@ -72,20 +179,51 @@ type ResizeConsoleCall struct {
 	Width  uint16
 }
 
+// SetProcessRlimitCall captures the arguments of SetProcessRlimit.
+type SetProcessRlimitCall struct {
+	Pid    int
+	Rlimit oci.LinuxRlimit
+}
+
 // MockCore serves as an argument capture mechanism which implements the Core
 // interface. Arguments passed to one of its methods are stored to be queried
 // later.
 type MockCore struct {
 	LastCreateContainer           CreateContainerCall
+	LastStartContainer            StartContainerCall
+	LastAttachContainerStdio      AttachContainerStdioCall
 	LastExecProcess               ExecProcessCall
+	LastExecProcessWithResult     ExecProcessCall
+	LastResumeContainer           ResumeContainerCall
+	LastGetContainerSpec          GetContainerSpecCall
+	LastGetContainerState         GetContainerStateCall
+	LastGetContainerResources     GetContainerResourcesCall
+	LastGetProcessEnviron         GetProcessEnvironCall
+	LastGetProcessCmdline         GetProcessCmdlineCall
+	LastGetContainerUsageHistory  GetContainerUsageHistoryCall
+	LastGetContainerHistory       GetContainerHistoryCall
+	LastGetScratchUsage           GetScratchUsageCall
+	LastWaitContainerReady        WaitContainerReadyCall
+	LastCheckpointContainer       CheckpointContainerCall
+	LastRestoreContainer          RestoreContainerCall
 	LastSignalContainer           SignalContainerCall
+	LastStopContainer             StopContainerCall
+	LastSignalAllContainers       SignalAllContainersCall
+	LastShutdown                  ShutdownCall
 	LastSignalProcess             SignalProcessCall
 	LastListProcesses             ListProcessesCall
 	LastRunExternalProcess        RunExternalProcessCall
+	LastReapProcess               ReapProcessCall
 	LastModifySettings            ModifySettingsCall
 	LastRegisterContainerExitHook RegisterContainerExitHookCall
 	LastRegisterProcessExitHook   RegisterProcessExitHookCall
 	LastResizeConsole             ResizeConsoleCall
+	LastSetProcessRlimit          SetProcessRlimitCall
+	// HealthCalls is the number of times Health has been called.
+	HealthCalls int
+	// ListMappedVirtualDisksCalls is the number of times
+	// ListMappedVirtualDisks has been called.
+	ListMappedVirtualDisksCalls int
 }
 
 // CreateContainer captures its arguments and returns a nil error.
@@ -97,6 +235,21 @@ func (c *MockCore) CreateContainer(id string, settings prot.VMHostedContainerSet
 	return nil
 }
 
+// StartContainer captures its arguments and returns a nil error.
+func (c *MockCore) StartContainer(id string) error {
+	c.LastStartContainer = StartContainerCall{ID: id}
+	return nil
+}
+
+// AttachContainerStdio captures its arguments and returns a nil error.
+func (c *MockCore) AttachContainerStdio(id string, stdioSet *stdio.ConnectionSet) error {
+	c.LastAttachContainerStdio = AttachContainerStdioCall{
+		ID:       id,
+		StdioSet: stdioSet,
+	}
+	return nil
+}
+
 // ExecProcess captures its arguments and returns pid 101 and a nil error.
 func (c *MockCore) ExecProcess(id string, params prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (pid int, err error) {
 	c.LastExecProcess = ExecProcessCall{
@@ -107,12 +260,163 @@ func (c *MockCore) ExecProcess(id string, params prot.ProcessParameters, stdioSe
 	return 101, nil
 }
 
+// ExecProcessWithResult captures its arguments and returns pid 101, with a
+// console allocated if one was requested, and a nil error.
+func (c *MockCore) ExecProcessWithResult(id string, params prot.ProcessParameters, stdioSet *stdio.ConnectionSet) (core.ExecResult, error) {
+	c.LastExecProcessWithResult = ExecProcessCall{
+		ID:       id,
+		Params:   params,
+		StdioSet: stdioSet,
+	}
+	return core.ExecResult{
+		Pid:              101,
+		ConsoleAllocated: params.EmulateConsole,
+		ConsoleOpen:      params.EmulateConsole,
+	}, nil
+}
+
+// ResumeContainer captures its arguments and returns a nil error.
+func (c *MockCore) ResumeContainer(id string) error {
+	c.LastResumeContainer = ResumeContainerCall{ID: id}
+	return nil
+}
+
+// GetContainerSpec captures its arguments and returns a spec with version
+// "1.0.0" and a nil error.
+func (c *MockCore) GetContainerSpec(id string, redact bool) (oci.Spec, error) {
+	c.LastGetContainerSpec = GetContainerSpecCall{ID: id, Redact: redact}
+	return oci.Spec{Version: "1.0.0"}, nil
+}
+
+// GetContainerState captures its arguments and returns a running state for a
+// container whose init process has run, as well as a nil error.
+func (c *MockCore) GetContainerState(id string) (prot.ContainerState, error) {
+	c.LastGetContainerState = GetContainerStateCall{ID: id}
+	return prot.ContainerState{Status: prot.CsRunning, HasRunInitProcess: true}, nil
+}
+
+// GetContainerResources captures its arguments and returns a single mapped
+// directory, as well as a nil error.
+func (c *MockCore) GetContainerResources(id string) (prot.ContainerResources, error) {
+	c.LastGetContainerResources = GetContainerResourcesCall{ID: id}
+	return prot.ContainerResources{
+		MappedDirectories: []prot.MappedDirectory{{ContainerPath: "/data", Port: 1}},
+	}, nil
+}
+
+// ListMappedVirtualDisks counts the call and returns a mounted disk in each of
+// two containers, as well as a nil error.
+func (c *MockCore) ListMappedVirtualDisks() ([]prot.MappedVirtualDiskStatus, error) {
+	c.ListMappedVirtualDisksCalls++
+	return []prot.MappedVirtualDiskStatus{
+		{
+			MappedVirtualDisk: prot.MappedVirtualDisk{ContainerPath: "/data", Lun: 1, CreateInUtilityVM: true},
+			ContainerID:       "abc",
+			Mounted:           true,
+		},
+		{
+			MappedVirtualDisk: prot.MappedVirtualDisk{ContainerPath: "/logs", Lun: 2, CreateInUtilityVM: true},
+			ContainerID:       "def",
+			Mounted:           true,
+		},
+	}, nil
+}
+
+// GetProcessEnviron captures its arguments and returns a single variable and
+// a nil error.
+func (c *MockCore) GetProcessEnviron(pid int) ([]string, error) {
+	c.LastGetProcessEnviron = GetProcessEnvironCall{Pid: pid}
+	return []string{"PATH=/usr/bin"}, nil
+}
+
+// GetProcessCmdline captures its arguments and returns a single argument and
+// a nil error.
+func (c *MockCore) GetProcessCmdline(pid int) ([]string, error) {
+	c.LastGetProcessCmdline = GetProcessCmdlineCall{Pid: pid}
+	return []string{"/bin/sh"}, nil
+}
+
+// GetContainerUsageHistory captures its arguments and returns a single sample,
+// as well as a nil error.
+func (c *MockCore) GetContainerUsageHistory(id string) ([]prot.UsageSample, error) {
+	c.LastGetContainerUsageHistory = GetContainerUsageHistoryCall{ID: id}
+	return []prot.UsageSample{{TimestampInMs: 1, CPUUsageInNs: 1000, MemoryUsageInBytes: 4096}}, nil
+}
+
+// GetContainerHistory captures its arguments and returns the container's
+// creation, as well as a nil error.
+func (c *MockCore) GetContainerHistory(id string) ([]prot.ContainerEvent, error) {
+	c.LastGetContainerHistory = GetContainerHistoryCall{ID: id}
+	return []prot.ContainerEvent{{TimestampInMs: 1, Type: prot.CeCreated}}, nil
+}
+
+// GetScratchUsage captures its arguments and returns a scratch layer with 1MB
+// of its 1GB used, as well as a nil error.
+func (c *MockCore) GetScratchUsage(id string) (prot.ScratchUsage, error) {
+	c.LastGetScratchUsage = GetScratchUsageCall{ID: id}
+	return prot.ScratchUsage{UsedBytes: 1 << 20, TotalBytes: 1 << 30}, nil
+}
+
+// WaitContainerReady captures its arguments and returns a nil error.
+func (c *MockCore) WaitContainerReady(id string, timeout time.Duration) error {
+	c.LastWaitContainerReady = WaitContainerReadyCall{
+		ID:      id,
+		Timeout: timeout,
+	}
+	return nil
+}
+
+// CheckpointContainer captures its arguments and returns a nil error.
+func (c *MockCore) CheckpointContainer(id string, imagePath string, options runtime.CheckpointOptions) error {
+	c.LastCheckpointContainer = CheckpointContainerCall{
+		ID:        id,
+		ImagePath: imagePath,
+		Options:   options,
+	}
+	return nil
+}
+
+// RestoreContainer captures its arguments and returns pid 101 and a nil
+// error.
+func (c *MockCore) RestoreContainer(id string, imagePath string, params prot.ProcessParameters, options runtime.CheckpointOptions, stdioSet *stdio.ConnectionSet) (pid int, err error) {
+	c.LastRestoreContainer = RestoreContainerCall{
+		ID:        id,
+		ImagePath: imagePath,
+		Params:    params,
+		Options:   options,
+		StdioSet:  stdioSet,
+	}
+	return 101, nil
+}
+
 // SignalContainer captures its arguments and returns a nil error.
 func (c *MockCore) SignalContainer(id string, signal oslayer.Signal) error {
 	c.LastSignalContainer = SignalContainerCall{ID: id, Signal: signal}
 	return nil
 }
 
+// StopContainer captures its arguments. If given a timeout, it reports pid
+// 101 as still running.
+func (c *MockCore) StopContainer(id string, timeout time.Duration) ([]int, error) {
+	c.LastStopContainer = StopContainerCall{ID: id, Timeout: timeout}
+	if timeout == 0 {
+		return nil, nil
+	}
+	return []int{101}, nil
+}
+
+// SignalAllContainers captures its arguments and returns a nil error.
+func (c *MockCore) SignalAllContainers(signal oslayer.Signal) error {
+	c.LastSignalAllContainers = SignalAllContainersCall{Signal: signal}
+	return nil
+}
+
+// Shutdown captures its arguments and returns a nil error.
+func (c *MockCore) Shutdown(timeout time.Duration) error {
+	c.LastShutdown = ShutdownCall{Timeout: timeout}
+	return nil
+}
+
 // SignalProcess captures its arguments and returns a nil error.
 func (c *MockCore) SignalProcess(pid int, options prot.SignalProcessOptions) error {
 	c.LastSignalProcess = SignalProcessCall{
@@ -125,8 +429,8 @@ func (c *MockCore) SignalProcess(pid int, options prot.SignalProcessOptions) err
 // ListProcesses captures its arguments. It then returns a process with pid
 // 101, command "sh -c testexe", CreatedByRuntime true, and IsZombie true, as
 // well as a nil error.
-func (c *MockCore) ListProcesses(id string) ([]runtime.ContainerProcessState, error) {
-	c.LastListProcesses = ListProcessesCall{ID: id}
+func (c *MockCore) ListProcesses(id string, reconcile bool) ([]runtime.ContainerProcessState, error) {
+	c.LastListProcesses = ListProcessesCall{ID: id, Reconcile: reconcile}
 	return []runtime.ContainerProcessState{
 		runtime.ContainerProcessState{
 			Pid:              101,
@@ -147,6 +451,17 @@ func (c *MockCore) RunExternalProcess(params prot.ProcessParameters, stdioSet *s
 	return 101, nil
 }
 
+// ReapProcess captures its arguments and returns a nil error.
+func (c *MockCore) ReapProcess(pid int) error {
+	c.LastReapProcess = ReapProcessCall{Pid: pid}
+	return nil
+}
+
+// ReapExitedProcesses returns 0.
+func (c *MockCore) ReapExitedProcesses() int {
+	return 0
+}
+
 // ModifySettings captures its arguments and returns a nil error.
 func (c *MockCore) ModifySettings(id string, request prot.ResourceModificationRequestResponse) error {
 	c.LastModifySettings = ModifySettingsCall{
@@ -176,6 +491,15 @@ func (c *MockCore) RegisterProcessExitHook(pid int, exitHook func(oslayer.Proces
 	return nil
 }
 
+// CoreDumpPath returns a path under /cores for a process killed by a signal,
+// and an empty string for any other process.
+func (c *MockCore) CoreDumpPath(pid int, state oslayer.ProcessExitState) string {
+	if _, ok := state.Signal(); !ok {
+		return ""
+	}
+	return fmt.Sprintf("/cores/core.%d", pid)
+}
+
 // ResizeConsole captures its arguments and returns a nil error.
 func (c *MockCore) ResizeConsole(pid int, height, width uint16) error {
 	c.LastResizeConsole = ResizeConsoleCall{
@@ -186,3 +510,24 @@ func (c *MockCore) ResizeConsole(pid int, height, width uint16) error {
 
 	return nil
 }
+
+// SetProcessRlimit captures its arguments and returns a nil error.
+func (c *MockCore) SetProcessRlimit(pid int, rlimit oci.LinuxRlimit) error {
+	c.LastSetProcessRlimit = SetProcessRlimitCall{
+		Pid:    pid,
+		Rlimit: rlimit,
+	}
+	return nil
+}
+
+// Health counts the call and returns the health of a GCS with version "mock",
+// which has been up for a second and has 1 container with 2 processes.
+func (c *MockCore) Health() prot.GcsHealth {
+	c.HealthCalls++
+	return prot.GcsHealth{
+		Version:        "mock",
+		UptimeInMs:     1000,
+		ContainerCount: 1,
+		ProcessCount:   2,
+	}
+}
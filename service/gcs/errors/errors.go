@@ -3,6 +3,9 @@ package errors
 import (
 	"fmt"
 	"io"
+	"os"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -21,6 +24,27 @@ const (
 	HrVmcomputeInvalidJSON = Hresult(-1070137075) // 0xC037010D
 )
 
+// ErrorCode identifies the kind of a GCS error, so that hosts can handle it
+// without matching its message. Codes are part of the protocol with the
+// host, so existing codes must never be changed or reused.
+type ErrorCode string
+
+const (
+	CodeContainerExists       = ErrorCode("ContainerExists")
+	CodeContainerDoesNotExist = ErrorCode("ContainerDoesNotExist")
+	CodeProcessDoesNotExist   = ErrorCode("ProcessDoesNotExist")
+	CodeProcessExitEvicted    = ErrorCode("ProcessExitEvicted")
+	CodeTooManyProcesses      = ErrorCode("TooManyProcesses")
+	CodeExecDenied            = ErrorCode("ExecDenied")
+	CodeContainerStartTimeout = ErrorCode("ContainerStartTimeout")
+	CodeShutdownTimeout       = ErrorCode("ShutdownTimeout")
+	CodeContainerNotReady     = ErrorCode("ContainerNotReady")
+	CodeDeviceNotPresent      = ErrorCode("DeviceNotPresent")
+	CodeInvalidSpec           = ErrorCode("InvalidSpec")
+	CodeCapacityExceeded      = ErrorCode("CapacityExceeded")
+	CodeNotATty               = ErrorCode("NotATty")
+)
+
 type containerExistsError struct {
 	ID string
 }
@@ -28,6 +52,12 @@ type containerExistsError struct {
 func (e *containerExistsError) Error() string {
 	return fmt.Sprintf("a container with the ID \"%s\" already exists", e.ID)
 }
+func (e *containerExistsError) Code() ErrorCode {
+	return CodeContainerExists
+}
+func (e *containerExistsError) Transient() bool {
+	return false
+}
 
 // NewContainerExistsError returns a *containerExistsError referring to the
 // given ID.
@@ -42,6 +72,12 @@ type containerDoesNotExistError struct {
 func (e *containerDoesNotExistError) Error() string {
 	return fmt.Sprintf("a container with the ID \"%s\" does not exist", e.ID)
 }
+func (e *containerDoesNotExistError) Code() ErrorCode {
+	return CodeContainerDoesNotExist
+}
+func (e *containerDoesNotExistError) Transient() bool {
+	return false
+}
 
 // NewContainerDoesNotExistError returns a *containerDoesNotExistError
 // referring to the given ID.
@@ -56,6 +92,12 @@ type processDoesNotExistError struct {
 func (e *processDoesNotExistError) Error() string {
 	return fmt.Sprintf("a process with the pid %d does not exist", e.Pid)
 }
+func (e *processDoesNotExistError) Code() ErrorCode {
+	return CodeProcessDoesNotExist
+}
+func (e *processDoesNotExistError) Transient() bool {
+	return false
+}
 
 // NewProcessDoesNotExistError returns a *processDoesNotExistError referring to
 // the given pid.
@@ -63,6 +105,178 @@ func NewProcessDoesNotExistError(pid int) *processDoesNotExistError {
 	return &processDoesNotExistError{Pid: pid}
 }
 
+type processExitEvictedError struct {
+	Pid int
+}
+
+func (e *processExitEvictedError) Error() string {
+	return fmt.Sprintf("the exit state of the process with the pid %d is no longer available", e.Pid)
+}
+func (e *processExitEvictedError) Code() ErrorCode {
+	return CodeProcessExitEvicted
+}
+func (e *processExitEvictedError) Transient() bool {
+	return false
+}
+
+// NewProcessExitEvictedError returns a *processExitEvictedError referring to
+// the given pid.
+func NewProcessExitEvictedError(pid int) *processExitEvictedError {
+	return &processExitEvictedError{Pid: pid}
+}
+
+type notATtyError struct {
+	Pid int
+}
+
+func (e *notATtyError) Error() string {
+	return fmt.Sprintf("process %d does not have a console and cannot be resized", e.Pid)
+}
+func (e *notATtyError) Code() ErrorCode {
+	return CodeNotATty
+}
+func (e *notATtyError) Transient() bool {
+	return false
+}
+
+// NewNotATtyError returns a *notATtyError referring to the given process,
+// which was not created with a console.
+func NewNotATtyError(pid int) *notATtyError {
+	return &notATtyError{Pid: pid}
+}
+
+type tooManyProcessesError struct {
+	ID    string
+	Limit int
+}
+
+func (e *tooManyProcessesError) Error() string {
+	return fmt.Sprintf("too many processes: the container with the ID \"%s\" already has the maximum of %d concurrently executing processes", e.ID, e.Limit)
+}
+func (e *tooManyProcessesError) Code() ErrorCode {
+	return CodeTooManyProcesses
+}
+func (e *tooManyProcessesError) Transient() bool {
+	return true
+}
+
+// NewTooManyProcessesError returns a *tooManyProcessesError referring to the
+// given container ID and process limit.
+func NewTooManyProcessesError(id string, limit int) *tooManyProcessesError {
+	return &tooManyProcessesError{ID: id, Limit: limit}
+}
+
+type execDeniedError struct {
+	ID     string
+	Args   []string
+	Reason string
+}
+
+func (e *execDeniedError) Error() string {
+	return fmt.Sprintf("executing %q in the container with the ID \"%s\" was denied: %s", e.Args, e.ID, e.Reason)
+}
+func (e *execDeniedError) Code() ErrorCode {
+	return CodeExecDenied
+}
+func (e *execDeniedError) Transient() bool {
+	return false
+}
+func (e *execDeniedError) Hresult() Hresult {
+	return HrAccessDenied
+}
+
+// NewExecDeniedError returns a *execDeniedError referring to the given
+// container ID, the arguments of the process which was denied, and the
+// reason it was denied.
+func NewExecDeniedError(id string, args []string, reason string) *execDeniedError {
+	return &execDeniedError{ID: id, Args: args, Reason: reason}
+}
+
+type containerStartTimeoutError struct {
+	ID      string
+	Timeout time.Duration
+}
+
+func (e *containerStartTimeoutError) Error() string {
+	return fmt.Sprintf("the container with the ID \"%s\" did not start within %s", e.ID, e.Timeout)
+}
+func (e *containerStartTimeoutError) Code() ErrorCode {
+	return CodeContainerStartTimeout
+}
+func (e *containerStartTimeoutError) Transient() bool {
+	return true
+}
+
+// NewContainerStartTimeoutError returns a *containerStartTimeoutError
+// referring to the given container ID and timeout.
+func NewContainerStartTimeoutError(id string, timeout time.Duration) *containerStartTimeoutError {
+	return &containerStartTimeoutError{ID: id, Timeout: timeout}
+}
+
+type shutdownTimeoutError struct {
+	IDs     []string
+	Timeout time.Duration
+}
+
+func (e *shutdownTimeoutError) Error() string {
+	return fmt.Sprintf("the containers with the IDs %q did not stop within %s and were killed", e.IDs, e.Timeout)
+}
+func (e *shutdownTimeoutError) Code() ErrorCode {
+	return CodeShutdownTimeout
+}
+func (e *shutdownTimeoutError) Transient() bool {
+	return false
+}
+
+// NewShutdownTimeoutError returns a *shutdownTimeoutError referring to the
+// IDs of the containers which did not stop within the given timeout.
+func NewShutdownTimeoutError(ids []string, timeout time.Duration) *shutdownTimeoutError {
+	return &shutdownTimeoutError{IDs: ids, Timeout: timeout}
+}
+
+type containerNotReadyError struct {
+	ID     string
+	Reason string
+}
+
+func (e *containerNotReadyError) Error() string {
+	return fmt.Sprintf("the container with the ID \"%s\" is not ready: %s", e.ID, e.Reason)
+}
+func (e *containerNotReadyError) Code() ErrorCode {
+	return CodeContainerNotReady
+}
+func (e *containerNotReadyError) Transient() bool {
+	return true
+}
+
+// NewContainerNotReadyError returns a *containerNotReadyError referring to the
+// given container ID and the reason it isn't ready, such as "its root
+// filesystem is not mounted".
+func NewContainerNotReadyError(id string, reason string) *containerNotReadyError {
+	return &containerNotReadyError{ID: id, Reason: reason}
+}
+
+type capacityExceededError struct {
+	ID    string
+	Limit int
+}
+
+func (e *capacityExceededError) Error() string {
+	return fmt.Sprintf("capacity exceeded: the container with the ID \"%s\" cannot be created, as the maximum of %d containers already exist", e.ID, e.Limit)
+}
+func (e *capacityExceededError) Code() ErrorCode {
+	return CodeCapacityExceeded
+}
+func (e *capacityExceededError) Transient() bool {
+	return true
+}
+
+// NewCapacityExceededError returns a *capacityExceededError referring to the
+// given container ID and container limit.
+func NewCapacityExceededError(id string, limit int) *capacityExceededError {
+	return &capacityExceededError{ID: id, Limit: limit}
+}
+
 // StackTracer is an interface originating (but not exported) from the
 // github.com/pkg/errors package. It defines something which can return a stack
 // trace.
@@ -97,6 +311,48 @@ func BaseStackTrace(e error) errors.StackTrace {
 	return tracer.StackTrace()
 }
 
+type deviceNotPresentError struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (e *deviceNotPresentError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for device %s to appear", e.Timeout, e.Path)
+}
+func (e *deviceNotPresentError) Code() ErrorCode {
+	return CodeDeviceNotPresent
+}
+func (e *deviceNotPresentError) Transient() bool {
+	return true
+}
+
+// NewDeviceNotPresentError returns a *deviceNotPresentError referring to the
+// given device path and the amount of time waited for it.
+func NewDeviceNotPresentError(path string, timeout time.Duration) *deviceNotPresentError {
+	return &deviceNotPresentError{Path: path, Timeout: timeout}
+}
+
+type invalidSpecError struct {
+	Field   string
+	Problem string
+}
+
+func (e *invalidSpecError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Problem)
+}
+func (e *invalidSpecError) Code() ErrorCode {
+	return CodeInvalidSpec
+}
+func (e *invalidSpecError) Transient() bool {
+	return false
+}
+
+// NewInvalidSpecError returns a *invalidSpecError referring to the given
+// field of an OCI spec and the problem with it, such as "must not be empty".
+func NewInvalidSpecError(field string, problem string) *invalidSpecError {
+	return &invalidSpecError{Field: field, Problem: problem}
+}
+
 type baseHresultError struct {
 	hresult Hresult
 }
@@ -187,3 +443,71 @@ func GetHresult(e error) (Hresult, error) {
 	}
 	return -1, errors.Errorf("no HRESULT found in cause stack for error %s", e)
 }
+
+// Code iterates through the error's cause stack in the same way as
+// GetHresult. At the first error it encounters which implements the Code()
+// method, it returns that error's ErrorCode. If there is no such error, ok is
+// false.
+func Code(e error) (code ErrorCode, ok bool) {
+	type coder interface {
+		Code() ErrorCode
+	}
+	type causer interface {
+		Cause() error
+	}
+	cause := e
+	for cause != nil {
+		cerr, ok := cause.(coder)
+		if ok {
+			return cerr.Code(), true
+		}
+		nextErr, ok := cause.(causer)
+		if !ok {
+			break
+		}
+		cause = nextErr.Cause()
+	}
+	return "", false
+}
+
+// IsTransient reports whether the error is caused by a condition which may
+// clear up on its own, such as a device which hasn't appeared yet, so that
+// the failed operation may succeed if it is retried. It iterates through the
+// error's cause stack in the same way as GetHresult, and the first error it
+// encounters which implements the Transient() method decides. A busy mount
+// or device is also transient. Any other error is treated as permanent.
+func IsTransient(e error) bool {
+	type transienter interface {
+		Transient() bool
+	}
+	type causer interface {
+		Cause() error
+	}
+	cause := e
+	for cause != nil {
+		if terr, ok := cause.(transienter); ok {
+			return terr.Transient()
+		}
+		if isBusy(cause) {
+			return true
+		}
+		cerr, ok := cause.(causer)
+		if !ok {
+			break
+		}
+		cause = cerr.Cause()
+	}
+	return false
+}
+
+// isBusy reports whether the error is an EBUSY returned by a system call,
+// such as by a mount of a device which is still in use.
+func isBusy(e error) bool {
+	switch typedError := e.(type) {
+	case *os.PathError:
+		e = typedError.Err
+	case *os.SyscallError:
+		e = typedError.Err
+	}
+	return e == syscall.EBUSY
+}
@@ -2,6 +2,9 @@ package errors
 
 import (
 	"fmt"
+	"os"
+	"syscall"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -221,5 +224,83 @@ var _ = Describe("Errors", func() {
 				})
 			})
 		})
+		Describe("getting error codes", func() {
+			codeOf := func(e error) ErrorCode {
+				code, ok := Code(e)
+				Expect(ok).To(BeTrue())
+				return code
+			}
+			It("should have a code for each error type", func() {
+				Expect(codeOf(NewContainerExistsError("id"))).To(Equal(CodeContainerExists))
+				Expect(codeOf(NewContainerDoesNotExistError("id"))).To(Equal(CodeContainerDoesNotExist))
+				Expect(codeOf(NewProcessDoesNotExistError(1))).To(Equal(CodeProcessDoesNotExist))
+				Expect(codeOf(NewProcessExitEvictedError(1))).To(Equal(CodeProcessExitEvicted))
+				Expect(codeOf(NewTooManyProcessesError("id", 1))).To(Equal(CodeTooManyProcesses))
+				Expect(codeOf(NewExecDeniedError("id", []string{"sh"}, "blocked"))).To(Equal(CodeExecDenied))
+				Expect(codeOf(NewContainerStartTimeoutError("id", time.Second))).To(Equal(CodeContainerStartTimeout))
+				Expect(codeOf(NewShutdownTimeoutError([]string{"id"}, time.Second))).To(Equal(CodeShutdownTimeout))
+				Expect(codeOf(NewContainerNotReadyError("id", "not mounted"))).To(Equal(CodeContainerNotReady))
+				Expect(codeOf(NewCapacityExceededError("id", 1))).To(Equal(CodeCapacityExceeded))
+				Expect(codeOf(NewNotATtyError(1))).To(Equal(CodeNotATty))
+			})
+			Context("the error is wrapped", func() {
+				var (
+					e error
+				)
+				BeforeEach(func() {
+					e = errors.WithStack(NewContainerDoesNotExistError("id"))
+					e = errors.Wrap(e, "failed to signal container")
+					e = errors.Wrapf(e, "failed to shut down %s", "id")
+				})
+				It("should find the code through the wrapping errors", func() {
+					code, ok := Code(e)
+					Expect(ok).To(BeTrue())
+					Expect(code).To(Equal(CodeContainerDoesNotExist))
+				})
+			})
+			Context("the error is wrapped with an HRESULT", func() {
+				It("should find the code of the wrapped error", func() {
+					e := errors.Wrap(WrapHresult(NewProcessDoesNotExistError(1), HrInvalidArg), "wrapper")
+					Expect(codeOf(e)).To(Equal(CodeProcessDoesNotExist))
+				})
+			})
+			Context("the error has no code", func() {
+				It("should not find a code", func() {
+					_, ok := Code(errors.Wrap(NewHresultError(HrFail), "wrapper"))
+					Expect(ok).To(BeFalse())
+				})
+			})
+		})
+		Describe("classifying transient errors", func() {
+			It("should classify conditions which may clear up as transient", func() {
+				Expect(IsTransient(errors.Wrap(NewDeviceNotPresentError("/dev/sdc", time.Second), "failed to wait for layer"))).To(BeTrue())
+				Expect(IsTransient(errors.WithStack(NewContainerStartTimeoutError("id", time.Second)))).To(BeTrue())
+				Expect(IsTransient(NewTooManyProcessesError("id", 1))).To(BeTrue())
+				Expect(IsTransient(NewContainerNotReadyError("id", "not mounted"))).To(BeTrue())
+				Expect(IsTransient(NewCapacityExceededError("id", 1))).To(BeTrue())
+			})
+			It("should classify a busy mount as transient", func() {
+				Expect(IsTransient(errors.Wrap(errors.WithStack(syscall.EBUSY), "failed to mount"))).To(BeTrue())
+				Expect(IsTransient(&os.PathError{Op: "mount", Path: "/mnt", Err: syscall.EBUSY})).To(BeTrue())
+			})
+			It("should classify permanent conditions as not transient", func() {
+				Expect(IsTransient(errors.WithStack(NewContainerExistsError("id")))).To(BeFalse())
+				Expect(IsTransient(errors.Wrap(NewInvalidSpecError("process.args", "must not be empty"), "invalid OCI spec"))).To(BeFalse())
+				Expect(IsTransient(NewContainerDoesNotExistError("id"))).To(BeFalse())
+				Expect(IsTransient(NewExecDeniedError("id", []string{"sh"}, "blocked"))).To(BeFalse())
+				Expect(IsTransient(NewNotATtyError(1))).To(BeFalse())
+			})
+			It("should classify unknown errors as not transient", func() {
+				Expect(IsTransient(errors.New("unknown"))).To(BeFalse())
+				Expect(IsTransient(errors.WithStack(syscall.ENOENT))).To(BeFalse())
+				Expect(IsTransient(nil)).To(BeFalse())
+			})
+			Context("a transient error is wrapped with an HRESULT", func() {
+				It("should still be transient", func() {
+					e := WrapHresult(NewDeviceNotPresentError("/dev/sdc", time.Second), HrFail)
+					Expect(IsTransient(e)).To(BeTrue())
+				})
+			})
+		})
 	})
 })
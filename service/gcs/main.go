@@ -4,6 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/bridge"
 	"github.com/Microsoft/opengcs/service/gcs/core/gcs"
@@ -14,9 +17,51 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// runtimeFlags collects the OCI runtimes given by repeated -runtime flags, as
+// "name=path" pairs, in the order they were given.
+type runtimeFlags struct {
+	names []string
+	paths []string
+}
+
+func (r *runtimeFlags) String() string {
+	var pairs []string
+	for i, name := range r.names {
+		pairs = append(pairs, name+"="+r.paths[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (r *runtimeFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("runtime \"%s\" must be of the form name=path", value)
+	}
+	r.names = append(r.names, kv[0])
+	r.paths = append(r.paths, kv[1])
+	return nil
+}
+
+// defaultRuntimeName is the name the default runc runtime is registered
+// under, so that containers preferring another runtime can name it as their
+// fallback.
+const defaultRuntimeName = "runc"
+
 func main() {
 	logLevel := flag.String("loglevel", "debug", "Logging Level: debug, info, warning, error, fatal, panic.")
 	logFile := flag.String("logfile", "", "Logging Target: An optional file name/path. Omit for console output.")
+	deviceTimeout := flag.Duration("devicetimeout", 5*time.Second, "Device Timeout: How long to wait for layer and mapped virtual disk devices to appear.")
+	mountTimeout := flag.Duration("mounttimeout", 30*time.Second, "Mount Timeout: How long to wait for a mount or unmount of a container's storage. An unmount which times out is replaced with a lazy one. Zero means no limit.")
+	startTimeout := flag.Duration("starttimeout", 30*time.Second, "Start Timeout: How long to wait for a container's init process to start.")
+	maxContainers := flag.Int("maxcontainers", 0, "Max Containers: The maximum number of containers which may exist at once. Zero means no limit.")
+	implicitStart := flag.Bool("implicitstart", true, "Implicit Start: Whether a container's first executed process becomes its init process, for hosts which don't start containers explicitly.")
+	historySize := flag.Int("historysize", 64, "History Size: The number of removed containers whose event histories are kept.")
+	historyMaxAge := flag.Duration("historymaxage", time.Hour, "History Max Age: How long the event histories of removed containers are kept. Zero means no limit.")
+	coreDumpDir := flag.String("coredumpdir", "", "Core Dump Directory: The directory in which the core dumps of crashed processes are kept. Omit to leave core dumps as the kernel is configured.")
+	maxCoreDumpSize := flag.Int64("maxcoredumpsize", 256<<20, "Max Core Dump Size: The number of bytes of each core dump which are kept. The rest of a larger dump is discarded.")
+	var runtimes runtimeFlags
+	flag.Var(&runtimes, "runtime", "Runtime: An OCI runtime which containers may select by name, as name=path to its runc-compatible binary. May be repeated.")
+	secretKeys := flag.String("secretkeys", "", "Secret Keys: A regular expression matching the names of environment variables and arguments whose values are redacted when a process's environment or command line is inspected. Omit for the default.")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "\nUsage of %s:\n", os.Args[0])
@@ -56,6 +101,40 @@ func main() {
 	}
 	os := realos.NewOS()
 	coreint := gcs.NewGCSCore(rtime, os)
+	coreint.DeviceTimeout = *deviceTimeout
+	coreint.MountTimeout = *mountTimeout
+	coreint.StartTimeout = *startTimeout
+	coreint.ImplicitStart = *implicitStart
+	coreint.MaxContainers = *maxContainers
+	coreint.HistorySize = *historySize
+	coreint.HistoryMaxAge = *historyMaxAge
+	for i, name := range runtimes.names {
+		namedRtime, err := runc.NewRuntimeWithBinary(runtimes.paths[i])
+		if err != nil {
+			logrus.Fatalf("%+v", err)
+		}
+		if err := coreint.RegisterRuntime(name, namedRtime); err != nil {
+			logrus.Fatalf("%+v", err)
+		}
+		logrus.Infof("registered runtime %s at %s", name, runtimes.paths[i])
+	}
+	if err := coreint.RegisterRuntime(defaultRuntimeName, rtime); err != nil {
+		// A runtime given by the flags takes the name.
+		logrus.Infof("the default runtime is not registered as %s: %s", defaultRuntimeName, err)
+	}
+	if *secretKeys != "" {
+		coreint.SecretKeys, err = regexp.Compile(*secretKeys)
+		if err != nil {
+			logrus.Fatalf("invalid secret keys pattern: %s", err)
+		}
+	}
+	if *coreDumpDir != "" {
+		coreint.CoreDumpDir = *coreDumpDir
+		coreint.MaxCoreDumpSize = *maxCoreDumpSize
+		if err := coreint.ConfigureCoreDumps(); err != nil {
+			logrus.Fatalf("%+v", err)
+		}
+	}
 	b := bridge.NewBridge(tport, coreint)
 	b.CommandLoop()
 }
@@ -36,6 +36,7 @@ func (c *mockReadWriteCloser) File() (*os.File, error) {
 
 type mockProcessExitState struct {
 	exitCode int
+	signal   oslayer.Signal
 }
 
 // NewProcessExitState returns a *mockProcessExitState with the given exit
@@ -43,9 +44,18 @@ type mockProcessExitState struct {
 func NewProcessExitState(exitCode int) *mockProcessExitState {
 	return &mockProcessExitState{exitCode: exitCode}
 }
+
+// NewSignaledProcessExitState returns a *mockProcessExitState of a process
+// killed by the given signal. Its exit code is -1, as for a real process.
+func NewSignaledProcessExitState(signal oslayer.Signal) *mockProcessExitState {
+	return &mockProcessExitState{exitCode: -1, signal: signal}
+}
 func (s *mockProcessExitState) ExitCode() int {
 	return s.exitCode
 }
+func (s *mockProcessExitState) Signal() (oslayer.Signal, bool) {
+	return s.signal, s.signal != 0
+}
 
 type mockFile struct {
 	name string
@@ -78,17 +88,59 @@ func (p *mockProcess) Pid() int {
 }
 
 type mockCmd struct {
-	name string
-	arg  []string
+	name  string
+	arg   []string
+	dir   string
+	env   []string
+	attr  *syscall.SysProcAttr
+	stdin *mockReadWriteCloser
 }
 
 func newCmd(name string, arg ...string) *mockCmd {
 	return &mockCmd{name: name, arg: arg}
 }
-func (c *mockCmd) SetDir(dir string)   {}
-func (c *mockCmd) SetEnv(env []string) {}
+func (c *mockCmd) SetDir(dir string) {
+	c.dir = dir
+}
+func (c *mockCmd) SetEnv(env []string) {
+	c.env = env
+}
 func (c *mockCmd) StdinPipe() (io.WriteCloser, error) {
-	return NewMockReadWriteCloser(), nil
+	c.stdin = NewMockReadWriteCloser()
+	return c.stdin, nil
+}
+
+// Name returns the name of the program the command runs.
+func (c *mockCmd) Name() string {
+	return c.name
+}
+
+// Args returns the arguments the command was created with.
+func (c *mockCmd) Args() []string {
+	return c.arg
+}
+
+// Dir returns the working directory set on the command.
+func (c *mockCmd) Dir() string {
+	return c.dir
+}
+
+// Env returns the environment set on the command.
+func (c *mockCmd) Env() []string {
+	return c.env
+}
+
+// SysProcAttr returns the process attributes set on the command.
+func (c *mockCmd) SysProcAttr() *syscall.SysProcAttr {
+	return c.attr
+}
+
+// StdinData returns everything written to the command's stdin pipe.
+func (c *mockCmd) StdinData() []byte {
+	if c.stdin == nil {
+		return nil
+	}
+	return c.stdin.Bytes()
 }
 func (c *mockCmd) StdoutPipe() (io.ReadCloser, error) {
 	return NewMockReadWriteCloser(), nil
@@ -99,6 +151,9 @@ func (c *mockCmd) StderrPipe() (io.ReadCloser, error) {
 func (c *mockCmd) SetStdin(stdin io.Reader)   {}
 func (c *mockCmd) SetStdout(stdout io.Writer) {}
 func (c *mockCmd) SetStderr(stderr io.Writer) {}
+func (c *mockCmd) SetSysProcAttr(attr *syscall.SysProcAttr) {
+	c.attr = attr
+}
 func (c *mockCmd) ExitState() oslayer.ProcessExitState {
 	return NewProcessExitState(123)
 }
@@ -153,6 +208,7 @@ func (i *mockFileInfo) Sys() interface{} {
 }
 
 type mockOS struct {
+	lastCommand *mockCmd
 }
 
 // NewOS returns a *mockOS, which mocks out operating system functionality.
@@ -165,7 +221,14 @@ func (o *mockOS) OpenFile(name string, flag int, perm os.FileMode) (oslayer.File
 	return newFile(name, flag, perm), nil
 }
 func (o *mockOS) Command(name string, arg ...string) oslayer.Cmd {
-	return newCmd(name, arg...)
+	o.lastCommand = newCmd(name, arg...)
+	return o.lastCommand
+}
+
+// LastCommand returns the most recent command created by Command, or nil if
+// none has been created.
+func (o *mockOS) LastCommand() *mockCmd {
+	return o.lastCommand
 }
 func (o *mockOS) MkdirAll(path string, perm os.FileMode) error {
 	return nil
@@ -197,8 +260,24 @@ func (o *mockOS) PathIsMounted(name string) (bool, error) {
 func (o *mockOS) Link(oldname, newname string) error {
 	return nil
 }
+func (o *mockOS) Lstat(name string) (os.FileInfo, error) {
+	return newFileInfo(name), nil
+}
+func (o *mockOS) Statfs(path string, buf *syscall.Statfs_t) error {
+	*buf = syscall.Statfs_t{}
+	return nil
+}
 
 // Processes
 func (o *mockOS) Kill(pid int, sig syscall.Signal) error {
 	return nil
 }
+func (o *mockOS) Prlimit(pid int, resource int, limit *syscall.Rlimit) error {
+	return nil
+}
+func (o *mockOS) SchedSetscheduler(pid int, policy int, priority int) error {
+	return nil
+}
+func (o *mockOS) Setpriority(pid int, nice int) error {
+	return nil
+}
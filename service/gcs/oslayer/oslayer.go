@@ -3,8 +3,11 @@
 package oslayer
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -17,12 +20,97 @@ const (
 	SIGTERM = Signal(syscall.SIGTERM)
 )
 
+// windowsSignals maps the signal numbers of the Windows C runtime, which
+// Windows hosts send, to Linux signals. SIGINT, SIGILL, SIGFPE, SIGSEGV, and SIGTERM
+// have the same numbers on both, while SIGBREAK, sent for Ctrl+Break, has no
+// Linux equivalent and is mapped to SIGQUIT, the signal sent for Ctrl+\.
+var windowsSignals = map[int32]Signal{
+	2:  Signal(syscall.SIGINT),
+	4:  Signal(syscall.SIGILL),
+	6:  Signal(syscall.SIGABRT), // SIGABRT_COMPAT
+	8:  Signal(syscall.SIGFPE),
+	11: Signal(syscall.SIGSEGV),
+	15: SIGTERM,
+	21: Signal(syscall.SIGQUIT), // SIGBREAK
+	22: Signal(syscall.SIGABRT),
+}
+
+// WindowsSignalToSignal translates a signal number sent by a Windows host into
+// a Linux signal using the windowsSignals table. Numbers which aren't in the
+// table are passed through unchanged.
+func WindowsSignalToSignal(signal int32) Signal {
+	if s, ok := windowsSignals[signal]; ok {
+		return s
+	}
+	return Signal(signal)
+}
+
+// signalNames maps the names of Linux signals, without their "SIG" prefix, to
+// their numbers.
+var signalNames = map[string]Signal{
+	"HUP":    Signal(syscall.SIGHUP),
+	"INT":    Signal(syscall.SIGINT),
+	"QUIT":   Signal(syscall.SIGQUIT),
+	"ILL":    Signal(syscall.SIGILL),
+	"TRAP":   Signal(syscall.SIGTRAP),
+	"ABRT":   Signal(syscall.SIGABRT),
+	"IOT":    Signal(syscall.SIGIOT),
+	"BUS":    Signal(syscall.SIGBUS),
+	"FPE":    Signal(syscall.SIGFPE),
+	"KILL":   Signal(syscall.SIGKILL),
+	"USR1":   Signal(syscall.SIGUSR1),
+	"SEGV":   Signal(syscall.SIGSEGV),
+	"USR2":   Signal(syscall.SIGUSR2),
+	"PIPE":   Signal(syscall.SIGPIPE),
+	"ALRM":   Signal(syscall.SIGALRM),
+	"TERM":   Signal(syscall.SIGTERM),
+	"STKFLT": Signal(syscall.SIGSTKFLT),
+	"CHLD":   Signal(syscall.SIGCHLD),
+	"CONT":   Signal(syscall.SIGCONT),
+	"STOP":   Signal(syscall.SIGSTOP),
+	"TSTP":   Signal(syscall.SIGTSTP),
+	"TTIN":   Signal(syscall.SIGTTIN),
+	"TTOU":   Signal(syscall.SIGTTOU),
+	"URG":    Signal(syscall.SIGURG),
+	"XCPU":   Signal(syscall.SIGXCPU),
+	"XFSZ":   Signal(syscall.SIGXFSZ),
+	"VTALRM": Signal(syscall.SIGVTALRM),
+	"PROF":   Signal(syscall.SIGPROF),
+	"WINCH":  Signal(syscall.SIGWINCH),
+	"IO":     Signal(syscall.SIGIO),
+	"POLL":   Signal(syscall.SIGPOLL),
+	"PWR":    Signal(syscall.SIGPWR),
+	"SYS":    Signal(syscall.SIGSYS),
+}
+
+// maxSignal is the highest Linux signal number, that of SIGRTMAX.
+const maxSignal = 64
+
+// ParseSignal parses a Linux signal given in the forms accepted by an image's
+// STOPSIGNAL: a name with or without its "SIG" prefix, such as "SIGQUIT" or
+// "QUIT", or a number, such as "3".
+func ParseSignal(s string) (Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > maxSignal {
+			return 0, fmt.Errorf("signal number %d is out of range", n)
+		}
+		return Signal(n), nil
+	}
+	if signal, ok := signalNames[strings.TrimPrefix(strings.ToUpper(s), "SIG")]; ok {
+		return signal, nil
+	}
+	return 0, fmt.Errorf("unknown signal \"%s\"", s)
+}
+
 // ProcessExitState is an interface describing the state of a process after it
 // exits. Since os.ProcessState structs can only be obtained by an actual
 // exited process, this interface can be mocked out for testing purposes to
 // provide fake exit states.
 type ProcessExitState interface {
 	ExitCode() int
+	// Signal returns the signal which killed the process, and false if the
+	// process exited on its own.
+	Signal() (Signal, bool)
 }
 
 // File is an interface describing the methods exposed by a file on the system.
@@ -46,6 +134,7 @@ type Cmd interface {
 	SetStdin(stdin io.Reader)
 	SetStdout(stdout io.Writer)
 	SetStderr(stderr io.Writer)
+	SetSysProcAttr(attr *syscall.SysProcAttr)
 	ExitState() ProcessExitState
 	Process() Process
 	Start() error
@@ -70,7 +159,12 @@ type OS interface {
 	PathExists(name string) (bool, error)
 	PathIsMounted(name string) (bool, error)
 	Link(oldname, newname string) error
+	Statfs(path string, buf *syscall.Statfs_t) error
+	Lstat(name string) (os.FileInfo, error)
 
 	// Processes
 	Kill(pid int, sig syscall.Signal) error
+	Prlimit(pid int, resource int, limit *syscall.Rlimit) error
+	SchedSetscheduler(pid int, policy int, priority int) error
+	Setpriority(pid int, nice int) error
 }
@@ -0,0 +1,18 @@
+package oslayer
+
+import (
+	"io/ioutil"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus"
+)
+
+func TestOSLayer(t *testing.T) {
+	// Turn off logging so as not to spam output.
+	logrus.SetOutput(ioutil.Discard)
+
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "OS Layer Suite")
+}
@@ -0,0 +1,49 @@
+package oslayer
+
+import (
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OS Layer", func() {
+	Describe("translating Windows signals", func() {
+		It("should translate Windows SIGBREAK to SIGQUIT", func() {
+			Expect(WindowsSignalToSignal(21)).To(Equal(Signal(syscall.SIGQUIT)))
+		})
+		It("should translate Windows SIGABRT to SIGABRT", func() {
+			Expect(WindowsSignalToSignal(22)).To(Equal(Signal(syscall.SIGABRT)))
+		})
+		It("should translate Windows SIGABRT_COMPAT to SIGABRT", func() {
+			Expect(WindowsSignalToSignal(6)).To(Equal(Signal(syscall.SIGABRT)))
+		})
+		It("should keep signals which have the same number on both", func() {
+			Expect(WindowsSignalToSignal(2)).To(Equal(Signal(syscall.SIGINT)))
+			Expect(WindowsSignalToSignal(15)).To(Equal(SIGTERM))
+		})
+		It("should pass through Linux signals which aren't in the table", func() {
+			Expect(WindowsSignalToSignal(9)).To(Equal(SIGKILL))
+			Expect(WindowsSignalToSignal(10)).To(Equal(Signal(syscall.SIGUSR1)))
+		})
+	})
+	Describe("parsing signals", func() {
+		It("should parse signal names with and without the SIG prefix", func() {
+			Expect(ParseSignal("SIGQUIT")).To(Equal(Signal(syscall.SIGQUIT)))
+			Expect(ParseSignal("QUIT")).To(Equal(Signal(syscall.SIGQUIT)))
+			Expect(ParseSignal("sigwinch")).To(Equal(Signal(syscall.SIGWINCH)))
+		})
+		It("should parse signal numbers", func() {
+			Expect(ParseSignal("3")).To(Equal(Signal(syscall.SIGQUIT)))
+			Expect(ParseSignal("37")).To(Equal(Signal(37)))
+		})
+		It("should reject unknown signals", func() {
+			_, err := ParseSignal("SIGBOGUS")
+			Expect(err).To(HaveOccurred())
+			_, err = ParseSignal("0")
+			Expect(err).To(HaveOccurred())
+			_, err = ParseSignal("65")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
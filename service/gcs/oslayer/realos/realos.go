@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"strings"
 	"syscall"
+	"unsafe"
 
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/pkg/errors"
@@ -29,6 +30,13 @@ func NewProcessExitState(state *os.ProcessState) *realProcessExitState {
 func (s *realProcessExitState) ExitCode() int {
 	return s.state.Sys().(syscall.WaitStatus).ExitStatus()
 }
+func (s *realProcessExitState) Signal() (oslayer.Signal, bool) {
+	status := s.state.Sys().(syscall.WaitStatus)
+	if !status.Signaled() {
+		return 0, false
+	}
+	return oslayer.Signal(status.Signal()), true
+}
 
 type realFile struct {
 	file *os.File
@@ -88,6 +96,9 @@ func (c *realCmd) SetStdout(stdout io.Writer) {
 func (c *realCmd) SetStderr(stderr io.Writer) {
 	c.cmd.Stderr = stderr
 }
+func (c *realCmd) SetSysProcAttr(attr *syscall.SysProcAttr) {
+	c.cmd.SysProcAttr = attr
+}
 func (c *realCmd) ExitState() oslayer.ProcessExitState {
 	return NewProcessExitState(c.cmd.ProcessState)
 }
@@ -218,6 +229,19 @@ func (o *realOS) Link(oldname, newname string) error {
 	}
 	return nil
 }
+func (o *realOS) Lstat(name string) (os.FileInfo, error) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return info, nil
+}
+func (o *realOS) Statfs(path string, buf *syscall.Statfs_t) error {
+	if err := syscall.Statfs(path, buf); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
 
 // Processes
 func (o *realOS) Kill(pid int, sig syscall.Signal) error {
@@ -226,3 +250,28 @@ func (o *realOS) Kill(pid int, sig syscall.Signal) error {
 	}
 	return nil
 }
+func (o *realOS) Prlimit(pid int, resource int, limit *syscall.Rlimit) error {
+	// The syscall package doesn't export prlimit, so call it directly. Only
+	// the new limit is set, so the old limit isn't returned.
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(limit)), 0, 0, 0)
+	if errno != 0 {
+		return errors.WithStack(errno)
+	}
+	return nil
+}
+func (o *realOS) SchedSetscheduler(pid int, policy int, priority int) error {
+	// The syscall package doesn't export sched_setscheduler either. Its
+	// struct sched_param holds only the priority.
+	param := struct{ priority int32 }{int32(priority)}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, uintptr(pid), uintptr(policy), uintptr(unsafe.Pointer(&param)))
+	if errno != 0 {
+		return errors.WithStack(errno)
+	}
+	return nil
+}
+func (o *realOS) Setpriority(pid int, nice int) error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
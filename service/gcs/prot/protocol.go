@@ -230,6 +230,16 @@ type ContainerResizeConsole struct {
 	Width     uint16
 }
 
+// ContainerShutdown is the message from the HCS requesting that the container
+// be shut down gracefully.
+type ContainerShutdown struct {
+	*MessageBase
+	// GracePeriodInMs, if non-zero, is how long the GCS waits for the
+	// container to exit before responding with the processes which are still
+	// running. If zero, the GCS responds as soon as the container is signaled.
+	GracePeriodInMs uint32 `json:",omitempty"`
+}
+
 // ContainerWaitForProcess is the message from the HCS specifying to wait until
 // the given process exits. After receiving this message, the corresponding
 // response should not be sent until the process has exited.
@@ -256,6 +266,14 @@ type ContainerGetProperties struct {
 	Query string
 }
 
+// PropertyQuery is the query sent in the ContainerGetProperties message.
+type PropertyQuery struct {
+	PropertyTypes []string `json:",omitempty"`
+	// ReconcileProcesses requests that the returned process list be
+	// reconciled against the process exits already observed by the GCS.
+	ReconcileProcesses bool `json:",omitempty"`
+}
+
 // PropertyType is the type of property, such as memory or virtual disk, which
 // is to be modified for the container.
 type PropertyType string
@@ -283,8 +301,48 @@ const (
 	PtMappedPipe = PropertyType("MappedPipe")
 	// PtMappedVirtualDisk is the property type for mapped virtual disks
 	PtMappedVirtualDisk = PropertyType("MappedVirtualDisk")
+	// PtGcsHealth is the property type for the health of the GCS itself,
+	// rather than of any container
+	PtGcsHealth = PropertyType("GcsHealth")
+	// PtResourceLimits is the property type for the memory, CPU and process
+	// limits of a running container
+	PtResourceLimits = PropertyType("ResourceLimits")
+	// PtDNS is the property type for the DNS configuration of a running
+	// container
+	PtDNS = PropertyType("Dns")
 )
 
+// ResourceLimits are limits applied to a running container's cgroup. A zero
+// field leaves its limit unchanged, and -1 removes the limit.
+type ResourceLimits struct {
+	MemoryLimitInBytes int64 `json:",omitempty"`
+	// CPUQuotaInUs limits the container to that much CPU time in each
+	// CPUPeriodInUs. If CPUPeriodInUs is zero, the period is unchanged.
+	CPUQuotaInUs  int64  `json:",omitempty"`
+	CPUPeriodInUs uint64 `json:",omitempty"`
+	PidsLimit     int64  `json:",omitempty"`
+}
+
+// DNSSettings is the DNS configuration written to a container's own
+// resolv.conf, which the GCS bind mounts into the container unless its spec
+// mounts another file there. At least one and at most three servers must be
+// given.
+type DNSSettings struct {
+	Servers       []string
+	SearchDomains []string `json:",omitempty"`
+}
+
+// GcsHealth is returned as a lightweight liveness probe of the GCS.
+type GcsHealth struct {
+	Version    string
+	UptimeInMs uint64
+	// ContainerCount is the number of containers the GCS knows about, and
+	// ProcessCount the number of their processes and external processes which
+	// have not exited.
+	ContainerCount uint32
+	ProcessCount   uint32
+}
+
 // RequestType is the type of operation to perform on a given property type.
 type RequestType string
 
@@ -306,6 +364,8 @@ const (
 type ResourceModificationSettings struct {
 	*MappedVirtualDisk
 	*MappedDirectory
+	*ResourceLimits
+	*DNSSettings
 }
 
 // ResourceModificationRequestResponse details a container resource which
@@ -356,6 +416,18 @@ func UnmarshalContainerModifySettings(b []byte) (*ContainerModifySettings, error
 			return nil, errors.Wrap(err, "failed to unmarshal settings as MappedDirectory")
 		}
 		request.Request.Settings = settings
+	case PtResourceLimits:
+		settings.ResourceLimits = &ResourceLimits{}
+		if err := commonutils.UnmarshalJSONWithHresult(rawSettings, settings.ResourceLimits); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal settings as ResourceLimits")
+		}
+		request.Request.Settings = settings
+	case PtDNS:
+		settings.DNSSettings = &DNSSettings{}
+		if err := commonutils.UnmarshalJSONWithHresult(rawSettings, settings.DNSSettings); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal settings as DNSSettings")
+		}
+		request.Request.Settings = settings
 	default:
 		return nil, errors.Errorf("invalid ResourceType '%s'", request.Request.ResourceType)
 	}
@@ -374,6 +446,9 @@ type ErrorRecord struct {
 	FileName     string
 	Line         uint32
 	FunctionName string `json:",omitempty"`
+	// Code is the machine-readable code of the error, if it has one, as
+	// given by the gcserr package's ErrorCode.
+	Code string `json:",omitempty"`
 }
 
 // MessageResponseBase is the base type embedded in all messages sent from the
@@ -406,6 +481,20 @@ type ContainerExecuteProcessResponse struct {
 type ContainerWaitForProcessResponse struct {
 	*MessageResponseBase
 	ExitCode uint32
+	// CoreDumpPath is the path in the utility VM of the core dump of a
+	// process which crashed, if core dumps are enabled. It may be read with
+	// remotefs's readcoredump command, given the core dump directory too.
+	CoreDumpPath string `json:",omitempty"`
+}
+
+// ContainerShutdownResponse is the message to the HCS responding to a
+// ContainerShutdown message.
+type ContainerShutdownResponse struct {
+	*MessageResponseBase
+	// RemainingProcessIDs lists the container's processes which were still
+	// running once the grace period elapsed, so that the HCS can escalate,
+	// such as by forcing the container to shut down.
+	RemainingProcessIDs []uint32 `json:",omitempty"`
 }
 
 // ContainerGetPropertiesResponse is the message to the HCS responding to a
@@ -448,6 +537,25 @@ type MappedVirtualDisk struct {
 	CreateInUtilityVM bool  `json:",omitempty"`
 	ReadOnly          bool  `json:",omitempty"`
 	AttachOnly        bool  `json:",omitempty"`
+	// FormatIfEmpty specifies that the disk should be formatted with ext4
+	// before it is mounted if no filesystem or other signature is found on
+	// it. A disk with an existing signature is never formatted.
+	FormatIfEmpty bool `json:",omitempty"`
+	// Resize requests that the filesystem on the disk be grown to fill it,
+	// after the host has grown its backing VHD. It is only valid in an
+	// update of an attached disk, and is never part of the disk's state.
+	Resize bool `json:",omitempty"`
+}
+
+// MappedVirtualDiskStatus describes a mapped virtual disk of a container, as
+// listed across all containers by the GCS.
+type MappedVirtualDiskStatus struct {
+	MappedVirtualDisk
+	// ContainerID is the ID of the container the disk belongs to.
+	ContainerID string
+	// Mounted is true if the disk is mounted at its ContainerPath. AttachOnly
+	// disks are never mounted.
+	Mounted bool
 }
 
 // MappedDirectory represents a directory on the host which is mapped to a
@@ -469,6 +577,149 @@ type VMHostedContainerSettings struct {
 	MappedVirtualDisks []MappedVirtualDisk
 	MappedDirectories  []MappedDirectory
 	NetworkAdapters    []NetworkAdapter `json:",omitempty"`
+	// Hooks are lifecycle hooks (such as a network setup script) which are
+	// added to the container's OCI spec in addition to any hooks the spec
+	// already contains.
+	Hooks *oci.Hooks `json:",omitempty"`
+	// Annotations are arbitrary metadata (such as sandbox information) which
+	// are added to the annotations of the container's OCI spec.
+	Annotations map[string]string `json:",omitempty"`
+	// RuntimeName selects the OCI runtime (such as one registered for kata or
+	// crun) used for the container. If empty, the GCS's default runtime is
+	// used.
+	RuntimeName string `json:",omitempty"`
+	// FallbackRuntimeName opts into creating the container with another
+	// registered runtime if the one selected by RuntimeName is unsupported on
+	// this system, such as a sandboxed runtime which needs kernel features
+	// the VM lacks. The GCS's default runtime is registered as "runc", so it
+	// may be named here. If empty, the container instead fails to be created.
+	FallbackRuntimeName string `json:",omitempty"`
+	// FreezeOnCreate specifies that the container's init process should be
+	// created in a frozen state. It is not started until the container is
+	// explicitly resumed.
+	FreezeOnCreate bool `json:",omitempty"`
+	// StopSignal is the signal which stops the container gracefully, as
+	// declared by its image's STOPSIGNAL, such as "SIGQUIT" or "3". If empty,
+	// SIGTERM is used.
+	StopSignal string `json:",omitempty"`
+	// MaxConcurrentExecs limits the number of processes which may be executed
+	// concurrently in the container, not counting its init process. Zero
+	// means no limit.
+	MaxConcurrentExecs int `json:",omitempty"`
+	// ContainerEnvironment is merged into the environment of every process
+	// executed in the container after its init process. Values in a
+	// process's own Environment take precedence.
+	ContainerEnvironment map[string]string `json:",omitempty"`
+	// CpusetCpus and CpusetMems pin the container to the given CPUs and
+	// memory nodes. They are cgroup cpuset lists, such as "0-3,7".
+	CpusetCpus string `json:",omitempty"`
+	CpusetMems string `json:",omitempty"`
+	// RootReadonly specifies that the container's root filesystem should be
+	// mounted read-only. Mounts in the container's OCI spec, such as tmpfs
+	// mounts and mapped directories, remain writable.
+	RootReadonly bool `json:",omitempty"`
+	// UsageSampleIntervalInMs enables sampling of the container's resource
+	// usage at the given interval, keeping a short rolling history which is
+	// returned by GetContainerUsageHistory. Zero disables sampling.
+	UsageSampleIntervalInMs uint32 `json:",omitempty"`
+	// CgroupsPath places the container in an existing cgroup managed by the
+	// host, rather than one created by the runtime. It is relative to the
+	// mount point of each cgroup hierarchy, such as "/host/containers/1", and
+	// replaces the cgroups path in the container's OCI spec.
+	CgroupsPath string `json:",omitempty"`
+	// CloneFrom is the ID of an existing container whose read-only layers are
+	// shared by this container, which only sets up its own scratch from
+	// SandboxDataPath. Layers must then be empty. The layers stay mounted by
+	// the existing container, which must outlive this one.
+	CloneFrom string `json:",omitempty"`
+	// Labels are operator-supplied labels, such as a namespace or pod, which
+	// the GCS includes as fields in its logs about the container, so that
+	// they can be correlated with the operator's own.
+	Labels map[string]string `json:",omitempty"`
+	// InitProcess, if set, is the container's init process, which is created
+	// and started by StartContainer. Its stdio isn't relayed to the host, so
+	// should be redirected to files if it is needed.
+	InitProcess *ProcessParameters `json:",omitempty"`
+	// ReapingInit runs the container's init process under a minimal init,
+	// which becomes pid 1 in the container, forwards signals to the init
+	// process, and reaps orphaned processes. It is for init processes which
+	// don't reap the children of the processes executed in the container.
+	ReapingInit bool `json:",omitempty"`
+	// LoggingDriver selects where the output of the container's processes
+	// goes. If empty, LdRelay is used.
+	LoggingDriver LoggingDriver `json:",omitempty"`
+	// CleanupPaths are absolute paths in the container, such as "/tmp",
+	// which are removed from its writable layer when it is cleaned up,
+	// resetting them to their contents in its image. The container must
+	// have a writable layer.
+	CleanupPaths []string `json:",omitempty"`
+	// SecretsPath is a directory in the utility VM, such as a mapped
+	// directory or tmpfs provided by the host, holding the container's
+	// secrets, one file per secret named by the secret's name. Processes
+	// executed in the container may reference them through their
+	// SecretEnvironment.
+	SecretsPath string `json:",omitempty"`
+}
+
+// LoggingDriver specifies where the output of a container's processes goes.
+type LoggingDriver string
+
+const (
+	// LdRelay relays the output to the host through the processes' stdio
+	// connections.
+	LdRelay = LoggingDriver("relay")
+	// LdJournald writes each line of the output to the utility VM's system
+	// journal, tagged with the container's ID, in place of relaying it to
+	// the host. Output redirected to files is still written to the files.
+	LdJournald = LoggingDriver("journald")
+)
+
+// UsageSample is a sample of a container's resource usage.
+type UsageSample struct {
+	// TimestampInMs is the time of the sample in milliseconds since the Unix
+	// epoch.
+	TimestampInMs int64
+	// CPUUsageInNs is the total CPU time consumed by the container.
+	CPUUsageInNs uint64
+	// MemoryUsageInBytes is the container's current memory usage, including
+	// the page cache.
+	MemoryUsageInBytes uint64
+}
+
+// ContainerEventType is the kind of an event in a container's history.
+type ContainerEventType string
+
+const (
+	// CeCreated is recorded when the container is created.
+	CeCreated = ContainerEventType("created")
+	// CeStarted is recorded when the container's init process has started.
+	CeStarted = ContainerEventType("started")
+	// CeSignaled is recorded when a signal is sent to the container's init
+	// process.
+	CeSignaled = ContainerEventType("signaled")
+	// CeExited is recorded when the container's init process exits.
+	CeExited = ContainerEventType("exited")
+	// CeCleanupFailed is recorded when cleaning up after the container
+	// exited fails.
+	CeCleanupFailed = ContainerEventType("cleanupFailed")
+)
+
+// ContainerEvent is an event in a container's history, as returned by
+// GetContainerHistory.
+type ContainerEvent struct {
+	// TimestampInMs is the time of the event in milliseconds since the Unix
+	// epoch.
+	TimestampInMs int64
+	Type          ContainerEventType
+	// Details describe the event, such as the signal sent or the exit code.
+	Details string `json:",omitempty"`
+}
+
+// ScratchUsage is the space used on the filesystem holding a container's
+// writable layer.
+type ScratchUsage struct {
+	UsedBytes  uint64
+	TotalBytes uint64
 }
 
 // ProcessParameters represents any process which may be started in the utility
@@ -501,13 +752,147 @@ type ProcessParameters struct {
 	// useful if, for example, you want to start up a shell in the utility VM
 	// for debugging/diagnostic purposes.
 	IsExternal bool `json:"CreateInUtilityVM,omitempty"`
+	// StdinPayload, if set, is piped to the stdin of an external process and
+	// then closed, in place of the stdin connection. It cannot be used
+	// together with EmulateConsole.
+	StdinPayload []byte `json:",omitempty"`
+	// InheritHostEnv specifies that an external process should inherit the
+	// utility VM's environment. Variables in Environment take precedence over
+	// inherited ones.
+	InheritHostEnv bool `json:",omitempty"`
+	// Chroot, if set, is an absolute path in the utility VM, such as a
+	// container's rootfs, which an external process runs chrooted into.
+	// WorkingDirectory is then interpreted relative to it.
+	Chroot string `json:",omitempty"`
+	// OCIProcess, if set, is used verbatim as the process's OCI spec in place
+	// of the one derived from CommandLine, CommandArgs, WorkingDirectory,
+	// Environment, and EmulateConsole. This allows callers to specify fields
+	// such as the user and capabilities which are otherwise defaulted.
+	OCIProcess *oci.Process `json:"OciProcess,omitempty"`
+	// Umask, if set, is the octal file mode creation mask (for example
+	// "0027") the process is started with. It is applied by running the
+	// process's command through /bin/sh, and so may not be combined with
+	// OCIProcess, and is rejected for processes whose root filesystem has no
+	// /bin/sh. It may not be given for a container's init process.
+	Umask string `json:",omitempty"`
+	// StdOutPath and StdErrPath, if set, are files within one of a
+	// container's mapped directories or mapped virtual disks which the
+	// process's stdout and stderr are written to directly, in place of being
+	// relayed to the host. StdOutMode and StdErrMode specify whether the
+	// files are truncated, which is the default, or appended to. They may
+	// not be used with an emulated console.
+	StdOutPath string        `json:",omitempty"`
+	StdOutMode StdioFileMode `json:",omitempty"`
+	StdErrPath string        `json:",omitempty"`
+	StdErrMode StdioFileMode `json:",omitempty"`
+	// OomScoreAdj, if set, is written to the process's oom_score_adj once it
+	// has started, between -1000 and 1000. Processes with higher values are
+	// killed first when the utility VM or container runs out of memory.
+	OomScoreAdj *int `json:",omitempty"`
+	// Nice, if set, is the niceness the process is given once it has
+	// started, between -20 and 19. Processes with higher values get less CPU
+	// time when the CPU is contended. Otherwise the process keeps the
+	// niceness it inherits.
+	Nice *int `json:",omitempty"`
+	// SchedulingPolicy, if set, is the scheduling policy the process is
+	// given once it has started: "other", "batch", "idle", "fifo", or "rr".
+	// SchedulingPriority is its static priority, between 1 and 99 for the
+	// real-time policies "fifo" and "rr", and 0 for the others. Otherwise
+	// the process keeps the policy it inherits.
+	SchedulingPolicy   string `json:",omitempty"`
+	SchedulingPriority int    `json:",omitempty"`
+	// Mounts are directories or files in the utility VM which are bind
+	// mounted into the container for an exec'd process, such as a debugging toolkit.
+	// They are made in a mount namespace of the process's own, so that only
+	// it and its children see them, and are removed once it exits. They may
+	// not be given for a container's init process or external processes.
+	Mounts []ProcessMount `json:",omitempty"`
+	// IdleTimeoutInMs, if non-zero, is how long an external process with an
+	// emulated console may go without any input or output before it is
+	// killed, so that forgotten diagnostic shells don't run forever.
+	IdleTimeoutInMs uint32 `json:",omitempty"`
+	// Term is the TERM environment variable of a process with an emulated
+	// console. If it is empty, TERM is taken from Environment, or is
+	// "xterm" if that doesn't set it either. ConsoleSize, if set, is the
+	// size of the console when the process starts.
+	Term        string       `json:",omitempty"`
+	ConsoleSize *ConsoleSize `json:",omitempty"`
+	// SecretEnvironment maps the names of environment variables of an
+	// exec'd process to the names of secrets in its container's SecretsPath,
+	// whose values they are set to. Unlike Environment, the values are
+	// injected only when the process is executed, and are never written to
+	// the container's spec or logged. It may not be given for a container's
+	// init process or external processes.
+	SecretEnvironment map[string]string `json:",omitempty"`
 	// If this is the first process created for this container, this field must
 	// be specified. Otherwise, it must be left blank and the other fields must
 	// be specified.
 	OCISpecification oci.Spec `json:"OciSpecification,omitempty"`
 }
 
+// StdioFileMode specifies how a file which a process's stdio is written to
+// is opened.
+type StdioFileMode string
+
+const (
+	// SfmTruncate truncates the file before the process writes to it.
+	SfmTruncate = StdioFileMode("truncate")
+	// SfmAppend appends the process's output to the file.
+	SfmAppend = StdioFileMode("append")
+)
+
+// ConsoleSize is the size of a process's emulated console, in characters.
+type ConsoleSize struct {
+	Height uint16
+	Width  uint16
+}
+
+// ProcessMount is a directory or file in the utility VM which is bind mounted
+// at Destination in a container for one of its processes. Symbolic links
+// aren't accepted as sources.
+type ProcessMount struct {
+	Source      string
+	Destination string
+	ReadOnly    bool `json:",omitempty"`
+}
+
 // SignalProcessOptions represents the options for signaling a process.
 type SignalProcessOptions struct {
 	Signal int32
+	// WindowsHost is set by Windows hosts, whose signal numbers are those of
+	// the Windows C runtime rather than Linux's, and must be translated.
+	WindowsHost bool `json:",omitempty"`
+}
+
+// ContainerStatus is the lifecycle status of a container.
+type ContainerStatus string
+
+const (
+	// CsCreated is the status of a container whose init process has not been
+	// started.
+	CsCreated = ContainerStatus("created")
+	// CsRunning is the status of a container whose init process is running.
+	CsRunning = ContainerStatus("running")
+	// CsPaused is the status of a container which is frozen.
+	CsPaused = ContainerStatus("paused")
+	// CsExited is the status of a container whose init process has exited.
+	CsExited = ContainerStatus("exited")
+)
+
+// ContainerState describes the lifecycle state of a container.
+type ContainerState struct {
+	Status ContainerStatus
+	// HasRunInitProcess is true once the container's init process has been
+	// created by ExecProcess or RestoreContainer, even if it has not yet been
+	// started.
+	HasRunInitProcess bool
+}
+
+// ContainerResources describes the resources currently mapped into a
+// container, including those added or removed since it was created. Disks
+// are ordered by LUN and directories by port.
+type ContainerResources struct {
+	MappedVirtualDisks []MappedVirtualDisk
+	MappedDirectories  []MappedDirectory
+	NetworkAdapters    []NetworkAdapter
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
 )
 
 // mockRuntime is an implementation of the Runtime interface which uses runC as
@@ -28,13 +29,36 @@ func NewRuntime() *mockRuntime {
 type container struct {
 	id string
 	r  *mockRuntime
+
+	stateLock sync.Mutex
+	// status is the runC-style status of the container: "created",
+	// "running", or "paused".
+	status string
+	// started records whether Start has been called, and so which status a
+	// resumed container returns to.
+	started bool
+	// killed records whether Kill has been called, so that Wait returns
+	// immediately once the container has been killed. It is protected by the
+	// runtime's killed lock.
+	killed bool
 }
 
 func (r *mockRuntime) CreateContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (c runtime.Container, err error) {
-	return &container{id: id, r: r}, nil
+	return &container{id: id, r: r, status: "created"}, nil
+}
+
+func (r *mockRuntime) RestoreContainer(id string, bundlePath string, imagePath string, options runtime.CheckpointOptions, stdioSet *stdio.ConnectionSet) (c runtime.Container, err error) {
+	return &container{id: id, r: r, status: "running", started: true}, nil
 }
 
 func (c *container) Start() error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.status != "created" {
+		return errors.Errorf("cannot start container %s in status %s", c.id, c.status)
+	}
+	c.started = true
+	c.status = "running"
 	return nil
 }
 
@@ -57,6 +81,7 @@ func (c *container) ExecProcess(process oci.Process, stdioSet *stdio.ConnectionS
 func (c *container) Kill(signal oslayer.Signal) error {
 	c.r.killed.L.Lock()
 	defer c.r.killed.L.Unlock()
+	c.killed = true
 	c.r.killed.Broadcast()
 	return nil
 }
@@ -66,21 +91,40 @@ func (c *container) Delete() error {
 }
 
 func (c *container) Pause() error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.status = "paused"
 	return nil
 }
 
 func (c *container) Resume() error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.status != "paused" {
+		return errors.Errorf("cannot resume container %s in status %s", c.id, c.status)
+	}
+	if c.started {
+		c.status = "running"
+	} else {
+		c.status = "created"
+	}
+	return nil
+}
+
+func (c *container) Checkpoint(imagePath string, options runtime.CheckpointOptions) error {
 	return nil
 }
 
 func (c *container) GetState() (*runtime.ContainerState, error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
 	state := &runtime.ContainerState{
 		OCIVersion: "v1",
 		ID:         "abcdef",
 		Pid:        123,
 		BundlePath: "/path/to/bundle",
 		RootfsPath: "/path/to/rootfs",
-		Status:     "running",
+		Status:     c.status,
 		Created:    "tuesday",
 	}
 	return state, nil
@@ -132,7 +176,9 @@ func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
 func (c *container) Wait() (oslayer.ProcessExitState, error) {
 	c.r.killed.L.Lock()
 	defer c.r.killed.L.Unlock()
-	c.r.killed.Wait()
+	if !c.killed {
+		c.r.killed.Wait()
+	}
 	state := mockos.NewProcessExitState(123)
 	return state, nil
 }
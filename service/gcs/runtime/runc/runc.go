@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/oslayer/realos"
@@ -25,11 +26,19 @@ import (
 const (
 	containerFilesDir = "/var/run/gcsrunc"
 	initPidFilename   = "initpid"
+
+	// defaultBinaryPath is the runtime binary used by NewRuntime. It is
+	// resolved using PATH.
+	defaultBinaryPath = "runc"
 )
 
 // runcRuntime is an implementation of the Runtime interface which uses runC as
 // the container runtime.
 type runcRuntime struct {
+	// binaryPath is the path of the runtime binary invoked for every
+	// operation. Any runtime with a runC-compatible command line, such as
+	// crun, may be used.
+	binaryPath string
 }
 
 var _ runtime.Runtime = &runcRuntime{}
@@ -66,9 +75,19 @@ func (p *process) Tty() *stdio.TtyRelay {
 	return p.relay
 }
 
-// NewRuntime instantiates a new runcRuntime struct.
+// NewRuntime instantiates a new runcRuntime struct which uses the runc binary
+// found in PATH.
 func NewRuntime() (*runcRuntime, error) {
-	rtime := &runcRuntime{}
+	return NewRuntimeWithBinary(defaultBinaryPath)
+}
+
+// NewRuntimeWithBinary instantiates a new runcRuntime struct which invokes the
+// runtime binary at the given path instead of runc.
+func NewRuntimeWithBinary(binaryPath string) (*runcRuntime, error) {
+	if binaryPath == "" {
+		return nil, errors.New("runtime binary path must not be empty")
+	}
+	rtime := &runcRuntime{binaryPath: binaryPath}
 	if err := rtime.initialize(); err != nil {
 		return nil, err
 	}
@@ -101,11 +120,24 @@ func (r *runcRuntime) CreateContainer(id string, bundlePath string, stdioSet *st
 	return c, nil
 }
 
+// RestoreContainer restores a container with the given ID and bundlePath from
+// the CRIU checkpoint image stored at imagePath. The restored container is
+// running once this returns, so Start must not be called on it.
+func (r *runcRuntime) RestoreContainer(id string, bundlePath string, imagePath string, options runtime.CheckpointOptions, stdioSet *stdio.ConnectionSet) (c runtime.Container, err error) {
+	args := []string{"restore", "-d", "-b", bundlePath, "--no-pivot", "--image-path", imagePath, "--work-path", imagePath}
+	args = append(args, checkpointOptionsToArgs(options)...)
+	c, err = r.runInitCommand(id, bundlePath, stdioSet, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "CRIU restore log: %s", readCriuLog(imagePath, "restore.log"))
+	}
+	return c, nil
+}
+
 // Start unblocks the container's init process created by the call to
 // CreateContainer.
 func (c *container) Start() error {
 	logPath := c.r.getLogPath()
-	cmd := exec.Command("runc", "--log", logPath, "start", c.id)
+	cmd := exec.Command(c.r.binaryPath, "--log", logPath, "start", c.id)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		c.r.cleanupContainer(c.id)
@@ -127,7 +159,7 @@ func (c *container) ExecProcess(process oci.Process, stdioSet *stdio.ConnectionS
 // Kill sends the specified signal to the container's init process.
 func (c *container) Kill(signal oslayer.Signal) error {
 	logPath := c.r.getLogPath()
-	cmd := exec.Command("runc", "--log", logPath, "kill", c.id, strconv.Itoa(int(signal)))
+	cmd := exec.Command(c.r.binaryPath, "--log", logPath, "kill", c.id, strconv.Itoa(int(signal)))
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "runc kill failed with: %s", out)
@@ -139,7 +171,7 @@ func (c *container) Kill(signal oslayer.Signal) error {
 // wrapper or runC itself.
 func (c *container) Delete() error {
 	logPath := c.r.getLogPath()
-	cmd := exec.Command("runc", "--log", logPath, "delete", c.id)
+	cmd := exec.Command(c.r.binaryPath, "--log", logPath, "delete", c.id)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "runc delete failed with: %s", out)
@@ -162,7 +194,7 @@ func (p *process) Delete() error {
 // Pause suspends all processes running in the container.
 func (c *container) Pause() error {
 	logPath := c.r.getLogPath()
-	cmd := exec.Command("runc", "--log", logPath, "pause", c.id)
+	cmd := exec.Command(c.r.binaryPath, "--log", logPath, "pause", c.id)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "runc pause failed with: %s", out)
@@ -173,7 +205,7 @@ func (c *container) Pause() error {
 // Resume unsuspends processes running in the container.
 func (c *container) Resume() error {
 	logPath := c.r.getLogPath()
-	cmd := exec.Command("runc", "--log", logPath, "resume", c.id)
+	cmd := exec.Command(c.r.binaryPath, "--log", logPath, "resume", c.id)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return errors.Wrapf(err, "runc resume failed with: %s", out)
@@ -181,10 +213,29 @@ func (c *container) Resume() error {
 	return nil
 }
 
+// Checkpoint uses CRIU to dump the state of the container to imagePath. Unless
+// options.LeaveRunning is set, the container is stopped once the checkpoint
+// has been written.
+func (c *container) Checkpoint(imagePath string, options runtime.CheckpointOptions) error {
+	logPath := c.r.getLogPath()
+	args := []string{"--log", logPath, "checkpoint", "--image-path", imagePath, "--work-path", imagePath}
+	args = append(args, checkpointOptionsToArgs(options)...)
+	if options.LeaveRunning {
+		args = append(args, "--leave-running")
+	}
+	args = append(args, c.id)
+	cmd := exec.Command(c.r.binaryPath, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "runc checkpoint failed with: %s\nCRIU dump log: %s", out, readCriuLog(imagePath, "dump.log"))
+	}
+	return nil
+}
+
 // GetState returns information about the given container.
 func (c *container) GetState() (*runtime.ContainerState, error) {
 	logPath := c.r.getLogPath()
-	cmd := exec.Command("runc", "--log", logPath, "state", c.id)
+	cmd := exec.Command(c.r.binaryPath, "--log", logPath, "state", c.id)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, errors.Wrapf(err, "runc state failed with: %s", out)
@@ -219,7 +270,7 @@ func (c *container) Exists() (bool, error) {
 // containers, whether they're running or not.
 func (r *runcRuntime) ListContainerStates() ([]runtime.ContainerState, error) {
 	logPath := r.getLogPath()
-	cmd := exec.Command("runc", "--log", logPath, "list", "-f", "json")
+	cmd := exec.Command(r.binaryPath, "--log", logPath, "list", "-f", "json")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, errors.Wrapf(err, "runc list failed with: %s", out)
@@ -238,16 +289,20 @@ func (c *container) GetRunningProcesses() ([]runtime.ContainerProcessState, erro
 	if err != nil {
 		return nil, err
 	}
+	bootTime, err := getBootTime()
+	if err != nil {
+		return nil, err
+	}
 
 	pidMap := map[int]*runtime.ContainerProcessState{}
 	// Initialize all processes with a pid and command, and mark correctly that
 	// none of them are zombies. Default CreatedByRuntime to false.
 	for _, pid := range pids {
-		command, err := c.r.getProcessCommand(pid)
+		state, err := c.r.getProcessState(pid, bootTime)
 		if err != nil {
 			return nil, err
 		}
-		pidMap[pid] = &runtime.ContainerProcessState{Pid: pid, Command: command, CreatedByRuntime: false, IsZombie: false}
+		pidMap[pid] = state
 	}
 
 	// For each process state directory which corresponds to a running pid, set
@@ -278,16 +333,20 @@ func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
 	if err != nil {
 		return nil, err
 	}
+	bootTime, err := getBootTime()
+	if err != nil {
+		return nil, err
+	}
 
 	pidMap := map[int]*runtime.ContainerProcessState{}
 	// Initialize all processes with a pid and command, leaving
 	// CreatedByRuntime and IsZombie at the default value of false.
 	for _, pid := range runningPids {
-		command, err := c.r.getProcessCommand(pid)
+		state, err := c.r.getProcessState(pid, bootTime)
 		if err != nil {
 			return nil, err
 		}
-		pidMap[pid] = &runtime.ContainerProcessState{Pid: pid, Command: command, CreatedByRuntime: false, IsZombie: false}
+		pidMap[pid] = state
 	}
 
 	processDirs, err := ioutil.ReadDir(filepath.Join(containerFilesDir, c.id))
@@ -311,11 +370,13 @@ func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
 				} else {
 					// Otherwise, since it's in /proc but not running, it must be a
 					// zombie.
-					command, err := c.r.getProcessCommand(pid)
+					state, err := c.r.getProcessState(pid, bootTime)
 					if err != nil {
 						return nil, err
 					}
-					pidMap[pid] = &runtime.ContainerProcessState{Pid: pid, Command: command, CreatedByRuntime: true, IsZombie: true}
+					state.CreatedByRuntime = true
+					state.IsZombie = true
+					pidMap[pid] = state
 				}
 			}
 		}
@@ -328,7 +389,7 @@ func (c *container) GetAllProcesses() ([]runtime.ContainerProcessState, error) {
 // running.
 func (r *runcRuntime) getRunningPids(id string) ([]int, error) {
 	logPath := r.getLogPath()
-	cmd := exec.Command("runc", "--log", logPath, "ps", "-f", "json", id)
+	cmd := exec.Command(r.binaryPath, "--log", logPath, "ps", "-f", "json", id)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, errors.Wrapf(err, "runc ps failed with: %s", out)
@@ -340,13 +401,27 @@ func (r *runcRuntime) getRunningPids(id string) ([]int, error) {
 	return pids, nil
 }
 
+// getProcessState returns the state of the process with the given pid, with
+// CreatedByRuntime and IsZombie left false.
+func (r *runcRuntime) getProcessState(pid int, bootTime time.Time) (*runtime.ContainerProcessState, error) {
+	command, err := r.getProcessCommand(pid)
+	if err != nil {
+		return nil, err
+	}
+	ppid, startTime, err := getProcessStat(pid, bootTime)
+	if err != nil {
+		return nil, err
+	}
+	return &runtime.ContainerProcessState{Pid: pid, Command: command, Ppid: ppid, StartTime: startTime}, nil
+}
+
 // getProcessCommand gets the command line command and arguments for the
 // process with the given pid.
 func (r *runcRuntime) getProcessCommand(pid int) ([]string, error) {
 	// Get the contents of the process's cmdline file.
 	// This file is formatted with a null character after every argument.
 	// e.g. "ping\0google.com\0"
-	data, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cmdline"))
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to read cmdline file for process %d", pid)
 	}
@@ -419,6 +494,12 @@ func (c *container) Wait() (oslayer.ProcessExitState, error) {
 
 // runCreateCommand sets up the arguments for calling runc create.
 func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (runtime.Container, error) {
+	return r.runInitCommand(id, bundlePath, stdioSet, "create", "-b", bundlePath, "--no-pivot")
+}
+
+// runInitCommand runs a runc command, such as create or restore, which
+// creates the init process of a new container with the given ID.
+func (r *runcRuntime) runInitCommand(id string, bundlePath string, stdioSet *stdio.ConnectionSet, args ...string) (runtime.Container, error) {
 	c := &container{r: r, id: id}
 	if err := r.makeContainerDir(id); err != nil {
 		return nil, err
@@ -433,7 +514,6 @@ func (r *runcRuntime) runCreateCommand(id string, bundlePath string, stdioSet *s
 	if err != nil {
 		return nil, err
 	}
-	args := []string{"create", "-b", bundlePath, "--no-pivot"}
 	p, err := c.startProcess(tempProcessDir, hasTerminal, stdioSet, args...)
 	if err != nil {
 		return nil, err
@@ -513,7 +593,7 @@ func (c *container) startProcess(tempProcessDir string, hasTerminal bool, stdioS
 	}
 	args = append(args, c.id)
 
-	cmd := exec.Command("runc", args...)
+	cmd := exec.Command(c.r.binaryPath, args...)
 
 	if !hasTerminal {
 		fileSet, err := stdioSet.Files()
@@ -1,14 +1,27 @@
 package runc
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Microsoft/opengcs/service/gcs/runtime"
 	"github.com/pkg/errors"
 )
 
+// procRoot is the path at which procfs is mounted. It is a variable so that
+// tests may substitute a fake /proc.
+var procRoot = "/proc"
+
+// clockTicksPerSecond is the number of clock ticks per second (USER_HZ) in
+// which procfs reports process times. The kernel fixes it at 100 on every
+// architecture the GCS runs on.
+const clockTicksPerSecond = 100
+
 // readPidFile reads the integer pid stored in the given file.
 func (r *runcRuntime) readPidFile(pidFile string) (pid int, err error) {
 	data, err := ioutil.ReadFile(pidFile)
@@ -71,6 +84,95 @@ func (r *runcRuntime) getLogPath() string {
 // It should be noted that processes which have exited, but have not yet been
 // waited on (i.e. zombies) are still considered to exist by this function.
 func (r *runcRuntime) processExists(pid int) bool {
-	_, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid)))
+	_, err := os.Stat(filepath.Join(procRoot, strconv.Itoa(pid)))
 	return !os.IsNotExist(err)
 }
+
+// getBootTime returns the time at which the system booted, as given by the
+// btime line of /proc/stat.
+func getBootTime() (time.Time, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "failed to read the system stat file")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			btime, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, errors.Wrapf(err, "failed to parse boot time \"%s\"", fields[1])
+			}
+			return time.Unix(btime, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("the system stat file has no btime line")
+}
+
+// getProcessStat returns the parent pid and start time of the process with
+// the given pid, as given by /proc/<pid>/stat. The start time is recorded
+// there in clock ticks since boot, so it is offset from bootTime.
+func getProcessStat(pid int, bootTime time.Time) (ppid int, startTime time.Time, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, time.Time{}, errors.Wrapf(err, "failed to read stat file for process %d", pid)
+	}
+	// The second field is the process's name in parentheses, which may itself
+	// contain spaces and parentheses, so the remaining fields are found after
+	// the last closing parenthesis. They begin with the third field, state.
+	stat := string(data)
+	end := strings.LastIndex(stat, ")")
+	if end == -1 {
+		return 0, time.Time{}, errors.Errorf("malformed stat file for process %d", pid)
+	}
+	fields := strings.Fields(stat[end+1:])
+	// ppid is the fourth field and starttime is the twenty-second.
+	const (
+		ppidIndex      = 1
+		startTimeIndex = 19
+	)
+	if len(fields) <= startTimeIndex {
+		return 0, time.Time{}, errors.Errorf("stat file for process %d has too few fields", pid)
+	}
+	ppid, err = strconv.Atoi(fields[ppidIndex])
+	if err != nil {
+		return 0, time.Time{}, errors.Wrapf(err, "failed to parse parent pid of process %d", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[startTimeIndex], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, errors.Wrapf(err, "failed to parse start time of process %d", pid)
+	}
+	return ppid, bootTime.Add(clockTicksToDuration(ticks)), nil
+}
+
+// clockTicksToDuration converts a number of clock ticks into a duration. The
+// whole seconds are converted separately so that the conversion doesn't
+// overflow for long uptimes.
+func clockTicksToDuration(ticks int64) time.Duration {
+	seconds := ticks / clockTicksPerSecond
+	remainder := ticks % clockTicksPerSecond
+	return time.Duration(seconds)*time.Second + time.Duration(remainder)*time.Second/clockTicksPerSecond
+}
+
+// checkpointOptionsToArgs converts the given options into the flags shared by
+// runc checkpoint and runc restore.
+func checkpointOptionsToArgs(options runtime.CheckpointOptions) []string {
+	var args []string
+	if options.TCPEstablished {
+		args = append(args, "--tcp-established")
+	}
+	if options.FileLocks {
+		args = append(args, "--file-locks")
+	}
+	return args
+}
+
+// readCriuLog returns the contents of the named CRIU log in workPath, so that
+// it may be surfaced when a checkpoint or restore fails. If the log can't be
+// read, a description of the failure is returned instead.
+func readCriuLog(workPath, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(workPath, name))
+	if err != nil {
+		return fmt.Sprintf("<failed to read %s: %s>", name, err)
+	}
+	return string(data)
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -156,4 +158,57 @@ var _ = Describe("Utils", func() {
 			Expect(actualPath).To(Equal(expectedPath))
 		})
 	})
+
+	Describe("reading a process's stat file", func() {
+		var (
+			fakeProc  string
+			oldRoot   string
+			bootTime  time.Time
+			ppid      int
+			startTime time.Time
+		)
+		BeforeEach(func() {
+			fakeProc, err = ioutil.TempDir("", "proc")
+			Expect(err).NotTo(HaveOccurred())
+			oldRoot = procRoot
+			procRoot = fakeProc
+			err = ioutil.WriteFile(filepath.Join(fakeProc, "stat"), []byte("cpu  1 2 3 4\nbtime 1500000000\nprocesses 42\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			err = os.MkdirAll(filepath.Join(fakeProc, "321"), 0755)
+			Expect(err).NotTo(HaveOccurred())
+			// The process's name contains a space and a parenthesis, and
+			// its start time is 123456.78 seconds after boot.
+			stat := "321 (my) proc) S 17 321 321 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 12345678 4000000 200 18446744073709551615\n"
+			err = ioutil.WriteFile(filepath.Join(fakeProc, "321", "stat"), []byte(stat), 0644)
+			Expect(err).NotTo(HaveOccurred())
+		})
+		AfterEach(func() {
+			procRoot = oldRoot
+			Expect(os.RemoveAll(fakeProc)).To(Succeed())
+		})
+		JustBeforeEach(func() {
+			bootTime, err = getBootTime()
+			Expect(err).NotTo(HaveOccurred())
+			ppid, startTime, err = getProcessStat(321, bootTime)
+		})
+		It("should read the boot time", func() {
+			Expect(bootTime).To(Equal(time.Unix(1500000000, 0)))
+		})
+		It("should read the parent pid", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ppid).To(Equal(17))
+		})
+		It("should compute the start time from the boot time", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(startTime).To(Equal(time.Unix(1500000000, 0).Add(123456*time.Second + 780*time.Millisecond)))
+		})
+	})
+
+	Describe("converting clock ticks to a duration", func() {
+		It("should not overflow for long uptimes", func() {
+			// Ten years of uptime at 100 ticks per second.
+			ticks := int64(10 * 365 * 24 * 60 * 60 * 100)
+			Expect(clockTicksToDuration(ticks)).To(Equal(10 * 365 * 24 * time.Hour))
+		})
+	})
 })
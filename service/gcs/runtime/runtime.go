@@ -4,12 +4,26 @@ package runtime
 
 import (
 	"io"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/oslayer"
 	"github.com/Microsoft/opengcs/service/gcs/stdio"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 )
 
+// UnsupportedError is returned by a Runtime's CreateContainer if the runtime
+// can't run containers on this system, such as because the kernel lacks a
+// feature it requires. It must be returned before the container's stdio is
+// used and with nothing left behind for the container, so that the container
+// may be created with another runtime instead.
+type UnsupportedError struct {
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return "runtime unsupported: " + e.Reason
+}
+
 // ContainerState gives information about a container created by a Runtime.
 type ContainerState struct {
 	OCIVersion string
@@ -28,6 +42,30 @@ type ContainerProcessState struct {
 	Command          []string
 	CreatedByRuntime bool
 	IsZombie         bool
+	// Ppid is the pid of the process's parent, and StartTime is the time at
+	// which the process started.
+	Ppid      int
+	StartTime time.Time
+	// Exited and ExitCode are only filled in when a process list is
+	// reconciled against the GCS's own record of process exits. Exited is true
+	// if the process is known to have exited, in which case ExitCode is its
+	// exit code.
+	Exited   bool `json:",omitempty"`
+	ExitCode int  `json:",omitempty"`
+}
+
+// CheckpointOptions specifies how CRIU should handle resources which are not
+// trivially serializable when checkpointing or restoring a container.
+type CheckpointOptions struct {
+	// TCPEstablished allows established TCP connections to be checkpointed
+	// and restored.
+	TCPEstablished bool
+	// FileLocks allows file locks held by the container's processes to be
+	// checkpointed and restored.
+	FileLocks bool
+	// LeaveRunning keeps the container running after it is checkpointed,
+	// rather than stopping it. It is ignored on restore.
+	LeaveRunning bool
 }
 
 // StdioPipes contain the interfaces for reading from and writing to a
@@ -59,11 +97,13 @@ type Container interface {
 	GetState() (*ContainerState, error)
 	GetRunningProcesses() ([]ContainerProcessState, error)
 	GetAllProcesses() ([]ContainerProcessState, error)
+	Checkpoint(imagePath string, options CheckpointOptions) error
 }
 
 // Runtime is the interface defining commands over an OCI container runtime,
 // such as runC.
 type Runtime interface {
 	CreateContainer(id string, bundlePath string, stdioSet *stdio.ConnectionSet) (c Container, err error)
+	RestoreContainer(id string, bundlePath string, imagePath string, options CheckpointOptions, stdioSet *stdio.ConnectionSet) (c Container, err error)
 	ListContainerStates() ([]ContainerState, error)
 }
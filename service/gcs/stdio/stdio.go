@@ -4,6 +4,8 @@ import (
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Microsoft/opengcs/service/gcs/transport"
 	"github.com/sirupsen/logrus"
@@ -106,6 +108,11 @@ func (s *ConnectionSet) NewTtyRelay(pty *os.File) *TtyRelay {
 
 // TtyRelay relays IO between a set of stdio connections and a master PTY file.
 type TtyRelay struct {
+	// lastActivity is when IO was last relayed in either direction, in
+	// nanoseconds since the Unix epoch. It is first so that it is aligned
+	// for atomic access.
+	lastActivity int64
+
 	m      sync.Mutex
 	closed bool
 	wg     sync.WaitGroup
@@ -113,24 +120,54 @@ type TtyRelay struct {
 	pty    *os.File
 }
 
+// ErrConsoleClosed is returned by ResizeConsole once the relay has closed the
+// master PTY, which happens after the process using the console exits.
+var ErrConsoleClosed = errors.New("console pty is closed")
+
 // ResizeConsole sends the appropriate resize to a pTTY FD
 func (r *TtyRelay) ResizeConsole(height, width uint16) error {
 	r.m.Lock()
 	defer r.m.Unlock()
 
 	if r.closed {
-		return errors.New("error resizing console pty is closed")
+		return errors.WithStack(ErrConsoleClosed)
 	}
 	return ResizeConsole(r.pty, height, width)
 }
 
+// Closed returns whether the relay has finished and closed the master PTY.
+func (r *TtyRelay) Closed() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.closed
+}
+
+// LastActivity returns when IO was last relayed in either direction, or when
+// the relay was started if there has been none.
+func (r *TtyRelay) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.lastActivity))
+}
+
+// activityWriter wraps the writer of one direction of a TtyRelay, recording
+// the relay's activity.
+type activityWriter struct {
+	w io.Writer
+	r *TtyRelay
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&a.r.lastActivity, time.Now().UnixNano())
+	return a.w.Write(p)
+}
+
 // Start starts the relay operation. The caller must call Wait to wait
 // for the relay to finish and release the associated resources.
 func (r *TtyRelay) Start() {
+	atomic.StoreInt64(&r.lastActivity, time.Now().UnixNano())
 	if r.s.In != nil {
 		r.wg.Add(1)
 		go func() {
-			_, err := io.Copy(r.pty, r.s.In)
+			_, err := io.Copy(activityWriter{r.pty, r}, r.s.In)
 			if err != nil {
 				logrus.Errorf("error copying stdin to pty: %s", err)
 			}
@@ -140,7 +177,7 @@ func (r *TtyRelay) Start() {
 	if r.s.Out != nil {
 		r.wg.Add(1)
 		go func() {
-			_, err := io.Copy(r.s.Out, r.pty)
+			_, err := io.Copy(activityWriter{r.s.Out, r}, r.pty)
 			if err != nil {
 				logrus.Errorf("error copying pty to stdout: %s", err)
 			}
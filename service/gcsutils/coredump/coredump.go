@@ -0,0 +1,67 @@
+// Package coredump implements the helper which the kernel pipes the core
+// dumps of crashed processes to, as configured through core_pattern. It
+// keeps a bounded prefix of each dump in a file, so that a process with a
+// huge address space can't fill the utility VM's storage.
+package coredump
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Save writes the core dump read from r to path, keeping at most maxSize
+// bytes of it. The dump is written to a temporary file in the same directory
+// and renamed to path once it is complete, so that a partial dump is never
+// found at path. It returns whether the dump was truncated.
+//
+// The kernel doesn't let the crashed process exit until the helper has
+// closed its end of the pipe, which it does when it exits after Save, so the
+// dump is in place by the time the process's exit is reported.
+func Save(path string, maxSize int64, r io.Reader) (truncated bool, err error) {
+	if !filepath.IsAbs(path) {
+		return false, fmt.Errorf("core dump path %s is not absolute", path)
+	}
+	if maxSize <= 0 {
+		return false, errors.New("the maximum core dump size must be positive")
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return false, fmt.Errorf("failed to create core dump file: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	if err := file.Chmod(0600); err != nil {
+		return false, fmt.Errorf("failed to restrict core dump file: %v", err)
+	}
+
+	// One byte beyond the maximum is read to tell whether the dump was
+	// truncated. The rest of the dump is left unread.
+	n, err := io.Copy(file, io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return false, fmt.Errorf("failed to write core dump: %v", err)
+	}
+	if n > maxSize {
+		truncated = true
+		if err := file.Truncate(maxSize); err != nil {
+			return false, fmt.Errorf("failed to truncate core dump: %v", err)
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return false, fmt.Errorf("failed to sync core dump: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return false, fmt.Errorf("failed to close core dump: %v", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return false, fmt.Errorf("failed to rename core dump into place: %v", err)
+	}
+	return truncated, nil
+}
@@ -0,0 +1,78 @@
+package coredump
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "core.42")
+
+	truncated, err := Save(path, 16, bytes.NewReader([]byte("ELF core")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated {
+		t.Fatal("expected a dump within the maximum size not to be truncated")
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "ELF core" {
+		t.Fatalf("expected the whole dump to be saved, got %q", contents)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected the dump to be readable only by its owner, got %v", fi.Mode().Perm())
+	}
+}
+
+func TestSaveTruncates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "core.42")
+
+	truncated, err := Save(path, 4, bytes.NewReader([]byte("ELF core")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Fatal("expected a dump over the maximum size to be truncated")
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "ELF " {
+		t.Fatalf("expected the first 4 bytes of the dump, got %q", contents)
+	}
+	// Only the dump itself is left in the directory.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the dump in %s, found %d entries", dir, len(entries))
+	}
+}
+
+func TestSaveRejectsRelativePath(t *testing.T) {
+	if _, err := Save("core.42", 4, bytes.NewReader(nil)); err == nil {
+		t.Fatal("expected an error for a relative path")
+	}
+}
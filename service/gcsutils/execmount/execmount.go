@@ -0,0 +1,153 @@
+// Package execmount implements a helper which runs a process in its own
+// mount namespace, with additional bind mounts which are visible to it and
+// its children but not to the rest of the container. The mounts go away with
+// the namespace once the process and its children have exited.
+package execmount
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mount is a bind mount of Source, a directory or a file, at Destination.
+type Mount struct {
+	Source      string
+	Destination string
+	ReadOnly    bool
+}
+
+// ParseMount parses a mount given as "source:destination", with an optional
+// ":ro" suffix for a read-only mount. Both paths must be absolute.
+func ParseMount(s string) (Mount, error) {
+	parts := strings.Split(s, ":")
+	var m Mount
+	switch {
+	case len(parts) == 2:
+	case len(parts) == 3 && parts[2] == "ro":
+		m.ReadOnly = true
+	default:
+		return Mount{}, fmt.Errorf("invalid mount \"%s\"", s)
+	}
+	m.Source, m.Destination = parts[0], parts[1]
+	if !filepath.IsAbs(m.Source) || !filepath.IsAbs(m.Destination) {
+		return Mount{}, fmt.Errorf("mount \"%s\" does not have absolute paths", s)
+	}
+	return m, nil
+}
+
+// String returns the mount in the form accepted by ParseMount.
+func (m Mount) String() string {
+	if m.ReadOnly {
+		return m.Source + ":" + m.Destination + ":ro"
+	}
+	return m.Source + ":" + m.Destination
+}
+
+// Run moves the caller into a new mount namespace, makes the given mounts in
+// it, and then replaces the caller with the process with the given
+// arguments. It only returns if one of these steps fails.
+//
+// The sources are expected to be mountpoints which were staged for the
+// process, and are unmounted, both in the original mount namespace and in the
+// new one, once the mounts have been made, so that only the process sees
+// them.
+//
+// Unsharing the mount namespace requires CAP_SYS_ADMIN. Destinations which
+// don't exist are created, as directories if their sources are directories
+// and as files otherwise.
+func Run(mounts []Mount, args []string) error {
+	if len(args) == 0 {
+		return errors.New("no process to run")
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %v", args[0], err)
+	}
+	// The namespace belongs to the thread which unshares it, and so must be
+	// the one the process is executed from.
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("failed to unshare the mount namespace: %v", err)
+	}
+	// Keep the new mounts from propagating back into the container.
+	if err := unix.Mount("", "/", "", unix.MS_SLAVE|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to make the mount namespace a slave: %v", err)
+	}
+	for _, m := range mounts {
+		if err := createDestination(m); err != nil {
+			return err
+		}
+		if err := unix.Mount(m.Source, m.Destination, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s at %s: %v", m.Source, m.Destination, err)
+		}
+		if m.ReadOnly {
+			if err := unix.Mount("", m.Destination, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+				return fmt.Errorf("failed to make %s read-only: %v", m.Destination, err)
+			}
+		}
+	}
+	// Only this thread is in the new mount namespace, so the sources are
+	// unmounted from the original one by a goroutine, which runs on another
+	// thread.
+	unmounted := make(chan error, 1)
+	go func() {
+		unmounted <- unmountSources(mounts)
+	}()
+	if err := <-unmounted; err != nil {
+		return err
+	}
+	// The unmounts only propagate to the new mount namespace if the
+	// sources were shared mounts.
+	if err := unmountSources(mounts); err != nil {
+		return err
+	}
+	if err := syscall.Exec(path, args, os.Environ()); err != nil {
+		return fmt.Errorf("failed to execute %s: %v", path, err)
+	}
+	return nil
+}
+
+// createDestination creates the destination of the given mount if it doesn't
+// exist: a directory if the source is a directory, and an empty file
+// otherwise.
+func createDestination(m Mount) error {
+	info, err := os.Stat(m.Source)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", m.Source, err)
+	}
+	if info.IsDir() {
+		if err := os.MkdirAll(m.Destination, 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %v", m.Destination, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.Destination), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(m.Destination), err)
+	}
+	f, err := os.OpenFile(m.Destination, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", m.Destination, err)
+	}
+	f.Close()
+	return nil
+}
+
+// unmountSources detaches the sources of the given mounts in the calling
+// thread's mount namespace. Sources which are no longer mounted there are
+// skipped.
+func unmountSources(mounts []Mount) error {
+	for _, m := range mounts {
+		if err := unix.Unmount(m.Source, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to unmount %s: %v", m.Source, err)
+		}
+	}
+	return nil
+}
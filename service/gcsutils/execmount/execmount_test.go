@@ -0,0 +1,80 @@
+package execmount
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMount(t *testing.T) {
+	tests := []struct {
+		spec  string
+		mount Mount
+	}{
+		{"/a:/b", Mount{Source: "/a", Destination: "/b"}},
+		{"/a:/b:ro", Mount{Source: "/a", Destination: "/b", ReadOnly: true}},
+	}
+	for _, test := range tests {
+		m, err := ParseMount(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != test.mount {
+			t.Errorf("%q: expected %+v, got %+v", test.spec, test.mount, m)
+		}
+		if m.String() != test.spec {
+			t.Errorf("%q: formatted as %q", test.spec, m.String())
+		}
+	}
+}
+
+func TestParseMountInvalid(t *testing.T) {
+	for _, spec := range []string{"/a", "/a:/b:rw", "/a:/b:ro:x", "a:/b", "/a:b"} {
+		if _, err := ParseMount(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestRunWithoutArgs(t *testing.T) {
+	if err := Run(nil, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestCreateDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dirDest := filepath.Join(dir, "a", "dir")
+	if err := createDestination(Mount{Source: dir, Destination: dirDest}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dirDest); err != nil || !info.IsDir() {
+		t.Errorf("expected a directory at %s: %v", dirDest, err)
+	}
+
+	fileDest := filepath.Join(dir, "b", "file")
+	if err := createDestination(Mount{Source: file, Destination: fileDest}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(fileDest); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("expected a file at %s: %v", fileDest, err)
+	}
+
+	// An existing destination is left unchanged.
+	if err := createDestination(Mount{Source: file, Destination: file}); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(file); err != nil || string(contents) != "contents" {
+		t.Errorf("expected %s to be unchanged, got %q: %v", file, contents, err)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/Microsoft/opengcs/service/gcsutils/coredump"
+)
+
+// coredumpMain saves the core dump piped to its stdin by the kernel. Its
+// arguments are the maximum number of bytes to keep and the path to save
+// the dump at. The GCS configures core_pattern to run it when it is given a
+// core dump directory.
+func coredumpMain() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s <max size> <path>\n", os.Args[0])
+		os.Exit(1)
+	}
+	maxSize, err := strconv.ParseInt(os.Args[1], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "coredump: invalid maximum size %s\n", os.Args[1])
+		os.Exit(1)
+	}
+	truncated, err := coredump.Save(os.Args[2], maxSize, os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "coredump: %s\n", err)
+		os.Exit(1)
+	}
+	if truncated {
+		fmt.Fprintf(os.Stderr, "coredump: %s was truncated to %d bytes\n", os.Args[2], maxSize)
+	}
+}
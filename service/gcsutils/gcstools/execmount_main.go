@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Microsoft/opengcs/service/gcsutils/execmount"
+)
+
+// execmountMain runs the process given by its arguments after "--" in its
+// own mount namespace, with the bind mounts given by the arguments before
+// it. The GCS bind mounts it into containers to run exec'd processes which
+// request additional mounts.
+func execmountMain() {
+	var mounts []execmount.Mount
+	args := os.Args[1:]
+	for len(args) > 0 && args[0] != "--" {
+		m, err := execmount.ParseMount(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "execmount: %s\n", err)
+			os.Exit(127)
+		}
+		mounts = append(mounts, m)
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	if err := execmount.Run(mounts, args); err != nil {
+		fmt.Fprintf(os.Stderr, "execmount: %s\n", err)
+		os.Exit(127)
+	}
+}
@@ -12,6 +12,9 @@ var commands = map[string]func(){
 	"exportSandbox": exportSandboxMain,
 	"netnscfg":      netnsConfigMain,
 	"remotefs":      remotefsMain,
+	"reapinit":      reapinitMain,
+	"execmount":     execmountMain,
+	"coredump":      coredumpMain,
 }
 
 func main() {
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Microsoft/opengcs/service/gcsutils/reapinit"
+)
+
+// reapinitMain runs the process given by its arguments under a minimal init
+// which reaps orphans, exiting with the process's exit status. The GCS
+// bind mounts it into containers which request a reaping init.
+func reapinitMain() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	status, err := reapinit.Run(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reapinit: %s\n", err)
+		os.Exit(127)
+	}
+	os.Exit(status)
+}
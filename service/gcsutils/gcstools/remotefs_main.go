@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/Microsoft/opengcs/service/gcsutils/remotefs"
 )
@@ -11,17 +16,67 @@ import (
 // ErrUnknown is returned for an unknown remotefs command
 var ErrUnknown = errors.New("unkown command")
 
+// commandsFlag is an optional first argument restricting the commands which
+// may be run to a set negotiated with remotefs.Version, given in base 10.
+const commandsFlag = "--commands="
+
+// framedFlag runs remotefs in framed mode, serving multiplexed requests from
+// stdin until it is closed, rather than running a single command. It may be
+// given as "--framed=<n>" to run at most n commands at once.
+const framedFlag = "--framed"
+
 func remotefsHandler() error {
-	if len(os.Args) < 2 {
+	args := os.Args[1:]
+	commands := remotefs.SupportedCommands()
+	if len(args) > 0 && strings.HasPrefix(args[0], commandsFlag) {
+		var err error
+		commands, err = strconv.ParseUint(strings.TrimPrefix(args[0], commandsFlag), 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid command set: %s\n", args[0])
+			return err
+		}
+		args = args[1:]
+	}
+	if len(args) < 1 {
 		return ErrUnknown
 	}
+	if args[0] == framedFlag || strings.HasPrefix(args[0], framedFlag+"=") {
+		var maxConcurrent int
+		if args[0] != framedFlag {
+			var err error
+			maxConcurrent, err = strconv.Atoi(strings.TrimPrefix(args[0], framedFlag+"="))
+			if err != nil || maxConcurrent <= 0 {
+				fmt.Fprintf(os.Stderr, "invalid concurrency limit: %s\n", args[0])
+				return remotefs.ErrInvalid
+			}
+		}
+		return remotefs.Serve(os.Stdin, os.Stdout, commands, maxConcurrent)
+	}
 
-	command := os.Args[1]
-	if cmd, ok := remotefs.Commands[command]; ok {
-		cmdErr := cmd(os.Stdin, os.Stdout, os.Args[2:])
+	command := args[0]
+	cmd, ok, err := remotefs.LookupContext(command, commands)
+	if ok {
+		if err == nil {
+			// Long-running commands are cancelled if the host gives up and
+			// signals the process, so that they can report a partial result.
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			defer signal.Stop(signals)
+			go func() {
+				select {
+				case <-signals:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			err = cmd(ctx, os.Stdin, os.Stdout, args[1:])
+		}
 
-		// Write the cmdErr to stderr, so that the client can handle it.
-		if err := remotefs.WriteError(cmdErr, os.Stderr); err != nil {
+		// Write the error to stderr, so that the client can handle it.
+		if err := remotefs.WriteError(err, os.Stderr); err != nil {
 			return err
 		}
 
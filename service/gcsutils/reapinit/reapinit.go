@@ -0,0 +1,79 @@
+// Package reapinit implements a minimal init process for containers, which
+// runs the container's real init process as its child, forwards signals to
+// it, and reaps the orphaned processes reparented to it so that they don't
+// linger as zombies.
+package reapinit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Run runs the process with the given arguments as a child, with the same
+// stdio, until it exits. Until then, it forwards the signals it receives to
+// the child and reaps any other child processes which exit, including
+// orphans reparented to it. It returns the child's exit status, or 128 plus
+// the number of the signal which killed it, as a shell would.
+//
+// Outside of a container, where the caller isn't pid 1, Run makes the caller
+// a child subreaper so that orphans are still reparented to it.
+func Run(args []string) (int, error) {
+	if len(args) == 0 {
+		return -1, errors.New("no process to run")
+	}
+	if _, _, errno := unix.RawSyscall(unix.SYS_PRCTL, unix.PR_SET_CHILD_SUBREAPER, 1, 0); errno != 0 {
+		return -1, fmt.Errorf("failed to become a child subreaper: %v", errno)
+	}
+
+	// Signals are caught before the child is started, so that none are lost
+	// and no SIGCHLD is missed.
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+	defer signal.Reset()
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return -1, fmt.Errorf("failed to start %s: %v", args[0], err)
+	}
+	child := cmd.Process.Pid
+
+	for {
+		// The child is reaped here, along with every other process, rather
+		// than by cmd.Wait.
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || pid <= 0 {
+				break
+			}
+			if pid == child {
+				if status.Signaled() {
+					return 128 + int(status.Signal()), nil
+				}
+				return status.ExitStatus(), nil
+			}
+		}
+
+		sig := <-signals
+		switch sig {
+		case syscall.SIGCHLD:
+		case syscall.SIGURG:
+			// The Go runtime sends itself SIGURG to preempt goroutines, so
+			// it isn't meant for the child.
+		default:
+			syscall.Kill(child, sig.(syscall.Signal))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package reapinit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRunReapsOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reapinit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidPath := filepath.Join(dir, "pid")
+
+	// The inner shell exits straight away, orphaning its sleep, which then
+	// exits while the outer shell is still running.
+	script := fmt.Sprintf("sh -c 'sleep 0.1 & echo $! > %s'; sleep 1", pidPath)
+	status, err := Run([]string{"sh", "-c", script})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0 {
+		t.Fatalf("expected exit status 0, got %d", status)
+	}
+
+	contents, err := ioutil.ReadFile(pidPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A zombie would still have an entry in /proc.
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); !os.IsNotExist(err) {
+		t.Fatalf("orphaned process %d was not reaped: %v", pid, err)
+	}
+}
+
+func TestRunReturnsExitStatus(t *testing.T) {
+	tests := []struct {
+		script string
+		status int
+	}{
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + 15},
+	}
+	for _, test := range tests {
+		status, err := Run([]string{"sh", "-c", test.script})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status {
+			t.Errorf("%q: expected exit status %d, got %d", test.script, test.status, status)
+		}
+	}
+}
+
+func TestRunWithoutArgs(t *testing.T) {
+	if _, err := Run(nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
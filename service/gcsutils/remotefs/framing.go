@@ -0,0 +1,249 @@
+package remotefs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxFrameLength bounds the length of a frame read by ReadFrame, so that a
+// corrupt header can't cause an arbitrarily large allocation.
+const maxFrameLength = 64 * 1024 * 1024
+
+// DefaultMaxConcurrent is the number of commands Serve runs at once if no
+// limit is given.
+const DefaultMaxConcurrent = 8
+
+// maxQueuedRequests is the number of requests which Serve queues once its
+// limit on running commands is reached. Further requests aren't read until
+// the queue drains.
+const maxQueuedRequests = 256
+
+// bulkCommands are the commands which may transfer or walk large amounts of
+// data. Serve never lets these occupy every slot, so that cheap metadata
+// commands aren't starved behind them.
+var bulkCommands = map[string]bool{
+	ReadFileCmd:       true,
+	WriteFileCmd:      true,
+	AtomicWriteCmd:    true,
+	RemoveAllCmd:      true,
+	ExtractArchiveCmd: true,
+	ArchivePathCmd:    true,
+	MkfsCmd:           true,
+	HashCmd:           true,
+	ChownRecursiveCmd: true,
+	ChmodRecursiveCmd: true,
+	IdmapCmd:          true,
+	CopyCmd:           true,
+	FindCmd:           true,
+}
+
+// runRequest runs a request for Serve. It may be replaced in tests.
+var runRequest = runFramedRequest
+
+// FrameHeader precedes each request and response in framed mode. Responses
+// carry the RequestID of the request they answer, so that requests may be
+// pipelined over a single connection and answered out of order.
+type FrameHeader struct {
+	RequestID uint64
+	// Length is the length of the JSON body which follows the header.
+	Length uint32
+}
+
+// FramedRequest is the body of a request frame. It carries the same command,
+// arguments, and input as a single remotefs invocation.
+type FramedRequest struct {
+	Cmd   string
+	Args  []string `json:",omitempty"`
+	Stdin []byte   `json:",omitempty"`
+
+	// Cancel marks a control frame, rather than a request. It cancels the
+	// request with the same RequestID if that is still running, which is then
+	// answered with ErrCancelled. The control frame itself isn't answered.
+	Cancel bool `json:",omitempty"`
+}
+
+// FramedResponse is the body of a response frame. It carries the same output
+// and error as a single remotefs invocation.
+type FramedResponse struct {
+	Stdout []byte         `json:",omitempty"`
+	Err    *ExportedError `json:",omitempty"`
+}
+
+// WriteFrame serializes v and writes it to w as a frame with the given
+// request ID.
+func WriteFrame(w io.Writer, requestID uint64, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxFrameLength {
+		return fmt.Errorf("frame length %d exceeds the maximum of %d", len(body), maxFrameLength)
+	}
+
+	// The header and body are written at once, so that concurrent writers
+	// synchronized by the caller never interleave a partial frame.
+	buf := &bytes.Buffer{}
+	header := FrameHeader{RequestID: requestID, Length: uint32(len(body))}
+	if err := binary.Write(buf, binary.BigEndian, header); err != nil {
+		return err
+	}
+	buf.Write(body)
+	if _, err := buf.WriteTo(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadFrame reads a frame from r, deserializes its body into v, and returns
+// its request ID. io.EOF is returned if r ends before a new frame.
+func ReadFrame(r io.Reader, v interface{}) (uint64, error) {
+	var header FrameHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return 0, err
+	}
+	if header.Length > maxFrameLength {
+		return 0, fmt.Errorf("frame length %d exceeds the maximum of %d", header.Length, maxFrameLength)
+	}
+
+	body := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return 0, err
+	}
+	return header.RequestID, nil
+}
+
+// Serve runs the commands in the request frames read from in concurrently,
+// writing a response frame for each to out as it completes. Only commands in
+// the given command set may be run. It returns once in is exhausted and every
+// request has been answered. If reading from in fails, the requests still
+// running are cancelled before the error is returned.
+//
+// At most maxConcurrent commands run at once, or DefaultMaxConcurrent if it
+// isn't positive, and further requests are queued. When more than one command
+// may run at once, one of these slots is reserved for commands other than
+// bulkCommands.
+//
+// This framed mode is an alternative to running one command per remotefs
+// invocation, which remains supported.
+func Serve(in io.Reader, out io.Writer, commands uint64, maxConcurrent int) error {
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrent
+	}
+	maxBulk := maxConcurrent - 1
+	if maxBulk == 0 {
+		maxBulk = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		outMutex sync.Mutex
+		writeErr error
+
+		cancelMutex sync.Mutex
+		cancels     = make(map[uint64]context.CancelFunc)
+
+		// pending bounds the requests which are queued or running, and
+		// running and bulkRunning bound the commands which are running.
+		pending     = make(chan struct{}, maxConcurrent+maxQueuedRequests)
+		running     = make(chan struct{}, maxConcurrent)
+		bulkRunning = make(chan struct{}, maxBulk)
+	)
+	defer wg.Wait()
+
+	for {
+		var request FramedRequest
+		requestID, err := ReadFrame(in, &request)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The connection has dropped, so cancel the requests still
+			// running, rather than holding their files open for a host
+			// which won't receive their responses.
+			cancelMutex.Lock()
+			for _, cancel := range cancels {
+				cancel()
+			}
+			cancelMutex.Unlock()
+			return err
+		}
+
+		cancelMutex.Lock()
+		if request.Cancel {
+			if cancel, ok := cancels[requestID]; ok {
+				cancel()
+			}
+			cancelMutex.Unlock()
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels[requestID] = cancel
+		cancelMutex.Unlock()
+
+		pending <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-pending }()
+
+			if bulkCommands[request.Cmd] {
+				bulkRunning <- struct{}{}
+			}
+			running <- struct{}{}
+			var response *FramedResponse
+			if ctx.Err() != nil {
+				// The request was cancelled while it was queued.
+				response = &FramedResponse{Err: ToExportedError(ErrCancelled)}
+			} else {
+				response = runRequest(ctx, &request, commands)
+			}
+			<-running
+			if bulkCommands[request.Cmd] {
+				<-bulkRunning
+			}
+
+			cancelMutex.Lock()
+			delete(cancels, requestID)
+			cancelMutex.Unlock()
+			cancel()
+
+			outMutex.Lock()
+			defer outMutex.Unlock()
+			if err := WriteFrame(out, requestID, response); err != nil && writeErr == nil {
+				writeErr = err
+			}
+		}()
+	}
+
+	wg.Wait()
+	outMutex.Lock()
+	defer outMutex.Unlock()
+	return writeErr
+}
+
+// runFramedRequest runs the command in the given request and returns its
+// response.
+func runFramedRequest(ctx context.Context, request *FramedRequest, commands uint64) *FramedResponse {
+	f, ok, err := LookupContext(request.Cmd, commands)
+	if !ok {
+		err = &ExportedError{ErrString: fmt.Sprintf("unknown command: %s", request.Cmd)}
+	}
+	stdout := &bytes.Buffer{}
+	if err == nil {
+		err = f(ctx, bytes.NewReader(request.Stdin), stdout, request.Args)
+	}
+
+	response := &FramedResponse{Stdout: stdout.Bytes()}
+	if err != nil {
+		response.Err = ToExportedError(err)
+	}
+	return response
+}
@@ -1,18 +1,87 @@
 package remotefs
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/realos"
 )
 
 // ErrInvalid is returned if the parameters are invalid
 var ErrInvalid = errors.New("invalid arguments")
 
+// ProtocolVersion is the version of the remotefs protocol implemented by this
+// package. It is incremented when the behavior of existing commands changes.
+//
+// Version 2 adds the optional range arguments of ReadFile.
+const ProtocolVersion = 2
+
+// commandBits lists the commands in the order of their bits in a command set,
+// as exchanged by Version. New commands must only be appended, so that the
+// bits of existing commands don't change.
+var commandBits = []string{
+	StatCmd,
+	LstatCmd,
+	ReadlinkCmd,
+	MkdirCmd,
+	MkdirAllCmd,
+	RemoveCmd,
+	RemoveAllCmd,
+	LinkCmd,
+	SymlinkCmd,
+	LchmodCmd,
+	LchownCmd,
+	MknodCmd,
+	MkfifoCmd,
+	ReadFileCmd,
+	WriteFileCmd,
+	ReadDirCmd,
+	ResolvePathCmd,
+	ResolveMountCmd,
+	MkfsCmd,
+	MountCmd,
+	UnmountCmd,
+	ExtractArchiveCmd,
+	ArchivePathCmd,
+	HashCmd,
+	ChownRecursiveCmd,
+	ChmodRecursiveCmd,
+	IdmapCmd,
+	AtomicWriteCmd,
+	CopyCmd,
+	FindCmd,
+	RealpathCmd,
+	VersionCmd,
+	MkdirTreeCmd,
+	MountInfoCmd,
+	ReadCoreDumpCmd,
+}
+
+// ErrBusy is returned by Unmount if the target is busy. A lazy unmount may be
+// used to detach it anyway.
+var ErrBusy = errors.New("target is busy")
+
+// ErrCancelled is returned by a long-running command which was cancelled
+// before it completed.
+var ErrCancelled = errors.New("operation cancelled")
+
+// osLayer is the OS interface through which commands run external programs.
+// It may be replaced in tests.
+var osLayer oslayer.OS = realos.NewOS()
+
 // Func is the function definition for a generic remote fs function
 // The input to the function is any serialized structs / data from in and the string slice
 // from args. The output of the function will be serialized and written to out.
 type Func func(stdin io.Reader, stdout io.Writer, args []string) error
 
+// ContextFunc is like Func, but for a long-running command which checks ctx
+// periodically, and aborts with ErrCancelled once it is cancelled.
+type ContextFunc func(ctx context.Context, stdin io.Reader, stdout io.Writer, args []string) error
+
 // RemotefsCmd is the name of the remotefs meta command
 const RemotefsCmd = "remotefs"
 
@@ -33,10 +102,26 @@ const (
 	MkfifoCmd         = "mkfifo"
 	ReadFileCmd       = "readfile"
 	WriteFileCmd      = "writefile"
+	AtomicWriteCmd    = "atomicwrite"
 	ReadDirCmd        = "readdir"
 	ResolvePathCmd    = "resolvepath"
+	ResolveMountCmd   = "resolvemount"
+	MkfsCmd           = "mkfs"
+	MountCmd          = "mount"
+	UnmountCmd        = "unmount"
 	ExtractArchiveCmd = "extractarchive"
 	ArchivePathCmd    = "archivepath"
+	HashCmd           = "hash"
+	ChownRecursiveCmd = "chownrecursive"
+	ChmodRecursiveCmd = "chmodrecursive"
+	IdmapCmd          = "idmap"
+	CopyCmd           = "copy"
+	FindCmd           = "find"
+	RealpathCmd       = "realpath"
+	VersionCmd        = "version"
+	MkdirTreeCmd      = "mkdirtree"
+	MountInfoCmd      = "mountinfo"
+	ReadCoreDumpCmd   = "readcoredump"
 )
 
 // Commands provide a string -> remotefs function mapping.
@@ -58,8 +143,88 @@ var Commands = map[string]Func{
 	MkfifoCmd:         Mkfifo,
 	ReadFileCmd:       ReadFile,
 	WriteFileCmd:      WriteFile,
+	AtomicWriteCmd:    AtomicWrite,
 	ReadDirCmd:        ReadDir,
 	ResolvePathCmd:    ResolvePath,
+	ResolveMountCmd:   ResolveMount,
+	MkfsCmd:           Mkfs,
+	MountCmd:          Mount,
+	UnmountCmd:        Unmount,
 	ExtractArchiveCmd: ExtractArchive,
 	ArchivePathCmd:    ArchivePath,
+	HashCmd:           Hash,
+	ChownRecursiveCmd: ChownRecursive,
+	ChmodRecursiveCmd: ChmodRecursive,
+	IdmapCmd:          Idmap,
+	CopyCmd:           Copy,
+	FindCmd:           Find,
+	RealpathCmd:       Realpath,
+	VersionCmd:        Version,
+	MkdirTreeCmd:      MkdirTree,
+	MountInfoCmd:      ListMounts,
+	ReadCoreDumpCmd:   ReadCoreDump,
+}
+
+// cancellableCommands maps the names of long-running commands to versions of
+// their functions which may be cancelled.
+var cancellableCommands = map[string]ContextFunc{
+	ExtractArchiveCmd: extractArchiveContext,
+	ChownRecursiveCmd: chownRecursiveContext,
+	ChmodRecursiveCmd: chmodRecursiveContext,
+	IdmapCmd:          idmapContext,
+	FindCmd:           findContext,
+}
+
+// CommandSet returns the set of commands with the given names, as a bitmask
+// using the bits given by commandBits. Names of unknown commands are ignored.
+func CommandSet(names ...string) uint64 {
+	var set uint64
+	for i, name := range commandBits {
+		for _, n := range names {
+			if n == name {
+				set |= 1 << uint(i)
+			}
+		}
+	}
+	return set
+}
+
+// SupportedCommands returns the set of all commands supported by this
+// package.
+func SupportedCommands() uint64 {
+	return CommandSet(commandBits...)
+}
+
+// Lookup returns the function for the named command, provided that the
+// command is in the given command set, such as one negotiated through
+// Version. If it isn't, an ExportedError wrapping ENOSYS is returned, and if
+// the command is unknown, ok is false.
+func Lookup(name string, commands uint64) (f Func, ok bool, err error) {
+	f, ok = Commands[name]
+	if !ok {
+		return nil, false, nil
+	}
+	if commands&CommandSet(name) == 0 {
+		return nil, true, &ExportedError{
+			ErrString: fmt.Sprintf("unsupported command: %s", name),
+			ErrNum:    int(syscall.ENOSYS),
+		}
+	}
+	return f, true, nil
+}
+
+// LookupContext works like Lookup, but returns a function which may be
+// cancelled through its context. Commands which can't be cancelled ignore
+// the context.
+func LookupContext(name string, commands uint64) (f ContextFunc, ok bool, err error) {
+	plain, ok, err := Lookup(name, commands)
+	if plain == nil {
+		return nil, ok, err
+	}
+	if f, ok := cancellableCommands[name]; ok {
+		return f, true, nil
+	}
+	return func(_ context.Context, in io.Reader, out io.Writer, args []string) error {
+		return plain(in, out, args)
+	}, true, nil
 }
@@ -1,9 +1,18 @@
 package remotefs
 
 import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/mount"
 	"github.com/docker/docker/pkg/symlink"
 )
 
@@ -35,26 +44,287 @@ func ResolvePath(in io.Reader, out io.Writer, args []string) error {
 	return nil
 }
 
-// ExtractArchive extracts the archive read from in.
+// ResolveMount resolves a path in the same way as ResolvePath, and then
+// reports the nearest mount point containing the resolved path, along with
+// the mount's filesystem type, as found in /proc/self/mountinfo.
+//
+// Args:
+// - args[0] is `path`
+// - args[1] is `root`
+// Out:
+// - Write json of MountInfo to stdout
+func ResolveMount(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return ErrInvalid
+	}
+	res, err := symlink.FollowSymlinkInScope(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return err
+	}
+	m := findMount(res, mounts)
+	if m == nil {
+		return ErrInvalid
+	}
+
+	info := MountInfo{
+		Path:       res,
+		MountPoint: m.Mountpoint,
+		FSType:     m.Fstype,
+		Source:     m.Source,
+		Root:       m.Root,
+	}
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListMounts lists the mounts in /proc/self/mountinfo, in the order they are
+// listed there, such as to debug mount issues.
+//
+// Args:
+// - args[0] is an optional path prefix, limiting the list to mounts at or under it
+// Out:
+// - Write json of []MountEntry to stdout
+func ListMounts(in io.Reader, out io.Writer, args []string) error {
+	var prefix string
+	if len(args) > 0 {
+		if !filepath.IsAbs(args[0]) {
+			return ErrInvalid
+		}
+		prefix = filepath.Clean(args[0])
+	}
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return err
+	}
+	entries := []MountEntry{}
+	for _, m := range mounts {
+		if prefix != "" && !pathHasPrefix(filepath.Clean(m.Mountpoint), prefix) {
+			continue
+		}
+		entries = append(entries, MountEntry{
+			MountPoint:   m.Mountpoint,
+			Source:       m.Source,
+			FSType:       m.Fstype,
+			Options:      splitMountOptions(m.Opts),
+			SuperOptions: splitMountOptions(m.VfsOpts),
+			Root:         m.Root,
+		})
+	}
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// splitMountOptions splits a comma separated list of mount options.
+func splitMountOptions(opts string) []string {
+	if opts == "" {
+		return nil
+	}
+	return strings.Split(opts, ",")
+}
+
+// findMount returns the mount from mounts whose mount point is the nearest
+// ancestor of (or equal to) the given absolute path, or nil if there is none.
+// When several mounts share a mount point, the one listed last is returned,
+// since it is stacked on top of the others and is the one that is visible.
+// Bind mounts and overlays are listed in mountinfo like any other mount, so
+// they need no special handling here.
+func findMount(path string, mounts []*mount.Info) *mount.Info {
+	path = filepath.Clean(path)
+	var best *mount.Info
+	for _, m := range mounts {
+		mountPoint := filepath.Clean(m.Mountpoint)
+		if !pathHasPrefix(path, mountPoint) {
+			continue
+		}
+		if best == nil || len(mountPoint) >= len(filepath.Clean(best.Mountpoint)) {
+			best = m
+		}
+	}
+	return best
+}
+
+// pathHasPrefix returns true if prefix is path or one of its ancestor
+// directories. Both paths are expected to be clean.
+func pathHasPrefix(path, prefix string) bool {
+	if prefix == "/" || path == prefix {
+		return true
+	}
+	return strings.HasPrefix(path, prefix+"/")
+}
+
+// ExtractArchive extracts the archive read from in. Hard links are recreated
+// as links, even if they precede their targets in the archive. Extended
+// attributes are restored, including file capabilities, unless they are to be
+// dropped.
 // Args:
 // - in = size of json | json of archive.TarOptions | input tar stream
 // - args[0] = extract directory name
+// - args[1] = optional "false" to drop the security.capability xattrs of files
 func ExtractArchive(in io.Reader, out io.Writer, args []string) error {
+	return extractArchiveContext(context.Background(), in, out, args)
+}
+
+func extractArchiveContext(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
 	if len(args) < 1 {
 		return ErrInvalid
 	}
 
+	preserveCapabilities := true
+	if len(args) > 1 {
+		var err error
+		preserveCapabilities, err = strconv.ParseBool(args[1])
+		if err != nil {
+			return err
+		}
+	}
+
 	opts, err := ReadTarOptions(in)
 	if err != nil {
 		return err
 	}
 
-	if err := archive.Untar(in, args[0], opts); err != nil {
+	r := &contextReader{ctx: ctx, r: in}
+	decompressed, err := archive.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+	rewritten := rewriteArchive(decompressed, preserveCapabilities)
+	defer rewritten.Close()
+
+	if err := archive.Untar(rewritten, args[0], opts); err != nil {
+		if ctx.Err() != nil {
+			// Report how far the extraction got, since the files extracted
+			// until then are left in place.
+			return &ExportedError{
+				ErrString: fmt.Sprintf("%s after reading %d bytes of the archive; %s may be partially extracted", ErrCancelled, r.n, args[0]),
+				ErrNum:    int(syscall.ECANCELED),
+			}
+		}
 		return err
 	}
 	return nil
 }
 
+// capabilityXattr is the extended attribute holding a file's capabilities.
+const capabilityXattr = "security.capability"
+
+// rewriteArchive returns the uncompressed tar stream read from r, except that
+// hard links whose targets haven't been seen yet are moved after the rest of
+// the entries, so that their targets exist by the time they are extracted.
+// Unless capabilities are to be preserved, the capabilityXattr of each entry
+// is dropped. The returned reader must be closed, to stop the rewriting of
+// the stream.
+func rewriteArchive(r io.Reader, preserveCapabilities bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(rewriteEntries(tar.NewReader(r), tar.NewWriter(pw), preserveCapabilities))
+	}()
+	return pr
+}
+
+// rewriteEntries copies the entries read from tr to tw, as described by
+// rewriteArchive.
+func rewriteEntries(tr *tar.Reader, tw *tar.Writer, preserveCapabilities bool) error {
+	seen := make(map[string]bool)
+	var deferred []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !preserveCapabilities {
+			// The writer merges Xattrs into PAXRecords, so the attribute
+			// must be dropped from both.
+			delete(hdr.Xattrs, capabilityXattr)
+			delete(hdr.PAXRecords, "SCHILY.xattr."+capabilityXattr)
+		}
+		if hdr.Typeflag == tar.TypeLink && !seen[tarEntryKey(hdr.Linkname)] {
+			deferred = append(deferred, hdr)
+			continue
+		}
+		seen[tarEntryKey(hdr.Name)] = true
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	// A deferred link may target another deferred link, so write the links
+	// whose targets have been written until there are none left. Any which
+	// remain have missing targets, and are written anyway so that extracting
+	// them reports the error.
+	for len(deferred) > 0 {
+		var remaining []*tar.Header
+		for _, hdr := range deferred {
+			if !seen[tarEntryKey(hdr.Linkname)] {
+				remaining = append(remaining, hdr)
+				continue
+			}
+			seen[tarEntryKey(hdr.Name)] = true
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+		if len(remaining) == len(deferred) {
+			for _, hdr := range remaining {
+				if err := tw.WriteHeader(hdr); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		deferred = remaining
+	}
+	return tw.Close()
+}
+
+// tarEntryKey normalizes the name of a tar entry, or the target of a hard
+// link, so that names referring to the same path compare equal.
+func tarEntryKey(name string) string {
+	return filepath.Clean("/" + name)
+}
+
+// contextReader wraps a reader, failing reads with ErrCancelled once ctx is
+// cancelled. n counts the bytes read until then.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   int64
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if cr.ctx.Err() != nil {
+		return 0, ErrCancelled
+	}
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
 // ArchivePath archives the given directory and writes it to out.
 // Args:
 // - in = size of json | json of archive.TarOptions
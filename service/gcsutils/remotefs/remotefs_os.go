@@ -1,15 +1,87 @@
 package remotefs
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
+// mkfsAllowedTypes is the set of filesystem types which Mkfs may create.
+var mkfsAllowedTypes = map[string]bool{
+	"ext2": true,
+	"ext3": true,
+	"ext4": true,
+	"xfs":  true,
+}
+
+// hashAlgorithms maps the algorithms which Hash supports to their
+// constructors.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// mkfsTimeout is how long Mkfs waits for mkfs to finish before killing it.
+var mkfsTimeout = 5 * time.Minute
+
+// Version negotiates the protocol version and set of commands to use with the
+// host. The result is the lower of the two protocol versions, and the
+// commands supported by both. The host should only send commands in the
+// negotiated set, and may pass it to later invocations, which then reject
+// other commands.
+// Args:
+// - args[0] = the host's protocol version in base 10
+// - args[1] = the set of commands supported by the host, in base 10
+// Out:
+// - out = VersionInfo
+func Version(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return ErrInvalid
+	}
+
+	hostVersion, err := strconv.Atoi(args[0])
+	if err != nil || hostVersion < 1 {
+		return ErrInvalid
+	}
+	hostCommands, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	info := VersionInfo{
+		ProtocolVersion: ProtocolVersion,
+		Commands:        hostCommands & SupportedCommands(),
+	}
+	if hostVersion < info.ProtocolVersion {
+		info.ProtocolVersion = hostVersion
+	}
+
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Stat functions like os.Stat.
 // Args:
 // - args[0] is the path
@@ -78,6 +150,39 @@ func Readlink(in io.Reader, out io.Writer, args []string) error {
 	return nil
 }
 
+// Realpath works like realpath(3). Unlike Readlink, it follows the whole chain
+// of symlinks in the path, and returns the absolute canonical path of the
+// final target. Unlike ResolvePath, the path is not scoped within a root. If
+// the symlinks form a cycle, a PathError wrapping ELOOP is returned.
+// Args:
+// - args[0] is the path
+// Out:
+// - Write resolved path to out
+func Realpath(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 1 {
+		return ErrInvalid
+	}
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	res, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// EvalSymlinks doesn't report cycles with an errno, but the kernel
+		// does, so stat the path to get a more specific error.
+		if _, statErr := os.Stat(path); statErr != nil {
+			return statErr
+		}
+		return err
+	}
+
+	if _, err := out.Write([]byte(res)); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Mkdir works like os.Mkdir
 // Args:
 // - args[0] is the path
@@ -106,6 +211,74 @@ func mkdir(in io.Reader, out io.Writer, args []string, mkdirFunc func(string, os
 	return mkdirFunc(args[0], os.FileMode(perm))
 }
 
+// MkdirTree creates the given directories under the root in order, setting the
+// mode and ownership of each, as when extracting an archive which specifies
+// metadata for each level of a path. The parent of each directory must
+// already exist, or be created by an earlier entry. Existing directories are
+// left unchanged, unless updating them is requested.
+// Args:
+// - in = json of []DirTreeEntry
+// - args[0] = root path
+// - args[1] = optional "true" to set the mode and ownership of existing directories
+func MkdirTree(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 1 {
+		return ErrInvalid
+	}
+	root := args[0]
+
+	var update bool
+	if len(args) > 1 {
+		var err error
+		update, err = strconv.ParseBool(args[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	var entries []DirTreeEntry
+	if err := json.NewDecoder(in).Decode(&entries); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		relPath := filepath.Clean(entry.Path)
+		if filepath.IsAbs(relPath) || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, "../") {
+			return ErrInvalid
+		}
+		if entry.Mode&^(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+			return ErrInvalid
+		}
+		path := filepath.Join(root, relPath)
+
+		if err := os.Mkdir(path, 0700); err != nil {
+			if !os.IsExist(err) {
+				return err
+			}
+			info, err := os.Lstat(path)
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+			}
+			if !update {
+				continue
+			}
+		}
+
+		// The ownership is set first, since changing it may clear the setuid
+		// and setgid bits of the mode. The mode is set explicitly, so that it
+		// isn't affected by the umask.
+		if err := os.Lchown(path, entry.UID, entry.GID); err != nil {
+			return err
+		}
+		if err := os.Chmod(path, entry.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Remove works like os.Remove
 // Args:
 //	- args[0] is the path
@@ -196,14 +369,88 @@ func Lchown(in io.Reader, out io.Writer, args []string) error {
 	return os.Lchown(args[0], int(uid), int(gid))
 }
 
-// Mknod works like syscall.Mknod
+// Filters selecting which paths ChownRecursive and ChmodRecursive apply to.
+const (
+	recursiveFilterAll   = "all"
+	recursiveFilterFiles = "files"
+	recursiveFilterDirs  = "dirs"
+)
+
+// ChownRecursive works like Lchown, but applies to every path in the tree
+// rooted at the given path. Symlinks are not followed. If shifting is
+// requested, uid and gid are added to each path's existing ownership, such as
+// to map ids into a user namespace. A failure on one path doesn't stop the
+// walk, and is reported in the result.
 // Args:
-//  - args[0] = path
-//  - args[1] = permission mode in octal (like 0755)
-//  - args[2] = major device number in base 10
-//  - args[3] = minor device number in base 10
-func Mknod(in io.Reader, out io.Writer, args []string) error {
-	if len(args) < 4 {
+// - args[0] = path
+// - args[1] = uid in base 10
+// - args[2] = gid in base 10
+// - args[3] = optional filter: "all" (the default), "files", or "dirs"
+// - args[4] = optional "true" to shift each path's ownership by uid and gid
+// Out:
+// - out = RecursiveChangeResult
+func ChownRecursive(in io.Reader, out io.Writer, args []string) error {
+	return chownRecursiveContext(context.Background(), in, out, args)
+}
+
+func chownRecursiveContext(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 3 {
+		return ErrInvalid
+	}
+
+	uid, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	filter := recursiveFilterAll
+	if len(args) > 3 {
+		filter = args[3]
+	}
+	var shift bool
+	if len(args) > 4 {
+		shift, err = strconv.ParseBool(args[4])
+		if err != nil {
+			return err
+		}
+	}
+
+	return walkRecursive(ctx, out, args[0], filter, func(path string, info os.FileInfo) error {
+		newUID, newGID := uid, gid
+		if shift {
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return fmt.Errorf("cannot determine the ownership of %s", path)
+			}
+			newUID += int64(stat.Uid)
+			newGID += int64(stat.Gid)
+			if newUID < 0 || newGID < 0 {
+				return fmt.Errorf("shifted ownership %d:%d of %s is negative", newUID, newGID, path)
+			}
+		}
+		return os.Lchown(path, int(newUID), int(newGID))
+	})
+}
+
+// ChmodRecursive works like Lchmod, but applies to every path in the tree
+// rooted at the given path. Symlinks are skipped, since their permissions
+// can't be changed. A failure on one path doesn't stop the walk, and is
+// reported in the result.
+// Args:
+// - args[0] = path
+// - args[1] = permission mode in octal (like 0755)
+// - args[2] = optional filter: "all" (the default), "files", or "dirs"
+// Out:
+// - out = RecursiveChangeResult
+func ChmodRecursive(in io.Reader, out io.Writer, args []string) error {
+	return chmodRecursiveContext(context.Background(), in, out, args)
+}
+
+func chmodRecursiveContext(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 2 {
 		return ErrInvalid
 	}
 
@@ -211,21 +458,194 @@ func Mknod(in io.Reader, out io.Writer, args []string) error {
 	if err != nil {
 		return err
 	}
+	filter := recursiveFilterAll
+	if len(args) > 2 {
+		filter = args[2]
+	}
+
+	return walkRecursive(ctx, out, args[0], filter, func(path string, info os.FileInfo) error {
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errSkipPath
+		}
+		return os.Chmod(path, os.FileMode(perm))
+	})
+}
+
+// Idmap shifts the ownership of every path in the tree rooted at the given
+// path from container ids to host ids, according to the supplied mappings.
+// This prepares a layer for use by a container in a user namespace. Symlinks
+// are not followed. A path owned by an id outside of the mapped ranges is
+// reported as an error in the result, unless unmapped paths are to be left
+// unchanged.
+// Args:
+// - in = json of IDMap
+// - args[0] = path
+// - args[1] = optional "true" to leave paths with unmapped owners unchanged
+// Out:
+// - out = RecursiveChangeResult
+func Idmap(in io.Reader, out io.Writer, args []string) error {
+	return idmapContext(context.Background(), in, out, args)
+}
+
+func idmapContext(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 1 {
+		return ErrInvalid
+	}
+
+	var leaveUnmapped bool
+	if len(args) > 1 {
+		var err error
+		leaveUnmapped, err = strconv.ParseBool(args[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	var idMap IDMap
+	if err := json.NewDecoder(in).Decode(&idMap); err != nil {
+		return err
+	}
+	if len(idMap.UIDMappings) == 0 || len(idMap.GIDMappings) == 0 {
+		return ErrInvalid
+	}
+
+	return walkRecursive(ctx, out, args[0], recursiveFilterAll, func(path string, info os.FileInfo) error {
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("cannot determine the ownership of %s", path)
+		}
+		uid, uidMapped := mapID(idMap.UIDMappings, stat.Uid)
+		gid, gidMapped := mapID(idMap.GIDMappings, stat.Gid)
+		if !uidMapped || !gidMapped {
+			if leaveUnmapped {
+				return errSkipPath
+			}
+			return fmt.Errorf("owner %d:%d of %s is outside of the mapped ranges", stat.Uid, stat.Gid, path)
+		}
+		return os.Lchown(path, int(uid), int(gid))
+	})
+}
+
+// mapID returns the host id which the given container id maps to, and
+// whether it falls within any of the mappings.
+func mapID(mappings []IDMapping, id uint32) (uint32, bool) {
+	for _, m := range mappings {
+		if id >= m.ContainerID && uint64(id) < uint64(m.ContainerID)+uint64(m.Size) {
+			return m.HostID + (id - m.ContainerID), true
+		}
+	}
+	return 0, false
+}
+
+// errSkipPath is returned by the change functions passed to walkRecursive to
+// indicate that a path was skipped rather than changed.
+var errSkipPath = errors.New("path skipped")
+
+// walkRecursive calls change on every path in the tree rooted at root which
+// matches filter, and writes a RecursiveChangeResult to out. If ctx is
+// cancelled, the walk stops, and the partial result is written before
+// ErrCancelled is returned.
+func walkRecursive(ctx context.Context, out io.Writer, root string, filter string, change func(string, os.FileInfo) error) error {
+	if filter != recursiveFilterAll && filter != recursiveFilterFiles && filter != recursiveFilterDirs {
+		return ErrInvalid
+	}
+
+	var result RecursiveChangeResult
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		if err != nil {
+			// The root itself must be walkable, but a failure below it is
+			// only reported.
+			if path == root {
+				return err
+			}
+			result.Errors = append(result.Errors, PathChangeError{Path: path, ErrString: err.Error()})
+			return nil
+		}
+		if (filter == recursiveFilterFiles && info.IsDir()) || (filter == recursiveFilterDirs && !info.IsDir()) {
+			return nil
+		}
+		switch err := change(path, info); err {
+		case nil:
+			result.Changed++
+		case errSkipPath:
+		default:
+			result.Errors = append(result.Errors, PathChangeError{Path: path, ErrString: err.Error()})
+		}
+		return nil
+	})
+	if err == ErrCancelled {
+		result.Cancelled = true
+	} else if err != nil {
+		return err
+	}
 
-	major, err := strconv.ParseInt(args[2], 10, 32)
+	buf, err := json.Marshal(result)
 	if err != nil {
 		return err
 	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	if result.Cancelled {
+		return ErrCancelled
+	}
+	return nil
+}
+
+// Mknod works like syscall.Mknod. The file type is given by the S_IFMT bits
+// of the mode, and must be a character device, block device, FIFO, or
+// socket. The device numbers are only required, and only used, for devices.
+// Args:
+//  - args[0] = path
+//  - args[1] = mode in octal, including the file type (like 020644)
+//  - args[2] = major device number in base 10
+//  - args[3] = minor device number in base 10
+func Mknod(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return ErrInvalid
+	}
 
-	minor, err := strconv.ParseInt(args[3], 10, 32)
+	mode, err := strconv.ParseUint(args[1], 8, 32)
 	if err != nil {
 		return err
 	}
+	if mode&^(unix.S_IFMT|07777) != 0 {
+		return ErrInvalid
+	}
+
+	var dev uint64
+	switch mode & unix.S_IFMT {
+	case unix.S_IFCHR, unix.S_IFBLK:
+		if len(args) < 4 {
+			return ErrInvalid
+		}
+		major, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil || major >= mknodMaxMajor {
+			return ErrInvalid
+		}
+		minor, err := strconv.ParseUint(args[3], 10, 32)
+		if err != nil || minor >= mknodMaxMinor {
+			return ErrInvalid
+		}
+		dev = unix.Mkdev(uint32(major), uint32(minor))
+	case unix.S_IFIFO, unix.S_IFSOCK:
+	default:
+		return ErrInvalid
+	}
 
-	dev := unix.Mkdev(uint32(major), uint32(minor))
-	return unix.Mknod(args[0], uint32(perm), int(dev))
+	return unix.Mknod(args[0], uint32(mode), int(dev))
 }
 
+// The limits on the device numbers passed to Mknod, as imposed by Linux's
+// dev_t, which holds a 12 bit major number and a 20 bit minor number.
+const (
+	mknodMaxMajor = 1 << 12
+	mknodMaxMinor = 1 << 20
+)
+
 // Mkfifo creates a FIFO special file with the given path name and permissions
 // Args:
 // 	- args[0] = path
@@ -239,14 +659,23 @@ func Mkfifo(in io.Reader, out io.Writer, args []string) error {
 	if err != nil {
 		return err
 	}
-	return unix.Mkfifo(args[0], uint32(perm))
+	if perm&^07777 != 0 {
+		return ErrInvalid
+	}
+	return Mknod(in, out, []string{args[0], strconv.FormatUint(unix.S_IFIFO|perm, 8)})
 }
 
-// ReadFile works like ioutil.ReadFile but instead writes the file to a writer
+// ReadFile works like ioutil.ReadFile but instead writes the file to a writer.
+// If an offset is given, only the given range of the file is read, and it is
+// preceded by a ReadRange describing it. A negative offset is relative to the
+// end of the file, such as to read its tail.
 // Args:
 //  - args[0] = path
+//  - args[1] = optional offset in base 10
+//  - args[2] = optional length in base 10; the range extends to the end of the file if it is absent or 0
 // Out:
-//  - Write file contents to out
+//  - Write file contents to out, or, if an offset is given:
+//  - out = size of json | json of ReadRange | range of the file contents
 func ReadFile(in io.Reader, out io.Writer, args []string) error {
 	if len(args) < 1 {
 		return ErrInvalid
@@ -258,82 +687,813 @@ func ReadFile(in io.Reader, out io.Writer, args []string) error {
 	}
 	defer f.Close()
 
-	if _, err := io.Copy(out, f); err != nil {
+	if len(args) < 2 {
+		if _, err := io.Copy(out, f); err != nil {
+			return nil
+		}
 		return nil
 	}
-	return nil
-}
 
-// WriteFile works like ioutil.WriteFile but instead reads the file from a reader
-// Args:
-//  - args[0] = path
-//  - args[1] = permission mode in octal (like 0755)
-//  - input data stream from in
-func WriteFile(in io.Reader, out io.Writer, args []string) error {
-	if len(args) < 2 {
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
 		return ErrInvalid
 	}
+	var length int64
+	if len(args) > 2 {
+		length, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil || length < 0 {
+			return ErrInvalid
+		}
+	}
 
-	perm, err := strconv.ParseUint(args[1], 8, 32)
+	fi, err := f.Stat()
 	if err != nil {
 		return err
 	}
+	size := fi.Size()
+	if offset < 0 {
+		offset += size
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if offset > size {
+		offset = size
+	}
+	if length == 0 || length > size-offset {
+		length = size - offset
+	}
 
-	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(perm))
-	if err != nil {
+	readRange := &ReadRange{
+		Offset: offset,
+		Length: length,
+		EOF:    offset+length == size,
+	}
+	if err := WriteReadRange(out, readRange); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	if _, err := io.Copy(f, in); err != nil {
+	if _, err := io.Copy(out, io.NewSectionReader(f, offset, length)); err != nil {
 		return err
 	}
 	return nil
 }
 
-// ReadDir works like *os.File.Readdir but instead writes the result to a writer
+// ReadCoreDump writes the core dump of a crashed process, as reported in the
+// process's exit, to a writer, and then removes it so that retrieved dumps
+// don't use up the utility VM's storage. The dump is kept if it can't be
+// written out in full. Only a file named core.<pid> directly in the core dump
+// directory the GCS is configured with may be read, so that the command
+// can't be used to remove other files.
 // Args:
-//  - args[0] = path
-//  - args[1] = number of directory entries to return. If <= 0, return all entries in directory
-func ReadDir(in io.Reader, out io.Writer, args []string) error {
+//  - args[0] = core dump directory
+//  - args[1] = path
+// Out:
+//  - Write the core dump to out
+func ReadCoreDump(in io.Reader, out io.Writer, args []string) error {
 	if len(args) < 2 {
 		return ErrInvalid
 	}
-
-	n, err := strconv.ParseInt(args[1], 10, 32)
-	if err != nil {
-		return err
+	if !filepath.IsAbs(args[0]) || !isCoreDumpPath(args[0], args[1]) {
+		return ErrInvalid
 	}
+	path := filepath.Clean(args[1])
 
-	f, err := os.Open(args[0])
+	// A link in the directory could otherwise expose a file outside it.
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ELOOP {
+			return ErrInvalid
+		}
 		return err
 	}
 	defer f.Close()
-
-	infos, err := f.Readdir(int(n))
+	fi, err := f.Stat()
 	if err != nil {
 		return err
 	}
+	if !fi.Mode().IsRegular() {
+		return ErrInvalid
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
 
-	fileInfos := make([]FileInfo, len(infos))
-	for i := range infos {
-		fileInfos[i] = FileInfo{
-			NameVar:    infos[i].Name(),
-			SizeVar:    infos[i].Size(),
-			ModeVar:    infos[i].Mode(),
-			ModTimeVar: infos[i].ModTime().UnixNano(),
-			IsDirVar:   infos[i].IsDir(),
+// isCoreDumpPath returns whether the given path, once cleaned, names a core
+// dump, core.<pid>, directly in the given directory.
+func isCoreDumpPath(dir, path string) bool {
+	path = filepath.Clean(path)
+	if filepath.Dir(path) != filepath.Clean(dir) {
+		return false
+	}
+	pid := strings.TrimPrefix(filepath.Base(path), "core.")
+	if pid == filepath.Base(path) || pid == "" {
+		return false
+	}
+	for _, c := range pid {
+		if c < '0' || c > '9' {
+			return false
 		}
 	}
+	return true
+}
 
-	buf, err := json.Marshal(fileInfos)
-	if err != nil {
-		return err
+// WriteFile works like ioutil.WriteFile but instead reads the file from a reader
+// If an offset is given, the file isn't truncated, and the data is instead
+// written at the offset, so that a write which was interrupted can be resumed.
+// The offset may only be beyond the end of the file if sparse is set, in which
+// case the gap is left as a hole.
+// Args:
+//  - args[0] = path
+//  - args[1] = permission mode in octal (like 0755)
+//  - args[2] = optional offset in base 10
+//  - args[3] = optional sparse flag, as "true" or "false"
+//  - input data stream from in
+// Out:
+//  - out = WriteResult, if an offset is given
+func WriteFile(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return ErrInvalid
 	}
 
-	if _, err := out.Write(buf); err != nil {
+	perm, err := strconv.ParseUint(args[1], 8, 32)
+	if err != nil {
 		return err
 	}
-	return nil
+
+	if len(args) < 3 {
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(perm))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(f, in); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	offset, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || offset < 0 {
+		return ErrInvalid
+	}
+	var sparse bool
+	if len(args) > 3 {
+		sparse, err = strconv.ParseBool(args[3])
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE, os.FileMode(perm))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if offset > fi.Size() && !sparse {
+		return ErrInvalid
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, in); err != nil {
+		return err
+	}
+
+	// The write may have ended before the end of the existing contents, so
+	// the size is taken from the file rather than from the offset.
+	fi, err = f.Stat()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(WriteResult{Size: fi.Size()})
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AtomicWrite works like WriteFile, but also sets the file's owner, and
+// replaces the file atomically. The contents are written to a temporary file
+// in the same directory which is only accessible to its creator, and which is
+// renamed into place once its mode and owner have been set. The temporary
+// file is removed if any step fails.
+// Args:
+//  - args[0] = path
+//  - args[1] = permission mode in octal (like 0755)
+//  - args[2] = uid in base 10
+//  - args[3] = gid in base 10
+//  - input data stream from in
+func AtomicWrite(in io.Reader, out io.Writer, args []string) (err error) {
+	if len(args) < 4 {
+		return ErrInvalid
+	}
+
+	perm, err := strconv.ParseUint(args[1], 8, 32)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	path := args[0]
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := io.Copy(f, in); err != nil {
+		return err
+	}
+	if err := f.Chown(int(uid), int(gid)); err != nil {
+		return err
+	}
+	if err := f.Chmod(os.FileMode(perm)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Limits on the searches done by Find.
+const (
+	findMaxDepth   = 64
+	findMaxResults = 10000
+)
+
+// errFindTruncated stops Find's walk once it has found the maximum number of
+// results.
+var errFindTruncated = errors.New("too many results")
+
+// Find searches the tree rooted at the given path for paths matching the
+// given options. Symlinks are not followed, and directories which can't be
+// read are skipped.
+// Args:
+// - in = json of FindOptions
+// - args[0] = root path
+// Out:
+// - out = FindResult
+func Find(in io.Reader, out io.Writer, args []string) error {
+	return findContext(context.Background(), in, out, args)
+}
+
+func findContext(ctx context.Context, in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 1 {
+		return ErrInvalid
+	}
+	root := args[0]
+
+	var opts FindOptions
+	if err := json.NewDecoder(in).Decode(&opts); err != nil {
+		return err
+	}
+	if _, err := filepath.Match(opts.Pattern, ""); err != nil {
+		return ErrInvalid
+	}
+	switch opts.Type {
+	case "", "file", "dir", "symlink":
+	default:
+		return ErrInvalid
+	}
+	if opts.MaxDepth <= 0 || opts.MaxDepth > findMaxDepth {
+		opts.MaxDepth = findMaxDepth
+	}
+	if opts.MaxResults <= 0 || opts.MaxResults > findMaxResults {
+		opts.MaxResults = findMaxResults
+	}
+
+	result := FindResult{Matches: []FindMatch{}}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if info.IsDir() && strings.Count(relPath, string(filepath.Separator)) >= opts.MaxDepth-1 {
+			// Consider the directory itself, but not its contents.
+			err = filepath.SkipDir
+		}
+		if findMatches(&opts, relPath, info) {
+			if len(result.Matches) == opts.MaxResults {
+				result.Truncated = true
+				return errFindTruncated
+			}
+			match := FindMatch{Path: relPath}
+			if opts.IncludeInfo {
+				match.Info = &FileInfo{
+					NameVar:    info.Name(),
+					SizeVar:    info.Size(),
+					ModeVar:    info.Mode(),
+					ModTimeVar: info.ModTime().UnixNano(),
+					IsDirVar:   info.IsDir(),
+				}
+			}
+			result.Matches = append(result.Matches, match)
+		}
+		return err
+	})
+	if err != nil && err != errFindTruncated {
+		return err
+	}
+
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// findMatches returns whether the path, relative to the root of a search,
+// passes all of the filters in opts.
+func findMatches(opts *FindOptions, relPath string, info os.FileInfo) bool {
+	if opts.Pattern != "" {
+		name := info.Name()
+		if strings.ContainsRune(opts.Pattern, filepath.Separator) {
+			name = relPath
+		}
+		if matched, _ := filepath.Match(opts.Pattern, name); !matched {
+			return false
+		}
+	}
+	switch opts.Type {
+	case "file":
+		if !info.Mode().IsRegular() {
+			return false
+		}
+	case "dir":
+		if !info.IsDir() {
+			return false
+		}
+	case "symlink":
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+	}
+	if info.Size() < opts.MinSize || (opts.MaxSize > 0 && info.Size() > opts.MaxSize) {
+		return false
+	}
+	modTime := info.ModTime().UnixNano()
+	if (opts.ModifiedAfter != 0 && modTime <= opts.ModifiedAfter) || (opts.ModifiedBefore != 0 && modTime >= opts.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// ficlone is the FICLONE ioctl, which makes a file share the data extents of
+// another on filesystems which support reflinks.
+const ficlone = 0x40049409
+
+// cloneFile reflinks the contents of src into dst. It may be replaced in
+// tests.
+var cloneFile = func(dst, src *os.File) error {
+	return unix.IoctlSetInt(int(dst.Fd()), ficlone, int(src.Fd()))
+}
+
+// createTempFile creates a new file in dir whose name starts with prefix.
+// Unlike with ioutil.TempFile, the file is created with the given permissions,
+// subject to the umask.
+func createTempFile(dir, prefix string, perm os.FileMode) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatInt(time.Now().UnixNano()+int64(i), 36))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// Methods reported by Copy.
+const (
+	copyMethodReflink = "reflink"
+	copyMethodStream  = "stream"
+)
+
+// Copy copies a regular file within the guest. The copy is made with a
+// reflink when the filesystem supports it, and by streaming the contents
+// otherwise. The source's mode, owner, and timestamps are all preserved unless
+// a subset of them is given; an existing destination keeps its own mode and
+// owner where the source's aren't preserved. The copy is written to a
+// temporary file beside the destination and renamed over it once complete, so
+// a failed copy leaves any existing destination untouched. Copying a file onto
+// itself is rejected.
+// Args:
+// - args[0] = source path
+// - args[1] = destination path
+// - args[2] = optional comma separated attributes to preserve (mode,owner,timestamps)
+// Out:
+// - out = the method used, "reflink" or "stream"
+func Copy(in io.Reader, out io.Writer, args []string) (err error) {
+	if len(args) < 2 {
+		return ErrInvalid
+	}
+	srcPath, dstPath := args[0], args[1]
+
+	preserve := map[string]bool{"mode": true, "owner": true, "timestamps": true}
+	if len(args) > 2 {
+		preserve = make(map[string]bool)
+		for _, attr := range strings.Split(args[2], ",") {
+			switch attr {
+			case "":
+			case "mode", "owner", "timestamps":
+				preserve[attr] = true
+			default:
+				return ErrInvalid
+			}
+		}
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return ErrInvalid
+	}
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ErrInvalid
+	}
+
+	// The copy takes the owner and mode of an existing destination unless
+	// the source's are preserved.
+	ownerStat, mode := stat, fi.Mode()
+	setOwner, setMode := preserve["owner"], preserve["mode"]
+	dstInfo, err := os.Stat(dstPath)
+	switch {
+	case err == nil:
+		if os.SameFile(fi, dstInfo) {
+			return ErrInvalid
+		}
+		if !setOwner {
+			if ownerStat, ok = dstInfo.Sys().(*syscall.Stat_t); !ok {
+				return ErrInvalid
+			}
+			setOwner = true
+		}
+		if !setMode {
+			mode = dstInfo.Mode()
+			setMode = true
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	dst, err := createTempFile(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".tmp", 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(dst.Name())
+		}
+	}()
+
+	method := copyMethodReflink
+	if err := cloneFile(dst, src); err != nil {
+		switch err {
+		case unix.EOPNOTSUPP, unix.ENOTTY, unix.EXDEV, unix.EINVAL, unix.ENOSYS:
+			method = copyMethodStream
+			if _, err := io.Copy(dst, src); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+
+	if setOwner {
+		if err := dst.Chown(int(ownerStat.Uid), int(ownerStat.Gid)); err != nil {
+			return err
+		}
+	}
+	if setMode {
+		// Changing the owner may clear the setuid and setgid bits, so the
+		// mode is set afterwards.
+		if err := dst.Chmod(mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if preserve["timestamps"] {
+		atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+		if err := os.Chtimes(dst.Name(), atime, fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(dst.Name(), dstPath); err != nil {
+		return err
+	}
+
+	if _, err := out.Write([]byte(method)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadDir works like *os.File.Readdir but instead writes the result to a writer
+// Args:
+//  - args[0] = path
+//  - args[1] = number of directory entries to return. If <= 0, return all entries in directory
+func ReadDir(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return ErrInvalid
+	}
+
+	n, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	infos, err := f.Readdir(int(n))
+	if err != nil {
+		return err
+	}
+
+	fileInfos := make([]FileInfo, len(infos))
+	for i := range infos {
+		fileInfos[i] = FileInfo{
+			NameVar:    infos[i].Name(),
+			SizeVar:    infos[i].Size(),
+			ModeVar:    infos[i].Mode(),
+			ModTimeVar: infos[i].ModTime().UnixNano(),
+			IsDirVar:   infos[i].IsDir(),
+		}
+	}
+
+	buf, err := json.Marshal(fileInfos)
+	if err != nil {
+		return err
+	}
+
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Mkfs creates a filesystem on a device or backing file by running
+// mkfs.<fstype>. If mkfs fails, its combined output and exit code are
+// returned as an ExportedError.
+// Args:
+// - args[0] = filesystem type, which must be one of mkfsAllowedTypes
+// - args[1] = device or backing file
+// - args[2:] = options passed to mkfs before the device
+// Out:
+// - out = combined output of mkfs
+func Mkfs(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return ErrInvalid
+	}
+	fsType, device, options := args[0], args[1], args[2:]
+	if !mkfsAllowedTypes[fsType] || device == "" {
+		return ErrInvalid
+	}
+
+	name := "mkfs." + fsType
+	cmdArgs := append(append([]string{}, options...), device)
+	cmd := osLayer.Command(name, cmdArgs...)
+	var output bytes.Buffer
+	cmd.SetStdout(&output)
+	cmd.SetStderr(&output)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			// ErrNum is an errno, so mkfs's exit code is only reported in
+			// the message.
+			return &ExportedError{
+				ErrString: fmt.Sprintf("%s failed with exit code %d: %s: %s", name, cmd.ExitState().ExitCode(), err, output.String()),
+				ErrNum:    int(syscall.EIO),
+			}
+		}
+	case <-time.After(mkfsTimeout):
+		osLayer.Kill(cmd.Process().Pid(), syscall.SIGKILL)
+		<-done
+		return &ExportedError{
+			ErrString: fmt.Sprintf("%s timed out after %s: %s", name, mkfsTimeout, output.String()),
+			ErrNum:    int(syscall.ETIMEDOUT),
+		}
+	}
+
+	if _, err := out.Write(output.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Mount works like unix.Mount.
+// Args:
+// - args[0] = source
+// - args[1] = target
+// - args[2] = filesystem type
+// - args[3] = optional mount flags in base 10, defaulting to 0
+// - args[4] = optional filesystem-specific data
+func Mount(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 3 {
+		return ErrInvalid
+	}
+
+	var flags uint64
+	if len(args) > 3 {
+		var err error
+		flags, err = strconv.ParseUint(args[3], 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	var data string
+	if len(args) > 4 {
+		data = args[4]
+	}
+
+	if err := unix.Mount(args[0], args[1], args[2], uintptr(flags), data); err != nil {
+		return &os.PathError{Op: "mount", Path: args[1], Err: err}
+	}
+	return nil
+}
+
+// Unmount works like unix.Unmount. If the target is busy, ErrBusy is
+// returned.
+// Args:
+// - args[0] = target
+// - args[1] = optional "true" to lazily unmount the target (MNT_DETACH)
+func Unmount(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 1 {
+		return ErrInvalid
+	}
+
+	var flags int
+	if len(args) > 1 {
+		lazy, err := strconv.ParseBool(args[1])
+		if err != nil {
+			return err
+		}
+		if lazy {
+			flags |= unix.MNT_DETACH
+		}
+	}
+
+	if err := unix.Unmount(args[0], flags); err != nil {
+		if err == unix.EBUSY {
+			return ErrBusy
+		}
+		return &os.PathError{Op: "unmount", Path: args[0], Err: err}
+	}
+	return nil
+}
+
+// Hash computes the digest of a file without transferring its contents, or
+// of every regular file in a directory tree.
+// Args:
+// - args[0] = path
+// - args[1] = algorithm, which must be one of hashAlgorithms
+// - args[2] = optional "true" to hash the directory tree rooted at path
+// Out:
+// - out = the file's digest in the form "<algorithm>:<hex>"
+// - out = for a directory tree, a JSON array of FileHash sorted by path
+func Hash(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return ErrInvalid
+	}
+	path, algorithm := args[0], args[1]
+	if _, ok := hashAlgorithms[algorithm]; !ok {
+		return ErrInvalid
+	}
+
+	var tree bool
+	if len(args) > 2 {
+		var err error
+		tree, err = strconv.ParseBool(args[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	if !tree {
+		digest, err := hashFile(path, algorithm)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write([]byte(digest)); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// filepath.Walk visits files in lexical order, so the manifest is
+	// sorted by path.
+	manifest := []FileHash{}
+	err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		digest, err := hashFile(filePath, algorithm)
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, FileHash{Path: relPath, Digest: digest})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// hashFile streams the file at path through the given hash algorithm and
+// returns its digest in the form "<algorithm>:<hex>".
+func hashFile(path string, algorithm string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := hashAlgorithms[algorithm]()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -1,16 +1,30 @@
 package remotefs
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/Microsoft/opengcs/service/gcs/oslayer"
+	"github.com/Microsoft/opengcs/service/gcs/oslayer/mockos"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/mount"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -85,7 +99,7 @@ func testError(input error, expectedExported *ExportedError, t *testing.T) {
 	}
 
 	if exported == nil {
-		t.Error("failed: got nil error instead of %+v", expectedExported)
+		t.Errorf("failed: got nil error instead of %+v", expectedExported)
 	}
 
 	if *exported != *expectedExported {
@@ -132,10 +146,40 @@ func TestPathToGenericError(t *testing.T) {
 	input := errorCases[ErrNotExistCase]
 	expectedExported := &ExportedError{
 		ErrString: os.ErrNotExist.Error(),
+		ErrNum:    int(syscall.ENOENT),
 	}
 	testError(input, expectedExported, t)
 }
 
+func TestExportedErrorErrno(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExportedErrorErrno")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Permission checks don't apply to root, so EACCES is simulated.
+	cases := map[syscall.Errno]error{
+		syscall.ENOENT: Stat(nil, &bytes.Buffer{}, []string{filepath.Join(dir, "missing")}),
+		syscall.EEXIST: Mkdir(nil, &bytes.Buffer{}, []string{dir, "0755"}),
+		syscall.EACCES: &os.PathError{Op: "open", Path: dir, Err: syscall.EACCES},
+		syscall.EINVAL: Stat(nil, &bytes.Buffer{}, nil),
+		syscall.ELOOP:  syscall.ELOOP,
+	}
+	for errno, input := range cases {
+		if input == nil {
+			t.Fatalf("expected an error for errno %d", errno)
+		}
+		exported := ToExportedError(input)
+		if exported.ErrNum != int(errno) {
+			t.Errorf("expected ErrNum %d for %q, got %d", errno, input, exported.ErrNum)
+		}
+		if exported.ErrString == "" {
+			t.Errorf("expected an error message for %q", input)
+		}
+	}
+}
+
 func TestStat(t *testing.T) {
 	file, err := ioutil.TempFile("", "TestStat")
 	if err != nil {
@@ -206,3 +250,1658 @@ func TestTar(t *testing.T) {
 		t.Errorf("error. tar opts is different. expected: %+v, got %+v", opts, opts2)
 	}
 }
+
+func TestFindMount(t *testing.T) {
+	mounts := []*mount.Info{
+		{Mountpoint: "/", Fstype: "ext4", Source: "/dev/sda1", Root: "/"},
+		{Mountpoint: "/mnt/layer", Fstype: "ext4", Source: "/dev/sdb", Root: "/"},
+		{Mountpoint: "/mnt/layerdata", Fstype: "xfs", Source: "/dev/sdc", Root: "/"},
+		{Mountpoint: "/mnt/bind", Fstype: "ext4", Source: "/dev/sdb", Root: "/subdir"},
+		{Mountpoint: "/mnt/rootfs", Fstype: "tmpfs", Source: "tmpfs", Root: "/"},
+		{Mountpoint: "/mnt/rootfs", Fstype: "overlay", Source: "overlay", Root: "/"},
+	}
+	cases := map[string]*mount.Info{
+		"/":                     mounts[0],
+		"/etc/hosts":            mounts[0],
+		"/mnt/layer":            mounts[1],
+		"/mnt/layer/a/b":        mounts[1],
+		"/mnt/layerdata/a":      mounts[2],
+		"/mnt/bind/file":        mounts[3],
+		"/mnt/rootfs/usr/bin/":  mounts[5],
+		"/mnt/rootfsextra/file": mounts[0],
+	}
+	for path, expected := range cases {
+		if actual := findMount(path, mounts); actual != expected {
+			t.Errorf("path %s: expected mount %+v, got %+v", path, expected, actual)
+		}
+	}
+}
+
+func TestResolveMount(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := ResolveMount(nil, buf, []string{"/proc/self/status", "/"}); err != nil {
+		t.Fatalf("failed to resolve mount: %s", err)
+	}
+
+	var info MountInfo
+	if err := json.Unmarshal(buf.Bytes(), &info); err != nil {
+		t.Fatalf("failed to unmarshal mount info: %s", err)
+	}
+	if info.MountPoint != "/proc" {
+		t.Errorf("expected mount point /proc, got %s", info.MountPoint)
+	}
+	if info.FSType != "proc" {
+		t.Errorf("expected fs type proc, got %s", info.FSType)
+	}
+}
+
+func TestListMounts(t *testing.T) {
+	listMounts := func(args ...string) []MountEntry {
+		buf := &bytes.Buffer{}
+		if err := ListMounts(nil, buf, args); err != nil {
+			t.Fatalf("failed to list mounts: %s", err)
+		}
+		var entries []MountEntry
+		if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+			t.Fatalf("failed to unmarshal mount entries: %s", err)
+		}
+		return entries
+	}
+
+	var shm *MountEntry
+	for _, entry := range listMounts() {
+		if entry.MountPoint == "/dev/shm" && entry.FSType == "tmpfs" {
+			entry := entry
+			shm = &entry
+		}
+	}
+	if shm == nil {
+		t.Skip("/dev/shm is not a tmpfs mount")
+	}
+	if len(shm.Options) == 0 {
+		t.Errorf("expected the options of /dev/shm to be listed")
+	}
+
+	for _, entry := range listMounts("/dev/") {
+		if !pathHasPrefix(entry.MountPoint, "/dev") {
+			t.Errorf("expected only mounts under /dev, got %s", entry.MountPoint)
+		}
+	}
+	for _, entry := range listMounts("/proc") {
+		if entry.MountPoint == "/dev/shm" {
+			t.Errorf("expected /dev/shm to be filtered out")
+		}
+	}
+	if err := ListMounts(nil, &bytes.Buffer{}, []string{"dev"}); err != ErrInvalid {
+		t.Errorf("expected a relative prefix to be invalid, got %v", err)
+	}
+}
+
+// recordingOS wraps an oslayer.OS, recording the commands created through it.
+// If exitCode is non-zero, the commands fail with it.
+type recordingOS struct {
+	oslayer.OS
+	commands [][]string
+	exitCode int
+}
+
+func (o *recordingOS) Command(name string, arg ...string) oslayer.Cmd {
+	o.commands = append(o.commands, append([]string{name}, arg...))
+	cmd := o.OS.Command(name, arg...)
+	if o.exitCode != 0 {
+		return &failingCmd{Cmd: cmd, exitCode: o.exitCode}
+	}
+	return cmd
+}
+
+// failingCmd wraps an oslayer.Cmd, making it exit with the given code.
+type failingCmd struct {
+	oslayer.Cmd
+	exitCode int
+}
+
+func (c *failingCmd) Wait() error {
+	c.Cmd.Wait()
+	return fmt.Errorf("exit status %d", c.exitCode)
+}
+
+func (c *failingCmd) ExitState() oslayer.ProcessExitState {
+	return mockos.NewProcessExitState(c.exitCode)
+}
+
+func withRecordingOS(f func(o *recordingOS)) {
+	o := &recordingOS{OS: mockos.NewOS()}
+	old := osLayer
+	osLayer = o
+	defer func() { osLayer = old }()
+	f(o)
+}
+
+func TestMkfs(t *testing.T) {
+	withRecordingOS(func(o *recordingOS) {
+		buf := &bytes.Buffer{}
+		if err := Mkfs(nil, buf, []string{"ext4", "/tmp/scratch.img", "-F", "-q"}); err != nil {
+			t.Fatalf("failed to run mkfs: %s", err)
+		}
+		expected := [][]string{{"mkfs.ext4", "-F", "-q", "/tmp/scratch.img"}}
+		if !reflect.DeepEqual(o.commands, expected) {
+			t.Errorf("expected commands %v, got %v", expected, o.commands)
+		}
+	})
+}
+
+func TestMkfsFailure(t *testing.T) {
+	withRecordingOS(func(o *recordingOS) {
+		o.exitCode = 1
+		err := Mkfs(nil, &bytes.Buffer{}, []string{"ext4", "/tmp/scratch.img"})
+		ee, ok := err.(*ExportedError)
+		if !ok {
+			t.Fatalf("expected an ExportedError, got %v", err)
+		}
+		if ee.ErrNum != int(syscall.EIO) {
+			t.Errorf("expected errno %d, got %d", syscall.EIO, ee.ErrNum)
+		}
+		if !strings.Contains(ee.ErrString, "exit code 1") {
+			t.Errorf("expected the exit code in %q", ee.ErrString)
+		}
+	})
+}
+
+func TestMkfsDisallowedType(t *testing.T) {
+	withRecordingOS(func(o *recordingOS) {
+		buf := &bytes.Buffer{}
+		if err := Mkfs(nil, buf, []string{"btrfs", "/tmp/scratch.img"}); err != ErrInvalid {
+			t.Errorf("expected %s, got %v", ErrInvalid, err)
+		}
+		if len(o.commands) != 0 {
+			t.Errorf("expected no commands to run, got %v", o.commands)
+		}
+	})
+}
+
+func TestMountUnmount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	target, err := ioutil.TempDir("", "TestMountUnmount")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(target)
+
+	if err := Mount(nil, nil, []string{"tmpfs", target, "tmpfs", "0", "size=1m"}); err != nil {
+		t.Fatalf("failed to mount tmpfs: %s", err)
+	}
+	mounted, err := mount.Mounted(target)
+	if err != nil {
+		t.Fatalf("failed to check mount: %s", err)
+	}
+	if !mounted {
+		t.Fatalf("expected %s to be mounted", target)
+	}
+
+	// Hold a file open on the mount so that a normal unmount fails.
+	f, err := os.Create(filepath.Join(target, "busy"))
+	if err != nil {
+		t.Fatalf("failed to create file: %s", err)
+	}
+	if err := Unmount(nil, nil, []string{target}); err != ErrBusy {
+		t.Errorf("expected %s, got %v", ErrBusy, err)
+	}
+	f.Close()
+
+	if err := Unmount(nil, nil, []string{target, "true"}); err != nil {
+		t.Fatalf("failed to unmount tmpfs: %s", err)
+	}
+	mounted, err = mount.Mounted(target)
+	if err != nil {
+		t.Fatalf("failed to check mount: %s", err)
+	}
+	if mounted {
+		t.Errorf("expected %s to be unmounted", target)
+	}
+}
+
+func TestHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestHash")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("hello world\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	cases := map[string]string{
+		"sha256": "sha256:a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447",
+		"sha512": "sha512:db3974a97f2407b7cae1ae637c0030687a11913274d578492558e39c16c017de84eacdc8c62fe34ee4e12b4b1428817f09b6a2760c3f8a664ceae94d2434a593",
+	}
+	for algorithm, expected := range cases {
+		buf := &bytes.Buffer{}
+		if err := Hash(nil, buf, []string{filepath.Join(dir, "hello"), algorithm}); err != nil {
+			t.Fatalf("failed to hash file with %s: %s", algorithm, err)
+		}
+		if buf.String() != expected {
+			t.Errorf("expected digest %s, got %s", expected, buf.String())
+		}
+	}
+
+	if err := Hash(nil, &bytes.Buffer{}, []string{filepath.Join(dir, "hello"), "md5"}); err != ErrInvalid {
+		t.Errorf("expected %s for an unsupported algorithm, got %v", ErrInvalid, err)
+	}
+}
+
+func TestHashTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestHashTree")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "abc"), []byte("abc"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("hello world\n"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if err := os.Symlink("hello", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Hash(nil, buf, []string{dir, "sha256", "true"}); err != nil {
+		t.Fatalf("failed to hash tree: %s", err)
+	}
+	var manifest []FileHash
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+		t.Fatalf("failed to unmarshal manifest: %s", err)
+	}
+	expected := []FileHash{
+		{Path: "hello", Digest: "sha256:a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447"},
+		{Path: "sub/abc", Digest: "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("expected manifest %v, got %v", expected, manifest)
+	}
+}
+
+// makeRecursiveTree creates a nested directory tree with files at each level
+// and returns its root, along with every path in the tree.
+func makeRecursiveTree(t *testing.T) (string, []string) {
+	root, err := ioutil.TempDir("", "TestRecursive")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	paths := []string{root}
+	dir := root
+	for _, name := range []string{"a", "b", "c"} {
+		file := filepath.Join(dir, name+".txt")
+		if err := ioutil.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+		dir = filepath.Join(dir, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("failed to create directory: %s", err)
+		}
+		paths = append(paths, file, dir)
+	}
+	return root, paths
+}
+
+func TestChownRecursive(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	root, paths := makeRecursiveTree(t)
+	defer os.RemoveAll(root)
+
+	buf := &bytes.Buffer{}
+	if err := ChownRecursive(nil, buf, []string{root, "1000", "1001"}); err != nil {
+		t.Fatalf("failed to chown tree: %s", err)
+	}
+	var result RecursiveChangeResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %s", err)
+	}
+	if result.Changed != len(paths) || len(result.Errors) != 0 {
+		t.Errorf("expected %d paths changed without errors, got %+v", len(paths), result)
+	}
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", path, err)
+		}
+		stat := fi.Sys().(*syscall.Stat_t)
+		if stat.Uid != 1000 || stat.Gid != 1001 {
+			t.Errorf("expected %s to be owned by 1000:1001, got %d:%d", path, stat.Uid, stat.Gid)
+		}
+	}
+
+	// Shift only the files' ownership.
+	buf.Reset()
+	if err := ChownRecursive(nil, buf, []string{root, "100000", "100000", "files", "true"}); err != nil {
+		t.Fatalf("failed to shift tree ownership: %s", err)
+	}
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", path, err)
+		}
+		stat := fi.Sys().(*syscall.Stat_t)
+		expectedUID, expectedGID := uint32(1000), uint32(1001)
+		if !fi.IsDir() {
+			expectedUID, expectedGID = 101000, 101001
+		}
+		if stat.Uid != expectedUID || stat.Gid != expectedGID {
+			t.Errorf("expected %s to be owned by %d:%d, got %d:%d", path, expectedUID, expectedGID, stat.Uid, stat.Gid)
+		}
+	}
+}
+
+func TestChmodRecursive(t *testing.T) {
+	root, paths := makeRecursiveTree(t)
+	defer os.RemoveAll(root)
+
+	buf := &bytes.Buffer{}
+	if err := ChmodRecursive(nil, buf, []string{root, "0700", "dirs"}); err != nil {
+		t.Fatalf("failed to chmod tree: %s", err)
+	}
+	var result RecursiveChangeResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %s", err)
+	}
+	if result.Changed != 4 || len(result.Errors) != 0 {
+		t.Errorf("expected 4 directories changed without errors, got %+v", result)
+	}
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", path, err)
+		}
+		expected := os.FileMode(0644)
+		if fi.IsDir() {
+			expected = 0700
+		}
+		if fi.Mode().Perm() != expected {
+			t.Errorf("expected %s to have mode %s, got %s", path, expected, fi.Mode().Perm())
+		}
+	}
+
+	if err := ChmodRecursive(nil, buf, []string{root, "0700", "sockets"}); err != ErrInvalid {
+		t.Errorf("expected %s for an unknown filter, got %v", ErrInvalid, err)
+	}
+}
+
+func TestIdmap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	root, paths := makeRecursiveTree(t)
+	defer os.RemoveAll(root)
+	for _, path := range paths {
+		if err := os.Lchown(path, 0, 0); err != nil {
+			t.Fatalf("failed to chown %s: %s", path, err)
+		}
+	}
+	// One file is owned by an id in a second mapped range, and another is
+	// owned by an unmapped id.
+	if err := os.Lchown(paths[1], 1000, 1000); err != nil {
+		t.Fatalf("failed to chown %s: %s", paths[1], err)
+	}
+	if err := os.Lchown(paths[3], 70000, 0); err != nil {
+		t.Fatalf("failed to chown %s: %s", paths[3], err)
+	}
+
+	idMap := IDMap{
+		UIDMappings: []IDMapping{
+			{ContainerID: 0, HostID: 100000, Size: 1000},
+			{ContainerID: 1000, HostID: 200000, Size: 1000},
+		},
+		GIDMappings: []IDMapping{
+			{ContainerID: 0, HostID: 100000, Size: 65536},
+		},
+	}
+	idMapJSON, err := json.Marshal(idMap)
+	if err != nil {
+		t.Fatalf("failed to marshal id map: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Idmap(bytes.NewReader(idMapJSON), buf, []string{root}); err != nil {
+		t.Fatalf("failed to map tree: %s", err)
+	}
+	var result RecursiveChangeResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %s", err)
+	}
+	if result.Changed != len(paths)-1 {
+		t.Errorf("expected %d paths changed, got %d", len(paths)-1, result.Changed)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Path != paths[3] {
+		t.Errorf("expected an error for %s only, got %+v", paths[3], result.Errors)
+	}
+
+	expected := map[string][2]uint32{paths[1]: {200000, 101000}, paths[3]: {70000, 0}}
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", path, err)
+		}
+		stat := fi.Sys().(*syscall.Stat_t)
+		owner, ok := expected[path]
+		if !ok {
+			owner = [2]uint32{100000, 100000}
+		}
+		if stat.Uid != owner[0] || stat.Gid != owner[1] {
+			t.Errorf("expected %s to be owned by %d:%d, got %d:%d", path, owner[0], owner[1], stat.Uid, stat.Gid)
+		}
+	}
+
+	// Mapping the tree again leaves the unmapped path, and the now host-owned
+	// paths, unchanged when requested.
+	buf.Reset()
+	if err := Idmap(bytes.NewReader(idMapJSON), buf, []string{root, "true"}); err != nil {
+		t.Fatalf("failed to map tree: %s", err)
+	}
+	result = RecursiveChangeResult{}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %s", err)
+	}
+	if result.Changed != 0 || len(result.Errors) != 0 {
+		t.Errorf("expected no paths changed without errors, got %+v", result)
+	}
+}
+
+func TestAtomicWrite(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	dir, err := ioutil.TempDir("", "TestAtomicWrite")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if err := AtomicWrite(bytes.NewBufferString("new"), nil, []string{path, "0640", "1000", "1001"}); err != nil {
+		t.Fatalf("failed to write file atomically: %s", err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %s", err)
+	}
+	if string(contents) != "new" {
+		t.Errorf("expected contents new, got %s", contents)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat file: %s", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("expected mode %s, got %s", os.FileMode(0640), fi.Mode().Perm())
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	if stat.Uid != 1000 || stat.Gid != 1001 {
+		t.Errorf("expected owner 1000:1001, got %d:%d", stat.Uid, stat.Gid)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %s", err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("expected only the written file to remain, got %d entries", len(infos))
+	}
+}
+
+func TestAtomicWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAtomicWriteFailure")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file can't be renamed over a non-empty directory.
+	path := filepath.Join(dir, "target")
+	if err := os.MkdirAll(filepath.Join(path, "child"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	if err := AtomicWrite(bytes.NewBufferString("new"), nil, []string{path, "0644", strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())}); err == nil {
+		t.Fatalf("expected writing over a directory to fail")
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %s", err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "target" {
+		t.Errorf("expected the temporary file to be removed, got %d entries", len(infos))
+	}
+}
+
+// withCloneFile replaces cloneFile with clone while f runs.
+func withCloneFile(clone func(dst, src *os.File) error, f func()) {
+	saved := cloneFile
+	cloneFile = clone
+	defer func() { cloneFile = saved }()
+	f()
+}
+
+// copyTestFile creates a source file for Copy in a new temp dir, and returns
+// the dir and the file's path.
+func copyTestFile(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "TestCopy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("hello world\n"), 0640); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	mtime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("failed to set times: %s", err)
+	}
+	return dir, src
+}
+
+func checkCopy(t *testing.T, src, dst string) {
+	contents, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("failed to read copy: %s", err)
+	}
+	if string(contents) != "hello world\n" {
+		t.Errorf("unexpected contents %q", contents)
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("failed to stat source: %s", err)
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("failed to stat copy: %s", err)
+	}
+	if dstInfo.Mode() != srcInfo.Mode() {
+		t.Errorf("expected mode %s, got %s", srcInfo.Mode(), dstInfo.Mode())
+	}
+	if !dstInfo.ModTime().Equal(srcInfo.ModTime()) {
+		t.Errorf("expected modification time %s, got %s", srcInfo.ModTime(), dstInfo.ModTime())
+	}
+}
+
+func TestCopyReflink(t *testing.T) {
+	dir, src := copyTestFile(t)
+	defer os.RemoveAll(dir)
+
+	// Reflinks aren't supported by the filesystems tests usually run on, so
+	// a supporting filesystem is simulated.
+	clone := func(dst, src *os.File) error {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	withCloneFile(clone, func() {
+		dst := filepath.Join(dir, "dst")
+		buf := &bytes.Buffer{}
+		if err := Copy(nil, buf, []string{src, dst}); err != nil {
+			t.Fatalf("failed to copy: %s", err)
+		}
+		if buf.String() != "reflink" {
+			t.Errorf("expected a reflink copy, got %s", buf.String())
+		}
+		checkCopy(t, src, dst)
+	})
+}
+
+func TestCopyStream(t *testing.T) {
+	dir, src := copyTestFile(t)
+	defer os.RemoveAll(dir)
+
+	withCloneFile(func(dst, src *os.File) error { return unix.EOPNOTSUPP }, func() {
+		dst := filepath.Join(dir, "dst")
+		buf := &bytes.Buffer{}
+		if err := Copy(nil, buf, []string{src, dst}); err != nil {
+			t.Fatalf("failed to copy: %s", err)
+		}
+		if buf.String() != "stream" {
+			t.Errorf("expected a streamed copy, got %s", buf.String())
+		}
+		checkCopy(t, src, dst)
+	})
+}
+
+func TestCopyWithoutPreserving(t *testing.T) {
+	dir, src := copyTestFile(t)
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "dst")
+	if err := Copy(nil, &bytes.Buffer{}, []string{src, dst, ""}); err != nil {
+		t.Fatalf("failed to copy: %s", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("failed to stat copy: %s", err)
+	}
+	if fi.ModTime().Year() == 2017 {
+		t.Errorf("expected the modification time not to be preserved")
+	}
+
+	if err := Copy(nil, &bytes.Buffer{}, []string{src, dst, "xattrs"}); err != ErrInvalid {
+		t.Errorf("expected %s for an unknown attribute, got %v", ErrInvalid, err)
+	}
+}
+
+func TestCopySameFile(t *testing.T) {
+	dir, src := copyTestFile(t)
+	defer os.RemoveAll(dir)
+
+	link := filepath.Join(dir, "link")
+	if err := os.Link(src, link); err != nil {
+		t.Fatalf("failed to link file: %s", err)
+	}
+	for _, dst := range []string{src, link} {
+		if err := Copy(nil, &bytes.Buffer{}, []string{src, dst}); err != ErrInvalid {
+			t.Errorf("expected %s copying onto %s, got %v", ErrInvalid, dst, err)
+		}
+	}
+	contents, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("failed to read source: %s", err)
+	}
+	if string(contents) != "hello world\n" {
+		t.Errorf("expected the source to be unchanged, got %q", contents)
+	}
+}
+
+func TestCopyFailureKeepsDestination(t *testing.T) {
+	dir, src := copyTestFile(t)
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(dst, []byte("original\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	withCloneFile(func(dst, src *os.File) error { return unix.EIO }, func() {
+		if err := Copy(nil, &bytes.Buffer{}, []string{src, dst}); err != unix.EIO {
+			t.Fatalf("expected %s, got %v", unix.EIO, err)
+		}
+	})
+	contents, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("failed to read destination: %s", err)
+	}
+	if string(contents) != "original\n" {
+		t.Errorf("expected the destination to be unchanged, got %q", contents)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected the temporary file to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestCopyKeepsDestinationMode(t *testing.T) {
+	dir, src := copyTestFile(t)
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(dst, []byte("original\n"), 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if err := os.Chmod(dst, 0604); err != nil {
+		t.Fatalf("failed to set mode: %s", err)
+	}
+	if err := Copy(nil, &bytes.Buffer{}, []string{src, dst, "timestamps"}); err != nil {
+		t.Fatalf("failed to copy: %s", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("failed to stat copy: %s", err)
+	}
+	if fi.Mode() != 0604 {
+		t.Errorf("expected the destination's mode 0604 to be kept, got %s", fi.Mode())
+	}
+}
+
+func find(t *testing.T, root string, opts FindOptions) FindResult {
+	optsJSON, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatalf("failed to marshal options: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := Find(bytes.NewReader(optsJSON), buf, []string{root}); err != nil {
+		t.Fatalf("failed to find: %s", err)
+	}
+	var result FindResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %s", err)
+	}
+	return result
+}
+
+func matchPaths(result FindResult) []string {
+	paths := []string{}
+	for _, match := range result.Matches {
+		paths = append(paths, match.Path)
+	}
+	return paths
+}
+
+func TestFind(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestFind")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"app.log":               "started\n",
+		"app.conf":              "debug=true\n",
+		"var/log/system.log":    "booted\n",
+		"var/log/old/boot.log":  "booted\n",
+		"empty.log":             "",
+		"var/log/old/notes.txt": "log rotation\n",
+	}
+	for path, contents := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir.log"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+
+	result := find(t, root, FindOptions{Pattern: "*.log", Type: "file"})
+	expected := []string{"app.log", "empty.log", "var/log/old/boot.log", "var/log/system.log"}
+	if paths := matchPaths(result); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected matches %v, got %v", expected, paths)
+	}
+	if result.Truncated || result.Matches[0].Info != nil {
+		t.Errorf("expected an untruncated result without file info, got %+v", result)
+	}
+
+	result = find(t, root, FindOptions{Pattern: "*.log", Type: "file", MinSize: 1, MaxDepth: 3, IncludeInfo: true})
+	expected = []string{"app.log", "var/log/system.log"}
+	if paths := matchPaths(result); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected matches %v, got %v", expected, paths)
+	}
+	if info := result.Matches[1].Info; info == nil || info.Name() != "system.log" || info.Size() != 7 {
+		t.Errorf("unexpected file info %+v", info)
+	}
+
+	result = find(t, root, FindOptions{Pattern: "*.log", MaxResults: 2})
+	if len(result.Matches) != 2 || !result.Truncated {
+		t.Errorf("expected 2 matches in a truncated result, got %+v", result)
+	}
+
+	result = find(t, root, FindOptions{Pattern: "var/log/*"})
+	expected = []string{"var/log/old", "var/log/system.log"}
+	if paths := matchPaths(result); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected matches %v, got %v", expected, paths)
+	}
+
+	if err := Find(bytes.NewBufferString(`{"Pattern":"["}`), &bytes.Buffer{}, []string{root}); err != ErrInvalid {
+		t.Errorf("expected %s for a malformed pattern, got %v", ErrInvalid, err)
+	}
+}
+
+func TestRealpath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRealpath")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// The temp dir may itself be reached through a symlink.
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("failed to resolve temp dir: %s", err)
+	}
+
+	target := filepath.Join(dir, "data", "target")
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	if err := ioutil.WriteFile(target, []byte("data"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	// link1 -> data/link2 -> ../link3 -> data/target, with relative and
+	// absolute hops.
+	links := map[string]string{
+		"link1":      "data/link2",
+		"data/link2": "../link3",
+		"link3":      target,
+	}
+	for link, dest := range links {
+		if err := os.Symlink(dest, filepath.Join(dir, link)); err != nil {
+			t.Fatalf("failed to create symlink: %s", err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Realpath(nil, buf, []string{filepath.Join(dir, "link1")}); err != nil {
+		t.Fatalf("failed to resolve path: %s", err)
+	}
+	if buf.String() != target {
+		t.Errorf("expected %s, got %s", target, buf.String())
+	}
+
+	// Readlink still only follows one hop.
+	buf.Reset()
+	if err := Readlink(nil, buf, []string{filepath.Join(dir, "link1")}); err != nil {
+		t.Fatalf("failed to read link: %s", err)
+	}
+	if buf.String() != "data/link2" {
+		t.Errorf("expected data/link2, got %s", buf.String())
+	}
+
+	if err := os.Symlink("cycle2", filepath.Join(dir, "cycle1")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+	if err := os.Symlink("cycle1", filepath.Join(dir, "cycle2")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+	err = Realpath(nil, &bytes.Buffer{}, []string{filepath.Join(dir, "cycle1")})
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.ELOOP {
+		t.Errorf("expected ELOOP for a symlink cycle, got %v", err)
+	}
+}
+
+func TestCommandBits(t *testing.T) {
+	if len(commandBits) > 64 {
+		t.Fatalf("%d commands don't fit in a command set", len(commandBits))
+	}
+	if len(commandBits) != len(Commands) {
+		t.Errorf("expected a bit for each of the %d commands, got %d", len(Commands), len(commandBits))
+	}
+	for _, name := range commandBits {
+		if _, ok := Commands[name]; !ok {
+			t.Errorf("command %s has a bit but no function", name)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	// A newer host which supports every command negotiates this package's
+	// version and commands.
+	buf := &bytes.Buffer{}
+	hostCommands := strconv.FormatUint(^uint64(0), 10)
+	if err := Version(nil, buf, []string{strconv.Itoa(ProtocolVersion + 1), hostCommands}); err != nil {
+		t.Fatalf("failed to negotiate version: %s", err)
+	}
+	var info VersionInfo
+	if err := json.Unmarshal(buf.Bytes(), &info); err != nil {
+		t.Fatalf("failed to unmarshal version info: %s", err)
+	}
+	expected := VersionInfo{ProtocolVersion: ProtocolVersion, Commands: SupportedCommands()}
+	if info != expected {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+}
+
+func TestVersionDowngrade(t *testing.T) {
+	// An older host which only knows some commands negotiates a reduced set.
+	buf := &bytes.Buffer{}
+	hostCommands := CommandSet(StatCmd, ReadFileCmd, VersionCmd)
+	if err := Version(nil, buf, []string{"1", strconv.FormatUint(hostCommands, 10)}); err != nil {
+		t.Fatalf("failed to negotiate version: %s", err)
+	}
+	var info VersionInfo
+	if err := json.Unmarshal(buf.Bytes(), &info); err != nil {
+		t.Fatalf("failed to unmarshal version info: %s", err)
+	}
+	if info.ProtocolVersion != 1 || info.Commands != hostCommands {
+		t.Errorf("expected version 1 with commands %d, got %+v", hostCommands, info)
+	}
+
+	if f, ok, err := Lookup(StatCmd, info.Commands); f == nil || !ok || err != nil {
+		t.Errorf("expected %s to be supported, got ok %t and error %v", StatCmd, ok, err)
+	}
+	f, ok, err := Lookup(HashCmd, info.Commands)
+	if f != nil || !ok {
+		t.Errorf("expected %s to be known but not returned, got ok %t", HashCmd, ok)
+	}
+	if exported := ToExportedError(err); exported.ErrNum != int(syscall.ENOSYS) || exported.ErrString != "unsupported command: hash" {
+		t.Errorf("expected an unsupported command error, got %+v", exported)
+	}
+	if _, ok, _ := Lookup("bogus", info.Commands); ok {
+		t.Errorf("expected an unknown command not to be found")
+	}
+}
+
+func TestServeInterleaved(t *testing.T) {
+	// Reading a FIFO blocks until it is opened for writing, so the first
+	// request can only be answered once the second has run concurrently.
+	dir, err := ioutil.TempDir("", "remotefs-framing")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "fifo")
+	if err := unix.Mkfifo(fifo, 0600); err != nil {
+		t.Fatalf("failed to create fifo: %s", err)
+	}
+
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(inReader, outWriter, SupportedCommands(), 0)
+		outWriter.Close()
+	}()
+
+	if err := WriteFrame(inWriter, 1, &FramedRequest{Cmd: ReadFileCmd, Args: []string{fifo}}); err != nil {
+		t.Fatalf("failed to write request 1: %s", err)
+	}
+	if err := WriteFrame(inWriter, 2, &FramedRequest{Cmd: WriteFileCmd, Args: []string{fifo, "0600"}, Stdin: []byte("hello")}); err != nil {
+		t.Fatalf("failed to write request 2: %s", err)
+	}
+	inWriter.Close()
+
+	responses := make(map[uint64]*FramedResponse)
+	for i := 0; i < 2; i++ {
+		response := &FramedResponse{}
+		id, err := ReadFrame(outReader, response)
+		if err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+		if _, ok := responses[id]; ok {
+			t.Fatalf("received a second response for request %d", id)
+		}
+		responses[id] = response
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve failed: %s", err)
+	}
+
+	if r, ok := responses[1]; !ok || r.Err != nil || string(r.Stdout) != "hello" {
+		t.Errorf("expected request 1 to read \"hello\", got %+v", r)
+	}
+	if r, ok := responses[2]; !ok || r.Err != nil || len(r.Stdout) != 0 {
+		t.Errorf("expected request 2 to succeed with no output, got %+v", r)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	in := &bytes.Buffer{}
+	if err := WriteFrame(in, 7, &FramedRequest{Cmd: HashCmd}); err != nil {
+		t.Fatalf("failed to write request: %s", err)
+	}
+	if err := WriteFrame(in, 8, &FramedRequest{Cmd: "bogus"}); err != nil {
+		t.Fatalf("failed to write request: %s", err)
+	}
+	out := &bytes.Buffer{}
+	if err := Serve(in, out, CommandSet(StatCmd), 0); err != nil {
+		t.Fatalf("serve failed: %s", err)
+	}
+
+	responses := make(map[uint64]*FramedResponse)
+	for i := 0; i < 2; i++ {
+		response := &FramedResponse{}
+		id, err := ReadFrame(out, response)
+		if err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+		responses[id] = response
+	}
+	if r := responses[7]; r == nil || r.Err == nil || r.Err.ErrNum != int(syscall.ENOSYS) {
+		t.Errorf("expected an unsupported command error for request 7, got %+v", r)
+	}
+	if r := responses[8]; r == nil || r.Err == nil || r.Err.ErrString != "unknown command: bogus" {
+		t.Errorf("expected an unknown command error for request 8, got %+v", r)
+	}
+}
+
+// slowReader returns at most chunk bytes per read, and calls onRead with the
+// total number of bytes read so far.
+type slowReader struct {
+	r      io.Reader
+	chunk  int
+	total  int
+	onRead func(total int)
+}
+
+func (sr *slowReader) Read(p []byte) (int, error) {
+	if len(p) > sr.chunk {
+		p = p[:sr.chunk]
+	}
+	n, err := sr.r.Read(p)
+	sr.total += n
+	sr.onRead(sr.total)
+	return n, err
+}
+
+func TestExtractArchiveCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotefs-extract")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const fileCount = 20
+	in := &bytes.Buffer{}
+	if err := WriteTarOptions(in, &archive.TarOptions{}); err != nil {
+		t.Fatalf("failed to write tar opts: %s", err)
+	}
+	tw := tar.NewWriter(in)
+	content := bytes.Repeat([]byte("a"), 4096)
+	for i := 0; i < fileCount; i++ {
+		hdr := &tar.Header{Name: "file" + strconv.Itoa(i), Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write tar header: %s", err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatalf("failed to write tar content: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %s", err)
+	}
+	archiveSize := in.Len()
+
+	// Cancel the extraction once a little under half of the archive is read.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &slowReader{r: in, chunk: 512, onRead: func(total int) {
+		if total >= archiveSize*2/5 {
+			cancel()
+		}
+	}}
+	err = extractArchiveContext(ctx, r, nil, []string{dir})
+	exported, ok := err.(*ExportedError)
+	if !ok || exported.ErrNum != int(syscall.ECANCELED) {
+		t.Fatalf("expected a cancellation error, got %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read extract dir: %s", err)
+	}
+	if len(entries) == 0 || len(entries) >= fileCount {
+		t.Errorf("expected a partial extraction, got %d of %d files", len(entries), fileCount)
+	}
+}
+
+func TestChmodRecursiveCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotefs-chmod")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	buf := &bytes.Buffer{}
+	if err := chmodRecursiveContext(ctx, nil, buf, []string{dir, "0700"}); err != ErrCancelled {
+		t.Fatalf("expected ErrCancelled, got %v", err)
+	}
+	var result RecursiveChangeResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("failed to unmarshal result: %s", err)
+	}
+	if !result.Cancelled || result.Changed != 0 {
+		t.Errorf("expected a cancelled result with no changes, got %+v", result)
+	}
+	if exported := ToExportedError(ErrCancelled); exported.ErrNum != int(syscall.ECANCELED) {
+		t.Errorf("expected ECANCELED, got %d", exported.ErrNum)
+	}
+}
+
+func TestServeConcurrencyLimit(t *testing.T) {
+	const maxConcurrent = 3
+	var (
+		mutex      sync.Mutex
+		current    int
+		maxCurrent int
+	)
+	defer func(f func(context.Context, *FramedRequest, uint64) *FramedResponse) { runRequest = f }(runRequest)
+	runRequest = func(ctx context.Context, request *FramedRequest, commands uint64) *FramedResponse {
+		mutex.Lock()
+		current++
+		if current > maxCurrent {
+			maxCurrent = current
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		current--
+		mutex.Unlock()
+		return &FramedResponse{}
+	}
+
+	const requestCount = 20
+	in := &bytes.Buffer{}
+	for i := 0; i < requestCount; i++ {
+		cmd := StatCmd
+		if i%2 == 0 {
+			cmd = ReadFileCmd
+		}
+		if err := WriteFrame(in, uint64(i), &FramedRequest{Cmd: cmd}); err != nil {
+			t.Fatalf("failed to write request: %s", err)
+		}
+	}
+	out := &bytes.Buffer{}
+	if err := Serve(in, out, SupportedCommands(), maxConcurrent); err != nil {
+		t.Fatalf("serve failed: %s", err)
+	}
+
+	for i := 0; i < requestCount; i++ {
+		if _, err := ReadFrame(out, &FramedResponse{}); err != nil {
+			t.Fatalf("failed to read response %d: %s", i, err)
+		}
+	}
+	if maxCurrent > maxConcurrent {
+		t.Errorf("expected at most %d commands at once, got %d", maxConcurrent, maxCurrent)
+	}
+}
+
+func TestServeReservesMetadataSlot(t *testing.T) {
+	gate := make(chan struct{})
+	defer func(f func(context.Context, *FramedRequest, uint64) *FramedResponse) { runRequest = f }(runRequest)
+	runRequest = func(ctx context.Context, request *FramedRequest, commands uint64) *FramedResponse {
+		if request.Cmd == ReadFileCmd {
+			<-gate
+		}
+		return &FramedResponse{}
+	}
+
+	// The bulk reads fill every slot but the reserved one, which the stat
+	// must be able to use while they are blocked.
+	in := &bytes.Buffer{}
+	for i := uint64(1); i <= 3; i++ {
+		if err := WriteFrame(in, i, &FramedRequest{Cmd: ReadFileCmd}); err != nil {
+			t.Fatalf("failed to write request: %s", err)
+		}
+	}
+	if err := WriteFrame(in, 4, &FramedRequest{Cmd: StatCmd}); err != nil {
+		t.Fatalf("failed to write request: %s", err)
+	}
+	outReader, outWriter := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(in, outWriter, SupportedCommands(), 2)
+		outWriter.Close()
+	}()
+
+	id, err := ReadFrame(outReader, &FramedResponse{})
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if id != 4 {
+		t.Errorf("expected the stat to be answered first, got request %d", id)
+	}
+	close(gate)
+	for i := 0; i < 3; i++ {
+		if _, err := ReadFrame(outReader, &FramedResponse{}); err != nil {
+			t.Fatalf("failed to read response: %s", err)
+		}
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve failed: %s", err)
+	}
+}
+
+func TestServeCancelsOnDisconnect(t *testing.T) {
+	defer func(f func(context.Context, *FramedRequest, uint64) *FramedResponse) { runRequest = f }(runRequest)
+	runRequest = func(ctx context.Context, request *FramedRequest, commands uint64) *FramedResponse {
+		<-ctx.Done()
+		return &FramedResponse{Err: ToExportedError(ErrCancelled)}
+	}
+
+	inReader, inWriter := io.Pipe()
+	out := &bytes.Buffer{}
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(inReader, out, SupportedCommands(), 0)
+	}()
+	if err := WriteFrame(inWriter, 1, &FramedRequest{Cmd: ExtractArchiveCmd}); err != nil {
+		t.Fatalf("failed to write request: %s", err)
+	}
+	disconnected := errors.New("disconnected")
+	inWriter.CloseWithError(disconnected)
+
+	if err := <-served; err != disconnected {
+		t.Fatalf("expected the disconnection error, got %v", err)
+	}
+	var response FramedResponse
+	if id, err := ReadFrame(out, &response); err != nil || id != 1 {
+		t.Fatalf("expected a response to request 1, got %d and error %v", id, err)
+	}
+	if response.Err == nil || response.Err.ErrNum != int(syscall.ECANCELED) {
+		t.Errorf("expected request 1 to be cancelled, got %+v", response.Err)
+	}
+}
+
+func TestReadFileRange(t *testing.T) {
+	f, err := ioutil.TempFile("", "remotefs-readfile")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("0123456789"); err != nil {
+		t.Fatalf("failed to write temp file: %s", err)
+	}
+	f.Close()
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected ReadRange
+		data     string
+	}{
+		{"mid-file range", []string{"2", "5"}, ReadRange{Offset: 2, Length: 5}, "23456"},
+		{"tail", []string{"-3"}, ReadRange{Offset: 7, Length: 3, EOF: true}, "789"},
+		{"tail longer than the file", []string{"-20", "4"}, ReadRange{Offset: 0, Length: 4}, "0123"},
+		{"length past EOF", []string{"8", "10"}, ReadRange{Offset: 8, Length: 2, EOF: true}, "89"},
+		{"offset past EOF", []string{"15", "5"}, ReadRange{Offset: 10, Length: 0, EOF: true}, ""},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		if err := ReadFile(nil, buf, append([]string{f.Name()}, test.args...)); err != nil {
+			t.Errorf("%s: failed to read file: %s", test.name, err)
+			continue
+		}
+		readRange, err := ReadReadRange(buf)
+		if err != nil {
+			t.Errorf("%s: failed to read range: %s", test.name, err)
+			continue
+		}
+		if *readRange != test.expected {
+			t.Errorf("%s: expected range %+v, got %+v", test.name, test.expected, *readRange)
+		}
+		if buf.String() != test.data {
+			t.Errorf("%s: expected data %q, got %q", test.name, test.data, buf.String())
+		}
+	}
+
+	if err := ReadFile(nil, &bytes.Buffer{}, []string{f.Name(), "0", "-1"}); err != ErrInvalid {
+		t.Errorf("expected a negative length to be invalid, got %v", err)
+	}
+}
+
+func TestReadCoreDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotefs-coredump")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "core.42")
+	if err := ioutil.WriteFile(path, []byte("ELF core"), 0600); err != nil {
+		t.Fatalf("failed to write core dump: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ReadCoreDump(nil, buf, []string{dir, path}); err != nil {
+		t.Fatalf("failed to read core dump: %s", err)
+	}
+	if buf.String() != "ELF core" {
+		t.Errorf("expected the core dump, got %q", buf.String())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the core dump to be removed once read, got %v", err)
+	}
+
+	if err := ReadCoreDump(nil, &bytes.Buffer{}, []string{dir, path}); !os.IsNotExist(err) {
+		t.Errorf("expected a missing core dump not to exist, got %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "core.43"), 0700); err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	if err := ReadCoreDump(nil, &bytes.Buffer{}, []string{dir, filepath.Join(dir, "core.43")}); err != ErrInvalid {
+		t.Errorf("expected a directory to be invalid, got %v", err)
+	}
+}
+
+func TestReadCoreDumpOutsideDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotefs-coredump")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	crashDir := filepath.Join(dir, "crash")
+	if err := os.MkdirAll(filepath.Join(crashDir, "sub"), 0700); err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	for _, name := range []string{"core.42", "config", "crash/sub/core.42", "crash/core.x", "crash/core."} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0600); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	tests := [][]string{
+		{crashDir, filepath.Join(dir, "core.42")},
+		{crashDir, filepath.Join(crashDir, "..", "core.42")},
+		{crashDir, filepath.Join(crashDir, "sub", "core.42")},
+		{crashDir, filepath.Join(crashDir, "core.x")},
+		{crashDir, filepath.Join(crashDir, "core.")},
+		{dir, filepath.Join(dir, "config")},
+		{"crash", "crash/core.42"},
+		{crashDir, filepath.Join(crashDir, "core.44")},
+		{crashDir},
+	}
+	// A link to a file outside the directory is not followed.
+	if err := os.Symlink(filepath.Join(dir, "config"), filepath.Join(crashDir, "core.44")); err != nil {
+		t.Fatalf("failed to create link: %s", err)
+	}
+	for _, args := range tests {
+		if err := ReadCoreDump(nil, &bytes.Buffer{}, args); err != ErrInvalid {
+			t.Errorf("%v: expected ErrInvalid, got %v", args, err)
+		}
+	}
+	for _, name := range []string{"core.42", "config", "crash/sub/core.42", "crash/core.x", "crash/core."} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be kept: %s", name, err)
+		}
+	}
+}
+
+func TestWriteFileOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		data     string
+		err      error
+		contents string
+	}{
+		{"resume mid-file", []string{"5"}, "abc", nil, "01234abc89"},
+		{"resume at EOF", []string{"10"}, "abc", nil, "0123456789abc"},
+		{"offset past EOF", []string{"12"}, "abc", ErrInvalid, "0123456789"},
+		{"sparse offset past EOF", []string{"12", "true"}, "abc", nil, "0123456789\x00\x00abc"},
+		{"negative offset", []string{"-1"}, "abc", ErrInvalid, "0123456789"},
+	}
+	for _, test := range tests {
+		f, err := ioutil.TempFile("", "remotefs-writefile")
+		if err != nil {
+			t.Fatalf("failed to create temp file: %s", err)
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.WriteString("0123456789"); err != nil {
+			t.Fatalf("failed to write temp file: %s", err)
+		}
+		f.Close()
+
+		buf := &bytes.Buffer{}
+		err = WriteFile(bytes.NewBufferString(test.data), buf, append([]string{f.Name(), "0600"}, test.args...))
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		contents, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("%s: failed to read file: %s", test.name, err)
+		}
+		if string(contents) != test.contents {
+			t.Errorf("%s: expected contents %q, got %q", test.name, test.contents, contents)
+		}
+		if test.err != nil {
+			continue
+		}
+		var result WriteResult
+		if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+			t.Errorf("%s: failed to decode result: %s", test.name, err)
+			continue
+		}
+		if result.Size != int64(len(test.contents)) {
+			t.Errorf("%s: expected size %d, got %d", test.name, len(test.contents), result.Size)
+		}
+	}
+}
+
+func TestMkdirTree(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+	root, err := ioutil.TempDir("", "remotefs-mkdirtree")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Mkdir(filepath.Join(root, "existing"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+
+	entries := []DirTreeEntry{
+		{Path: "a", Mode: 0755, UID: 0, GID: 0},
+		{Path: "a/b", Mode: 0700, UID: 1000, GID: 1000},
+		{Path: "a/b/c", Mode: 0777 | os.ModeSticky, UID: 1001, GID: 1002},
+		{Path: "existing", Mode: 0700, UID: 1000, GID: 1000},
+	}
+	mkdirTree := func(update string) {
+		in := &bytes.Buffer{}
+		if err := json.NewEncoder(in).Encode(entries); err != nil {
+			t.Fatalf("failed to encode entries: %s", err)
+		}
+		if err := MkdirTree(in, nil, []string{root, update}); err != nil {
+			t.Fatalf("failed to create tree: %s", err)
+		}
+	}
+	check := func(path string, mode os.FileMode, uid, gid uint32) {
+		info, err := os.Lstat(filepath.Join(root, path))
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", path, err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if !info.IsDir() || info.Mode()&^os.ModeDir != mode || stat.Uid != uid || stat.Gid != gid {
+			t.Errorf("expected %s to be a dir with mode %s owned by %d:%d, got mode %s owned by %d:%d", path, mode, uid, gid, info.Mode(), stat.Uid, stat.Gid)
+		}
+	}
+
+	mkdirTree("false")
+	check("a", 0755, 0, 0)
+	check("a/b", 0700, 1000, 1000)
+	check("a/b/c", 0777|os.ModeSticky, 1001, 1002)
+	check("existing", 0755, 0, 0)
+
+	mkdirTree("true")
+	check("existing", 0700, 1000, 1000)
+
+	for _, path := range []string{"../escape", "/abs", "."} {
+		in := bytes.NewBufferString(`[{"Path":"` + path + `","Mode":493}]`)
+		if err := MkdirTree(in, nil, []string{root}); err != ErrInvalid {
+			t.Errorf("expected path %s to be invalid, got %v", path, err)
+		}
+	}
+	in := bytes.NewBufferString(`[{"Path":"missing/child","Mode":493}]`)
+	if err := MkdirTree(in, nil, []string{root}); !os.IsNotExist(err) {
+		t.Errorf("expected a missing parent to fail, got %v", err)
+	}
+}
+
+func TestExtractArchiveHardlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotefs-extract")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// "b" links to "a", which precedes it, and "c" links to "d", which
+	// follows it, so that "c" must be deferred.
+	in := &bytes.Buffer{}
+	if err := WriteTarOptions(in, &archive.TarOptions{}); err != nil {
+		t.Fatalf("failed to write tar opts: %s", err)
+	}
+	tw := tar.NewWriter(in)
+	headers := []*tar.Header{
+		{Name: "a", Mode: 0644, Size: 5, Typeflag: tar.TypeReg},
+		{Name: "b", Mode: 0644, Typeflag: tar.TypeLink, Linkname: "a"},
+		{Name: "c", Mode: 0644, Typeflag: tar.TypeLink, Linkname: "./d"},
+		{Name: "d", Mode: 0644, Size: 5, Typeflag: tar.TypeReg},
+	}
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write tar header: %s", err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("hello")); err != nil {
+				t.Fatalf("failed to write tar content: %s", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %s", err)
+	}
+
+	if err := ExtractArchive(in, nil, []string{dir}); err != nil {
+		t.Fatalf("failed to extract archive: %s", err)
+	}
+
+	inode := func(name string) uint64 {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", name, err)
+		}
+		return info.Sys().(*syscall.Stat_t).Ino
+	}
+	if inode("a") != inode("b") {
+		t.Errorf("expected a and b to share an inode")
+	}
+	if inode("c") != inode("d") {
+		t.Errorf("expected c and d to share an inode")
+	}
+	if inode("a") == inode("d") {
+		t.Errorf("expected a and d to be separate files")
+	}
+}
+
+func TestMknod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remotefs-mknod")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name         string
+		args         []string
+		mode         uint32
+		major, minor uint32
+		needsRoot    bool
+	}{
+		{"char", []string{"020644", "1", "3"}, unix.S_IFCHR | 0644, 1, 3, true},
+		{"block", []string{"060600", "7", "0"}, unix.S_IFBLK | 0600, 7, 0, true},
+		{"fifo", []string{"010640"}, unix.S_IFIFO | 0640, 0, 0, false},
+		{"socket", []string{"0140600"}, unix.S_IFSOCK | 0600, 0, 0, false},
+	}
+	oldUmask := unix.Umask(0)
+	defer unix.Umask(oldUmask)
+	for _, test := range tests {
+		if test.needsRoot && os.Geteuid() != 0 {
+			continue
+		}
+		path := filepath.Join(dir, test.name)
+		if err := Mknod(nil, nil, append([]string{path}, test.args...)); err != nil {
+			t.Errorf("%s: failed to mknod: %s", test.name, err)
+			continue
+		}
+		var stat unix.Stat_t
+		if err := unix.Lstat(path, &stat); err != nil {
+			t.Errorf("%s: failed to stat: %s", test.name, err)
+			continue
+		}
+		if stat.Mode != test.mode {
+			t.Errorf("%s: expected mode %o, got %o", test.name, test.mode, stat.Mode)
+		}
+		if major, minor := unix.Major(stat.Rdev), unix.Minor(stat.Rdev); major != test.major || minor != test.minor {
+			t.Errorf("%s: expected device %d:%d, got %d:%d", test.name, test.major, test.minor, major, minor)
+		}
+	}
+
+	fifo := filepath.Join(dir, "mkfifo")
+	if err := Mkfifo(nil, nil, []string{fifo, "0600"}); err != nil {
+		t.Fatalf("failed to mkfifo: %s", err)
+	}
+	if info, err := os.Lstat(fifo); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("expected a fifo, got %v and error %v", info, err)
+	}
+
+	invalid := [][]string{
+		{"0100644"},                // regular file
+		{"040755"},                 // directory
+		{"0644"},                   // no file type
+		{"020644"},                 // device without numbers
+		{"020644", "4096", "0"},    // major out of range
+		{"020644", "1", "1048576"}, // minor out of range
+	}
+	for i, args := range invalid {
+		path := filepath.Join(dir, "invalid"+strconv.Itoa(i))
+		if err := Mknod(nil, nil, append([]string{path}, args...)); err != ErrInvalid {
+			t.Errorf("expected mknod %v to be invalid, got %v", args, err)
+		}
+	}
+}
+
+func TestExtractArchiveCapabilities(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("setting file capabilities requires root")
+	}
+	dir, err := ioutil.TempDir("", "remotefs-extract")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A revision 2 vfs_cap_data granting an effective CAP_NET_RAW, as set by
+	// "setcap cap_net_raw+ep".
+	capability := make([]byte, 20)
+	binary.LittleEndian.PutUint32(capability[0:], 0x02000001)
+	binary.LittleEndian.PutUint32(capability[4:], 1<<13)
+
+	probe := filepath.Join(dir, "probe")
+	if err := ioutil.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatalf("failed to create probe file: %s", err)
+	}
+	if err := unix.Lsetxattr(probe, capabilityXattr, capability, 0); err != nil {
+		t.Skipf("file capabilities aren't supported in %s: %s", dir, err)
+	}
+
+	extract := func(name string, preserve string) []byte {
+		in := &bytes.Buffer{}
+		if err := WriteTarOptions(in, &archive.TarOptions{}); err != nil {
+			t.Fatalf("failed to write tar opts: %s", err)
+		}
+		tw := tar.NewWriter(in)
+		hdr := &tar.Header{
+			Name:       name,
+			Mode:       0755,
+			Size:       5,
+			Typeflag:   tar.TypeReg,
+			PAXRecords: map[string]string{"SCHILY.xattr." + capabilityXattr: string(capability)},
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write tar header: %s", err)
+		}
+		if _, err := tw.Write([]byte("hello")); err != nil {
+			t.Fatalf("failed to write tar content: %s", err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("failed to close tar: %s", err)
+		}
+		if err := ExtractArchive(in, nil, []string{dir, preserve}); err != nil {
+			t.Fatalf("failed to extract archive: %s", err)
+		}
+
+		buf := make([]byte, 64)
+		n, err := unix.Lgetxattr(filepath.Join(dir, name), capabilityXattr, buf)
+		if err == unix.ENODATA {
+			return nil
+		}
+		if err != nil {
+			t.Fatalf("failed to get capabilities of %s: %s", name, err)
+		}
+		return buf[:n]
+	}
+
+	if restored := extract("preserved", "true"); !bytes.Equal(restored, capability) {
+		t.Errorf("expected capabilities %x to be restored, got %x", capability, restored)
+	}
+	if restored := extract("dropped", "false"); restored != nil {
+		t.Errorf("expected capabilities to be dropped, got %x", restored)
+	}
+}
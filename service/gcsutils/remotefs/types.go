@@ -46,3 +46,155 @@ func (f *FileInfo) IsDir() bool { return f.IsDirVar }
 
 // Sys provides an interface to a FileInfo structure
 func (f *FileInfo) Sys() interface{} { return nil }
+
+// MountInfo is the struct returned by ResolveMount. It describes the mount
+// which a resolved path lands on.
+type MountInfo struct {
+	// Path is the resolved path.
+	Path string
+	// MountPoint is the nearest mount point containing Path.
+	MountPoint string
+	// FSType is the filesystem type of the mount, such as "ext4" or
+	// "overlay".
+	FSType string
+	// Source is the mount source, such as the backing device.
+	Source string
+	// Root is the directory within the source filesystem which is mounted at
+	// MountPoint. It is "/" unless the mount is a bind mount of a
+	// subdirectory.
+	Root string
+}
+
+// MountEntry is an entry in the list returned by ListMounts, describing one
+// line of /proc/self/mountinfo.
+type MountEntry struct {
+	MountPoint string
+	// Source is the mount source, such as the backing device, or "none".
+	Source string
+	FSType string
+	// Options are the options of the mount, such as "ro", and SuperOptions
+	// those of the filesystem it mounts.
+	Options      []string
+	SuperOptions []string
+	// Root is the directory within the source filesystem which is mounted at
+	// MountPoint.
+	Root string
+}
+
+// FileHash is an entry in the manifest written by Hash when hashing a
+// directory tree.
+type FileHash struct {
+	// Path is the path of the file relative to the hashed directory.
+	Path string
+	// Digest is the file's digest, in the form "<algorithm>:<hex>".
+	Digest string
+}
+
+// DirTreeEntry is a directory created by MkdirTree.
+type DirTreeEntry struct {
+	// Path is the path of the directory relative to the root.
+	Path string
+	// Mode holds the permission bits of the directory, along with any of
+	// the setuid, setgid, and sticky bits.
+	Mode os.FileMode
+	UID  int
+	GID  int
+}
+
+// ReadRange is the struct written by ReadFile to describe the range of a file
+// which follows it.
+type ReadRange struct {
+	// Offset is the offset of the range from the start of the file.
+	Offset int64
+	// Length is the number of bytes in the range.
+	Length int64
+	// EOF is set if the range extends to the end of the file.
+	EOF bool
+}
+
+// WriteResult is the struct returned by WriteFile when it writes at an
+// offset.
+type WriteResult struct {
+	// Size is the size of the file after the write.
+	Size int64
+}
+
+// RecursiveChangeResult is the struct returned by ChownRecursive and
+// ChmodRecursive.
+type RecursiveChangeResult struct {
+	// Changed is the number of paths which were changed.
+	Changed int
+	// Errors holds the paths which could not be changed, and why.
+	Errors []PathChangeError `json:",omitempty"`
+	// Cancelled is set if the command was cancelled before every path was
+	// visited, in which case Changed counts the paths changed until then.
+	Cancelled bool `json:",omitempty"`
+}
+
+// PathChangeError describes a path which a recursive change failed on.
+type PathChangeError struct {
+	Path      string
+	ErrString string
+}
+
+// IDMapping maps a range of Size ids starting at ContainerID to the range
+// starting at HostID, as in a user namespace's uid_map or gid_map.
+type IDMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// IDMap is the set of uid and gid mappings read by Idmap.
+type IDMap struct {
+	UIDMappings []IDMapping
+	GIDMappings []IDMapping
+}
+
+// FindOptions is the struct read by Find. Zero values leave a filter unset.
+type FindOptions struct {
+	// Pattern is a filepath.Match pattern, such as "*.log". It is matched
+	// against the path relative to the root if it contains a separator, and
+	// against the base name otherwise.
+	Pattern string `json:",omitempty"`
+	// Type restricts matches to "file", "dir", or "symlink".
+	Type string `json:",omitempty"`
+	// MinSize and MaxSize bound the size of matches in bytes.
+	MinSize int64 `json:",omitempty"`
+	MaxSize int64 `json:",omitempty"`
+	// ModifiedAfter and ModifiedBefore bound the modification time of
+	// matches, in nanoseconds since the Unix epoch.
+	ModifiedAfter  int64 `json:",omitempty"`
+	ModifiedBefore int64 `json:",omitempty"`
+	// MaxDepth limits the depth of matches below the root, where the root's
+	// own entries have a depth of 1. MaxResults limits the number of
+	// matches. Both are capped by, and default to, findMaxDepth and
+	// findMaxResults.
+	MaxDepth   int `json:",omitempty"`
+	MaxResults int `json:",omitempty"`
+	// IncludeInfo specifies that each match's FileInfo should be returned.
+	IncludeInfo bool `json:",omitempty"`
+}
+
+// FindMatch is a path found by Find.
+type FindMatch struct {
+	// Path is the path of the match relative to the root.
+	Path string
+	Info *FileInfo `json:",omitempty"`
+}
+
+// FindResult is the struct returned by Find.
+type FindResult struct {
+	Matches []FindMatch
+	// Truncated is true if the search stopped at the maximum number of
+	// results.
+	Truncated bool `json:",omitempty"`
+}
+
+// VersionInfo is the struct returned by Version. It describes the protocol
+// version and the set of commands which both the host and the guest support.
+type VersionInfo struct {
+	ProtocolVersion int
+	// Commands is a bitmask of commands, as returned by CommandSet.
+	Commands uint64
+}
@@ -43,6 +43,10 @@ func ExportedToError(ee *ExportedError) error {
 		return os.ErrExist
 	} else if ee.Error() == os.ErrPermission.Error() {
 		return os.ErrPermission
+	} else if ee.Error() == ErrBusy.Error() {
+		return ErrBusy
+	} else if ee.Error() == ErrCancelled.Error() {
+		return ErrCancelled
 	}
 	return ee
 }
@@ -53,30 +57,8 @@ func WriteError(err error, out io.Writer) error {
 	if err == nil {
 		return nil
 	}
-	err = fixOSError(err)
 
-	var errno int
-	switch typedError := err.(type) {
-	case *os.PathError:
-		if se, ok := typedError.Err.(syscall.Errno); ok {
-			errno = int(se)
-		}
-	case *os.LinkError:
-		if se, ok := typedError.Err.(syscall.Errno); ok {
-			errno = int(se)
-		}
-	case *os.SyscallError:
-		if se, ok := typedError.Err.(syscall.Errno); ok {
-			errno = int(se)
-		}
-	}
-
-	exportedError := &ExportedError{
-		ErrString: err.Error(),
-		ErrNum:    errno,
-	}
-
-	b, err1 := json.Marshal(exportedError)
+	b, err1 := json.Marshal(ToExportedError(err))
 	if err1 != nil {
 		return err1
 	}
@@ -88,6 +70,45 @@ func WriteError(err error, out io.Writer) error {
 	return nil
 }
 
+// ToExportedError converts a Go error into an ExportedError. ErrNum is the
+// syscall.Errno underlying the error, if there is one. ErrString is the
+// error's message, except that errors with portable equivalents in the os
+// package are replaced by them, so that ExportedToError can recover them.
+func ToExportedError(err error) *ExportedError {
+	if ee, ok := err.(*ExportedError); ok {
+		return &ExportedError{ErrString: ee.ErrString, ErrNum: ee.ErrNum}
+	}
+	return &ExportedError{
+		ErrString: fixOSError(err).Error(),
+		ErrNum:    int(errnoOf(err)),
+	}
+}
+
+// errnoOf returns the syscall.Errno underlying err, or zero if there is none.
+func errnoOf(err error) syscall.Errno {
+	switch typedError := err.(type) {
+	case *os.PathError:
+		err = typedError.Err
+	case *os.LinkError:
+		err = typedError.Err
+	case *os.SyscallError:
+		err = typedError.Err
+	}
+
+	switch err {
+	case ErrInvalid:
+		return syscall.EINVAL
+	case ErrBusy:
+		return syscall.EBUSY
+	case ErrCancelled:
+		return syscall.ECANCELED
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+	return 0
+}
+
 // fixOSError converts possible platform dependent error into the portable errors in the
 // Go os package if possible.
 func fixOSError(err error) error {
@@ -106,41 +127,67 @@ func fixOSError(err error) error {
 
 // ReadTarOptions reads from the specified reader and deserializes an archive.TarOptions struct.
 func ReadTarOptions(r io.Reader) (*archive.TarOptions, error) {
+	var opts archive.TarOptions
+	if err := readSizedJSON(r, &opts); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+// WriteTarOptions serializes a archive.TarOptions struct and writes it to the writer.
+func WriteTarOptions(w io.Writer, opts *archive.TarOptions) error {
+	return writeSizedJSON(w, opts)
+}
+
+// ReadReadRange reads from the specified reader and deserializes a ReadRange
+// struct, leaving the range of file contents which follows it to be read.
+func ReadReadRange(r io.Reader) (*ReadRange, error) {
+	var readRange ReadRange
+	if err := readSizedJSON(r, &readRange); err != nil {
+		return nil, err
+	}
+	return &readRange, nil
+}
+
+// WriteReadRange serializes a ReadRange struct and writes it to the writer.
+func WriteReadRange(w io.Writer, readRange *ReadRange) error {
+	return writeSizedJSON(w, readRange)
+}
+
+// readSizedJSON deserializes into v the json read from r, which is preceded
+// by its size.
+func readSizedJSON(r io.Reader, v interface{}) error {
 	var size uint64
 	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
-		return nil, err
+		return err
 	}
 
 	rawJSON := make([]byte, size)
 	if _, err := io.ReadFull(r, rawJSON); err != nil {
-		return nil, err
+		return err
 	}
 
-	var opts archive.TarOptions
-	if err := json.Unmarshal(rawJSON, &opts); err != nil {
-		return nil, err
-	}
-	return &opts, nil
+	return json.Unmarshal(rawJSON, v)
 }
 
-// WriteTarOptions serializes a archive.TarOptions struct and writes it to the writer.
-func WriteTarOptions(w io.Writer, opts *archive.TarOptions) error {
-	optsBuf, err := json.Marshal(opts)
+// writeSizedJSON serializes v and writes it to w, preceded by its size.
+func writeSizedJSON(w io.Writer, v interface{}) error {
+	buf, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	optsSize := uint64(len(optsBuf))
-	optsSizeBuf := &bytes.Buffer{}
-	if err := binary.Write(optsSizeBuf, binary.BigEndian, optsSize); err != nil {
+	size := uint64(len(buf))
+	sizeBuf := &bytes.Buffer{}
+	if err := binary.Write(sizeBuf, binary.BigEndian, size); err != nil {
 		return err
 	}
 
-	if _, err := optsSizeBuf.WriteTo(w); err != nil {
+	if _, err := sizeBuf.WriteTo(w); err != nil {
 		return err
 	}
 
-	if _, err := w.Write(optsBuf); err != nil {
+	if _, err := w.Write(buf); err != nil {
 		return err
 	}
 